@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"strings"
+)
+
+// Right is an access right which can be granted via an ACL.
+//
+// See RFC 4314 section 2.1.
+type Right byte
+
+const (
+	RightLookup        Right = 'l'
+	RightRead          Right = 'r'
+	RightSeen          Right = 's'
+	RightWrite         Right = 'w'
+	RightInsert        Right = 'i'
+	RightPost          Right = 'p'
+	RightCreateMailbox Right = 'k'
+	RightDeleteMailbox Right = 'x'
+	RightDeleteMessage Right = 't'
+	RightExpunge       Right = 'e'
+	RightAdminister    Right = 'a'
+)
+
+// RightSet is a set of access rights, e.g. "lrs".
+type RightSet string
+
+// AllRights contains all of the rights defined in RFC 4314.
+const AllRights RightSet = "lrswipkxtea"
+
+// Has checks whether a right is part of the set.
+func (set RightSet) Has(right Right) bool {
+	return strings.IndexByte(string(set), byte(right)) >= 0
+}
+
+// Add returns the union of two sets.
+func (set RightSet) Add(other RightSet) RightSet {
+	var sb strings.Builder
+	sb.WriteString(string(set))
+	for i := 0; i < len(other); i++ {
+		if !RightSet(sb.String()).Has(Right(other[i])) {
+			sb.WriteByte(other[i])
+		}
+	}
+	return RightSet(sb.String())
+}
+
+// Remove returns the rights of the set which aren't part of other.
+func (set RightSet) Remove(other RightSet) RightSet {
+	var sb strings.Builder
+	for i := 0; i < len(set); i++ {
+		if !other.Has(Right(set[i])) {
+			sb.WriteByte(set[i])
+		}
+	}
+	return RightSet(sb.String())
+}
+
+// RightModification describes how SETACL modifies the rights of an
+// identifier.
+type RightModification byte
+
+const (
+	RightModificationReplace RightModification = 0
+	RightModificationAdd     RightModification = '+'
+	RightModificationRemove  RightModification = '-'
+)
+
+// ACLData is the data returned by the GETACL command.
+type ACLData struct {
+	Mailbox string
+	Rights  map[string]RightSet // by identifier
+}
+
+// ListRightsData is the data returned by the LISTRIGHTS command.
+type ListRightsData struct {
+	Mailbox    string
+	Identifier string
+	// Rights always granted to the identifier
+	RequiredRights RightSet
+	// Rights which can be granted to the identifier. Rights grouped in the
+	// same RightSet are tied together.
+	OptionalRights []RightSet
+}
+
+// MyRightsData is the data returned by the MYRIGHTS command.
+type MyRightsData struct {
+	Mailbox string
+	Rights  RightSet
+}
@@ -40,7 +40,10 @@ const (
 	CapBinary           Cap = "BINARY"             // RFC 3516
 	CapCatenate         Cap = "CATENATE"           // RFC 4469
 	CapChildren         Cap = "CHILDREN"           // RFC 3348
+	CapCompressDeflate  Cap = "COMPRESS=DEFLATE"   // RFC 4978
 	CapCondStore        Cap = "CONDSTORE"          // RFC 7162
+	CapContextSearch    Cap = "CONTEXT=SEARCH"     // RFC 5267
+	CapContextSort      Cap = "CONTEXT=SORT"       // RFC 5267
 	CapConvert          Cap = "CONVERT"            // RFC 5259
 	CapCreateSpecialUse Cap = "CREATE-SPECIAL-USE" // RFC 6154
 	CapESort            Cap = "ESORT"              // RFC 5267
@@ -73,6 +76,9 @@ const (
 	CapUTF8Accept       Cap = "UTF8=ACCEPT"        // RFC 6855
 	CapUTF8Only         Cap = "UTF8=ONLY"          // RFC 6855
 	CapWithin           Cap = "WITHIN"             // RFC 5032
+
+	CapThreadOrderedSubject Cap = "THREAD=ORDEREDSUBJECT" // RFC 5256
+	CapThreadReferences     Cap = "THREAD=REFERENCES"     // RFC 5256
 )
 
 var imap4rev2Caps = CapSet{
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"io"
@@ -21,6 +22,7 @@ var (
 	password     string
 	debug        bool
 	insecureAuth bool
+	importDir    string
 )
 
 func main() {
@@ -31,6 +33,7 @@ func main() {
 	flag.StringVar(&password, "password", "user", "Password")
 	flag.BoolVar(&debug, "debug", false, "Print all commands and responses")
 	flag.BoolVar(&insecureAuth, "insecure-auth", false, "Allow authentication without TLS")
+	flag.StringVar(&importDir, "import", "", "Directory of .eml files to import into INBOX")
 	flag.Parse()
 
 	var tlsConfig *tls.Config
@@ -54,7 +57,12 @@ func main() {
 
 	if username != "" || password != "" {
 		user := imapmemserver.NewUser(username, password)
-		user.Create("INBOX", nil)
+		user.Create(context.Background(), "INBOX", nil)
+		if importDir != "" {
+			if err := user.ImportDir("INBOX", importDir); err != nil {
+				log.Fatalf("Failed to import messages: %v", err)
+			}
+		}
 		memServer.AddUser(user)
 	}
 
@@ -68,8 +76,30 @@ func main() {
 			return memServer.NewSession(), nil, nil
 		},
 		Caps: imap.CapSet{
-			imap.CapIMAP4rev1: {},
-			imap.CapIMAP4rev2: {},
+			imap.CapIMAP4rev1:        {},
+			imap.CapIMAP4rev2:        {},
+			imap.CapCondStore:        {},
+			imap.CapQResync:          {},
+			imap.CapSort:             {},
+			imap.CapESort:            {},
+			imap.CapContextSearch:    {},
+			imap.CapContextSort:      {},
+			imap.CapUTF8Accept:       {},
+			imap.CapSpecialUse:       {},
+			imap.CapCreateSpecialUse: {},
+			imap.CapQuota:            {},
+			imap.CapQuotaSet:         {},
+			"QUOTA=RES-STORAGE":      {},
+			"QUOTA=RES-MESSAGE":      {},
+			imap.CapCatenate:         {},
+			imap.CapMultiAppend:      {},
+			imap.CapBinary:           {},
+			imap.CapNotify:           {},
+			imap.CapACL:              {},
+			imap.CapObjectID:         {},
+			imap.CapSaveDate:         {},
+			imap.CapWithin:           {},
+			imap.CapSearchFuzzy:      {},
 		},
 		TLSConfig:    tlsConfig,
 		InsecureAuth: insecureAuth,
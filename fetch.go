@@ -18,6 +18,15 @@ type FetchOptions struct {
 	BodySection       []*FetchItemBodySection
 	BinarySection     []*FetchItemBinarySection     // requires IMAP4rev2 or BINARY
 	BinarySectionSize []*FetchItemBinarySectionSize // requires IMAP4rev2 or BINARY
+	ModSeq            bool                          // requires CONDSTORE
+	EmailID           bool                          // requires OBJECTID
+	ThreadID          bool                          // requires OBJECTID
+	SaveDate          bool                          // requires SAVEDATE
+
+	ChangedSince uint64 // requires CONDSTORE
+	// HasChangedSince is set if ChangedSince has been specified, since zero
+	// is a valid value.
+	HasChangedSince bool
 }
 
 // FetchItemBodyStructure contains FETCH options for the body structure.
@@ -187,6 +196,7 @@ type BodyStructureText struct {
 // BodyStructureSinglePartExt contains extended body structure data for
 // BodyStructureSinglePart.
 type BodyStructureSinglePartExt struct {
+	MD5         string // Content-MD5 header field
 	Disposition *BodyStructureDisposition
 	Language    []string
 	Location    string
@@ -1,6 +1,6 @@
 module github.com/emersion/go-imap/v2
 
-go 1.18
+go 1.21
 
 require golang.org/x/text v0.8.0
 
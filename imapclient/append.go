@@ -28,6 +28,40 @@ func (c *Client) Append(mailbox string, size int64, options *imap.AppendOptions)
 	return cmd
 }
 
+// AppendReader sends an APPEND command and streams the message from r, which
+// must contain exactly size bytes. The message isn't buffered in memory: a
+// synchronizing literal is used for large messages, so the message is only
+// sent once the server is ready to accept it.
+//
+// If the server supports UIDPLUS, the returned data contains the UID of the
+// new message.
+//
+// If the server rejects the message before it's sent (e.g. because it's too
+// large), the command's error is returned. If the message cannot be read from
+// r once the literal has started, the connection is closed, because the
+// APPEND command cannot be completed.
+func (c *Client) AppendReader(mailbox string, r io.Reader, size int64, options *imap.AppendOptions) (*imap.AppendData, error) {
+	cmd := c.Append(mailbox, size, options)
+	_, err := io.Copy(cmd, r)
+	if closeErr := cmd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		select {
+		case cmdErr := <-cmd.done:
+			// The server has rejected the synchronizing literal
+			cmd.err = cmdErr
+			if cmdErr != nil {
+				return nil, cmdErr
+			}
+		default:
+		}
+		c.Close()
+		return nil, err
+	}
+	return cmd.Wait()
+}
+
 // AppendCommand is an APPEND command.
 //
 // Callers must write the message contents, then call Close.
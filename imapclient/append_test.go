@@ -0,0 +1,86 @@
+package imapclient_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestAppendReader(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapUIDPlus:   {},
+		},
+	})
+	c := dialTestClient(t, addr)
+
+	// Larger than the LITERAL- limit, to exercise synchronizing literals
+	msg := testMessage + strings.Repeat("Hello, world!\r\n", 64*1024)
+	name := filepath.Join(t.TempDir(), "msg.eml")
+	if err := os.WriteFile(name, []byte(msg), 0644); err != nil {
+		t.Fatalf("os.WriteFile() = %v", err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("os.Open() = %v", err)
+	}
+	defer f.Close()
+
+	date := time.Date(2016, 9, 5, 19, 0, 0, 0, time.UTC)
+	data, err := c.AppendReader("INBOX", f, int64(len(msg)), &imap.AppendOptions{
+		Flags: []imap.Flag{imap.FlagSeen},
+		Time:  date,
+	})
+	if err != nil {
+		t.Fatalf("AppendReader() = %v", err)
+	} else if data.UID != 1 {
+		t.Errorf("AppendReader() returned UID %v, want 1", data.UID)
+	}
+
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+	msgs, err := c.Fetch(imap.SeqSetNum(1), &imap.FetchOptions{
+		Flags:        true,
+		InternalDate: true,
+		RFC822Size:   true,
+	}).Collect()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	if msgs[0].RFC822Size != int64(len(msg)) {
+		t.Errorf("got RFC822.SIZE %v, want %v", msgs[0].RFC822Size, len(msg))
+	}
+	if !msgs[0].InternalDate.Equal(date) {
+		t.Errorf("got INTERNALDATE %v, want %v", msgs[0].InternalDate, date)
+	}
+	if len(msgs[0].Flags) != 1 || !strings.EqualFold(string(msgs[0].Flags[0]), string(imap.FlagSeen)) {
+		t.Errorf("got flags %v, want %v", msgs[0].Flags, imap.FlagSeen)
+	}
+}
+
+func TestAppendReaderTooBig(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{
+		MaxCommandLiteralSize: map[string]int64{"APPEND": 8192},
+	})
+	c := dialTestClient(t, addr)
+
+	msg := testMessage + strings.Repeat("Hello, world!\r\n", 1024)
+	_, err := c.AppendReader("INBOX", strings.NewReader(msg), int64(len(msg)), nil)
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) || imapErr.Code != imap.ResponseCodeTooBig {
+		t.Fatalf("AppendReader() = %v, want a TOOBIG error", err)
+	}
+
+	// The connection is still usable
+	if err := c.Noop().Wait(); err != nil {
+		t.Fatalf("Noop() = %v", err)
+	}
+}
@@ -21,6 +21,7 @@ package imapclient
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -43,8 +44,26 @@ const (
 
 	cmdWriteTimeout     = 30 * time.Second
 	literalWriteTimeout = 5 * time.Minute
+
+	dialTimeout = 30 * time.Second
 )
 
+// GreetingError is returned when the server greeting cannot be read or
+// parsed.
+type GreetingError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (err *GreetingError) Error() string {
+	return fmt.Sprintf("imapclient: failed to read greeting: %v", err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err *GreetingError) Unwrap() error {
+	return err.Err
+}
+
 // SelectedMailbox contains metadata for the currently selected mailbox.
 type SelectedMailbox struct {
 	Name           string
@@ -170,15 +189,68 @@ func New(conn net.Conn, options *Options) *Client {
 
 // DialTLS connects to an IMAP server with implicit TLS.
 func DialTLS(address string, options *Options) (*Client, error) {
-	conn, err := tls.Dial("tcp", address, &tls.Config{
-		NextProtos: []string{"imap"},
-	})
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: dialTimeout},
+		Config:    &tls.Config{NextProtos: []string{"imap"}},
+	}
+	conn, err := dialer.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
 	return New(conn, options), nil
 }
 
+// DialContext connects to an IMAP server without encryption, and waits for
+// the server greeting.
+//
+// The context is only used while connecting and waiting for the greeting.
+func DialContext(ctx context.Context, address string, options *Options) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newWithGreeting(ctx, conn, options)
+}
+
+// DialTLSContext connects to an IMAP server with implicit TLS, and waits for
+// the server greeting.
+//
+// A nil TLS configuration is equivalent to a zero configuration. The context
+// is only used while connecting and waiting for the greeting.
+func DialTLSContext(ctx context.Context, address string, tlsConfig *tls.Config, options *Options) (*Client, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"imap"}
+	}
+
+	dialer := tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newWithGreeting(ctx, conn, options)
+}
+
+func newWithGreeting(ctx context.Context, conn net.Conn, options *Options) (*Client, error) {
+	client := New(conn, options)
+	select {
+	case <-client.greetingCh:
+		if client.greetingErr != nil {
+			client.Close()
+			return nil, client.greetingErr
+		}
+		return client, nil
+	case <-ctx.Done():
+		client.Close()
+		return nil, ctx.Err()
+	}
+}
+
 // DialStartTLS connects to an IMAP server with STARTTLS.
 func DialStartTLS(address string, options *Options) (*Client, error) {
 	host, _, err := net.SplitHostPort(address)
@@ -186,7 +258,7 @@ func DialStartTLS(address string, options *Options) (*Client, error) {
 		return nil, err
 	}
 
-	conn, err := net.Dial("tcp", address)
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -518,6 +590,10 @@ func (c *Client) read() {
 		if cmdErr == nil {
 			cmdErr = io.ErrUnexpectedEOF
 		}
+		if !c.greetingRecv {
+			c.greetingErr = &GreetingError{Err: cmdErr}
+			close(c.greetingCh)
+		}
 		for _, cmd := range pendingCmds {
 			c.completeCommand(cmd, cmdErr)
 		}
@@ -563,11 +639,11 @@ func (c *Client) readResponse() error {
 	var (
 		token    string
 		err      error
-		startTLS *startTLSCommand
+		upgrader connUpgrader
 	)
 	if tag != "" {
 		token = "response-tagged"
-		startTLS, err = c.readResponseTagged(tag, typ)
+		upgrader, err = c.readResponseTagged(tag, typ)
 	} else if typ == "BYE" {
 		token = "resp-cond-bye"
 		var text string
@@ -586,9 +662,8 @@ func (c *Client) readResponse() error {
 		return fmt.Errorf("in response: %v", c.dec.Err())
 	}
 
-	if startTLS != nil {
-		c.upgradeStartTLS(startTLS.tlsConfig)
-		close(startTLS.upgradeDone)
+	if upgrader != nil {
+		upgrader.upgrade(c)
 	}
 
 	return nil
@@ -619,7 +694,7 @@ func (c *Client) readContinueReq() error {
 	return nil
 }
 
-func (c *Client) readResponseTagged(tag, typ string) (*startTLSCommand, error) {
+func (c *Client) readResponseTagged(tag, typ string) (connUpgrader, error) {
 	cmd := c.deletePendingCmdByTag(tag)
 	if cmd == nil {
 		return nil, fmt.Errorf("received tagged response with unknown tag %q", tag)
@@ -628,13 +703,22 @@ func (c *Client) readResponseTagged(tag, typ string) (*startTLSCommand, error) {
 	if !c.dec.ExpectSP() {
 		return nil, c.dec.Err()
 	}
-	var code string
+	var (
+		code         string
+		referralURLs []string
+	)
 	if c.dec.Special('[') { // resp-text-code
 		if !c.dec.ExpectAtom(&code) {
 			return nil, fmt.Errorf("in resp-text-code: %v", c.dec.Err())
 		}
 		// TODO: LONGENTRIES and MAXSIZE from METADATA
 		switch code {
+		case "REFERRAL":
+			var err error
+			referralURLs, err = readReferralURLs(c.dec)
+			if err != nil {
+				return nil, fmt.Errorf("in resp-code-referral: %v", err)
+			}
 		case "CAPABILITY": // capability-data
 			caps, err := readCapabilities(c.dec)
 			if err != nil {
@@ -687,15 +771,18 @@ func (c *Client) readResponseTagged(tag, typ string) (*startTLSCommand, error) {
 			Code: imap.ResponseCode(code),
 			Text: text,
 		}
+		if referralURLs != nil {
+			cmdErr = &ReferralError{URLs: referralURLs, Err: cmdErr.(*imap.Error)}
+		}
 	default:
 		return nil, fmt.Errorf("in resp-cond-state: expected OK, NO or BAD status condition, but got %v", typ)
 	}
 
 	c.completeCommand(cmd, cmdErr)
 
-	var startTLS *startTLSCommand
-	if cmd, ok := cmd.(*startTLSCommand); ok && cmdErr == nil {
-		startTLS = cmd
+	var upgrader connUpgrader
+	if cmd, ok := cmd.(connUpgrader); ok && cmdErr == nil {
+		upgrader = cmd
 	}
 
 	if cmdErr == nil && code != "CAPABILITY" {
@@ -706,7 +793,7 @@ func (c *Client) readResponseTagged(tag, typ string) (*startTLSCommand, error) {
 		}
 	}
 
-	return startTLS, nil
+	return upgrader, nil
 }
 
 func (c *Client) readResponseData(typ string) error {
@@ -772,6 +859,14 @@ func (c *Client) readResponseData(typ string) error {
 				if cmd := findPendingCmdByType[*SelectCommand](c); cmd != nil {
 					cmd.data.UIDNext = uidNext
 				}
+			case "UNSEEN":
+				var seqNum uint32
+				if !c.dec.ExpectSP() || !c.dec.ExpectNumber(&seqNum) {
+					return c.dec.Err()
+				}
+				if cmd := findPendingCmdByType[*SelectCommand](c); cmd != nil {
+					cmd.data.FirstUnseenSeqNum = seqNum
+				}
 			case "UIDVALIDITY":
 				var uidValidity uint32
 				if !c.dec.ExpectSP() || !c.dec.ExpectNumber(&uidValidity) {
@@ -852,7 +947,9 @@ func (c *Client) readResponseData(typ string) error {
 	case "EXISTS":
 		return c.handleExists(num)
 	case "RECENT":
-		// ignore
+		if cmd := findPendingCmdByType[*SelectCommand](c); cmd != nil {
+			cmd.data.NumRecent = num
+		}
 	case "LIST":
 		if !c.dec.ExpectSP() {
 			return c.dec.Err()
@@ -1067,6 +1164,16 @@ type command interface {
 	base() *Command
 }
 
+// connUpgrader is a command which changes the transport layer (e.g.
+// STARTTLS) once it has successfully completed.
+//
+// upgrade is invoked by the decoder goroutine right after the tagged response
+// has been read.
+type connUpgrader interface {
+	command
+	upgrade(c *Client)
+}
+
 // Command is a basic IMAP command.
 type Command struct {
 	tag  string
@@ -1,12 +1,18 @@
 package imapclient_test
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"net"
+	"testing"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
 )
 
 func ExampleClient() {
@@ -257,3 +263,184 @@ func ExampleClient_Idle() {
 		log.Fatalf("failed to stop idling: %v", err)
 	}
 }
+
+func ExamplePool() {
+	pool := imapclient.NewPool(&imapclient.PoolOptions{
+		Dial: func(ctx context.Context, account string) (*imapclient.Client, error) {
+			c, err := imapclient.DialTLS("mail.example.org:993", nil)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.Login(account, "asdf").Wait(); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		},
+		IdleTimeout: 5 * time.Minute,
+	})
+	defer pool.Close()
+
+	c, err := pool.Get(context.TODO(), "root")
+	if err != nil {
+		log.Fatalf("failed to get client: %v", err)
+	}
+
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		// Don't re-use a client in an unknown state
+		c.Close()
+		pool.Put(c)
+		log.Fatalf("failed to select INBOX: %v", err)
+	}
+
+	pool.Put(c)
+}
+
+const (
+	testUsername = "test-user"
+	testPassword = "test-password"
+
+	testMessage = "From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+		"To: Taki Tachibana <taki.tachibana@example.org>\r\n" +
+		"Subject: Your Name.\r\n" +
+		"Date: Mon, 05 Sep 2016 19:00:00 +0900\r\n" +
+		"Message-Id: <42@example.org>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Who are you?\r\n"
+)
+
+// newTestMemServer creates an in-memory server with a single test user.
+func newTestMemServer() *imapmemserver.Server {
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(testUsername, testPassword)
+	user.Create(context.Background(), "INBOX", nil)
+	memServer.AddUser(user)
+	return memServer
+}
+
+// startTestServer starts a server backed by imapmemserver and returns its
+// address.
+func startTestServer(t *testing.T, options *imapserver.Options) string {
+	t.Helper()
+
+	memServer := newTestMemServer()
+	if options == nil {
+		options = &imapserver.Options{}
+	}
+	if options.NewSession == nil {
+		options.NewSession = func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		}
+	}
+	if options.Caps == nil {
+		options.Caps = imap.CapSet{imap.CapIMAP4rev1: {}}
+	}
+	options.InsecureAuth = true
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+
+	server := imapserver.New(options)
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return ln.Addr().String()
+}
+
+// dialTestClient connects an imapclient.Client to a test server and logs in.
+func dialTestClient(t *testing.T, addr string) *imapclient.Client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	c := imapclient.New(conn, nil)
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	if err := c.Login(testUsername, testPassword).Wait(); err != nil {
+		t.Fatalf("Login() = %v", err)
+	}
+	return c
+}
+
+func TestDialContext(t *testing.T) {
+	addr := startTestServer(t, nil)
+	c, err := imapclient.DialContext(context.Background(), addr, nil)
+	if err != nil {
+		t.Fatalf("DialContext() = %v", err)
+	}
+	defer c.Close()
+	if state := c.State(); state != imap.ConnStateNotAuthenticated {
+		t.Errorf("got state %v, want %v", state, imap.ConnStateNotAuthenticated)
+	}
+	if err := c.Login(testUsername, testPassword).Wait(); err != nil {
+		t.Errorf("Login() = %v", err)
+	}
+}
+
+// listenRaw starts a listener which calls f for each connection.
+func listenRaw(t *testing.T, f func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				f(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialContextCancel(t *testing.T) {
+	// The server accepts connections but never sends a greeting
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+	})
+	addr := listenRaw(t, func(conn net.Conn) {
+		<-done
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := imapclient.DialContext(ctx, addr, nil); err != context.Canceled {
+		t.Errorf("DialContext() = %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("DialContext() took %v", d)
+	}
+}
+
+func TestDialContextBadGreeting(t *testing.T) {
+	for _, greeting := range []string{"garbage\r\n", ""} {
+		addr := listenRaw(t, func(conn net.Conn) {
+			io.WriteString(conn, greeting)
+		})
+		_, err := imapclient.DialContext(context.Background(), addr, nil)
+		var greetingErr *imapclient.GreetingError
+		if !errors.As(err, &greetingErr) {
+			t.Errorf("%q: DialContext() = %v, want a GreetingError", greeting, err)
+		}
+	}
+}
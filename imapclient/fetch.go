@@ -1,12 +1,15 @@
 package imapclient
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/mail"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-message"
+
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
@@ -42,6 +45,45 @@ func (c *Client) UIDFetch(seqSet imap.SeqSet, options *imap.FetchOptions) *Fetch
 	return c.fetch(true, seqSet, options)
 }
 
+// FetchMessage fetches and parses the full contents of the message with the
+// specified UID.
+//
+// The message is stored in memory. Fetching the message sets its \Seen flag.
+// The returned entity may be accompanied by an unknown charset error, see
+// message.IsUnknownCharset.
+func (c *Client) FetchMessage(uid uint32) (*message.Entity, error) {
+	cmd := c.UIDFetch(imap.SeqSetNum(uid), &imap.FetchOptions{
+		BodySection: []*imap.FetchItemBodySection{{}},
+	})
+	defer cmd.Close()
+
+	var body []byte
+	for {
+		msg := cmd.Next()
+		if msg == nil {
+			break
+		}
+		buf, err := msg.Collect()
+		if err != nil {
+			return nil, err
+		}
+		// Unsolicited FETCH responses may be interleaved
+		if buf.UID != uid {
+			continue
+		}
+		for _, b := range buf.BodySection {
+			body = b
+		}
+	}
+	if err := cmd.Close(); err != nil {
+		return nil, err
+	} else if body == nil {
+		return nil, fmt.Errorf("imapclient: message with UID %v not found", uid)
+	}
+
+	return message.Read(bytes.NewReader(body))
+}
+
 func writeFetchItems(enc *imapwire.Encoder, uid bool, options *imap.FetchOptions) {
 	listEnc := enc.BeginList()
 
@@ -58,6 +100,7 @@ func writeFetchItems(enc *imapwire.Encoder, uid bool, options *imap.FetchOptions
 		"FLAGS":         options.Flags,
 		"INTERNALDATE":  options.InternalDate,
 		"RFC822.SIZE":   options.RFC822Size,
+		"SAVEDATE":      options.SaveDate,
 	}
 	for k, req := range m {
 		if req {
@@ -74,6 +117,8 @@ func writeFetchItems(enc *imapwire.Encoder, uid bool, options *imap.FetchOptions
 	for _, bss := range options.BinarySectionSize {
 		writeFetchItemBinarySectionSize(listEnc.Item(), bss)
 	}
+
+	listEnc.End()
 }
 
 func writeFetchItemBodySection(enc *imapwire.Encoder, item *imap.FetchItemBodySection) {
@@ -268,6 +313,7 @@ var (
 	_ FetchItemData = FetchItemDataFlags{}
 	_ FetchItemData = FetchItemDataEnvelope{}
 	_ FetchItemData = FetchItemDataInternalDate{}
+	_ FetchItemData = FetchItemDataSaveDate{}
 	_ FetchItemData = FetchItemDataRFC822Size{}
 	_ FetchItemData = FetchItemDataUID{}
 	_ FetchItemData = FetchItemDataBodyStructure{}
@@ -327,6 +373,15 @@ type FetchItemDataInternalDate struct {
 
 func (FetchItemDataInternalDate) fetchItemData() {}
 
+// FetchItemDataSaveDate holds data returned by FETCH SAVEDATE.
+//
+// Time is zero if the mailbox doesn't support save dates.
+type FetchItemDataSaveDate struct {
+	Time time.Time
+}
+
+func (FetchItemDataSaveDate) fetchItemData() {}
+
 // FetchItemDataRFC822Size holds data returned by FETCH RFC822.SIZE.
 type FetchItemDataRFC822Size struct {
 	Size int64
@@ -366,6 +421,7 @@ type FetchMessageBuffer struct {
 	Flags             []imap.Flag
 	Envelope          *imap.Envelope
 	InternalDate      time.Time
+	SaveDate          time.Time
 	RFC822Size        int64
 	UID               uint32
 	BodyStructure     imap.BodyStructure
@@ -400,6 +456,8 @@ func (buf *FetchMessageBuffer) populateItemData(item FetchItemData) error {
 		buf.Envelope = item.Envelope
 	case FetchItemDataInternalDate:
 		buf.InternalDate = item.Time
+	case FetchItemDataSaveDate:
+		buf.SaveDate = item.Time
 	case FetchItemDataRFC822Size:
 		buf.RFC822Size = item.Size
 	case FetchItemDataUID:
@@ -513,6 +571,20 @@ func (c *Client) handleFetch(seqNum uint32) error {
 			}
 
 			item = FetchItemDataInternalDate{Time: t}
+		case "SAVEDATE":
+			if !dec.ExpectSP() {
+				return dec.Err()
+			}
+
+			t, err := internal.DecodeDateTime(dec)
+			if err != nil {
+				return err
+			}
+			if t.IsZero() && !dec.ExpectNIL() {
+				return dec.Err()
+			}
+
+			item = FetchItemDataSaveDate{Time: t}
 		case "RFC822.SIZE":
 			var size int64
 			if !dec.ExpectSP() || !dec.ExpectNumber64(&size) {
@@ -830,8 +902,7 @@ func readBodyType1part(dec *imapwire.Decoder, typ string, options *Options) (*im
 func readBodyExt1part(dec *imapwire.Decoder, options *Options) (*imap.BodyStructureSinglePartExt, error) {
 	var ext imap.BodyStructureSinglePartExt
 
-	var md5 string
-	if !dec.ExpectNString(&md5) {
+	if !dec.ExpectNString(&ext.MD5) {
 		return nil, dec.Err()
 	}
 
@@ -0,0 +1,100 @@
+package imapclient_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestFetchMessage(t *testing.T) {
+	const msg = "From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+		"Subject: Photos\r\n" +
+		"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+		"\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--frontier--\r\n"
+
+	addr := startTestServer(t, nil)
+	c := dialTestClient(t, addr)
+	if _, err := c.AppendReader("INBOX", strings.NewReader(msg), int64(len(msg)), nil); err != nil {
+		t.Fatalf("AppendReader() = %v", err)
+	}
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+
+	entity, err := c.FetchMessage(1)
+	if err != nil {
+		t.Fatalf("FetchMessage() = %v", err)
+	}
+	if subject := entity.Header.Get("Subject"); subject != "Photos" {
+		t.Errorf("got subject %q, want %q", subject, "Photos")
+	}
+	mr := entity.MultipartReader()
+	if mr == nil {
+		t.Fatalf("expected a multipart message")
+	}
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("NextPart() = %v", err)
+		}
+		b, err := io.ReadAll(part.Body)
+		if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+		parts = append(parts, part.Header.Get("Content-Type")+": "+string(b))
+	}
+	want := []string{"text/plain: See attached.", "image/png: \x89PNG\r\n\x1a\n"}
+	if strings.Join(parts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got parts %q, want %q", parts, want)
+	}
+
+	if _, err := c.FetchMessage(42); err == nil {
+		t.Errorf("FetchMessage() for a missing message should fail")
+	}
+}
+
+func TestFetchSaveDate(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapSaveDate:  {},
+		},
+	})
+	c := dialTestClient(t, addr)
+
+	before := time.Now().Truncate(time.Second)
+	if _, err := c.AppendReader("INBOX", strings.NewReader(testMessage), int64(len(testMessage)), nil); err != nil {
+		t.Fatalf("AppendReader() = %v", err)
+	}
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+
+	msgs, err := c.Fetch(imap.SeqSetNum(1), &imap.FetchOptions{SaveDate: true}).Collect()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("got %v messages, want 1", len(msgs))
+	}
+	if saveDate := msgs[0].SaveDate; saveDate.Before(before) || saveDate.After(time.Now()) {
+		t.Errorf("got save date %v, want a time after %v", saveDate, before)
+	}
+}
@@ -1,9 +1,15 @@
 package imapclient
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
+// defaultIdleRefreshInterval is the default duration after which IDLE is
+// restarted. Servers may log out clients after 30 minutes of inactivity.
+const defaultIdleRefreshInterval = 28 * time.Minute
+
 // Idle sends an IDLE command.
 //
 // Unlike other commands, this method blocks until the server acknowledges it.
@@ -68,3 +74,64 @@ func (cmd *IdleCommand) Wait() error {
 	}
 	return cmd.cmd.Wait()
 }
+
+// IdleOptions contains options for Client.IdleWithOptions.
+type IdleOptions struct {
+	// RefreshInterval is the duration after which the IDLE command is
+	// restarted, to avoid being logged out for inactivity. If zero, 28
+	// minutes is used.
+	RefreshInterval time.Duration
+}
+
+// IdleWithOptions runs the IDLE command until the context is cancelled.
+//
+// Updates sent by the server are delivered to Options.UnilateralDataHandler,
+// including the ones received after IDLE has been stopped but before the
+// server has acknowledged it. IDLE is periodically restarted according to
+// IdleOptions.RefreshInterval.
+//
+// Once the context is cancelled, IDLE is stopped and nil is returned. An
+// error is returned if the server terminates IDLE on its own.
+//
+// This command requires support for IMAP4rev2 or the IDLE extension.
+func (c *Client) IdleWithOptions(ctx context.Context, options *IdleOptions) error {
+	refreshInterval := defaultIdleRefreshInterval
+	if options != nil && options.RefreshInterval > 0 {
+		refreshInterval = options.RefreshInterval
+	}
+
+	for {
+		idleCmd, err := c.Idle()
+		if err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(refreshInterval)
+		stop := false
+		select {
+		case <-ctx.Done():
+			stop = true
+		case <-timer.C:
+		case err := <-idleCmd.done:
+			timer.Stop()
+			idleCmd.enc.end()
+			idleCmd.enc = nil
+			if err == nil {
+				err = fmt.Errorf("imapclient: server terminated IDLE")
+			}
+			idleCmd.err = err
+			return err
+		}
+		timer.Stop()
+
+		if err := idleCmd.Close(); err != nil {
+			return err
+		}
+		if err := idleCmd.Wait(); err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package imapclient_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestIdleWithOptions(t *testing.T) {
+	var numIdle atomic.Int32
+	addr := startTestServer(t, &imapserver.Options{
+		OnCommand: func(info imapserver.CommandInfo) {
+			if info.Name == "IDLE" {
+				numIdle.Add(1)
+			}
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	updates := make(chan uint32, 16)
+	c := imapclient.New(conn, &imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					updates <- *data.NumMessages
+				}
+			},
+		},
+	})
+	defer c.Close()
+	if err := c.Login(testUsername, testPassword).Wait(); err != nil {
+		t.Fatalf("Login() = %v", err)
+	}
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.IdleWithOptions(ctx, &imapclient.IdleOptions{
+			RefreshInterval: 50 * time.Millisecond,
+		})
+	}()
+
+	// Let IDLE be restarted a few times
+	time.Sleep(200 * time.Millisecond)
+
+	other := dialTestClient(t, addr)
+	appendCmd := other.Append("INBOX", int64(len(testMessage)), nil)
+	if _, err := io.WriteString(appendCmd, testMessage); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := appendCmd.Close(); err != nil {
+		t.Fatalf("failed to close message: %v", err)
+	}
+	if _, err := appendCmd.Wait(); err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+
+	select {
+	case n := <-updates:
+		if n != 1 {
+			t.Errorf("got EXISTS %v, want 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for EXISTS")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("IdleWithOptions() = %v", err)
+	}
+	if n := numIdle.Load(); n < 2 {
+		t.Errorf("IDLE was sent %v times, want at least 2", n)
+	}
+
+	// The client must be usable again
+	if err := c.Noop().Wait(); err != nil {
+		t.Errorf("Noop() = %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package imapclient_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+// TestIntegration exercises imapclient against an imapmemserver backend
+// populated from a directory of .eml files.
+func TestIntegration(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1.eml": testMessage,
+		"2.eml": "Subject: Second\r\n\r\nHello!\r\n",
+		"3.txt": "Not a message\r\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("os.WriteFile() = %v", err)
+		}
+	}
+
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(testUsername, testPassword)
+	user.Create(context.Background(), "INBOX", nil)
+	if err := user.ImportDir("Archive", dir); err != nil {
+		t.Fatalf("ImportDir() = %v", err)
+	}
+	memServer.AddUser(user)
+
+	addr := startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+	})
+	c := dialTestClient(t, addr)
+
+	mailboxes, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	} else if len(mailboxes) != 2 {
+		t.Errorf("List() returned %v mailboxes, want 2", len(mailboxes))
+	}
+
+	selectData, err := c.Select("Archive", nil).Wait()
+	if err != nil {
+		t.Fatalf("Select() = %v", err)
+	} else if selectData.NumMessages != 2 {
+		t.Errorf("Select() reported %v messages, want 2", selectData.NumMessages)
+	}
+
+	msgs, err := c.Fetch(imap.SeqSetNum(1, 2), &imap.FetchOptions{Envelope: true}).Collect()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	} else if len(msgs) != 2 || msgs[0].Envelope.Subject != "Your Name." || msgs[1].Envelope.Subject != "Second" {
+		t.Errorf("Fetch() returned unexpected messages")
+	}
+
+	storeFlags := &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagFlagged},
+	}
+	if err := c.Store(imap.SeqSetNum(2), storeFlags, nil).Close(); err != nil {
+		t.Fatalf("Store() = %v", err)
+	}
+
+	searchData, err := c.Search(&imap.SearchCriteria{Flag: []imap.Flag{imap.FlagFlagged}}, nil).Wait()
+	if err != nil {
+		t.Fatalf("Search() = %v", err)
+	} else if seqNums := searchData.AllNums(); len(seqNums) != 1 || seqNums[0] != 2 {
+		t.Errorf("Search() = %v, want [2]", seqNums)
+	}
+
+	if err := c.Logout().Wait(); err != nil {
+		t.Fatalf("Logout() = %v", err)
+	}
+}
@@ -25,6 +25,9 @@ func getSelectOpts(options *imap.ListOptions) []string {
 	if options.SelectRecursiveMatch {
 		l = append(l, "RECURSIVEMATCH")
 	}
+	if options.SelectSpecialUse {
+		l = append(l, "SPECIAL-USE")
+	}
 	return l
 }
 
@@ -43,6 +46,9 @@ func getReturnOpts(options *imap.ListOptions) []string {
 	if options.ReturnStatus != nil {
 		l = append(l, "STATUS")
 	}
+	if options.ReturnSpecialUse {
+		l = append(l, "SPECIAL-USE")
+	}
 	return l
 }
 
@@ -176,6 +182,7 @@ func readList(dec *imapwire.Decoder) (*imap.ListData, error) {
 	if err != nil {
 		return nil, err
 	}
+	data.NoDelim = data.Delim == 0
 
 	if !dec.ExpectSP() || !dec.ExpectMailbox(&data.Mailbox) {
 		return nil, dec.Err()
@@ -0,0 +1,223 @@
+package imapclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+const defaultPoolMaxIdle = 2
+
+// PoolOptions contains options for Pool.
+type PoolOptions struct {
+	// Dial is called to create a new client for an account. The returned
+	// client must be authenticated. This field is required.
+	Dial func(ctx context.Context, account string) (*Client, error)
+	// Maximum number of idle connections kept per account. If zero, a default
+	// of 2 is used.
+	MaxIdle int
+	// Idle connections unused for longer than this duration are closed. If
+	// zero, idle connections never expire.
+	IdleTimeout time.Duration
+}
+
+// Pool is a pool of authenticated clients, keyed by account.
+//
+// A client is obtained with Get, and must be returned with Put once the
+// caller is done with it. Before being handed out again, an idle client is
+// checked with a NOOP command.
+//
+// The pool doesn't reset the state of the clients it hands out: a client may
+// have a mailbox selected by a previous user.
+//
+// A Pool is safe for concurrent use by multiple goroutines.
+type Pool struct {
+	options PoolOptions
+
+	mutex  sync.Mutex
+	idle   map[string][]poolConn
+	active map[*Client]string
+	closed bool
+}
+
+type poolConn struct {
+	client   *Client
+	idleTime time.Time
+}
+
+// NewPool creates a new pool.
+func NewPool(options *PoolOptions) *Pool {
+	if options.Dial == nil {
+		panic("imapclient: PoolOptions.Dial must be set")
+	}
+	return &Pool{
+		options: *options,
+		idle:    make(map[string][]poolConn),
+		active:  make(map[*Client]string),
+	}
+}
+
+func (p *Pool) maxIdle() int {
+	if p.options.MaxIdle > 0 {
+		return p.options.MaxIdle
+	}
+	return defaultPoolMaxIdle
+}
+
+// Get returns a client for an account.
+//
+// An idle client is re-used if possible, otherwise a new one is created via
+// PoolOptions.Dial.
+func (p *Pool) Get(ctx context.Context, account string) (*Client, error) {
+	for {
+		client, err := p.popIdle(account)
+		if err != nil {
+			return nil, err
+		} else if client == nil {
+			break
+		}
+
+		if err := noopContext(ctx, client); err != nil {
+			client.Close()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			continue
+		}
+
+		p.mutex.Lock()
+		p.active[client] = account
+		p.mutex.Unlock()
+		return client, nil
+	}
+
+	client, err := p.options.Dial(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		client.Close()
+		return nil, fmt.Errorf("imapclient: pool is closed")
+	}
+	p.active[client] = account
+	return client, nil
+}
+
+// popIdle removes the most recently used idle client for an account from the
+// pool. Expired clients are closed. If there is no idle client, nil is
+// returned.
+func (p *Pool) popIdle(account string) (*Client, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, fmt.Errorf("imapclient: pool is closed")
+	}
+
+	p.closeExpiredLocked(account)
+
+	l := p.idle[account]
+	if len(l) == 0 {
+		return nil, nil
+	}
+	pc := l[len(l)-1]
+	p.idle[account] = l[:len(l)-1]
+	return pc.client, nil
+}
+
+func (p *Pool) closeExpiredLocked(account string) {
+	if p.options.IdleTimeout <= 0 {
+		return
+	}
+
+	l := p.idle[account]
+	var kept []poolConn
+	for _, pc := range l {
+		if time.Since(pc.idleTime) > p.options.IdleTimeout {
+			go pc.client.Close()
+		} else {
+			kept = append(kept, pc)
+		}
+	}
+	if len(kept) > 0 {
+		p.idle[account] = kept
+	} else {
+		delete(p.idle, account)
+	}
+}
+
+// Put returns a client obtained with Get to the pool.
+//
+// Clients which have been closed, either by the caller or by the server, are
+// discarded. Callers should close clients which are in an unknown state (e.g.
+// after a failed command) before returning them to the pool.
+func (p *Pool) Put(client *Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	account, ok := p.active[client]
+	if !ok {
+		panic("imapclient: client returned to the pool wasn't obtained via Pool.Get")
+	}
+	delete(p.active, client)
+
+	p.closeExpiredLocked(account)
+
+	state := client.State()
+	reusable := state == imap.ConnStateAuthenticated || state == imap.ConnStateSelected
+	if p.closed || !reusable || len(p.idle[account]) >= p.maxIdle() {
+		go client.Close()
+		return
+	}
+
+	p.idle[account] = append(p.idle[account], poolConn{
+		client:   client,
+		idleTime: time.Now(),
+	})
+}
+
+// Close closes all idle clients and prevents new clients from being handed
+// out.
+//
+// Clients currently in use are closed when returned with Put.
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mutex.Unlock()
+
+	var firstErr error
+	for _, l := range idle {
+		for _, pc := range l {
+			if err := pc.client.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// noopContext sends a NOOP command and waits for its completion. The client
+// is closed if the context is cancelled before the command completes.
+func noopContext(ctx context.Context, client *Client) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Noop().Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		client.Close()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,138 @@
+package imapclient_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// newTestPool creates an imapclient.Pool connected to a test server. The
+// returned counter is incremented each time a new connection is dialed.
+func newTestPool(t *testing.T, addr string, options *imapclient.PoolOptions) (*imapclient.Pool, *atomic.Int32, chan net.Conn) {
+	t.Helper()
+
+	var dials atomic.Int32
+	conns := make(chan net.Conn, 16)
+	options.Dial = func(ctx context.Context, account string) (*imapclient.Client, error) {
+		dials.Add(1)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		c := imapclient.New(conn, nil)
+		if err := c.Login(account, testPassword).Wait(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		conns <- conn
+		return c, nil
+	}
+	pool := imapclient.NewPool(options)
+	t.Cleanup(func() {
+		pool.Close()
+	})
+	return pool, &dials, conns
+}
+
+func getPoolClient(t *testing.T, pool *imapclient.Pool) *imapclient.Client {
+	t.Helper()
+
+	c, err := pool.Get(context.Background(), testUsername)
+	if err != nil {
+		t.Fatalf("Pool.Get() = %v", err)
+	}
+	return c
+}
+
+func TestPool(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{})
+	pool, dials, _ := newTestPool(t, addr, &imapclient.PoolOptions{})
+
+	c1 := getPoolClient(t, pool)
+	pool.Put(c1)
+	c2 := getPoolClient(t, pool)
+	if c2 != c1 {
+		t.Errorf("Pool.Get() didn't re-use the idle client")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("dialed %v times, want 1", n)
+	}
+
+	// A closed client must not be handed out again
+	c2.Close()
+	pool.Put(c2)
+	c3 := getPoolClient(t, pool)
+	if c3 == c2 {
+		t.Errorf("Pool.Get() returned a closed client")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("dialed %v times, want 2", n)
+	}
+	if err := c3.Noop().Wait(); err != nil {
+		t.Errorf("NOOP = %v", err)
+	}
+	pool.Put(c3)
+}
+
+func TestPoolRedial(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{})
+	pool, dials, conns := newTestPool(t, addr, &imapclient.PoolOptions{})
+
+	c1 := getPoolClient(t, pool)
+	pool.Put(c1)
+
+	// Break the idle connection: the NOOP check should fail and a new
+	// connection should be dialed
+	(<-conns).Close()
+
+	c2 := getPoolClient(t, pool)
+	if c2 == c1 {
+		t.Errorf("Pool.Get() returned a broken client")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("dialed %v times, want 2", n)
+	}
+	if err := c2.Noop().Wait(); err != nil {
+		t.Errorf("NOOP = %v", err)
+	}
+	pool.Put(c2)
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{})
+	pool, dials, _ := newTestPool(t, addr, &imapclient.PoolOptions{MaxIdle: 1})
+
+	c1 := getPoolClient(t, pool)
+	c2 := getPoolClient(t, pool)
+	pool.Put(c1)
+	pool.Put(c2)
+
+	if c := getPoolClient(t, pool); c != c1 {
+		t.Errorf("Pool.Get() didn't re-use the first idle client")
+	}
+	getPoolClient(t, pool)
+	if n := dials.Load(); n != 3 {
+		t.Errorf("dialed %v times, want 3", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	addr := startTestServer(t, &imapserver.Options{})
+	pool, dials, _ := newTestPool(t, addr, &imapclient.PoolOptions{IdleTimeout: 10 * time.Millisecond})
+
+	c1 := getPoolClient(t, pool)
+	pool.Put(c1)
+	time.Sleep(50 * time.Millisecond)
+
+	if c := getPoolClient(t, pool); c == c1 {
+		t.Errorf("Pool.Get() returned an expired client")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("dialed %v times, want 2", n)
+	}
+}
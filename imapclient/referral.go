@@ -0,0 +1,42 @@
+package imapclient
+
+import (
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// ReferralError is returned when a command fails because the server refers
+// the client to another server, e.g. because the account or the mailbox is
+// located there (RFC 2193 and RFC 2221).
+//
+// The client can connect to one of the IMAP URLs and retry the command.
+type ReferralError struct {
+	URLs []string
+	Err  *imap.Error
+}
+
+func (err *ReferralError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ReferralError) Unwrap() error {
+	return err.Err
+}
+
+// readReferralURLs reads the space-separated list of IMAP URLs of a REFERRAL
+// response code.
+func readReferralURLs(dec *imapwire.Decoder) ([]string, error) {
+	urls := []string{}
+	for dec.SP() {
+		var url string
+		if !dec.Expect(dec.Func(&url, isReferralURLChar), "URL") {
+			return nil, dec.Err()
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func isReferralURLChar(ch byte) bool {
+	return ch > ' ' && ch < 0x7F && ch != ']'
+}
@@ -0,0 +1,59 @@
+package imapclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// referralSession redirects the "Remote" mailbox to another server.
+type referralSession struct {
+	imapserver.Session
+}
+
+const testMailboxReferralURL = "imap://test-user@other.example.org/Remote"
+
+// Select redirects the "Remote" mailbox to another server (RFC 2193).
+func (sess *referralSession) Select(ctx context.Context, mailbox string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	if mailbox == "Remote" {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCode(fmt.Sprintf("%v %v", imap.ResponseCodeReferral, testMailboxReferralURL)),
+			Text: "Mailbox is located on another server",
+		}
+	}
+	return sess.Session.Select(ctx, mailbox, options)
+}
+
+func TestReferral(t *testing.T) {
+	memServer := newTestMemServer()
+	addr := startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &referralSession{memServer.NewSession()}, nil, nil
+		},
+	})
+	c := dialTestClient(t, addr)
+
+	_, err := c.Select("Remote", nil).Wait()
+	var referralErr *imapclient.ReferralError
+	if !errors.As(err, &referralErr) {
+		t.Fatalf("Select() = %v, want a referral error", err)
+	}
+	if len(referralErr.URLs) != 1 || referralErr.URLs[0] != testMailboxReferralURL {
+		t.Errorf("got referral URLs %q, want %q", referralErr.URLs, testMailboxReferralURL)
+	}
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) || imapErr.Type != imap.StatusResponseTypeNo {
+		t.Errorf("expected the referral to unwrap to a NO response, got %v", err)
+	}
+
+	// The connection must still be usable
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Errorf("Select() = %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package imapclient
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"time"
 	"unicode"
@@ -17,10 +18,11 @@ func returnSearchOptions(options *imap.SearchOptions) []string {
 	}
 
 	m := map[string]bool{
-		"MIN":   options.ReturnMin,
-		"MAX":   options.ReturnMax,
-		"ALL":   options.ReturnAll,
-		"COUNT": options.ReturnCount,
+		"MIN":       options.ReturnMin,
+		"MAX":       options.ReturnMax,
+		"ALL":       options.ReturnAll,
+		"COUNT":     options.ReturnCount,
+		"RELEVANCY": options.ReturnRelevancy,
 	}
 
 	var l []string
@@ -49,6 +51,7 @@ func (c *Client) search(uid bool, criteria *imap.SearchCriteria, options *imap.S
 	}
 
 	cmd := &SearchCommand{}
+	cmd.data.UID = uid
 	enc := c.beginCommand(uidCmdName("SEARCH", uid), cmd)
 	if returnOpts := returnSearchOptions(options); len(returnOpts) > 0 {
 		enc.SP().Atom("RETURN").SP().List(len(returnOpts), func(i int) {
@@ -77,12 +80,36 @@ func (c *Client) UIDSearch(criteria *imap.SearchCriteria, options *imap.SearchOp
 func (c *Client) handleSearch() error {
 	cmd := findPendingCmdByType[*SearchCommand](c)
 	for c.dec.SP() {
+		if c.dec.Special('(') {
+			// search-sort-mod-seq, see RFC 7162 section 7
+			var (
+				name   string
+				modSeq uint64
+			)
+			if !c.dec.ExpectAtom(&name) || !c.dec.ExpectSP() || !c.dec.ExpectModSeq(&modSeq) || !c.dec.ExpectSpecial(')') {
+				return c.dec.Err()
+			}
+			if cmd != nil && strings.EqualFold(name, "MODSEQ") {
+				cmd.data.ModSeq = modSeq
+			}
+			continue
+		}
+
 		var num uint32
 		if !c.dec.ExpectNumber(&num) {
 			return c.dec.Err()
 		}
 		if cmd != nil {
-			cmd.data.All.AddNum(num)
+			// Populate the fields otherwise returned in ESEARCH responses
+			data := &cmd.data
+			data.All.AddNum(num)
+			data.Count++
+			if data.Min == 0 || num < data.Min {
+				data.Min = num
+			}
+			if num > data.Max {
+				data.Max = num
+			}
 		}
 	}
 	return nil
@@ -109,12 +136,17 @@ func (c *Client) handleESearch() error {
 	})
 	if cmd != nil {
 		cmd := cmd.(*SearchCommand)
+		data.ESearch = true
 		cmd.data = *data
 	}
 	return nil
 }
 
 // SearchCommand is a SEARCH command.
+//
+// The results are returned in the same form regardless of whether the server
+// replied with a SEARCH or an ESEARCH response. For SEARCH responses, Min,
+// Max and Count are computed from the list of matching messages.
 type SearchCommand struct {
 	cmd
 	data imap.SearchData
@@ -164,6 +196,27 @@ func writeSearchKey(enc *imapwire.Encoder, criteria *imap.SearchCriteria) {
 		}
 	}
 
+	if !criteria.SavedSince.IsZero() && !criteria.SavedBefore.IsZero() && criteria.SavedBefore.Sub(criteria.SavedSince) == 24*time.Hour {
+		encodeItem().Atom("SAVEDON").SP().String(criteria.SavedSince.Format(internal.DateLayout))
+	} else {
+		if !criteria.SavedSince.IsZero() {
+			encodeItem().Atom("SAVEDSINCE").SP().String(criteria.SavedSince.Format(internal.DateLayout))
+		}
+		if !criteria.SavedBefore.IsZero() {
+			encodeItem().Atom("SAVEDBEFORE").SP().String(criteria.SavedBefore.Format(internal.DateLayout))
+		}
+	}
+	if criteria.SaveDateSupported {
+		encodeItem().Atom("SAVEDATESUPPORTED")
+	}
+
+	if !criteria.Younger.IsZero() {
+		encodeItem().Atom("YOUNGER").SP().Number64(withinInterval(criteria.Younger, math.Ceil))
+	}
+	if !criteria.Older.IsZero() {
+		encodeItem().Atom("OLDER").SP().Number64(withinInterval(criteria.Older, math.Floor))
+	}
+
 	for _, kv := range criteria.Header {
 		switch k := strings.ToUpper(kv.Key); k {
 		case "BCC", "CC", "FROM", "SUBJECT", "TO":
@@ -213,6 +266,10 @@ func writeSearchKey(enc *imapwire.Encoder, criteria *imap.SearchCriteria) {
 		enc.SP()
 		writeSearchKey(enc, &or[1])
 	}
+	for _, fuzzy := range criteria.Fuzzy {
+		encodeItem().Atom("FUZZY").SP()
+		writeSearchKey(enc, &fuzzy)
+	}
 
 	if firstItem {
 		enc.Atom("ALL")
@@ -277,6 +334,22 @@ func readESearchResponse(dec *imapwire.Decoder) (tag string, data *imap.SearchDa
 				return "", nil, dec.Err()
 			}
 			data.Count = num
+		case "MODSEQ":
+			if !dec.ExpectModSeq(&data.ModSeq) {
+				return "", nil, dec.Err()
+			}
+		case "RELEVANCY":
+			err := dec.ExpectList(func() error {
+				var score uint32
+				if !dec.ExpectNumber(&score) {
+					return dec.Err()
+				}
+				data.Relevancy = append(data.Relevancy, uint8(score))
+				return nil
+			})
+			if err != nil {
+				return "", nil, err
+			}
 		default:
 			if !dec.DiscardValue() {
 				return "", nil, dec.Err()
@@ -321,6 +394,11 @@ func searchCriteriaIsASCII(criteria *imap.SearchCriteria) bool {
 			return false
 		}
 	}
+	for _, fuzzy := range criteria.Fuzzy {
+		if !searchCriteriaIsASCII(&fuzzy) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -332,3 +410,13 @@ func isASCII(s string) bool {
 	}
 	return true
 }
+
+// withinInterval converts a time into a positive number of seconds relative
+// to the current time, for the WITHIN search keys.
+func withinInterval(t time.Time, round func(float64) float64) int64 {
+	n := int64(round(time.Since(t).Seconds()))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package imapclient_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+func TestSearchResponses(t *testing.T) {
+	// Scripted server replying to SEARCH and UID SEARCH
+	addr := listenRaw(t, func(conn net.Conn) {
+		io.WriteString(conn, "* OK [CAPABILITY IMAP4rev1 ESEARCH CONDSTORE] Hello\r\n")
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, cmd, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), " ")
+			switch {
+			case strings.HasPrefix(cmd, "SEARCH "):
+				io.WriteString(conn, "* SEARCH 7 2 4 (MODSEQ 917162500)\r\n")
+			case strings.HasPrefix(cmd, "UID SEARCH "):
+				fmt.Fprintf(conn, "* ESEARCH (TAG %q) UID MIN 4 MAX 8 COUNT 3 ALL 4,7:8 MODSEQ 12345\r\n", tag)
+			}
+			fmt.Fprintf(conn, "%v OK Done\r\n", tag)
+		}
+	})
+	client, err := imapclient.DialContext(context.Background(), addr, nil)
+	if err != nil {
+		t.Fatalf("DialContext() = %v", err)
+	}
+	defer client.Close()
+
+	criteria := &imap.SearchCriteria{Flag: []imap.Flag{imap.FlagSeen}}
+
+	data, err := client.Search(criteria, nil).Wait()
+	if err != nil {
+		t.Fatalf("Search() = %v", err)
+	}
+	want := imap.SearchData{Min: 2, Max: 7, Count: 3, ModSeq: 917162500}
+	want.All.AddNum(7, 2, 4)
+	if data.All.String() != want.All.String() || data.UID || data.ESearch || data.Min != want.Min || data.Max != want.Max || data.Count != want.Count || data.ModSeq != want.ModSeq {
+		t.Errorf("Search() = %+v, want %+v", data, &want)
+	}
+
+	data, err = client.UIDSearch(criteria, &imap.SearchOptions{ReturnAll: true}).Wait()
+	if err != nil {
+		t.Fatalf("UIDSearch() = %v", err)
+	}
+	want = imap.SearchData{UID: true, ESearch: true, Min: 4, Max: 8, Count: 3, ModSeq: 12345}
+	want.All.AddNum(4, 7, 8)
+	if data.All.String() != want.All.String() || !data.UID || !data.ESearch || data.Min != want.Min || data.Max != want.Max || data.Count != want.Count || data.ModSeq != want.ModSeq {
+		t.Errorf("UIDSearch() = %+v, want %+v", data, &want)
+	}
+}
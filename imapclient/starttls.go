@@ -64,6 +64,11 @@ type startTLSCommand struct {
 	upgradeDone chan<- struct{}
 }
 
+func (cmd *startTLSCommand) upgrade(c *Client) {
+	c.upgradeStartTLS(cmd.tlsConfig)
+	close(cmd.upgradeDone)
+}
+
 type startTLSConn struct {
 	net.Conn
 	r io.Reader
@@ -16,8 +16,11 @@ func statusItems(options *imap.StatusOptions) []string {
 		"UNSEEN":          options.NumUnseen,
 		"DELETED":         options.NumDeleted,
 		"SIZE":            options.Size,
+		"RECENT":          options.NumRecent,
 		"APPENDLIMIT":     options.AppendLimit,
 		"DELETED-STORAGE": options.DeletedStorage,
+		"HIGHESTMODSEQ":   options.HighestModSeq,
+		"MAILBOXID":       options.MailboxID,
 	}
 
 	var l []string
@@ -125,6 +128,10 @@ func readStatusAttVal(dec *imapwire.Decoder, data *imap.StatusData) error {
 		var size int64
 		ok = dec.ExpectNumber64(&size)
 		data.Size = &size
+	case "RECENT":
+		var num uint32
+		ok = dec.ExpectNumber(&num)
+		data.NumRecent = &num
 	case "APPENDLIMIT":
 		var num uint32
 		if dec.Number(&num) {
@@ -138,6 +145,10 @@ func readStatusAttVal(dec *imapwire.Decoder, data *imap.StatusData) error {
 		var storage int64
 		ok = dec.ExpectNumber64(&storage)
 		data.DeletedStorage = &storage
+	case "HIGHESTMODSEQ":
+		ok = dec.ExpectModSeq(&data.HighestModSeq)
+	case "MAILBOXID":
+		ok = dec.ExpectSpecial('(') && dec.ExpectAtom(&data.MailboxID) && dec.ExpectSpecial(')')
 	default:
 		if !dec.DiscardValue() {
 			return dec.Err()
@@ -0,0 +1,46 @@
+package imapclient_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestStatus(t *testing.T) {
+	client := dialTestClient(t, startTestServer(t, nil))
+	if _, err := client.AppendReader("INBOX", strings.NewReader(testMessage), int64(len(testMessage)), nil); err != nil {
+		t.Fatalf("AppendReader() = %v", err)
+	}
+
+	data, err := client.Status("INBOX", &imap.StatusOptions{
+		NumMessages: true,
+		UIDNext:     true,
+	}).Wait()
+	if err != nil {
+		t.Fatalf("Status() = %v", err)
+	}
+	if data.Mailbox != "INBOX" {
+		t.Errorf("Status().Mailbox = %q, want %q", data.Mailbox, "INBOX")
+	}
+	if data.NumMessages == nil || *data.NumMessages != 1 {
+		t.Errorf("Status().NumMessages = %v, want 1", data.NumMessages)
+	}
+	if data.UIDNext != 2 {
+		t.Errorf("Status().UIDNext = %v, want 2", data.UIDNext)
+	}
+	if data.UIDValidity != 0 || data.NumUnseen != nil || data.NumDeleted != nil || data.Size != nil || data.NumRecent != nil || data.HighestModSeq != 0 {
+		t.Errorf("Status() = %+v, want only MESSAGES and UIDNEXT", data)
+	}
+
+	data, err = client.Status("INBOX", &imap.StatusOptions{NumRecent: true}).Wait()
+	if err != nil {
+		t.Fatalf("Status() = %v", err)
+	}
+	if data.NumRecent == nil || *data.NumRecent != 1 {
+		t.Errorf("Status().NumRecent = %v, want 1", data.NumRecent)
+	}
+	if data.NumMessages != nil || data.UIDNext != 0 {
+		t.Errorf("Status() = %+v, want only RECENT", data)
+	}
+}
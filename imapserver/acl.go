@@ -0,0 +1,186 @@
+package imapserver
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+func (c *Conn) handleSetACL(dec *imapwire.Decoder) error {
+	var mailbox, identifier, rights string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() || !dec.ExpectAString(&identifier) || !dec.ExpectSP() || !dec.ExpectAString(&rights) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	mod := imap.RightModificationReplace
+	if len(rights) > 0 {
+		switch m := imap.RightModification(rights[0]); m {
+		case imap.RightModificationAdd, imap.RightModificationRemove:
+			mod = m
+			rights = rights[1:]
+		}
+	}
+	set, err := parseRightSet(rights)
+	if err != nil {
+		return err
+	}
+
+	session, err := c.aclSession()
+	if err != nil {
+		return err
+	}
+	if err := c.checkAdminister(session, mailbox); err != nil {
+		return err
+	}
+	return session.SetACL(c.ctx, mailbox, identifier, mod, set)
+}
+
+func (c *Conn) handleDeleteACL(dec *imapwire.Decoder) error {
+	var mailbox, identifier string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() || !dec.ExpectAString(&identifier) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.aclSession()
+	if err != nil {
+		return err
+	}
+	if err := c.checkAdminister(session, mailbox); err != nil {
+		return err
+	}
+	return session.DeleteACL(c.ctx, mailbox, identifier)
+}
+
+func (c *Conn) handleGetACL(dec *imapwire.Decoder) error {
+	var mailbox string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.aclSession()
+	if err != nil {
+		return err
+	}
+	if err := c.checkAdminister(session, mailbox); err != nil {
+		return err
+	}
+
+	data, err := session.GetACL(c.ctx, mailbox)
+	if err != nil {
+		return err
+	}
+	return c.writeACL(data)
+}
+
+func (c *Conn) handleListRights(dec *imapwire.Decoder) error {
+	var mailbox, identifier string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() || !dec.ExpectAString(&identifier) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.aclSession()
+	if err != nil {
+		return err
+	}
+	if err := c.checkAdminister(session, mailbox); err != nil {
+		return err
+	}
+
+	data, err := session.ListRights(c.ctx, mailbox, identifier)
+	if err != nil {
+		return err
+	}
+	return c.writeListRights(data)
+}
+
+func (c *Conn) handleMyRights(dec *imapwire.Decoder) error {
+	var mailbox string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.aclSession()
+	if err != nil {
+		return err
+	}
+
+	data, err := session.MyRights(c.ctx, mailbox)
+	if err != nil {
+		return err
+	}
+	return c.writeMyRights(data)
+}
+
+func (c *Conn) aclSession() (SessionACL, error) {
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return nil, err
+	}
+	session, ok := c.session.(SessionACL)
+	if !ok || !c.server.options.caps().Has(imap.CapACL) {
+		return nil, newClientBugError("ACL is not supported")
+	}
+	return session, nil
+}
+
+// checkAdminister checks that the user is allowed to read and modify the ACL
+// of a mailbox.
+func (c *Conn) checkAdminister(session SessionACL, mailbox string) error {
+	data, err := session.MyRights(c.ctx, mailbox)
+	if err != nil {
+		return err
+	}
+	if !data.Rights.Has(imap.RightAdminister) {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeNoPerm,
+			Text: "Administer right required",
+		}
+	}
+	return nil
+}
+
+func parseRightSet(s string) (imap.RightSet, error) {
+	for i := 0; i < len(s); i++ {
+		// Digits are reserved for implementation-defined rights
+		ch := s[i]
+		if !imap.AllRights.Has(imap.Right(ch)) && (ch < '0' || ch > '9') {
+			return "", newClientBugError("Unknown ACL right")
+		}
+	}
+	return imap.RightSet(s), nil
+}
+
+func (c *Conn) writeACL(data *imap.ACLData) error {
+	identifiers := make([]string, 0, len(data.Rights))
+	for identifier := range data.Rights {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("ACL").SP().Mailbox(data.Mailbox)
+	for _, identifier := range identifiers {
+		enc.SP().String(identifier).SP().String(string(data.Rights[identifier]))
+	}
+	return enc.CRLF()
+}
+
+func (c *Conn) writeListRights(data *imap.ListRightsData) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("LISTRIGHTS").SP().Mailbox(data.Mailbox)
+	enc.SP().String(data.Identifier).SP().String(string(data.RequiredRights))
+	for _, rights := range data.OptionalRights {
+		enc.SP().String(string(rights))
+	}
+	return enc.CRLF()
+}
+
+func (c *Conn) writeMyRights(data *imap.MyRightsData) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("MYRIGHTS").SP().Mailbox(data.Mailbox).SP().String(string(data.Rights))
+	return enc.CRLF()
+}
@@ -0,0 +1,63 @@
+package imapserver_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestACL(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapACL:       {},
+		},
+	})
+	tc.login()
+
+	tc.writeLine("M1 MYRIGHTS INBOX")
+	if got, want := tc.expectOK("M1"), []string{`* MYRIGHTS INBOX "lrswipkxtea"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("S1 SETACL INBOX someone +lr")
+	tc.expectOK("S1")
+	tc.writeLine("S2 SETACL INBOX someone +s")
+	tc.expectOK("S2")
+
+	tc.writeLine("G1 GETACL INBOX")
+	want := []string{`* ACL INBOX "someone" "lrs" "test-user" "lrswipkxtea"`}
+	if got := tc.expectOK("G1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("L1 LISTRIGHTS INBOX someone")
+	want = []string{`* LISTRIGHTS INBOX "someone" "" "l" "r" "s" "w" "i" "p" "k" "x" "t" "e" "a"`}
+	if got := tc.expectOK("L1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("D1 DELETEACL INBOX someone")
+	tc.expectOK("D1")
+
+	// Grant lrs to ourselves: MYRIGHTS must reflect it, and since the
+	// administer right has been dropped, the ACL can't be modified anymore
+	tc.writeLine("S3 SETACL INBOX test-user lrs")
+	tc.expectOK("S3")
+	tc.writeLine("M2 MYRIGHTS INBOX")
+	if got, want := tc.expectOK("M2"), []string{`* MYRIGHTS INBOX "lrs"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("S4 SETACL INBOX test-user +a")
+	if resp, _ := tc.readTagged("S4"); !strings.HasPrefix(resp, "S4 NO [NOPERM] ") {
+		t.Errorf("expected NO [NOPERM], got %q", resp)
+	}
+	tc.writeLine("G2 GETACL INBOX")
+	if resp, _ := tc.readTagged("G2"); !strings.HasPrefix(resp, "G2 NO [NOPERM] ") {
+		t.Errorf("expected NO [NOPERM], got %q", resp)
+	}
+}
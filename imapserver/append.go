@@ -1,28 +1,482 @@
 package imapserver
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-// appendLimit is the maximum size of an APPEND payload.
-//
-// TODO: make configurable
-const appendLimit = 100 * 1024 * 1024 // 100MiB
+// AppendMessage is a message appended via MULTIAPPEND.
+type AppendMessage struct {
+	Literal imap.LiteralReader
+	Options *imap.AppendOptions
+}
+
+type catenatePart struct {
+	text []byte
+	url  string
+}
 
 func (c *Conn) handleAppend(tag string, dec *imapwire.Decoder) error {
+	var mailbox string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+
+	if session, ok := c.multiAppendSession(); ok {
+		return c.handleMultiAppend(tag, dec, session, mailbox)
+	}
+
+	appendLimit := c.appendLimit(mailbox)
+
+	var options imap.AppendOptions
+	if err := readAppendOptions(dec, &options); err != nil {
+		return err
+	}
+
 	var (
-		mailbox string
-		options imap.AppendOptions
+		lit     *imapwire.LiteralReader
+		nonSync bool
+		utf8    bool
+		name    string
+		err     error
 	)
-	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() {
+	binary := dec.Special('~')
+	if !binary && dec.Atom(&name) {
+		switch strings.ToUpper(name) {
+		case "UTF8":
+			if !dec.ExpectSP() || !dec.ExpectSpecial('(') {
+				return dec.Err()
+			}
+			lit, nonSync, err = dec.ExpectLiteral8Reader()
+			utf8 = true
+		case "CATENATE":
+			return c.handleAppendCatenate(tag, dec, mailbox, &options, appendLimit)
+		default:
+			return newClientBugError("Unknown APPEND data item")
+		}
+	} else {
+		lit, nonSync, err = c.readAppendLiteralReader(dec, binary)
+	}
+	if err != nil {
+		return err
+	}
+	if utf8 && !c.enabled.Has(imap.CapUTF8Accept) {
+		return newClientBugError("UTF8=ACCEPT must be enabled to append UTF-8 messages")
+	}
+	if lit.Size() > appendLimit {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: fmt.Sprintf("Literals are limited to %v bytes for this command", appendLimit),
+		}
+	}
+	appendErr := c.checkState(imap.ConnStateAuthenticated)
+	if appendErr != nil && !nonSync {
+		// Don't ask the client for data which would be thrown away
+		return appendErr
+	}
+	if err := c.acceptLiteral(lit.Size(), nonSync); err != nil {
+		return err
+	}
+
+	// Only the literal is subject to the literal read timeout, the rest of
+	// the command is bounded by the command read timeout
+	c.setReadTimeout(c.server.options.Timeouts.LiteralRead)
+
+	var data *imap.AppendData
+	if appendErr == nil {
+		var r imap.LiteralReader = lit
+		_, locking := c.session.(SessionMailboxLocker)
+		if locking || (c.server.options.DefaultInternalDate != nil && options.Time.IsZero()) {
+			// The hook needs the whole message, and the mailbox can't stay
+			// locked while the client uploads it
+			var buf bytes.Buffer
+			if _, err := buf.ReadFrom(lit); err != nil {
+				c.setReadTimeout(c.server.options.Timeouts.CommandRead)
+				return err
+			}
+			c.setDefaultInternalDate(&options, buf.Bytes())
+			r = bytes.NewReader(buf.Bytes())
+		}
+
+		var unlock func()
+		unlock, appendErr = c.lockMailboxes(mailbox)
+		if appendErr == nil {
+			data, appendErr = c.session.Append(c.ctx, mailbox, r, &options)
+			unlock()
+		}
+	}
+	_, discardErr := io.Copy(io.Discard, lit)
+	c.setReadTimeout(c.server.options.Timeouts.CommandRead)
+	if discardErr != nil {
+		return discardErr
+	}
+	if utf8 && !dec.ExpectSpecial(')') {
+		return dec.Err()
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+	if appendErr != nil {
+		return appendErr
+	}
+	if err := c.poll("APPEND"); err != nil {
+		return err
+	}
+	return c.writeAppendOK(tag, data)
+}
+
+func (c *Conn) handleAppendCatenate(tag string, dec *imapwire.Decoder, mailbox string, options *imap.AppendOptions, appendLimit int64) error {
+	// Check the state before accepting any literal
+	session, err := c.catenateSession()
+	if err != nil {
+		c.discardCatenate(dec)
+		return err
+	}
+
+	parts, err := c.readCatenate(dec, appendLimit)
+	if err != nil {
+		return err
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	buf, err := c.resolveCatenate(session, parts, appendLimit)
+	if err != nil {
+		return err
+	}
+	c.setDefaultInternalDate(options, buf)
+
+	unlock, err := c.lockMailboxes(mailbox)
+	if err != nil {
+		return err
+	}
+	data, err := c.session.Append(c.ctx, mailbox, bytes.NewReader(buf), options)
+	unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.poll("APPEND"); err != nil {
+		return err
+	}
+	return c.writeAppendOK(tag, data)
+}
+
+// handleMultiAppend handles an APPEND command which may contain more than one
+// message. Messages are streamed to SessionMultiAppend.MultiAppend, which is
+// responsible for appending all of them or none of them.
+func (c *Conn) handleMultiAppend(tag string, dec *imapwire.Decoder, session SessionMultiAppend, mailbox string) error {
+	// Check the state before accepting any literal
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return err
+	}
+
+	r := &MultiAppendReader{conn: c, dec: dec, appendLimit: c.appendLimit(mailbox)}
+	var (
+		data []*imap.AppendData
+		err  error
+	)
+	if _, ok := c.session.(SessionMailboxLocker); ok {
+		// The mailbox can't stay locked while the client uploads messages
+		err = r.readAll()
+		if err == nil {
+			var unlock func()
+			unlock, err = c.lockMailboxes(mailbox)
+			if err == nil {
+				data, err = session.MultiAppend(c.ctx, mailbox, r)
+				unlock()
+			}
+		}
+	} else {
+		data, err = session.MultiAppend(c.ctx, mailbox, r)
+	}
+	if err == nil && !r.done {
+		err = fmt.Errorf("imapserver: MultiAppend returned before reading all messages")
+	}
+	if err != nil {
+		// Consume the rest of the command, unless the error comes from
+		// the command itself
+		r.discard()
+		if r.err != nil && r.err != errMultiAppendDiscarded {
+			return r.err
+		}
+		return err
+	}
+	if !dec.ExpectCRLF() {
 		return dec.Err()
 	}
 
+	if err := c.poll("APPEND"); err != nil {
+		return err
+	}
+	return c.writeAppendOK(tag, data...)
+}
+
+// MultiAppendReader decodes the messages of an APPEND command with
+// MULTIAPPEND.
+type MultiAppendReader struct {
+	conn *Conn
+	dec  *imapwire.Decoder
+
+	n           int   // number of messages
+	size        int64 // total size of messages
+	appendLimit int64 // maximum size of a message
+
+	lit        *imapwire.LiteralReader // literal of the current message, if any
+	utf8       bool                    // current message is wrapped in UTF8 ( )
+	discarding bool                    // draining the command after a failure
+	buffered   []*AppendMessage        // messages read by readAll
+	replay     bool                    // messages are returned from buffered
+	done       bool
+	err        error
+}
+
+// Next returns the next message. It returns io.EOF once all messages have
+// been read.
+//
+// Calling Next discards the unread part of the previous message.
+func (r *MultiAppendReader) Next() (*AppendMessage, error) {
+	if r.err != nil {
+		return nil, r.err
+	} else if r.done {
+		return nil, io.EOF
+	}
+	if r.replay {
+		if len(r.buffered) == 0 {
+			r.done = true
+			return nil, io.EOF
+		}
+		msg := r.buffered[0]
+		r.buffered = r.buffered[1:]
+		return msg, nil
+	}
+	msg, err := r.next()
+	if err == io.EOF {
+		r.done = true
+	} else if err != nil {
+		r.err = err
+	}
+	return msg, err
+}
+
+func (r *MultiAppendReader) next() (*AppendMessage, error) {
+	c, dec := r.conn, r.dec
+
+	if r.n > 0 {
+		if err := r.endMessage(); err != nil {
+			return nil, err
+		}
+		if !dec.SP() {
+			return nil, io.EOF
+		}
+	}
+
+	r.n++
+	if max := c.server.options.maxMultiAppendMessages(); r.n > max {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeLimit,
+			Text: fmt.Sprintf("At most %v messages can be appended at once", max),
+		}
+	}
+
+	var options imap.AppendOptions
+	if err := readAppendOptions(dec, &options); err != nil {
+		return nil, err
+	}
+
+	var (
+		lit     *imapwire.LiteralReader
+		nonSync bool
+		name    string
+		err     error
+	)
+	binary := dec.Special('~')
+	if !binary && dec.Atom(&name) {
+		switch strings.ToUpper(name) {
+		case "UTF8":
+			if !dec.ExpectSP() || !dec.ExpectSpecial('(') {
+				return nil, dec.Err()
+			}
+			lit, nonSync, err = dec.ExpectLiteral8Reader()
+			if err != nil {
+				return nil, err
+			}
+			if !c.enabled.Has(imap.CapUTF8Accept) {
+				return nil, newClientBugError("UTF8=ACCEPT must be enabled to append UTF-8 messages")
+			}
+			r.utf8 = true
+		case "CATENATE":
+			session, err := c.catenateSession()
+			if err != nil {
+				c.discardCatenate(dec)
+				return nil, err
+			}
+			parts, err := c.readCatenate(dec, r.appendLimit)
+			if err != nil {
+				return nil, err
+			}
+			buf, err := c.resolveCatenate(session, parts, r.appendLimit)
+			if err != nil {
+				return nil, err
+			}
+			if err := r.addSize(int64(len(buf))); err != nil {
+				return nil, err
+			}
+			c.setDefaultInternalDate(&options, buf)
+			return &AppendMessage{Literal: bytes.NewReader(buf), Options: &options}, nil
+		default:
+			return nil, newClientBugError("Unknown APPEND data item")
+		}
+	} else {
+		lit, nonSync, err = c.readAppendLiteralReader(dec, binary)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if lit.Size() > r.appendLimit {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: fmt.Sprintf("Literals are limited to %v bytes for this command", r.appendLimit),
+		}
+	}
+	if err := r.addSize(lit.Size()); err != nil {
+		return nil, err
+	}
+	if r.discarding && !nonSync {
+		// Don't ask the client for data which would be thrown away
+		return nil, errMultiAppendDiscarded
+	}
+	if err := c.acceptLiteral(lit.Size(), nonSync); err != nil {
+		return nil, err
+	}
+	c.setReadTimeout(c.server.options.Timeouts.LiteralRead)
+	r.lit = lit
+
+	if c.server.options.DefaultInternalDate != nil && options.Time.IsZero() {
+		// The hook needs the whole message
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(lit); err != nil {
+			return nil, err
+		}
+		c.setDefaultInternalDate(&options, buf.Bytes())
+		return &AppendMessage{Literal: bytes.NewReader(buf.Bytes()), Options: &options}, nil
+	}
+	return &AppendMessage{Literal: lit, Options: &options}, nil
+}
+
+// readAll reads all messages in memory. Next then returns them again.
+func (r *MultiAppendReader) readAll() error {
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(msg.Literal); err != nil {
+			r.err = err
+			return err
+		}
+		msg.Literal = bytes.NewReader(buf.Bytes())
+		r.buffered = append(r.buffered, msg)
+	}
+	r.replay = true
+	r.done = false
+	return nil
+}
+
+func (r *MultiAppendReader) addSize(size int64) error {
+	r.size += size
+	if max := r.conn.server.options.maxMultiAppendSize(); r.size > max {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: fmt.Sprintf("Messages appended at once are limited to %v bytes", max),
+		}
+	}
+	return nil
+}
+
+// endMessage discards the rest of the current message.
+func (r *MultiAppendReader) endMessage() error {
+	if r.lit != nil {
+		_, err := io.Copy(io.Discard, r.lit)
+		r.conn.setReadTimeout(r.conn.server.options.Timeouts.CommandRead)
+		r.lit = nil
+		if err != nil {
+			return err
+		}
+	}
+	if r.utf8 {
+		r.utf8 = false
+		if !r.dec.ExpectSpecial(')') {
+			return r.dec.Err()
+		}
+	}
+	return nil
+}
+
+var errMultiAppendDiscarded = errors.New("imapserver: APPEND discarded")
+
+// discard consumes the remaining messages after a failure. It stops at the
+// first synchronizing literal: the rest of the command is discarded with the
+// line.
+func (r *MultiAppendReader) discard() {
+	r.discarding = true
+	for {
+		if _, err := r.Next(); err != nil {
+			break
+		}
+	}
+	if r.lit != nil {
+		io.Copy(io.Discard, r.lit)
+		r.conn.setReadTimeout(r.conn.server.options.Timeouts.CommandRead)
+		r.lit = nil
+	}
+}
+
+// appendLimit returns the maximum size of a message appended to a mailbox.
+//
+// If APPENDLIMIT is enabled, the per-mailbox limit returned by Session.Status
+// is enforced on top of the server limit. The mailbox may not exist yet: in
+// this case, the server limit is used and the session reports the error when
+// appending.
+func (c *Conn) appendLimit(mailbox string) int64 {
+	limit := c.server.options.appendLimit()
+	if _, ok := c.server.options.caps().AppendLimit(); !ok {
+		return limit
+	}
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return limit
+	}
+	data, err := c.session.Status(c.ctx, mailbox, &imap.StatusOptions{AppendLimit: true})
+	if err != nil || data.AppendLimit == nil {
+		return limit
+	}
+	return min(limit, int64(*data.AppendLimit))
+}
+
+// setDefaultInternalDate sets the internal date of a message appended without
+// one, see Options.DefaultInternalDate.
+func (c *Conn) setDefaultInternalDate(options *imap.AppendOptions, msg []byte) {
+	if f := c.server.options.DefaultInternalDate; f != nil && options.Time.IsZero() {
+		options.Time = f(msg)
+	}
+}
+
+func readAppendOptions(dec *imapwire.Decoder, options *imap.AppendOptions) error {
 	hasFlagList, err := dec.List(func() error {
 		flag, err := internal.ExpectFlag(dec)
 		if err != nil {
@@ -46,55 +500,194 @@ func (c *Conn) handleAppend(tag string, dec *imapwire.Decoder) error {
 		return dec.Err()
 	}
 	options.Time = t
+	return nil
+}
 
-	lit, nonSync, err := dec.ExpectLiteralReader()
-	if err != nil {
-		return err
+// readAppendLiteralReader reads the header of a message literal. If binary is
+// true, the "~" prefix of a literal8 has already been consumed.
+func (c *Conn) readAppendLiteralReader(dec *imapwire.Decoder, binary bool) (*imapwire.LiteralReader, bool, error) {
+	if binary && !c.server.options.caps().Has(imap.CapBinary) {
+		return nil, false, newClientBugError("BINARY is not supported")
+	}
+	return dec.ExpectLiteralReader()
+}
+
+// multiAppendSession returns the session if MULTIAPPEND is enabled.
+func (c *Conn) multiAppendSession() (SessionMultiAppend, bool) {
+	session, ok := c.session.(SessionMultiAppend)
+	return session, ok && c.server.options.caps().Has(imap.CapMultiAppend)
+}
+
+// catenateSession returns the session if CATENATE is enabled.
+func (c *Conn) catenateSession() (SessionCatenate, error) {
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return nil, err
 	}
+	session, ok := c.session.(SessionCatenate)
+	if !ok || !c.server.options.caps().Has(imap.CapCatenate) {
+		return nil, newClientBugError("CATENATE is not supported")
+	}
+	return session, nil
+}
+
+// readAppendLiteral reads a whole message literal in memory.
+func (c *Conn) readAppendLiteral(lit *imapwire.LiteralReader, nonSync bool, appendLimit int64) ([]byte, error) {
 	if lit.Size() > appendLimit {
-		return &imap.Error{
+		return nil, &imap.Error{
 			Type: imap.StatusResponseTypeNo,
 			Code: imap.ResponseCodeTooBig,
 			Text: fmt.Sprintf("Literals are limited to %v bytes for this command", appendLimit),
 		}
 	}
 	if err := c.acceptLiteral(lit.Size(), nonSync); err != nil {
-		return err
+		return nil, err
 	}
 
-	c.setReadTimeout(literalReadTimeout)
-	defer c.setReadTimeout(cmdReadTimeout)
+	c.setReadTimeout(c.server.options.Timeouts.LiteralRead)
+	defer c.setReadTimeout(c.server.options.Timeouts.CommandRead)
 
-	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
-		io.Copy(io.Discard, lit)
-		dec.CRLF()
-		return err
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(lit); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	data, appendErr := c.session.Append(mailbox, lit, &options)
-	if _, discardErr := io.Copy(io.Discard, lit); discardErr != nil {
-		return err
+func (c *Conn) readCatenate(dec *imapwire.Decoder, appendLimit int64) ([]catenatePart, error) {
+	if !dec.ExpectSP() {
+		return nil, dec.Err()
 	}
-	if !dec.ExpectCRLF() {
-		return err
-	}
-	if appendErr != nil {
-		return appendErr
+
+	var (
+		parts []catenatePart
+		size  int64
+	)
+	err := dec.ExpectList(func() error {
+		var name string
+		if !dec.ExpectAtom(&name) || !dec.ExpectSP() {
+			return dec.Err()
+		}
+		switch strings.ToUpper(name) {
+		case "TEXT":
+			lit, nonSync, err := dec.ExpectLiteralReader()
+			if err != nil {
+				return err
+			}
+			size += lit.Size()
+			if size > appendLimit {
+				return &imap.Error{
+					Type: imap.StatusResponseTypeNo,
+					Code: imap.ResponseCodeTooBig,
+					Text: fmt.Sprintf("Messages are limited to %v bytes", appendLimit),
+				}
+			}
+			b, err := c.readAppendLiteral(lit, nonSync, appendLimit)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, catenatePart{text: b})
+		case "URL":
+			var url string
+			if !dec.ExpectAString(&url) {
+				return dec.Err()
+			}
+			parts = append(parts, catenatePart{url: url})
+		default:
+			return newClientBugError("Unknown CATENATE part")
+		}
+		return nil
+	})
+	return parts, err
+}
+
+// discardCatenate consumes the non-synchronizing literals of a rejected
+// CATENATE list. It stops at the first synchronizing literal: the rest of the
+// command is discarded with the line.
+func (c *Conn) discardCatenate(dec *imapwire.Decoder) {
+	if !dec.ExpectSP() {
+		return
 	}
-	if err := c.poll("APPEND"); err != nil {
+	dec.ExpectList(func() error {
+		var name string
+		if !dec.ExpectAtom(&name) || !dec.ExpectSP() {
+			return dec.Err()
+		}
+		if !strings.EqualFold(name, "TEXT") {
+			if !dec.DiscardValue() {
+				return dec.Err()
+			}
+			return nil
+		}
+		lit, nonSync, err := dec.ExpectLiteralReader()
+		if err != nil {
+			return err
+		} else if !nonSync {
+			return errMultiAppendDiscarded
+		}
+		c.setReadTimeout(c.server.options.Timeouts.LiteralRead)
+		defer c.setReadTimeout(c.server.options.Timeouts.CommandRead)
+		_, err = io.Copy(io.Discard, lit)
 		return err
+	})
+}
+
+// resolveCatenate resolves all URLs of a CATENATE list and returns the
+// resulting message. URLs are resolved before anything is appended, so that
+// the command fails atomically.
+func (c *Conn) resolveCatenate(session SessionCatenate, parts []catenatePart, appendLimit int64) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		if part.url == "" {
+			buf.Write(part.text)
+			continue
+		}
+
+		b, err := session.ResolveURL(c.ctx, part.url)
+		var imapErr *imap.Error
+		if errors.As(err, &imapErr) {
+			return nil, &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCode(fmt.Sprintf("%v %v", imap.ResponseCodeBadURL, part.url)),
+				Text: imapErr.Text,
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+
+		if int64(buf.Len()) > appendLimit {
+			return nil, &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeTooBig,
+				Text: fmt.Sprintf("Messages are limited to %v bytes", appendLimit),
+			}
+		}
 	}
-	return c.writeAppendOK(tag, data)
+	return buf.Bytes(), nil
 }
 
-func (c *Conn) writeAppendOK(tag string, data *imap.AppendData) error {
+func (c *Conn) writeAppendOK(tag string, data ...*imap.AppendData) error {
+	// APPENDUID can only be sent if all messages have been assigned a UID
+	var (
+		uidValidity uint32
+		uids        imap.SeqSet
+	)
+	for _, d := range data {
+		if d == nil || d.UID == 0 {
+			uids = nil
+			break
+		}
+		uidValidity = d.UIDValidity
+		uids.AddNum(d.UID)
+	}
+
 	enc := newResponseEncoder(c)
 	defer enc.end()
 
 	enc.Atom(tag).SP().Atom("OK").SP()
-	if data != nil {
+	if len(uids) > 0 && c.server.options.caps().Has(imap.CapUIDPlus) {
 		enc.Special('[')
-		enc.Atom("APPENDUID").SP().Number(data.UIDValidity).SP().Number(data.UID)
+		enc.Atom("APPENDUID").SP().Number(uidValidity).SP().SeqSet(uids)
 		enc.Special(']').SP()
 	}
 	enc.Text("APPEND completed")
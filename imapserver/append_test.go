@@ -0,0 +1,63 @@
+package imapserver_test
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestAppendDefaultInternalDate(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		DefaultInternalDate: func(msg []byte) time.Time {
+			m, err := mail.ReadMessage(bytes.NewReader(msg))
+			if err != nil {
+				return time.Time{}
+			}
+			date, _ := m.Header.Date()
+			return date
+		},
+	})
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.writeLine(`A1 APPEND INBOX "01-Jan-2020 10:00:00 +0000" {%v+}`, len(testMessage))
+	tc.writeString(testMessage + "\r\n")
+	tc.expectOK("A1")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1:2 (INTERNALDATE)")
+	untagged := tc.expectOK("F1")
+	for i, want := range []string{
+		`INTERNALDATE " 5-Sep-2016 19:00:00 +0900"`,
+		`INTERNALDATE " 1-Jan-2020 10:00:00 +0000"`,
+	} {
+		if i >= len(untagged) || !strings.Contains(untagged[i], want) {
+			t.Errorf("expected %v in FETCH response, got %q", want, untagged)
+		}
+	}
+}
+
+func TestAppendNotAuthenticated(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		DefaultInternalDate: func(msg []byte) time.Time {
+			return time.Now()
+		},
+	})
+
+	// The literal must not be accepted before the state is checked
+	tc.writeLine("A1 APPEND INBOX {%v}", len(testMessage))
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "A1 NO ") && !strings.HasPrefix(resp, "A1 BAD ") {
+		t.Fatalf("expected A1 to be rejected, got %q", resp)
+	}
+
+	// Non-synchronizing literals are discarded
+	tc.writeLine("A2 APPEND INBOX {%v+}\r\n%v", len(testMessage), testMessage)
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "A2 NO ") && !strings.HasPrefix(resp, "A2 BAD ") {
+		t.Fatalf("expected A2 to be rejected, got %q", resp)
+	}
+	tc.writeLine("N1 NOOP")
+	tc.expectOK("N1")
+}
@@ -1,6 +1,8 @@
 package imapserver
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -18,6 +20,7 @@ func (c *Conn) handleAuthenticate(tag string, dec *imapwire.Decoder) error {
 	}
 	mech = strings.ToUpper(mech)
 
+	// SASL-IR (RFC 4959) initial response, "=" stands for an empty response
 	var initialResp []byte
 	if dec.SP() {
 		var initialRespStr string
@@ -25,7 +28,7 @@ func (c *Conn) handleAuthenticate(tag string, dec *imapwire.Decoder) error {
 			return dec.Err()
 		}
 		var err error
-		initialResp, err = internal.DecodeSASL(initialRespStr)
+		initialResp, err = decodeSASL(initialRespStr)
 		if err != nil {
 			return err
 		}
@@ -49,9 +52,9 @@ func (c *Conn) handleAuthenticate(tag string, dec *imapwire.Decoder) error {
 	var saslServer sasl.Server
 	if authSess, ok := c.session.(SessionSASL); ok {
 		var err error
-		saslServer, err = authSess.Authenticate(mech)
+		saslServer, err = authSess.Authenticate(c.ctx, mech)
 		if err != nil {
-			return err
+			return loginError(err)
 		}
 	} else {
 		if mech != "PLAIN" {
@@ -60,15 +63,8 @@ func (c *Conn) handleAuthenticate(tag string, dec *imapwire.Decoder) error {
 				Text: "SASL mechanism not supported",
 			}
 		}
-		saslServer = sasl.NewPlainServer(func(identity, username, password string) error {
-			if identity != "" && identity != username {
-				return &imap.Error{
-					Type: imap.StatusResponseTypeNo,
-					Code: imap.ResponseCodeAuthorizationFailed,
-					Text: "SASL identity not supported",
-				}
-			}
-			return c.session.Login(username, password)
+		saslServer = newPlainServer(func(username, password string) error {
+			return c.session.Login(c.ctx, username, password)
 		})
 	}
 
@@ -79,15 +75,13 @@ func (c *Conn) handleAuthenticate(tag string, dec *imapwire.Decoder) error {
 	for {
 		challenge, done, err := saslServer.Next(resp)
 		if err != nil {
-			return err
+			return loginError(saslError(err))
 		} else if done {
 			break
 		}
 
-		var challengeStr string
-		if challenge != nil {
-			challengeStr = internal.EncodeSASL(challenge)
-		}
+		// Unlike initial responses, empty challenges are sent as-is
+		challengeStr := base64.StdEncoding.EncodeToString(challenge)
 		if err := writeContReq(enc.Encoder, challengeStr); err != nil {
 			return err
 		}
@@ -115,6 +109,16 @@ func (c *Conn) handleAuthenticate(tag string, dec *imapwire.Decoder) error {
 	return writeCapabilityOK(enc.Encoder, tag, c.availableCaps(), text)
 }
 
+// saslError converts errors returned by the SASL servers of the go-sasl
+// package into IMAP errors.
+func saslError(err error) error {
+	var oauthErr *sasl.OAuthBearerError
+	if errors.As(err, &oauthErr) || errors.Is(err, sasl.ErrUnexpectedClientResponse) {
+		return errAuthFailed
+	}
+	return err
+}
+
 func decodeSASL(s string) ([]byte, error) {
 	b, err := internal.DecodeSASL(s)
 	if err != nil {
@@ -125,3 +129,20 @@ func decodeSASL(s string) ([]byte, error) {
 	}
 	return b, nil
 }
+
+var errAuthorizationIdentity = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeAuthorizationFailed,
+	Text: "SASL identity not supported",
+}
+
+// newPlainServer creates a SASL PLAIN server which doesn't support
+// authorization identities.
+func newPlainServer(login func(username, password string) error) sasl.Server {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errAuthorizationIdentity
+		}
+		return login(username, password)
+	})
+}
@@ -0,0 +1,493 @@
+package imapserver_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-sasl"
+)
+
+var testPlainResp = base64.StdEncoding.EncodeToString([]byte("\x00" + testUsername + "\x00" + testPassword))
+
+func TestAuthenticatePlain(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	tc.writeLine("A1 AUTHENTICATE PLAIN")
+	if line := tc.readLine(); line != "+ " {
+		t.Fatalf("expected empty continuation request, got %q", line)
+	}
+	tc.writeLine("%v", testPlainResp)
+	tc.expectOK("A1")
+}
+
+func TestAuthenticateInitialResponse(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	tc.writeLine("C1 CAPABILITY")
+	if untagged := tc.expectOK("C1"); len(untagged) != 1 || !strings.Contains(untagged[0], " SASL-IR") {
+		t.Errorf("SASL-IR isn't advertised: %q", untagged)
+	}
+
+	// The server must not send a continuation request
+	tc.writeLine("A1 AUTHENTICATE PLAIN %v", testPlainResp)
+	if line := tc.readLine(); !strings.HasPrefix(line, "A1 OK ") {
+		t.Errorf("expected OK, got %q", line)
+	}
+}
+
+type anonymousSession struct {
+	imapserver.Session
+	trace chan<- string
+}
+
+func (sess *anonymousSession) AuthenticateMechanisms() []string {
+	return []string{sasl.Anonymous}
+}
+
+func (sess *anonymousSession) Authenticate(ctx context.Context, mech string) (sasl.Server, error) {
+	return sasl.NewAnonymousServer(func(trace string) error {
+		sess.trace <- trace
+		return nil
+	}), nil
+}
+
+func TestAuthenticateEmptyInitialResponse(t *testing.T) {
+	trace := make(chan string, 1)
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &anonymousSession{Session: memServer.NewSession(), trace: trace}, nil, nil
+		},
+	})
+
+	tc.writeLine("A1 AUTHENTICATE ANONYMOUS =")
+	if line := tc.readLine(); !strings.HasPrefix(line, "A1 OK ") {
+		t.Fatalf("expected OK, got %q", line)
+	}
+	if s := <-trace; s != "" {
+		t.Errorf("got trace %q, want empty", s)
+	}
+}
+
+func TestAuthenticateMalformedInitialResponse(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	tc.writeLine("A1 AUTHENTICATE PLAIN not*base64")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+
+	// The connection must still be usable
+	tc.login()
+}
+
+const testOAuthToken = "s3cr3t"
+
+type oauthBearerSession struct {
+	imapserver.Session
+}
+
+func (sess *oauthBearerSession) AuthenticateMechanisms() []string {
+	return []string{sasl.Plain, sasl.OAuthBearer, imapserver.XOAuth2}
+}
+
+func (sess *oauthBearerSession) Authenticate(ctx context.Context, mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return sess.Login(ctx, username, password)
+		}), nil
+	case sasl.OAuthBearer:
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if opts.Username != testUsername || opts.Token != testOAuthToken {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			if err := sess.Login(ctx, testUsername, testPassword); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		}), nil
+	case imapserver.XOAuth2:
+		return imapserver.NewXOAuth2Server(func(username, token string) error {
+			if username != testUsername || token != testOAuthToken {
+				return imapserver.ErrAuthFailed
+			}
+			return sess.Login(ctx, testUsername, testPassword)
+		}), nil
+	default:
+		return nil, imapserver.ErrAuthFailed
+	}
+}
+
+func oauthBearerResp(token string) string {
+	resp := "n,a=" + testUsername + ",\x01auth=Bearer " + token + "\x01\x01"
+	return base64.StdEncoding.EncodeToString([]byte(resp))
+}
+
+func TestAuthenticateOAuthBearer(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &oauthBearerSession{Session: memServer.NewSession()}, nil, nil
+		},
+	})
+
+	if caps := tc.capabilities(); !hasCap(caps, "AUTH=PLAIN") || !hasCap(caps, "AUTH=OAUTHBEARER") {
+		t.Errorf("expected AUTH=PLAIN and AUTH=OAUTHBEARER, got %v", caps)
+	}
+
+	// On failure, the server sends an error challenge and waits for the
+	// client's dummy response before failing
+	tc.writeLine("A1 AUTHENTICATE OAUTHBEARER %v", oauthBearerResp("invalid"))
+	line := tc.readLine()
+	if !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	if b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "+ ")); err != nil || !strings.Contains(string(b), `"invalid_token"`) {
+		t.Errorf("unexpected error challenge %q: %v", b, err)
+	}
+	tc.writeLine("%v", base64.StdEncoding.EncodeToString([]byte{0x01}))
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [AUTHENTICATIONFAILED] ") {
+		t.Errorf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+	}
+
+	tc.writeLine("A2 AUTHENTICATE OAUTHBEARER %v", oauthBearerResp(testOAuthToken))
+	if resp, _ := tc.readTagged("A2"); !strings.HasPrefix(resp, "A2 OK ") {
+		t.Errorf("expected OK, got %q", resp)
+	}
+}
+
+type challengeSession struct {
+	imapserver.Session
+}
+
+func (sess *challengeSession) AuthenticateMechanisms() []string {
+	return []string{"CRAM-MD5", "SCRAM-SHA-256"}
+}
+
+func (sess *challengeSession) Authenticate(ctx context.Context, mech string) (sasl.Server, error) {
+	login := func(username string) error {
+		return sess.Login(ctx, username, testPassword)
+	}
+	switch mech {
+	case "CRAM-MD5":
+		return imapserver.NewCRAMMD5Server("example.org", func(username string) (string, error) {
+			if username != testUsername {
+				return "", imapserver.ErrAuthFailed
+			}
+			return testPassword, nil
+		}, login), nil
+	case "SCRAM-SHA-256":
+		return imapserver.NewSCRAMSHA256Server(func(username string) (*imapserver.SCRAMCredentials, error) {
+			if username != testUsername {
+				return nil, imapserver.ErrAuthFailed
+			}
+			return imapserver.NewSCRAMSHA256Credentials(testPassword, []byte("salt"), 4096), nil
+		}, login), nil
+	default:
+		return nil, imapserver.ErrAuthFailed
+	}
+}
+
+func newChallengeTestConn(t *testing.T) *testConn {
+	memServer := newTestMemServer()
+	return newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &challengeSession{Session: memServer.NewSession()}, nil, nil
+		},
+	})
+}
+
+// readChallenge reads a continuation request and decodes its SASL challenge.
+func (tc *testConn) readChallenge() string {
+	tc.t.Helper()
+	line := tc.readLine()
+	if !strings.HasPrefix(line, "+ ") {
+		tc.t.Fatalf("expected continuation request, got %q", line)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "+ "))
+	if err != nil {
+		tc.t.Fatalf("malformed challenge %q: %v", line, err)
+	}
+	return string(b)
+}
+
+func (tc *testConn) writeSASL(s string) {
+	tc.t.Helper()
+	tc.writeLine("%v", base64.StdEncoding.EncodeToString([]byte(s)))
+}
+
+func TestAuthenticateCRAMMD5(t *testing.T) {
+	tc := newChallengeTestConn(t)
+
+	if caps := tc.capabilities(); !hasCap(caps, "AUTH=CRAM-MD5") || !hasCap(caps, "AUTH=SCRAM-SHA-256") {
+		t.Errorf("expected AUTH=CRAM-MD5 and AUTH=SCRAM-SHA-256, got %v", caps)
+	}
+
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{
+		{"invalid", false},
+		{testPassword, true},
+	} {
+		tc.writeLine("A1 AUTHENTICATE CRAM-MD5")
+		challenge := tc.readChallenge()
+		if !strings.HasPrefix(challenge, "<") || !strings.HasSuffix(challenge, "@example.org>") {
+			t.Errorf("unexpected challenge %q", challenge)
+		}
+		mac := hmac.New(md5.New, []byte(tt.password))
+		mac.Write([]byte(challenge))
+		tc.writeSASL(testUsername + " " + hex.EncodeToString(mac.Sum(nil)))
+
+		resp, _ := tc.readTagged("A1")
+		if tt.ok && !strings.HasPrefix(resp, "A1 OK ") {
+			t.Errorf("expected OK, got %q", resp)
+		} else if !tt.ok && !strings.HasPrefix(resp, "A1 NO [AUTHENTICATIONFAILED] ") {
+			t.Errorf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+		}
+	}
+}
+
+// scramClient is the client side of SCRAM-SHA-256 (RFC 7677).
+type scramClient struct {
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func (sc *scramClient) clientFirst(username, nonce string) string {
+	sc.clientFirstBare = "n=" + username + ",r=" + nonce
+	return "n,," + sc.clientFirstBare
+}
+
+func (sc *scramClient) clientFinal(serverFirst, password string) (string, error) {
+	var (
+		nonce      string
+		salt       []byte
+		iterations int
+	)
+	for _, attr := range strings.Split(serverFirst, ",") {
+		k, v, _ := strings.Cut(attr, "=")
+		switch k {
+		case "r":
+			nonce = v
+		case "s":
+			var err error
+			if salt, err = base64.StdEncoding.DecodeString(v); err != nil {
+				return "", err
+			}
+		case "i":
+			if _, err := fmt.Sscan(v, &iterations); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	sc.saltedPassword = testPBKDF2([]byte(password), salt, iterations)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	sc.authMessage = sc.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	clientKey := testHMAC(sc.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := testHMAC(storedKey[:], sc.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (sc *scramClient) serverFinal() string {
+	serverKey := testHMAC(sc.saltedPassword, "Server Key")
+	return "v=" + base64.StdEncoding.EncodeToString(testHMAC(serverKey, sc.authMessage))
+}
+
+func testHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func testPBKDF2(password, salt []byte, iterations int) []byte {
+	u := testHMAC(password, string(salt)+"\x00\x00\x00\x01")
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = testHMAC(password, string(u))
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+func TestAuthenticateSCRAMSHA256(t *testing.T) {
+	tc := newChallengeTestConn(t)
+
+	var sc scramClient
+	tc.writeLine("A1 AUTHENTICATE SCRAM-SHA-256")
+	if challenge := tc.readChallenge(); challenge != "" {
+		t.Errorf("expected empty challenge, got %q", challenge)
+	}
+	tc.writeSASL(sc.clientFirst(testUsername, "rOprNGfwEbeRWgbNEkqO"))
+
+	serverFirst := tc.readChallenge()
+	if !strings.HasPrefix(serverFirst, "r=rOprNGfwEbeRWgbNEkqO") {
+		t.Fatalf("server nonce doesn't start with client nonce: %q", serverFirst)
+	}
+	clientFinal, err := sc.clientFinal(serverFirst, testPassword)
+	if err != nil {
+		t.Fatalf("malformed server-first-message %q: %v", serverFirst, err)
+	}
+	tc.writeSASL(clientFinal)
+
+	if serverFinal, want := tc.readChallenge(), sc.serverFinal(); serverFinal != want {
+		t.Errorf("got server-final-message %q, want %q", serverFinal, want)
+	}
+	tc.writeLine("")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 OK ") {
+		t.Errorf("expected OK, got %q", resp)
+	}
+}
+
+func TestAuthenticateSCRAMSHA256InvalidProof(t *testing.T) {
+	tc := newChallengeTestConn(t)
+
+	var sc scramClient
+	tc.writeLine("A1 AUTHENTICATE SCRAM-SHA-256 %v", base64.StdEncoding.EncodeToString([]byte(sc.clientFirst(testUsername, "nonce"))))
+	clientFinal, err := sc.clientFinal(tc.readChallenge(), "invalid")
+	if err != nil {
+		t.Fatalf("malformed server-first-message: %v", err)
+	}
+	tc.writeSASL(clientFinal)
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [AUTHENTICATIONFAILED] ") {
+		t.Errorf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+	}
+
+	// The connection must still be usable
+	tc.login()
+}
+
+func TestAuthenticateSCRAMSHA256UnknownUser(t *testing.T) {
+	tc := newChallengeTestConn(t)
+
+	// The exchange must go on as usual, with a stable salt
+	var salts []string
+	for i := 0; i < 2; i++ {
+		var sc scramClient
+		tc.writeLine("A1 AUTHENTICATE SCRAM-SHA-256 %v", base64.StdEncoding.EncodeToString([]byte(sc.clientFirst("unknown-user", "nonce"))))
+		serverFirst := tc.readChallenge()
+		_, salt, _ := strings.Cut(serverFirst, ",s=")
+		salts = append(salts, salt)
+		clientFinal, err := sc.clientFinal(serverFirst, testPassword)
+		if err != nil {
+			t.Fatalf("malformed server-first-message %q: %v", serverFirst, err)
+		}
+		tc.writeSASL(clientFinal)
+		if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [AUTHENTICATIONFAILED] ") {
+			t.Errorf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+		}
+	}
+	if salts[0] != salts[1] {
+		t.Errorf("salt changed between attempts: %q, then %q", salts[0], salts[1])
+	}
+}
+
+func TestAuthenticateSCRAMSHA256MandatoryExtension(t *testing.T) {
+	tc := newChallengeTestConn(t)
+
+	clientFirst := "n,,m=ext,n=" + testUsername + ",r=nonce"
+	tc.writeLine("A1 AUTHENTICATE SCRAM-SHA-256 %v", base64.StdEncoding.EncodeToString([]byte(clientFirst)))
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+}
+
+type normalizationSession struct {
+	imapserver.Session
+}
+
+func (sess *normalizationSession) AuthenticateMechanisms() []string {
+	return []string{"SCRAM-SHA-256"}
+}
+
+func (sess *normalizationSession) Authenticate(ctx context.Context, mech string) (sasl.Server, error) {
+	return imapserver.NewSCRAMSHA256Server(func(username string) (*imapserver.SCRAMCredentials, error) {
+		if username != "caf\u00e9" {
+			return nil, imapserver.ErrAuthFailed
+		}
+		// U+00A0 NO-BREAK SPACE is mapped to a regular space
+		return imapserver.NewSCRAMSHA256Credentials("pass\u00a0word", []byte("salt"), 4096), nil
+	}, func(username string) error {
+		return sess.Login(ctx, testUsername, testPassword)
+	}), nil
+}
+
+func TestAuthenticateSCRAMSHA256Normalization(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &normalizationSession{memServer.NewSession()}, nil, nil
+		},
+	})
+
+	// The decomposed username is normalized to its composed form
+	var sc scramClient
+	tc.writeLine("A1 AUTHENTICATE SCRAM-SHA-256 %v", base64.StdEncoding.EncodeToString([]byte(sc.clientFirst("cafe\u0301", "nonce"))))
+	clientFinal, err := sc.clientFinal(tc.readChallenge(), "pass word")
+	if err != nil {
+		t.Fatalf("malformed server-first-message: %v", err)
+	}
+	tc.writeSASL(clientFinal)
+	tc.readChallenge()
+	tc.writeLine("")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 OK ") {
+		t.Errorf("expected OK, got %q", resp)
+	}
+}
+
+func TestAuthenticateXOAuth2(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &oauthBearerSession{Session: memServer.NewSession()}, nil, nil
+		},
+	})
+
+	if caps := tc.capabilities(); !hasCap(caps, "AUTH=XOAUTH2") {
+		t.Errorf("expected AUTH=XOAUTH2, got %v", caps)
+	}
+
+	xoauth2Resp := func(token string) string {
+		return "user=" + testUsername + "\x01auth=Bearer " + token + "\x01\x01"
+	}
+
+	// On failure, the server sends an error challenge and waits for the
+	// client's empty response before failing
+	tc.writeLine("A1 AUTHENTICATE XOAUTH2 %v", base64.StdEncoding.EncodeToString([]byte(xoauth2Resp("invalid"))))
+	if challenge := tc.readChallenge(); !strings.Contains(challenge, `"status":"401"`) {
+		t.Errorf("unexpected error challenge %q", challenge)
+	}
+	tc.writeLine("")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [AUTHENTICATIONFAILED] ") {
+		t.Errorf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+	}
+
+	// Without SASL-IR, the server sends an empty challenge first
+	tc.writeLine("A2 AUTHENTICATE XOAUTH2")
+	if challenge := tc.readChallenge(); challenge != "" {
+		t.Errorf("expected empty challenge, got %q", challenge)
+	}
+	tc.writeSASL(xoauth2Resp(testOAuthToken))
+	if resp, _ := tc.readTagged("A2"); !strings.HasPrefix(resp, "A2 OK ") {
+		t.Errorf("expected OK, got %q", resp)
+	}
+}
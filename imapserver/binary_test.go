@@ -0,0 +1,73 @@
+package imapserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+const testBinaryMessage = "From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+	"Subject: Binary\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8Ad29y\r\n" +
+	"bGQ=\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: x-unknown\r\n" +
+	"\r\n" +
+	"???\r\n" +
+	"--b--\r\n"
+
+func TestFetchBinary(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapBinary:    {},
+		},
+	})
+	tc.login()
+
+	if caps := tc.capabilities(); !hasCap(caps, "BINARY") {
+		t.Errorf("expected BINARY to be advertised, got %v", caps)
+	}
+
+	tc.writeLine("A1 APPEND INBOX ~{%v+}\r\n%v", len(testBinaryMessage), testBinaryMessage)
+	tc.expectOK("A1")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1 (BINARY.SIZE[1] BINARY.SIZE[2])")
+	got := tc.expectOK("F1")
+	if want := "* 1 FETCH (UID 1 BINARY.SIZE[1] 5 BINARY.SIZE[2] 11)"; len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The decoded part contains a NUL byte, so a literal8 must be used
+	tc.writeLine("F2 FETCH 1 (BINARY.PEEK[2])")
+	got = tc.expectOK("F2")
+	if want := "* 1 FETCH (UID 1 BINARY[2] ~{11}\r\nhello\x00world)"; strings.Join(got, "\r\n") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("F3 FETCH 1 (BINARY.PEEK[2]<6.5>)")
+	got = tc.expectOK("F3")
+	if want := "* 1 FETCH (UID 1 BINARY[2]<6> ~{5}\r\nworld)"; strings.Join(got, "\r\n") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("F4 FETCH 1 (BINARY.PEEK[3])")
+	if resp, _ := tc.readTagged("F4"); !strings.HasPrefix(resp, "F4 NO [UNKNOWN-CTE] ") {
+		t.Errorf("expected NO [UNKNOWN-CTE], got %q", resp)
+	}
+}
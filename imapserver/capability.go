@@ -1,19 +1,27 @@
 package imapserver
 
 import (
+	"fmt"
+
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-func (c *Conn) handleCapability(dec *imapwire.Decoder) error {
+func (c *Conn) handleCapability(dec *imapwire.Decoder) (exec func() error, err error) {
 	if !dec.ExpectCRLF() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 
-	enc := newResponseEncoder(c)
-	defer enc.end()
+	return func() error {
+		enc := newResponseEncoder(c)
+		defer enc.end()
+		return writeCapability(enc.Encoder, c.availableCaps())
+	}, nil
+}
+
+func writeCapability(enc *imapwire.Encoder, caps []imap.Cap) error {
 	enc.Atom("*").SP().Atom("CAPABILITY")
-	for _, c := range c.availableCaps() {
+	for _, c := range caps {
 		enc.SP().Atom(string(c))
 	}
 	return enc.CRLF()
@@ -38,11 +46,15 @@ func (c *Conn) availableCaps() []imap.Cap {
 	}
 
 	if available.Has(imap.CapIMAP4rev1) {
-		caps = append(caps, []imap.Cap{
-			imap.CapSASLIR,
-			imap.CapLiteralMinus,
-		}...)
+		caps = append(caps, imap.CapSASLIR)
+	}
+	// LITERAL+ supersedes LITERAL-, only one of them is advertised
+	if c.server.options.AllowUnlimitedNonSyncLiterals {
+		caps = append(caps, imap.CapLiteralPlus)
+	} else if available.Has(imap.CapIMAP4rev1) {
+		caps = append(caps, imap.CapLiteralMinus)
 	}
+	addAvailableCaps(&caps, available, []imap.Cap{imap.CapID, imap.CapLoginReferrals})
 	if c.canStartTLS() {
 		caps = append(caps, imap.CapStartTLS)
 	}
@@ -73,16 +85,93 @@ func (c *Conn) availableCaps() []imap.Cap {
 				imap.CapListStatus,
 				imap.CapMove,
 				imap.CapStatusSize,
+				imap.CapBinary,
 			})
 		}
 		addAvailableCaps(&caps, available, []imap.Cap{
+			imap.CapSort,
+			imap.CapESort,
+			imap.CapContextSearch,
+			imap.CapContextSort,
+			imap.CapSearchFuzzy,
+			imap.CapThreadOrderedSubject,
+			imap.CapThreadReferences,
+			imap.CapSpecialUse,
 			imap.CapCreateSpecialUse,
-			imap.CapLiteralPlus,
+			imap.CapCondStore,
+			imap.CapQResync,
+			imap.CapCompressDeflate,
+			imap.CapUTF8Accept,
+			imap.CapQuota,
+			imap.CapQuotaSet,
+			imap.CapMetadata,
+			imap.CapMetadataServer,
+			imap.CapCatenate,
+			imap.CapNotify,
+			imap.CapACL,
+			imap.CapObjectID,
+			imap.CapSaveDate,
+			imap.CapWithin,
 		})
+		if _, ok := c.session.(SessionMultiAppend); ok {
+			addAvailableCaps(&caps, available, []imap.Cap{imap.CapMultiAppend})
+		}
+		if _, ok := c.session.(SessionURLAuth); ok {
+			addAvailableCaps(&caps, available, []imap.Cap{imap.CapURLAuth})
+		}
+		// A bare APPENDLIMIT capability indicates that limits are
+		// per-mailbox, and are reported by STATUS
+		if limit, ok := available.AppendLimit(); ok {
+			if limit == nil {
+				caps = append(caps, imap.CapAppendLimit)
+			} else {
+				caps = append(caps, imap.Cap(fmt.Sprintf("%v=%v", imap.CapAppendLimit, *limit)))
+			}
+		}
+		if available.Has(imap.CapQuota) {
+			for _, t := range quotaResourceTypes {
+				if c := imap.Cap("QUOTA=RES-" + string(t)); available.Has(c) {
+					caps = append(caps, c)
+				}
+			}
+		}
 	}
+
+	if len(c.server.options.DisabledCommands) > 0 {
+		filtered := caps[:0]
+		for _, name := range caps {
+			if cmd, ok := capCommands[name]; !ok || !c.server.options.commandDisabled(cmd) {
+				filtered = append(filtered, name)
+			}
+		}
+		caps = filtered
+	}
+
+	if f := c.server.options.CapabilityFilter; f != nil {
+		caps = f(caps)
+	}
+
 	return caps
 }
 
+// capCommands contains capabilities which only provide a command.
+var capCommands = map[imap.Cap]string{
+	imap.CapStartTLS:             "STARTTLS",
+	imap.CapID:                   "ID",
+	imap.CapUnselect:             "UNSELECT",
+	imap.CapEnable:               "ENABLE",
+	imap.CapIdle:                 "IDLE",
+	imap.CapNamespace:            "NAMESPACE",
+	imap.CapSort:                 "SORT",
+	imap.CapESort:                "SORT",
+	imap.CapContextSort:          "SORT",
+	imap.CapThreadOrderedSubject: "THREAD",
+	imap.CapThreadReferences:     "THREAD",
+	imap.CapMove:                 "MOVE",
+	imap.CapCompressDeflate:      "COMPRESS",
+	imap.CapNotify:               "NOTIFY",
+}
+
 func addAvailableCaps(caps *[]imap.Cap, available imap.CapSet, l []imap.Cap) {
 	for _, c := range l {
 		if available.Has(c) {
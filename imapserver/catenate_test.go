@@ -0,0 +1,96 @@
+package imapserver_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestAppendCatenate(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapUIDPlus:   {},
+			imap.CapCatenate:  {},
+		},
+	})
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	var uidValidity uint32
+	for _, line := range tc.selectMailbox("INBOX") {
+		if _, err := fmt.Sscanf(line, "* OK [UIDVALIDITY %d]", &uidValidity); err == nil {
+			break
+		}
+	}
+	if uidValidity == 0 {
+		t.Fatalf("missing UIDVALIDITY in SELECT response")
+	}
+
+	header := "From: Taki Tachibana <taki.tachibana@example.org>\r\n" +
+		"Subject: Re: Your Name.\r\n" +
+		"\r\n"
+	url := fmt.Sprintf("/INBOX;UIDVALIDITY=%v/;UID=1/;SECTION=TEXT", uidValidity)
+	tc.writeLine(`C1 APPEND INBOX CATENATE (TEXT {%v+}`+"\r\n"+`%v URL "%v")`, len(header), header, url)
+	resp, _ := tc.readTagged("C1")
+	if want := fmt.Sprintf("C1 OK [APPENDUID %v 2] ", uidValidity); !strings.HasPrefix(resp, want) {
+		t.Fatalf("expected %q, got %q", want, resp)
+	}
+
+	tc.writeLine("F1 UID FETCH 2 RFC822.SIZE")
+	got := tc.expectOK("F1")
+	want := fmt.Sprintf("* 2 FETCH (UID 2 RFC822.SIZE %v)", len(header)+len("Who are you?\r\n"))
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// A URL referring to a missing message must abort the whole command
+	url = fmt.Sprintf("/INBOX;UIDVALIDITY=%v/;UID=42", uidValidity)
+	tc.writeLine(`C2 APPEND INBOX CATENATE (TEXT {%v+}`+"\r\n"+`%v URL "%v")`, len(header), header, url)
+	resp, _ = tc.readTagged("C2")
+	if want := "C2 NO [BADURL " + url + "] "; !strings.HasPrefix(resp, want) {
+		t.Errorf("expected %q, got %q", want, resp)
+	}
+
+	tc.writeLine("N1 NOOP")
+	if got := tc.expectOK("N1"); len(got) != 0 {
+		t.Errorf("expected no message to be appended, got %q", got)
+	}
+}
+
+func TestAppendCatenateNotAuthenticated(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapCatenate:  {},
+		},
+	})
+
+	// The literal must not be accepted before the state is checked
+	tc.writeLine("C1 APPEND INBOX CATENATE (TEXT {%v}", len(testMessage))
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "C1 NO ") && !strings.HasPrefix(resp, "C1 BAD ") {
+		t.Fatalf("expected C1 to be rejected, got %q", resp)
+	}
+
+	// Non-synchronizing literals are discarded
+	tc.writeLine(`C2 APPEND INBOX CATENATE (URL "/INBOX;UIDVALIDITY=1/;UID=1" TEXT {%v+}`+"\r\n"+`%v)`, len(testMessage), testMessage)
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "C2 NO ") && !strings.HasPrefix(resp, "C2 BAD ") {
+		t.Fatalf("expected C2 to be rejected, got %q", resp)
+	}
+	tc.writeLine("N1 NOOP")
+	tc.expectOK("N1")
+}
+
+func TestAppendCatenateUnsupported(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+
+	// The literal must not be accepted if CATENATE isn't supported
+	tc.writeLine("C1 APPEND INBOX CATENATE (TEXT {%v}", len(testMessage))
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "C1 BAD ") {
+		t.Fatalf("expected C1 to be rejected, got %q", resp)
+	}
+}
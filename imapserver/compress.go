@@ -0,0 +1,79 @@
+package imapserver
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+func (c *Conn) handleCompress(tag string, dec *imapwire.Decoder) error {
+	var mech string
+	if !dec.ExpectSP() || !dec.ExpectAtom(&mech) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return err
+	}
+	if !c.server.options.caps().Has(imap.CapCompressDeflate) {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Text: "COMPRESS not supported",
+		}
+	}
+	if strings.ToUpper(mech) != "DEFLATE" {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeBad,
+			Text: "Unsupported compression mechanism",
+		}
+	}
+
+	c.mutex.Lock()
+	compressed := c.compressed
+	c.mutex.Unlock()
+	if compressed {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeBad,
+			Code: imap.ResponseCodeCompressionActive,
+			Text: "Compression is already active",
+		}
+	}
+
+	// Do not allow to write uncompressed data past this point: keep
+	// c.encMutex locked until the end
+	enc := newResponseEncoder(c)
+	defer enc.end()
+
+	err := writeStatusResp(enc.Encoder, tag, &imap.StatusResponse{
+		Type: imap.StatusResponseTypeOK,
+		Text: "DEFLATE active",
+	})
+	if err != nil {
+		return err
+	}
+
+	// Drain buffered data from our bufio.Reader
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, c.br, int64(c.br.Buffered())); err != nil {
+		panic(err) // unreachable
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var r io.Reader = c.conn
+	if buf.Len() > 0 {
+		r = io.MultiReader(&buf, c.conn)
+	}
+
+	rw := c.wrapReadWriter(internal.NewDeflateReadWriter(r, c.conn))
+	c.br.Reset(rw)
+	c.bw.Reset(rw)
+	c.compressed = true
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package imapserver_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestCompress(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:       {},
+			imap.CapCompressDeflate: {},
+		},
+	})
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	conn, err := net.Dial("tcp", tc.addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	client := imapclient.New(conn, nil)
+	defer client.Close()
+
+	if err := client.Login(testUsername, testPassword).Wait(); err != nil {
+		t.Fatalf("Login() = %v", err)
+	}
+	if !client.Caps().Has(imap.CapCompressDeflate) {
+		t.Fatalf("server doesn't advertise COMPRESS=DEFLATE")
+	}
+	if err := client.Compress(); err != nil {
+		t.Fatalf("Compress() = %v", err)
+	}
+
+	data, err := client.Select("INBOX", nil).Wait()
+	if err != nil {
+		t.Fatalf("Select() = %v", err)
+	} else if data.NumMessages != 1 {
+		t.Errorf("Select().NumMessages = %v, want 1", data.NumMessages)
+	}
+
+	var imapErr *imap.Error
+	if err := client.Compress(); !errors.As(err, &imapErr) || imapErr.Code != imap.ResponseCodeCompressionActive {
+		t.Errorf("Compress() = %v, want COMPRESSIONACTIVE error", err)
+	}
+
+	if err := client.Noop().Wait(); err != nil {
+		t.Errorf("Noop() = %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package imapserver_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+type slowFetchSession struct {
+	imapserver.Session
+	fetching chan<- struct{}
+	release  <-chan struct{}
+}
+
+func (sess *slowFetchSession) Fetch(ctx context.Context, w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	sess.fetching <- struct{}{}
+	<-sess.release
+	return sess.Session.Fetch(ctx, w, kind, seqSet, options)
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &slowFetchSession{
+				Session:  memServer.NewSession(),
+				fetching: fetching,
+				release:  release,
+			}, nil, nil
+		},
+		MaxConcurrentCommands: 4,
+	})
+	tc.login()
+
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1 (FLAGS)")
+	<-fetching
+	tc.writeLine("C1 CAPABILITY")
+	resp, untagged := tc.readTagged("C1")
+	if !strings.HasPrefix(resp, "C1 OK") {
+		t.Fatalf("expected OK for CAPABILITY, got %q", resp)
+	}
+	if len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* CAPABILITY ") {
+		t.Errorf("expected a single CAPABILITY response, got %q", untagged)
+	}
+
+	close(release)
+	untagged = tc.expectOK("F1")
+	if len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* 1 FETCH ") {
+		t.Errorf("expected a single FETCH response, got %q", untagged)
+	}
+}
+
+func TestConcurrentCommands_barrier(t *testing.T) {
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &slowFetchSession{
+				Session:  memServer.NewSession(),
+				fetching: fetching,
+				release:  release,
+			}, nil, nil
+		},
+		MaxConcurrentCommands: 4,
+	})
+	tc.login()
+
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	// STORE must wait for the pending FETCH to complete
+	tc.writeLine("F1 FETCH 1 (FLAGS)")
+	<-fetching
+	tc.writeLine("T1 STORE 1 +FLAGS.SILENT (\\Seen)")
+	close(release)
+	tc.expectOK("F1")
+	tc.expectOK("T1")
+}
+
+type lockingSession struct {
+	imapserver.Session
+	*imapserver.MailboxLocks
+
+	active, maxActive *int32
+}
+
+func (sess *lockingSession) Expunge(ctx context.Context, w *imapserver.ExpungeWriter, uids *imap.SeqSet) error {
+	n := atomic.AddInt32(sess.active, 1)
+	defer atomic.AddInt32(sess.active, -1)
+	for {
+		max := atomic.LoadInt32(sess.maxActive)
+		if n <= max || atomic.CompareAndSwapInt32(sess.maxActive, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return sess.Session.Expunge(ctx, w, uids)
+}
+
+func TestMailboxLocks(t *testing.T) {
+	var (
+		locks             imapserver.MailboxLocks
+		active, maxActive int32
+	)
+	memServer := newTestMemServer()
+	_, addr := startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &lockingSession{
+				Session:      memServer.NewSession(),
+				MailboxLocks: &locks,
+				active:       &active,
+				maxActive:    &maxActive,
+			}, nil, nil
+		},
+	})
+
+	var conns []*testConn
+	for i := 0; i < 2; i++ {
+		tc := dialTestServer(t, addr)
+		tc.login()
+		conns = append(conns, tc)
+	}
+	for i := 0; i < 4; i++ {
+		conns[0].appendMessage("INBOX", testMessage)
+	}
+	for _, tc := range conns {
+		tc.selectMailbox("INBOX")
+	}
+	conns[0].writeLine(`S1 STORE 1:4 +FLAGS.SILENT (\Deleted)`)
+	conns[0].expectOK("S1")
+
+	for _, tc := range conns {
+		tc.writeLine("E1 EXPUNGE")
+	}
+	total := 0
+	for _, tc := range conns {
+		for _, line := range tc.expectOK("E1") {
+			if strings.HasSuffix(line, " EXPUNGE") {
+				total++
+			}
+		}
+	}
+
+	if n := atomic.LoadInt32(&maxActive); n != 1 {
+		t.Errorf("got %v concurrent EXPUNGE calls, want 1", n)
+	}
+	// Each connection sees all messages disappear exactly once
+	for _, tc := range conns {
+		tc.writeLine("N1 NOOP")
+		for _, line := range tc.expectOK("N1") {
+			if strings.HasSuffix(line, " EXPUNGE") {
+				total++
+			}
+		}
+	}
+	if total != 8 {
+		t.Errorf("got %v EXPUNGE responses, want 8", total)
+	}
+}
+
+type heldStoreSession struct {
+	imapserver.Session
+	imapserver.MailboxLocks
+
+	stored  chan<- struct{}
+	release <-chan struct{}
+}
+
+func (sess *heldStoreSession) Store(ctx context.Context, w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+	err := sess.Session.Store(ctx, w, kind, seqSet, flags, options)
+	sess.stored <- struct{}{}
+	<-sess.release
+	return err
+}
+
+func TestMailboxLocksHoldResponses(t *testing.T) {
+	stored := make(chan struct{})
+	release := make(chan struct{})
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &heldStoreSession{
+				Session: memServer.NewSession(),
+				stored:  stored,
+				release: release,
+			}, nil, nil
+		},
+	})
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`S1 STORE 1 +FLAGS (\Flagged)`)
+	<-stored
+
+	// No response must be written while the mailbox is locked
+	tc.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if line, err := tc.br.ReadString('\n'); err == nil {
+		t.Errorf("got response while the mailbox is locked: %q", line)
+	}
+
+	close(release)
+	untagged := tc.expectOK("S1")
+	if len(untagged) != 1 || !strings.Contains(untagged[0], `FLAGS (\flagged)`) {
+		t.Errorf("unexpected STORE response: %q", untagged)
+	}
+}
+
+// lockRecorderSession records whether mailboxes are locked when messages are
+// appended.
+type lockRecorderSession struct {
+	imapserver.Session
+
+	mutex  sync.Mutex
+	locked map[string]bool
+	calls  []bool // whether INBOX was locked for each append call
+}
+
+func (sess *lockRecorderSession) LockMailbox(ctx context.Context, mailbox string) error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	sess.locked[mailbox] = true
+	return nil
+}
+
+func (sess *lockRecorderSession) UnlockMailbox(mailbox string) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	delete(sess.locked, mailbox)
+}
+
+func (sess *lockRecorderSession) record() {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	sess.calls = append(sess.calls, sess.locked["INBOX"])
+}
+
+func (sess *lockRecorderSession) Append(ctx context.Context, mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	sess.record()
+	return sess.Session.Append(ctx, mailbox, r, options)
+}
+
+func (sess *lockRecorderSession) MultiAppend(ctx context.Context, mailbox string, r *imapserver.MultiAppendReader) ([]*imap.AppendData, error) {
+	sess.record()
+	return sess.Session.(imapserver.SessionMultiAppend).MultiAppend(ctx, mailbox, r)
+}
+
+func (sess *lockRecorderSession) ResolveURL(ctx context.Context, url string) ([]byte, error) {
+	return sess.Session.(imapserver.SessionCatenate).ResolveURL(ctx, url)
+}
+
+func TestMailboxLocksAppend(t *testing.T) {
+	for _, multiAppend := range []bool{false, true} {
+		t.Run(fmt.Sprintf("multiappend=%v", multiAppend), func(t *testing.T) {
+			caps := imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapCatenate: {}}
+			if multiAppend {
+				caps[imap.CapMultiAppend] = struct{}{}
+			}
+			sessions := make(chan *lockRecorderSession, 1)
+			memServer := newTestMemServer()
+			tc := newTestServer(t, &imapserver.Options{
+				NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+					sess := &lockRecorderSession{
+						Session: memServer.NewSession(),
+						locked:  make(map[string]bool),
+					}
+					sessions <- sess
+					return sess, nil, nil
+				},
+				Caps: caps,
+			})
+			sess := <-sessions
+			tc.login()
+
+			lit := fmt.Sprintf("{%v}", len(testMessage))
+			tc.writeLine("A1 APPEND INBOX %v", lit)
+			if line := tc.readLine(); !strings.HasPrefix(line, "+ ") {
+				t.Fatalf("expected continuation request, got %q", line)
+			}
+			tc.writeLine("%v", testMessage)
+			tc.expectOK("A1")
+
+			tc.writeLine("A2 APPEND INBOX CATENATE (TEXT {%v+}\r\n%v)", len(testMessage), testMessage)
+			tc.expectOK("A2")
+
+			sess.mutex.Lock()
+			defer sess.mutex.Unlock()
+			if len(sess.calls) != 2 {
+				t.Fatalf("got %v append calls, want 2", len(sess.calls))
+			}
+			for i, locked := range sess.calls {
+				if !locked {
+					t.Errorf("mailbox not locked for append #%v", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestMailboxLocksHoldResponsesLimit(t *testing.T) {
+	stored := make(chan struct{})
+	release := make(chan struct{})
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &heldStoreSession{
+				Session: memServer.NewSession(),
+				stored:  stored,
+				release: release,
+			}, nil, nil
+		},
+		MaxWriteBuffer: 4096,
+	})
+	tc.login()
+	for i := 0; i < 200; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`S1 STORE 1:* +FLAGS (\Flagged)`)
+	<-stored
+
+	// Responses exceeding the limit are written while the mailbox is locked
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := tc.br.ReadString('\n'); err != nil {
+		t.Errorf("failed to read held response: %v", err)
+	} else if !strings.HasPrefix(line, "* 1 FETCH ") {
+		t.Errorf("unexpected response: %q", line)
+	}
+
+	close(release)
+	if untagged := tc.expectOK("S1"); len(untagged) != 199 {
+		t.Errorf("got %v untagged responses, want 199", len(untagged))
+	}
+}
@@ -0,0 +1,166 @@
+package imapserver_test
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var modSeqRegexp = regexp.MustCompile(`MODSEQ \((\d+)\)`)
+
+func condStoreTestServer(t *testing.T) *testConn {
+	return newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapCondStore: {},
+		},
+	})
+}
+
+func fetchModSeq(tc *testConn) uint64 {
+	tc.t.Helper()
+	tc.writeLine("F1 FETCH 1 (MODSEQ)")
+	untagged := tc.expectOK("F1")
+	for _, line := range untagged {
+		if m := modSeqRegexp.FindStringSubmatch(line); m != nil {
+			modSeq, err := strconv.ParseUint(m[1], 10, 64)
+			if err != nil {
+				tc.t.Fatalf("invalid MODSEQ in %q: %v", line, err)
+			}
+			return modSeq
+		}
+	}
+	tc.t.Fatalf("no MODSEQ in FETCH response: %q", untagged)
+	return 0
+}
+
+func TestCondStoreSelect(t *testing.T) {
+	tc := condStoreTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("S1 SELECT INBOX (CONDSTORE)")
+	untagged := tc.expectOK("S1")
+	found := false
+	for _, line := range untagged {
+		if strings.HasPrefix(line, "* OK [HIGHESTMODSEQ ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no HIGHESTMODSEQ response code in SELECT response: %q", untagged)
+	}
+
+	tc.writeLine("T1 STATUS INBOX (HIGHESTMODSEQ)")
+	untagged = tc.expectOK("T1")
+	if len(untagged) != 1 || !strings.Contains(untagged[0], "HIGHESTMODSEQ ") {
+		t.Errorf("unexpected STATUS response: %q", untagged)
+	}
+}
+
+func TestCondStoreFetchChangedSince(t *testing.T) {
+	tc := condStoreTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	modSeq := fetchModSeq(tc)
+
+	tc.writeLine("T1 STORE 2 +FLAGS.SILENT (\\Flagged)")
+	tc.expectOK("T1")
+
+	tc.writeLine("F2 FETCH 1:* (FLAGS) (CHANGEDSINCE %v)", modSeq)
+	untagged := tc.expectOK("F2")
+	if len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* 2 FETCH ") || !strings.Contains(untagged[0], "MODSEQ") {
+		t.Errorf("unexpected FETCH CHANGEDSINCE response: %q", untagged)
+	}
+}
+
+func TestCondStoreUnchangedSince(t *testing.T) {
+	tc := condStoreTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	other := tc.newConn()
+	other.login()
+	other.selectMailbox("INBOX")
+
+	modSeq := fetchModSeq(tc)
+
+	// A conditional STORE succeeds when nothing changed
+	tc.writeLine("T1 STORE 1 (UNCHANGEDSINCE %v) +FLAGS (\\Seen)", modSeq)
+	tc.expectOK("T1")
+
+	modSeq = fetchModSeq(tc)
+
+	// Another session bumps the mod-sequence
+	other.writeLine("T2 STORE 1 +FLAGS.SILENT (\\Answered)")
+	other.expectOK("T2")
+
+	tc.writeLine("T3 UID STORE 1 (UNCHANGEDSINCE %v) +FLAGS (\\Deleted)", modSeq)
+	resp, _ := tc.readTagged("T3")
+	if resp != "T3 OK [MODIFIED 1] Conditional STORE failed" {
+		t.Errorf("expected MODIFIED response code, got %q", resp)
+	}
+
+	tc.writeLine("F2 FETCH 1 (FLAGS)")
+	untagged := tc.expectOK("F2")
+	for _, line := range untagged {
+		if strings.Contains(line, "\\Deleted") {
+			t.Errorf("message has been modified despite conditional STORE failure: %q", line)
+		}
+	}
+}
+
+func TestCondStoreZero(t *testing.T) {
+	tc := condStoreTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	// UNCHANGEDSINCE 0 fails for all messages
+	tc.writeLine("T1 STORE 1:2 (UNCHANGEDSINCE 0) +FLAGS (\\Deleted)")
+	if resp, _ := tc.readTagged("T1"); resp != "T1 OK [MODIFIED 1:2] Conditional STORE failed" {
+		t.Errorf("expected MODIFIED response code, got %q", resp)
+	}
+
+	// CHANGEDSINCE 0 returns all messages
+	tc.writeLine("F1 FETCH 1:* (FLAGS) (CHANGEDSINCE 0)")
+	untagged := tc.expectOK("F1")
+	if len(untagged) != 2 {
+		t.Fatalf("unexpected FETCH CHANGEDSINCE response: %q", untagged)
+	}
+	for _, line := range untagged {
+		if !strings.Contains(line, "MODSEQ") || strings.Contains(line, "\\deleted") {
+			t.Errorf("unexpected FETCH CHANGEDSINCE response: %q", line)
+		}
+	}
+}
+
+func TestCondStoreFetchChangedSinceSeen(t *testing.T) {
+	tc := condStoreTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	modSeq := fetchModSeq(tc)
+
+	// Messages filtered out by CHANGEDSINCE aren't marked as seen
+	tc.writeLine("F1 FETCH 1 (BODY[]) (CHANGEDSINCE %v)", modSeq)
+	if untagged := tc.expectOK("F1"); len(untagged) != 0 {
+		t.Errorf("unexpected FETCH CHANGEDSINCE response: %q", untagged)
+	}
+	tc.writeLine("F2 FETCH 1 (FLAGS)")
+	for _, line := range tc.expectOK("F2") {
+		if strings.Contains(strings.ToLower(line), "\\seen") {
+			t.Errorf("message has been marked as seen: %q", line)
+		}
+	}
+}
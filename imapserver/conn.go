@@ -2,28 +2,31 @@ package imapserver
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-const (
-	cmdReadTimeout     = 30 * time.Second
-	idleReadTimeout    = 35 * time.Minute // section 5.4 says 30min minimum
-	literalReadTimeout = 5 * time.Minute
+var errCommandPanic = errors.New("imapserver: panic handling command")
 
-	respWriteTimeout    = 30 * time.Second
-	literalWriteTimeout = 5 * time.Minute
-)
+var commandLineTooLongResp = &imap.StatusResponse{
+	Type: imap.StatusResponseTypeBad,
+	Code: imap.ResponseCodeTooBig,
+	Text: "Command line too long",
+}
 
 var internalServerErrorResp = &imap.StatusResponse{
 	Type: imap.StatusResponseTypeNo,
@@ -34,28 +37,103 @@ var internalServerErrorResp = &imap.StatusResponse{
 // A Conn represents an IMAP connection to the server.
 type Conn struct {
 	server   *Server
+	logger   *slog.Logger
 	br       *bufio.Reader
 	bw       *bufio.Writer
 	encMutex sync.Mutex
 
-	mutex   sync.Mutex
-	conn    net.Conn
-	enabled imap.CapSet
+	// Responses written while mailboxes are locked, guarded by encMutex
+	held         *bufio.Writer
+	heldBuf      bytes.Buffer
+	holds        int
+	holdOverflow bool // too many responses are held, see holdResponses
+
+	// Set if a response encoder was released in the middle of a response,
+	// e.g. because of a panic, guarded by encMutex
+	respInProgress bool
+
+	ctx    context.Context // cancelled when the connection is closed
+	cancel context.CancelFunc
+
+	remoteAddr net.Addr
+
+	mutex      sync.Mutex
+	conn       net.Conn
+	enabled    imap.CapSet
+	compressed bool
+	searchRes  imap.SeqSet               // UIDs saved by SEARCH RETURN (SAVE)
+	searchCtxs map[string]*searchContext // RETURN (UPDATE) contexts, by tag
+	idleRead   bool                      // waiting for client input between commands
+
+	state    imap.ConnState
+	mailbox  string // selected mailbox
+	readOnly bool   // mailbox selected with EXAMINE
+	session  Session
+
+	authFailures int // failed LOGIN and AUTHENTICATE commands
 
-	state   imap.ConnState
-	session Session
+	writeErrOnce sync.Once
+	hijacked     atomic.Bool
+
+	cmdSem       chan struct{} // nil if commands are executed sequentially
+	cmdWaitGroup sync.WaitGroup
+
+	// only updated if Options.OnCommand is set
+	bytesRead, bytesWritten int64 // atomic
 }
 
 func newConn(c net.Conn, server *Server) *Conn {
-	rw := server.options.wrapReadWriter(c)
-	br := bufio.NewReader(rw)
-	bw := bufio.NewWriter(rw)
-	return &Conn{
-		conn:    c,
-		server:  server,
-		br:      br,
-		bw:      bw,
-		enabled: make(imap.CapSet),
+	ctx, cancel := context.WithCancel(server.ctx)
+	logger := server.logger.With(
+		"conn", atomic.AddUint64(&server.nextConnID, 1),
+		"remote_addr", c.RemoteAddr().String(),
+	)
+	conn := &Conn{
+		logger:     logger,
+		ctx:        ctx,
+		cancel:     cancel,
+		remoteAddr: c.RemoteAddr(),
+		conn:       c,
+		server:     server,
+		enabled:    make(imap.CapSet),
+	}
+	if n := server.options.MaxWriteBuffer; n > 0 {
+		if wb := writeBufferSetter(c); wb != nil {
+			if err := wb.SetWriteBuffer(n); err != nil {
+				logger.Warn("failed to set write buffer size", "err", err)
+			}
+		}
+	}
+	rw := conn.wrapReadWriter(c)
+	conn.br = bufio.NewReader(rw)
+	conn.bw = bufio.NewWriter(rw)
+	if n := server.options.MaxConcurrentCommands; n > 1 {
+		conn.cmdSem = make(chan struct{}, n)
+	}
+	return conn
+}
+
+type writeBufferConn interface {
+	SetWriteBuffer(bytes int) error
+}
+
+// writeBufferSetter returns the connection which can set the operating system
+// send buffer size for c, e.g. the *net.TCPConn underlying a TLS, PROXY or
+// WebSocket connection. It returns nil if there is none.
+func writeBufferSetter(c net.Conn) writeBufferConn {
+	for {
+		switch conn := c.(type) {
+		case writeBufferConn:
+			return conn
+		case *tls.Conn:
+			c = conn.NetConn()
+		case *proxyConn:
+			c = conn.Conn
+		case *wsConn:
+			c = conn.Conn
+		default:
+			return nil
+		}
 	}
 }
 
@@ -70,6 +148,103 @@ func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
 
+// RemoteAddr returns the address of the client. If the connection comes
+// from a trusted proxy, the address sent in the PROXY protocol header is
+// returned.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// ConnInfo contains information about a connection.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// TLS contains the state of the TLS connection, or nil if the connection
+	// isn't encrypted with TLS
+	TLS *tls.ConnectionState
+}
+
+// Info returns information about the connection. It can be used in
+// Options.NewSession, e.g. to apply per-IP policies or to identify clients
+// with their TLS certificate.
+//
+// The TLS handshake of connections accepted by a TLS listener is completed
+// before Options.NewSession is called.
+func (c *Conn) Info() *ConnInfo {
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+
+	info := &ConnInfo{
+		RemoteAddr: c.remoteAddr,
+		LocalAddr:  conn.LocalAddr(),
+	}
+	info.TLS = connectionState(conn)
+	return info
+}
+
+// connectionState returns the TLS state of a connection, or nil if it isn't
+// encrypted. Besides *tls.Conn, any connection with a ConnectionState method
+// is recognized, e.g. a wrapper around a TLS connection.
+func connectionState(conn net.Conn) *tls.ConnectionState {
+	if wsConn, ok := conn.(*wsConn); ok {
+		return wsConn.tls
+	}
+	tlsConn, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// Context returns the connection's context.
+//
+// The context is cancelled when the connection is closed or when the server
+// shuts down.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Hijack lets the caller take over the connection, e.g. to implement an
+// unsupported extension. After Hijack returns, the server stops reading
+// commands and doesn't write to the connection anymore, including the
+// response to the current command. The caller becomes responsible for
+// closing the connection.
+//
+// The returned bufio.ReadWriter preserves data buffered by the server, such
+// as pipelined commands. If COMPRESS is active, it transparently handles
+// compression.
+//
+// Hijack must be called from a Session method of a command which doesn't
+// run concurrently with other commands, and not while a response is being
+// written. Session.Close is still called once the server is done with the
+// connection.
+func (c *Conn) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c.encMutex.Lock()
+	defer c.encMutex.Unlock()
+
+	if c.hijacked.Load() {
+		return nil, nil, errors.New("imapserver: connection already hijacked")
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	rw := bufio.NewReadWriter(c.br, c.bw)
+	c.bw = bufio.NewWriter(io.Discard)
+	c.hijacked.Store(true)
+
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+	conn.SetDeadline(time.Time{})
+
+	return conn, rw, nil
+}
+
 // Bye terminates the IMAP connection.
 func (c *Conn) Bye(text string) error {
 	respErr := c.writeStatusResp("", &imap.StatusResponse{
@@ -86,10 +261,13 @@ func (c *Conn) Bye(text string) error {
 func (c *Conn) serve() {
 	defer func() {
 		if v := recover(); v != nil {
-			c.server.logger().Printf("panic handling command: %v\n%s", v, debug.Stack())
+			c.logger.Error("panic serving connection", "panic", v, "stack", string(debug.Stack()))
 		}
 
-		c.conn.Close()
+		c.cancel()
+		if !c.hijacked.Load() {
+			c.conn.Close()
+		}
 	}()
 
 	c.server.mutex.Lock()
@@ -101,6 +279,20 @@ func (c *Conn) serve() {
 		c.server.mutex.Unlock()
 	}()
 
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		// Complete the handshake, so that the TLS connection state is
+		// available when creating the session
+		if dur := c.server.options.Timeouts.CommandRead; dur > 0 {
+			tlsConn.SetDeadline(time.Now().Add(dur))
+		}
+		err := tlsConn.HandshakeContext(c.ctx)
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			c.logger.Warn("TLS handshake failed", "err", err)
+			return
+		}
+	}
+
 	var (
 		greetingData *GreetingData
 		err          error
@@ -114,19 +306,22 @@ func (c *Conn) serve() {
 		if errors.As(err, &imapErr) && imapErr.Type == imap.StatusResponseTypeBye {
 			resp = (*imap.StatusResponse)(imapErr)
 		} else {
-			c.server.logger().Printf("failed to create session: %v", err)
+			c.logger.Error("failed to create session", "err", err)
 			resp = internalServerErrorResp
 		}
 		if err := c.writeStatusResp("", resp); err != nil {
-			c.server.logger().Printf("failed to write greeting: %v", err)
+			c.logger.Error("failed to write greeting", "err", err)
 		}
 		return
 	}
 
 	defer func() {
+		// Abort commands which are still running
+		c.cancel()
+		c.waitCommands()
 		if c.session != nil {
 			if err := c.session.Close(); err != nil {
-				c.server.logger().Printf("failed to close session: %v", err)
+				c.logger.Error("failed to close session", "err", err)
 			}
 		}
 	}()
@@ -148,43 +343,75 @@ func (c *Conn) serve() {
 		c.state = imap.ConnStateAuthenticated
 		statusType = imap.StatusResponseTypePreAuth
 	}
-	if err := c.writeCapabilityStatus("", statusType, "IMAP server ready"); err != nil {
-		c.server.logger().Printf("failed to write greeting: %v", err)
+	if err := c.writeGreeting(statusType); err != nil {
+		c.logger.Error("failed to write greeting", "err", err)
 		return
 	}
 
-	for {
+	for !c.hijacked.Load() {
 		var readTimeout time.Duration
 		switch c.state {
 		case imap.ConnStateAuthenticated, imap.ConnStateSelected:
-			readTimeout = idleReadTimeout
+			readTimeout = c.server.options.Timeouts.IdleRead
 		default:
-			readTimeout = cmdReadTimeout
+			readTimeout = c.server.options.Timeouts.CommandRead
 		}
 		c.setReadTimeout(readTimeout)
 
 		dec := imapwire.NewDecoder(c.br, imapwire.ConnSideServer)
-		dec.CheckBufferedLiteralFunc = c.checkBufferedLiteral
+		dec.MaxLineSize = c.server.options.maxCommandLineSize()
+		dec.StrictCRLF = !c.server.options.AllowBareLF
 
-		if c.state == imap.ConnStateLogout || dec.EOF() {
+		if c.state == imap.ConnStateLogout {
 			break
 		}
 
-		c.setReadTimeout(cmdReadTimeout)
-		if err := c.readCommand(dec); err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				c.server.logger().Printf("failed to read command: %v", err)
+		if !c.beginIdleRead() {
+			c.byeShutdown()
+			break
+		}
+		eof := dec.EOF()
+		c.endIdleRead()
+		if eof {
+			break
+		} else if dec.Err() != nil && c.server.isShuttingDown() {
+			c.byeShutdown()
+			break
+		}
+
+		c.setReadTimeout(c.server.options.Timeouts.CommandRead)
+		if err := c.readCommand(dec, c.newCommandStats()); err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, errCommandPanic) {
+				c.logger.Error("failed to read command", "err", err)
 			}
 			break
 		}
 	}
 }
 
-func (c *Conn) readCommand(dec *imapwire.Decoder) error {
+func (c *Conn) readCommand(dec *imapwire.Decoder, stats *commandStats) (err error) {
+	var line string
+	if c.server.options.OnRawCommand != nil {
+		line = peekLine(c.br)
+	}
+
 	var tag, name string
 	if !dec.ExpectAtom(&tag) || !dec.ExpectSP() || !dec.ExpectAtom(&name) {
+		if errors.Is(dec.Err(), imapwire.ErrLineTooLong) {
+			dec.DiscardLine()
+			return c.writeStatusResp("", commandLineTooLongResp)
+		}
 		return fmt.Errorf("in command: %w", dec.Err())
 	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			c.commandLogger(tag, name).Error("panic handling command", "panic", v, "stack", string(debug.Stack()))
+			c.reportCommand(stats, tag, name, "")
+			c.writePanicResp(tag)
+			err = errCommandPanic
+		}
+	}()
 	name = strings.ToUpper(name)
 
 	numKind := NumKindSeq
@@ -197,16 +424,42 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 		name = "UID " + strings.ToUpper(subName)
 	}
 
-	// TODO: handle multiple commands concurrently
+	if c.server.options.commandDisabled(name) {
+		return c.rejectCommand(dec, stats, tag, name, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Command disabled",
+		})
+	}
+
+	dec.CheckBufferedLiteralFunc = func(size int64, nonSync bool) error {
+		return c.checkBufferedLiteral(name, size, nonSync)
+	}
+
+	if c.server.options.OnRawCommand != nil {
+		if err := c.server.options.OnRawCommand(c, line); err != nil {
+			return c.rejectCommand(dec, stats, tag, name, err)
+		}
+	}
+
+	if !isConcurrentCommand(name) {
+		// Commands which may change the connection or mailbox state cannot
+		// run concurrently with other commands
+		c.waitCommands()
+	}
+
 	sendOK := true
-	var err error
+	var exec func() error
 	switch name {
 	case "NOOP", "CHECK":
 		err = c.handleNoop(dec)
 	case "LOGOUT":
 		err = c.handleLogout(dec)
 	case "CAPABILITY":
-		err = c.handleCapability(dec)
+		exec, err = c.handleCapability(dec)
+	case "COMPRESS":
+		err = c.handleCompress(tag, dec)
+		sendOK = false
 	case "STARTTLS":
 		err = c.handleStartTLS(tag, dec)
 		sendOK = false
@@ -218,8 +471,11 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 		sendOK = false
 	case "ENABLE":
 		err = c.handleEnable(dec)
+	case "ID":
+		exec, err = c.handleID(dec)
 	case "CREATE":
-		err = c.handleCreate(dec)
+		err = c.handleCreate(tag, dec)
+		sendOK = false
 	case "DELETE":
 		err = c.handleDelete(dec)
 	case "RENAME":
@@ -229,15 +485,18 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 	case "UNSUBSCRIBE":
 		err = c.handleUnsubscribe(dec)
 	case "STATUS":
-		err = c.handleStatus(dec)
+		exec, err = c.handleStatus(dec)
 	case "LIST":
-		err = c.handleList(dec)
+		exec, err = c.handleList(dec)
 	case "LSUB":
-		err = c.handleLSub(dec)
+		exec, err = c.handleLSub(dec)
 	case "NAMESPACE":
-		err = c.handleNamespace(dec)
+		exec, err = c.handleNamespace(dec)
+	case "NOTIFY":
+		err = c.handleNotify(dec)
 	case "IDLE":
-		err = c.handleIdle(dec)
+		err = c.handleIdle(tag, dec)
+		sendOK = false
 	case "SELECT", "EXAMINE":
 		err = c.handleSelect(tag, dec, name == "EXAMINE")
 		sendOK = false
@@ -247,20 +506,54 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 		err = c.handleAppend(tag, dec)
 		sendOK = false
 	case "FETCH", "UID FETCH":
-		err = c.handleFetch(dec, numKind)
+		exec, err = c.handleFetch(dec, numKind)
 	case "EXPUNGE":
 		err = c.handleExpunge(dec)
 	case "UID EXPUNGE":
 		err = c.handleUIDExpunge(dec)
 	case "STORE", "UID STORE":
-		err = c.handleStore(dec, numKind)
+		err = c.handleStore(tag, dec, numKind)
+		sendOK = false
 	case "COPY", "UID COPY":
 		err = c.handleCopy(tag, dec, numKind)
 		sendOK = false
 	case "MOVE", "UID MOVE":
 		err = c.handleMove(dec, numKind)
 	case "SEARCH", "UID SEARCH":
-		err = c.handleSearch(tag, dec, numKind)
+		exec, err = c.handleSearch(tag, dec, numKind)
+	case "GETQUOTA":
+		err = c.handleGetQuota(dec)
+	case "GETQUOTAROOT":
+		err = c.handleGetQuotaRoot(dec)
+	case "SETQUOTA":
+		err = c.handleSetQuota(dec)
+	case "GETMETADATA":
+		err = c.handleGetMetadata(tag, dec)
+		sendOK = false
+	case "SETMETADATA":
+		err = c.handleSetMetadata(dec)
+	case "SETACL":
+		err = c.handleSetACL(dec)
+	case "DELETEACL":
+		err = c.handleDeleteACL(dec)
+	case "GETACL":
+		err = c.handleGetACL(dec)
+	case "LISTRIGHTS":
+		err = c.handleListRights(dec)
+	case "MYRIGHTS":
+		err = c.handleMyRights(dec)
+	case "GENURLAUTH":
+		err = c.handleGenURLAuth(dec)
+	case "RESETKEY":
+		err = c.handleResetKey(dec)
+	case "URLFETCH":
+		err = c.handleURLFetch(dec)
+	case "CANCELUPDATE":
+		err = c.handleCancelUpdate(dec)
+	case "SORT", "UID SORT":
+		exec, err = c.handleSort(tag, dec, numKind)
+	case "THREAD", "UID THREAD":
+		exec, err = c.handleThread(dec, numKind)
 	default:
 		if c.state == imap.ConnStateNotAuthenticated {
 			// Don't allow a single unknown command before authentication to
@@ -275,8 +568,221 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 		}
 	}
 
+	if (name == "LOGIN" || name == "AUTHENTICATE") && c.authFailed(err) {
+		c.state = imap.ConnStateLogout
+		defer c.Bye("Too many authentication failures")
+	}
+
+	dec.DiscardLine()
+	stats.endRead(c)
+
+	if err == nil && exec != nil {
+		if c.cmdSem != nil {
+			c.startCommand(tag, name, exec, stats)
+			return nil
+		}
+		err = exec()
+	}
+
+	status := commandStatusType(err)
+	err = c.writeCommandStatus(tag, name, sendOK, err)
+	c.reportCommand(stats, tag, name, status)
+	return err
+}
+
+// rejectCommand discards a command refused by Options.OnRawCommand.
+func (c *Conn) rejectCommand(dec *imapwire.Decoder, stats *commandStats, tag, name string, err error) error {
 	dec.DiscardLine()
+	stats.endRead(c)
+
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) {
+		imapErr = &imap.Error{
+			Type: imap.StatusResponseTypeBad,
+			Text: err.Error(),
+		}
+	}
+	err = c.writeCommandStatus(tag, name, true, imapErr)
+	c.reportCommand(stats, tag, name, imapErr.Type)
+	return err
+}
+
+// peekLine returns the next line buffered in br, without consuming it. The
+// line is truncated if it doesn't fit in the buffer.
+func peekLine(br *bufio.Reader) string {
+	n := br.Buffered()
+	for {
+		b, err := br.Peek(n)
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return strings.TrimSuffix(string(b[:i]), "\r")
+		} else if err != nil {
+			return string(b)
+		}
+		n = max(n+1, br.Buffered())
+	}
+}
+
+// beginIdleRead marks the connection as waiting for client input which can be
+// interrupted by a graceful shutdown. It returns false if the server is
+// shutting down.
+func (c *Conn) beginIdleRead() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.server.isShuttingDown() {
+		return false
+	}
+	c.idleRead = true
+	return true
+}
+
+func (c *Conn) endIdleRead() {
+	c.mutex.Lock()
+	c.idleRead = false
+	c.mutex.Unlock()
+}
+
+// interruptIdleRead aborts the pending read if the connection is waiting for
+// client input between commands.
+func (c *Conn) interruptIdleRead() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.idleRead {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// authFailed records the result of a LOGIN or AUTHENTICATE command. For
+// failures, it waits for Options.AuthFailureDelay times the number of
+// failures, and returns true if the connection has reached
+// Options.MaxAuthFailures.
+func (c *Conn) authFailed(err error) bool {
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) || imapErr.Type != imap.StatusResponseTypeNo {
+		return false
+	}
+	switch imapErr.Code {
+	case "", imap.ResponseCodeAuthenticationFailed, imap.ResponseCodeAuthorizationFailed:
+		// invalid credentials
+	default:
+		return false // e.g. TLS required or referral
+	}
+
+	c.authFailures++
+	if delay := c.server.options.AuthFailureDelay; delay > 0 {
+		timer := time.NewTimer(delay * time.Duration(c.authFailures))
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	max := c.server.options.MaxAuthFailures
+	return max > 0 && c.authFailures >= max
+}
+
+// byeOverloaded rejects the connection because the server has reached its
+// connection limits.
+func (c *Conn) byeOverloaded() {
+	defer c.cancel()
+	// Writing to an implicit TLS connection performs the handshake, which
+	// also needs to read from the client
+	if dur := c.server.options.Timeouts.ResponseWrite; dur > 0 {
+		c.conn.SetDeadline(time.Now().Add(dur))
+	}
+	c.writeStatusResp("", &imap.StatusResponse{
+		Type: imap.StatusResponseTypeBye,
+		Code: imap.ResponseCodeUnavailable,
+		Text: "Too many connections",
+	})
+	c.conn.Close()
+}
+
+// byeIdleTimeout terminates the connection because the client has been idling
+// for longer than Timeouts.IdleRead.
+func (c *Conn) byeIdleTimeout() {
+	c.writeStatusResp("", &imap.StatusResponse{
+		Type: imap.StatusResponseTypeBye,
+		Text: "Idle timeout",
+	})
+	c.state = imap.ConnStateLogout
+}
+
+// byeShutdown terminates the connection because the server is shutting down.
+func (c *Conn) byeShutdown() {
+	c.waitCommands()
+	c.Bye("Server shutting down")
+}
+
+// isConcurrentCommand returns true if the command doesn't alter the
+// connection state and can be executed concurrently with other commands of
+// the same kind.
+func isConcurrentCommand(name string) bool {
+	switch name {
+	case "CAPABILITY", "ID", "STATUS", "LIST", "LSUB", "NAMESPACE", "FETCH", "UID FETCH", "SEARCH", "UID SEARCH", "SORT", "UID SORT", "THREAD", "UID THREAD":
+		return true
+	default:
+		return false
+	}
+}
+
+// startCommand executes a command in a separate goroutine.
+//
+// The command line must have been fully decoded.
+func (c *Conn) startCommand(tag, name string, exec func() error, stats *commandStats) {
+	c.cmdSem <- struct{}{}
+	c.cmdWaitGroup.Add(1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				c.commandLogger(tag, name).Error("panic handling command", "panic", v, "stack", string(debug.Stack()))
+				c.reportCommand(stats, tag, name, "")
+				c.writePanicResp(tag)
+				c.NetConn().Close()
+			}
+			<-c.cmdSem
+			c.cmdWaitGroup.Done()
+		}()
+
+		err := exec()
+		status := commandStatusType(err)
+		if err := c.writeCommandStatus(tag, name, true, err); err != nil {
+			c.commandLogger(tag, name).Error("failed to write response", "err", err)
+			c.NetConn().Close()
+		}
+		c.reportCommand(stats, tag, name, status)
+	}()
+}
 
+// writePanicResp replies to a command which has panicked, before the
+// connection is closed. If the panic happened while a response was being
+// written, the connection is closed right away instead: writing the tagged
+// response in the middle of another one would confuse the client.
+func (c *Conn) writePanicResp(tag string) {
+	if !c.encMutex.TryLock() {
+		c.conn.Close()
+		return
+	}
+	inProgress := c.respInProgress
+	c.encMutex.Unlock()
+	if inProgress {
+		c.conn.Close()
+		return
+	}
+	c.writeStatusResp(tag, internalServerErrorResp)
+}
+
+// commandLogger returns a logger annotated with command information.
+func (c *Conn) commandLogger(tag, name string) *slog.Logger {
+	return c.logger.With("tag", tag, "command", name)
+}
+
+// waitCommands waits for all commands started with startCommand to complete.
+func (c *Conn) waitCommands() {
+	c.cmdWaitGroup.Wait()
+}
+
+func (c *Conn) writeCommandStatus(tag, name string, sendOK bool, err error) error {
 	var (
 		resp    *imap.StatusResponse
 		imapErr *imap.Error
@@ -284,6 +790,8 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 	)
 	if errors.As(err, &imapErr) {
 		resp = (*imap.StatusResponse)(imapErr)
+	} else if errors.Is(err, imapwire.ErrLineTooLong) {
+		resp = commandLineTooLongResp
 	} else if errors.As(err, &decErr) {
 		resp = &imap.StatusResponse{
 			Type: imap.StatusResponseTypeBad,
@@ -291,7 +799,7 @@ func (c *Conn) readCommand(dec *imapwire.Decoder) error {
 			Text: "Syntax error: " + decErr.Message,
 		}
 	} else if err != nil {
-		c.server.logger().Printf("handling %v command: %v", name, err)
+		c.commandLogger(tag, name).Error("failed to handle command", "err", err)
 		resp = internalServerErrorResp
 	} else {
 		if !sendOK {
@@ -336,7 +844,7 @@ func (c *Conn) handleDelete(dec *imapwire.Decoder) error {
 	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
 		return err
 	}
-	return c.session.Delete(name)
+	return c.session.Delete(c.ctx, name)
 }
 
 func (c *Conn) handleRename(dec *imapwire.Decoder) error {
@@ -347,7 +855,10 @@ func (c *Conn) handleRename(dec *imapwire.Decoder) error {
 	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
 		return err
 	}
-	return c.session.Rename(oldName, newName)
+	if err := c.checkMailboxName(newName); err != nil {
+		return err
+	}
+	return c.session.Rename(c.ctx, oldName, newName)
 }
 
 func (c *Conn) handleSubscribe(dec *imapwire.Decoder) error {
@@ -358,7 +869,7 @@ func (c *Conn) handleSubscribe(dec *imapwire.Decoder) error {
 	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
 		return err
 	}
-	return c.session.Subscribe(name)
+	return c.session.Subscribe(c.ctx, name)
 }
 
 func (c *Conn) handleUnsubscribe(dec *imapwire.Decoder) error {
@@ -369,23 +880,31 @@ func (c *Conn) handleUnsubscribe(dec *imapwire.Decoder) error {
 	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
 		return err
 	}
-	return c.session.Unsubscribe(name)
+	return c.session.Unsubscribe(c.ctx, name)
 }
 
-func (c *Conn) checkBufferedLiteral(size int64, nonSync bool) error {
-	if size > 4096 {
+func (c *Conn) checkBufferedLiteral(cmd string, size int64, nonSync bool) error {
+	if max := c.server.options.maxLiteralSize(cmd); size > max {
 		return &imap.Error{
 			Type: imap.StatusResponseTypeNo,
 			Code: imap.ResponseCodeTooBig,
-			Text: "Literals are limited to 4096 bytes for this command",
+			Text: fmt.Sprintf("Literals are limited to %v bytes for this command", max),
 		}
 	}
 
 	return c.acceptLiteral(size, nonSync)
 }
 
+// acceptLiteral sends a continuation request for synchronizing literals. It
+// is called for each literal of a command, so that commands with several
+// literals (e.g. LOGIN with a literal username and password) get one
+// continuation request per literal.
+//
+// Unless Options.AllowUnlimitedNonSyncLiterals is set, LITERAL- (RFC 7888)
+// caps non-synchronizing literals to 4096 bytes. With LITERAL+, the
+// command-specific limits apply.
 func (c *Conn) acceptLiteral(size int64, nonSync bool) error {
-	if nonSync && size > 4096 && !c.server.options.caps().Has(imap.CapLiteralPlus) {
+	if nonSync && size > maxLiteralMinusSize && !c.server.options.AllowUnlimitedNonSyncLiterals {
 		return &imap.Error{
 			Type: imap.StatusResponseTypeBad,
 			Text: "Non-synchronizing literals are limited to 4096 bytes",
@@ -403,8 +922,7 @@ func (c *Conn) canAuth() bool {
 	if c.state != imap.ConnStateNotAuthenticated {
 		return false
 	}
-	_, isTLS := c.conn.(*tls.Conn)
-	return isTLS || c.server.options.InsecureAuth
+	return connectionState(c.conn) != nil || c.server.options.InsecureAuth
 }
 
 func (c *Conn) writeStatusResp(tag string, statusResp *imap.StatusResponse) error {
@@ -425,6 +943,17 @@ func (c *Conn) writeCapabilityStatus(tag string, typ imap.StatusResponseType, te
 	return writeCapabilityStatus(enc.Encoder, tag, typ, c.availableCaps(), text)
 }
 
+func (c *Conn) writeGreeting(typ imap.StatusResponseType) error {
+	text := c.server.options.Greeting
+	if text == "" {
+		text = "IMAP server ready"
+	}
+	if c.server.options.OmitGreetingCaps {
+		return c.writeStatusResp("", &imap.StatusResponse{Type: typ, Text: text})
+	}
+	return c.writeCapabilityStatus("", typ, text)
+}
+
 func (c *Conn) checkState(state imap.ConnState) error {
 	if state == imap.ConnStateAuthenticated && c.state == imap.ConnStateSelected {
 		return nil
@@ -435,7 +964,22 @@ func (c *Conn) checkState(state imap.ConnState) error {
 	return nil
 }
 
+// checkWritable checks that the selected mailbox wasn't opened with EXAMINE.
+func (c *Conn) checkWritable() error {
+	if c.readOnly {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: "READ-ONLY",
+			Text: "Mailbox is read-only",
+		}
+	}
+	return nil
+}
+
 func (c *Conn) setReadTimeout(dur time.Duration) {
+	if c.hijacked.Load() {
+		return
+	}
 	if dur > 0 {
 		c.conn.SetReadDeadline(time.Now().Add(dur))
 	} else {
@@ -444,6 +988,9 @@ func (c *Conn) setReadTimeout(dur time.Duration) {
 }
 
 func (c *Conn) setWriteTimeout(dur time.Duration) {
+	if c.hijacked.Load() {
+		return
+	}
 	if dur > 0 {
 		c.conn.SetWriteDeadline(time.Now().Add(dur))
 	} else {
@@ -451,6 +998,33 @@ func (c *Conn) setWriteTimeout(dur time.Duration) {
 	}
 }
 
+// writeFailer closes the connection when a write fails, e.g. because the
+// client stopped reading and the write deadline expired. Write errors are
+// sticky in bufio.Writer so the connection is unusable anyway: closing it
+// unblocks the command reader and concurrent commands.
+type writeFailer struct {
+	io.ReadWriter
+	conn *Conn
+}
+
+func (wf *writeFailer) Write(b []byte) (int, error) {
+	n, err := wf.ReadWriter.Write(b)
+	if err != nil {
+		wf.conn.closeOnWriteError(err)
+	}
+	return n, err
+}
+
+func (c *Conn) closeOnWriteError(err error) {
+	c.writeErrOnce.Do(func() {
+		if !errors.Is(err, net.ErrClosed) {
+			c.logger.Warn("closing connection after write failure", "err", err)
+		}
+		c.cancel()
+		c.conn.Close()
+	})
+}
+
 func (c *Conn) poll(cmd string) error {
 	switch c.state {
 	case imap.ConnStateAuthenticated, imap.ConnStateSelected:
@@ -461,32 +1035,49 @@ func (c *Conn) poll(cmd string) error {
 
 	allowExpunge := true
 	switch cmd {
-	case "FETCH", "STORE", "SEARCH":
+	case "FETCH", "STORE", "SEARCH", "SORT", "THREAD":
+		allowExpunge = false
+	}
+	if c.cmdSem != nil && isConcurrentCommand(cmd) {
+		// Other commands may be in progress
 		allowExpunge = false
 	}
 
 	w := &UpdateWriter{conn: c, allowExpunge: allowExpunge}
-	return c.session.Poll(w, allowExpunge)
+	if err := c.session.Poll(c.ctx, w, allowExpunge); err != nil {
+		return err
+	}
+	if w.pendingSearch {
+		return c.updateSearchContexts()
+	}
+	return nil
 }
 
 type responseEncoder struct {
 	*imapwire.Encoder
 	conn *Conn
+	bw   *bufio.Writer
 }
 
 func newResponseEncoder(conn *Conn) *responseEncoder {
 	conn.mutex.Lock()
-	quotedUTF8 := conn.enabled.Has(imap.CapIMAP4rev2)
+	quotedUTF8 := conn.enabled.Has(imap.CapIMAP4rev2) || conn.enabled.Has(imap.CapUTF8Accept)
 	conn.mutex.Unlock()
 
-	wireEnc := imapwire.NewEncoder(conn.bw, imapwire.ConnSideServer)
+	conn.encMutex.Lock() // released by responseEncoder.end
+
+	bw := conn.bw
+	if conn.holds > 0 {
+		bw = conn.held
+	}
+	wireEnc := imapwire.NewEncoder(bw, imapwire.ConnSideServer)
 	wireEnc.QuotedUTF8 = quotedUTF8
 
-	conn.encMutex.Lock() // released by responseEncoder.end
-	conn.setWriteTimeout(respWriteTimeout)
+	conn.setWriteTimeout(conn.server.options.Timeouts.ResponseWrite)
 	return &responseEncoder{
 		Encoder: wireEnc,
 		conn:    conn,
+		bw:      bw,
 	}
 }
 
@@ -495,12 +1086,16 @@ func (enc *responseEncoder) end() {
 		panic("imapserver: responseEncoder.end called twice")
 	}
 	enc.Encoder = nil
+	// Complete responses end with a CRLF, which flushes the buffer
+	if enc.bw.Buffered() > 0 {
+		enc.conn.respInProgress = true
+	}
 	enc.conn.setWriteTimeout(0)
 	enc.conn.encMutex.Unlock()
 }
 
 func (enc *responseEncoder) Literal(size int64) io.WriteCloser {
-	enc.conn.setWriteTimeout(literalWriteTimeout)
+	enc.conn.setWriteTimeout(enc.conn.server.options.Timeouts.LiteralWrite)
 	return literalWriter{
 		WriteCloser: enc.Encoder.Literal(size, nil),
 		conn:        enc.conn,
@@ -513,7 +1108,7 @@ type literalWriter struct {
 }
 
 func (lw literalWriter) Close() error {
-	lw.conn.setWriteTimeout(respWriteTimeout)
+	lw.conn.setWriteTimeout(lw.conn.server.options.Timeouts.ResponseWrite)
 	return lw.WriteCloser.Close()
 }
 
@@ -562,6 +1157,12 @@ func newClientBugError(text string) error {
 type UpdateWriter struct {
 	conn         *Conn
 	allowExpunge bool
+
+	// Search contexts are updated after the session method returns, so that
+	// the session isn't re-entered while it may hold locks. If searchUpdate
+	// is set, a value is sent to it instead.
+	searchUpdate  chan<- struct{}
+	pendingSearch bool
 }
 
 // WriteExpunge writes an EXPUNGE response.
@@ -572,9 +1173,46 @@ func (w *UpdateWriter) WriteExpunge(seqNum uint32) error {
 	return w.conn.writeExpunge(seqNum)
 }
 
+// WriteExpungeUID writes an EXPUNGE response, or a VANISHED response if the
+// client has enabled QRESYNC.
+func (w *UpdateWriter) WriteExpungeUID(seqNum, uid uint32) error {
+	return w.writeExpungeUIDs([]uint32{seqNum}, []uint32{uid})
+}
+
+// writeExpungeUIDs writes EXPUNGE responses for multiple messages, or a single
+// VANISHED response if the client has enabled QRESYNC.
+func (w *UpdateWriter) writeExpungeUIDs(seqNums, uids []uint32) error {
+	if !w.allowExpunge {
+		return fmt.Errorf("imapserver: EXPUNGE updates are not allowed in this context")
+	}
+	return w.conn.writeExpungeUIDs(seqNums, uids)
+}
+
 // WriteNumMessages writes an EXISTS response.
+//
+// If the client has requested SEARCH or SORT result updates (see RFC 5267),
+// Session.Search and SessionSort.Sort are called to find out whether the new
+// messages match. They're called once the Poll callback has returned, but
+// while the Idle callback is still running.
 func (w *UpdateWriter) WriteNumMessages(n uint32) error {
-	return w.conn.writeExists(n)
+	if err := w.conn.writeExists(n); err != nil {
+		return err
+	}
+	if w.searchUpdate == nil {
+		w.pendingSearch = true
+		return nil
+	}
+	select {
+	case w.searchUpdate <- struct{}{}:
+	default:
+		// An update is already pending
+	}
+	return nil
+}
+
+// WriteMailboxStatus writes a STATUS response.
+func (w *UpdateWriter) WriteMailboxStatus(data *imap.StatusData, options *imap.StatusOptions) error {
+	return w.conn.writeStatus(data, options, false)
 }
 
 // WriteMailboxFlags writes a FLAGS response.
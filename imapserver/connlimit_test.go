@@ -0,0 +1,106 @@
+package imapserver_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// dialGreeting opens a connection and returns the first line sent by the
+// server.
+func dialGreeting(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func testConnLimit(t *testing.T, options *imapserver.Options, n int) {
+	_, addr := startTestServer(t, options)
+
+	conns := make([]*testConn, n)
+	for i := range conns {
+		conns[i] = dialTestServer(t, addr)
+	}
+
+	if greeting := dialGreeting(t, addr); !strings.HasPrefix(greeting, "* BYE [UNAVAILABLE] ") {
+		t.Fatalf("expected BYE [UNAVAILABLE], got %q", greeting)
+	}
+
+	// Closing a connection releases its slot
+	conns[0].writeLine("L1 LOGOUT")
+	conns[0].expectOK("L1")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		greeting := dialGreeting(t, addr)
+		if strings.HasPrefix(greeting, "* OK ") {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("connection slot not released, got %q", greeting)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	testConnLimit(t, &imapserver.Options{MaxConns: 3}, 3)
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	testConnLimit(t, &imapserver.Options{MaxConnsPerIP: 2}, 2)
+}
+
+func TestMaxConnsTLSHandshakeTimeout(t *testing.T) {
+	tlsConfig := newTestTLSConfig(t)
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return newTestMemServer().NewSession(), nil, nil
+		},
+		TLSConfig: tlsConfig,
+		MaxConns:  1,
+		Timeouts:  imapserver.Timeouts{ResponseWrite: 100 * time.Millisecond},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	go server.Serve(tls.NewListener(ln, tlsConfig))
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	first, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial() = %v", err)
+	}
+	defer first.Close()
+	if _, err := bufio.NewReader(first).ReadString('\n'); err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+
+	// Never start the TLS handshake: the server must give up and close the
+	// connection instead of waiting forever to send its BYE
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("connection wasn't closed by the server: %v", err)
+	}
+}
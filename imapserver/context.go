@@ -0,0 +1,184 @@
+package imapserver
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// searchContext is a SEARCH or SORT result which is kept up-to-date after a
+// RETURN (UPDATE) option, see RFC 5267 section 4.
+//
+// Only messages added to the result are reported (with ADDTO). Messages which
+// stop matching, e.g. because their flags have changed, are not reported with
+// REMOVEFROM.
+type searchContext struct {
+	numKind      NumKind
+	criteria     imap.SearchCriteria
+	sortCriteria []imap.SortCriterion // nil for SEARCH
+	uids         map[uint32]struct{}  // UIDs of the matching messages
+}
+
+func (c *Conn) addSearchContext(tag string, numKind NumKind, criteria *imap.SearchCriteria, sortCriteria []imap.SortCriterion) error {
+	uids, err := c.searchContextUIDs(criteria)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.searchCtxs == nil {
+		c.searchCtxs = make(map[string]*searchContext)
+	}
+	c.searchCtxs[tag] = &searchContext{
+		numKind:      numKind,
+		criteria:     *criteria,
+		sortCriteria: sortCriteria,
+		uids:         uids,
+	}
+	return nil
+}
+
+func (c *Conn) resetSearchContexts() {
+	c.mutex.Lock()
+	c.searchCtxs = nil
+	c.mutex.Unlock()
+}
+
+func (c *Conn) searchContextUIDs(criteria *imap.SearchCriteria) (map[uint32]struct{}, error) {
+	data, err := c.session.Search(c.ctx, NumKindUID, criteria, &imap.SearchOptions{ReturnAll: true})
+	if err != nil {
+		return nil, err
+	}
+	uids := make(map[uint32]struct{})
+	for _, uid := range data.AllNums() {
+		uids[uid] = struct{}{}
+	}
+	return uids, nil
+}
+
+// updateSearchContexts sends ADDTO responses for new messages matching
+// search contexts.
+func (c *Conn) updateSearchContexts() error {
+	c.mutex.Lock()
+	tags := make([]string, 0, len(c.searchCtxs))
+	for tag := range c.searchCtxs {
+		tags = append(tags, tag)
+	}
+	c.mutex.Unlock()
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		c.mutex.Lock()
+		ctx := c.searchCtxs[tag]
+		c.mutex.Unlock()
+		if ctx == nil {
+			continue // cancelled
+		}
+		if err := c.updateSearchContext(tag, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) updateSearchContext(tag string, ctx *searchContext) error {
+	uids, err := c.searchContextUIDs(&ctx.criteria)
+	if err != nil {
+		return err
+	}
+	var added imap.SeqSet
+	for uid := range uids {
+		if _, ok := ctx.uids[uid]; !ok {
+			added.AddNum(uid)
+		}
+	}
+	c.mutex.Lock()
+	ctx.uids = uids
+	c.mutex.Unlock()
+	if len(added) == 0 {
+		return nil
+	}
+
+	nums, err := c.convertSeqSet(NumKindUID, ctx.numKind, added)
+	if err != nil {
+		return err
+	}
+
+	if ctx.sortCriteria == nil {
+		return c.writeESearchAddTo(tag, ctx.numKind, []searchContextPos{{0, nums}})
+	}
+
+	session, ok := c.session.(SessionSort)
+	if !ok {
+		return nil
+	}
+	sorted, err := session.Sort(c.ctx, ctx.numKind, &ctx.criteria, ctx.sortCriteria)
+	if err != nil {
+		return err
+	}
+	var positions []searchContextPos
+	for i, num := range sorted {
+		if nums.Contains(num) {
+			var set imap.SeqSet
+			set.AddNum(num)
+			positions = append(positions, searchContextPos{uint32(i + 1), set})
+		}
+	}
+	return c.writeESearchAddTo(tag, ctx.numKind, positions)
+}
+
+// searchContextPos is a set of messages inserted at a position in a search
+// result. The position is always zero for unsorted results.
+type searchContextPos struct {
+	pos  uint32
+	nums imap.SeqSet
+}
+
+func (c *Conn) writeESearchAddTo(tag string, numKind NumKind, positions []searchContextPos) error {
+	if len(positions) == 0 {
+		return nil
+	}
+
+	enc := newResponseEncoder(c)
+	defer enc.end()
+
+	enc.Atom("*").SP().Atom("ESEARCH")
+	enc.SP().Special('(').Atom("TAG").SP().Quoted(tag).Special(')')
+	if numKind == NumKindUID {
+		enc.SP().Atom("UID")
+	}
+	enc.SP().Atom("ADDTO").SP().List(len(positions), func(i int) {
+		enc.Number(positions[i].pos).SP().SeqSet(positions[i].nums)
+	})
+	return enc.CRLF()
+}
+
+func (c *Conn) handleCancelUpdate(dec *imapwire.Decoder) error {
+	var tags []string
+	for dec.SP() {
+		var tag string
+		if !dec.ExpectString(&tag) {
+			return dec.Err()
+		}
+		tags = append(tags, tag)
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+	if len(tags) == 0 {
+		return newClientBugError("Expected at least one tag")
+	}
+
+	if err := c.checkState(imap.ConnStateSelected); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	for _, tag := range tags {
+		delete(c.searchCtxs, tag)
+	}
+	c.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,181 @@
+package imapserver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+type blockingFetchSession struct {
+	imapserver.Session
+	fetching  chan<- struct{}
+	cancelled chan<- error
+}
+
+func (sess *blockingFetchSession) Fetch(ctx context.Context, w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	sess.fetching <- struct{}{}
+	<-ctx.Done()
+	sess.cancelled <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestSessionContextCancelledOnDisconnect(t *testing.T) {
+	fetching := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &blockingFetchSession{
+				Session:   memServer.NewSession(),
+				fetching:  fetching,
+				cancelled: cancelled,
+			}, nil, nil
+		},
+		MaxConcurrentCommands: 2,
+	})
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1 (FLAGS)")
+	<-fetching
+	tc.conn.Close()
+
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("ctx.Err() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context wasn't cancelled after the client disconnected")
+	}
+}
+
+type legacyIDSession struct {
+	imapserver.LegacySession
+}
+
+func (sess *legacyIDSession) ID(clientParams map[string]*string) (map[string]*string, error) {
+	name := "legacy"
+	return map[string]*string{"name": &name}, nil
+}
+
+// legacyMemSession strips contexts from an imapmemserver session.
+type legacyMemSession struct {
+	sess imapserver.Session
+}
+
+func (s *legacyMemSession) Close() error { return s.sess.Close() }
+func (s *legacyMemSession) Login(username, password string) error {
+	return s.sess.Login(context.Background(), username, password)
+}
+func (s *legacyMemSession) Select(mailbox string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	return s.sess.Select(context.Background(), mailbox, options)
+}
+func (s *legacyMemSession) Create(mailbox string, options *imap.CreateOptions) error {
+	return s.sess.Create(context.Background(), mailbox, options)
+}
+func (s *legacyMemSession) Delete(mailbox string) error {
+	return s.sess.Delete(context.Background(), mailbox)
+}
+func (s *legacyMemSession) Rename(mailbox, newName string) error {
+	return s.sess.Rename(context.Background(), mailbox, newName)
+}
+func (s *legacyMemSession) Subscribe(mailbox string) error {
+	return s.sess.Subscribe(context.Background(), mailbox)
+}
+func (s *legacyMemSession) Unsubscribe(mailbox string) error {
+	return s.sess.Unsubscribe(context.Background(), mailbox)
+}
+func (s *legacyMemSession) List(w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	return s.sess.List(context.Background(), w, ref, patterns, options)
+}
+func (s *legacyMemSession) Status(mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	return s.sess.Status(context.Background(), mailbox, options)
+}
+func (s *legacyMemSession) Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	return s.sess.Append(context.Background(), mailbox, r, options)
+}
+func (s *legacyMemSession) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	return s.sess.Poll(context.Background(), w, allowExpunge)
+}
+func (s *legacyMemSession) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	return s.sess.Idle(context.Background(), w, stop)
+}
+func (s *legacyMemSession) Unselect() error {
+	return s.sess.Unselect(context.Background())
+}
+func (s *legacyMemSession) Expunge(w *imapserver.ExpungeWriter, uids *imap.SeqSet) error {
+	return s.sess.Expunge(context.Background(), w, uids)
+}
+func (s *legacyMemSession) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	return s.sess.Search(context.Background(), kind, criteria, options)
+}
+func (s *legacyMemSession) Fetch(w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	return s.sess.Fetch(context.Background(), w, kind, seqSet, options)
+}
+func (s *legacyMemSession) Store(w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+	return s.sess.Store(context.Background(), w, kind, seqSet, flags, options)
+}
+func (s *legacyMemSession) Copy(kind imapserver.NumKind, seqSet imap.SeqSet, dest string) (*imap.CopyData, error) {
+	return s.sess.Copy(context.Background(), kind, seqSet, dest)
+}
+
+func TestAdaptLegacySession(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			legacy := &legacyIDSession{&legacyMemSession{memServer.NewSession()}}
+			return imapserver.AdaptLegacySession(legacy), nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapID:        {},
+		},
+	})
+
+	tc.writeLine("I1 ID NIL")
+	untagged := tc.expectOK("I1")
+	if len(untagged) != 1 || untagged[0] != `* ID ("name" "legacy")` {
+		t.Errorf("unexpected ID response: %q", untagged)
+	}
+
+	tc.writeString("A1 AUTHENTICATE PLAIN " + "AHRlc3QtdXNlcgB0ZXN0LXBhc3N3b3Jk" + "\r\n")
+	tc.expectOK("A1")
+
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+	tc.writeLine("F1 FETCH 1 (FLAGS)")
+	if untagged := tc.expectOK("F1"); len(untagged) != 1 {
+		t.Errorf("unexpected FETCH response: %q", untagged)
+	}
+}
+
+func TestAdaptLegacySessionInterfaces(t *testing.T) {
+	memServer := newTestMemServer()
+
+	sess := imapserver.AdaptLegacySession(&legacyMemSession{memServer.NewSession()})
+	if _, ok := sess.(imapserver.SessionID); ok {
+		t.Errorf("adapted session implements SessionID")
+	}
+	if _, ok := sess.(imapserver.SessionSASL); ok {
+		t.Errorf("adapted session implements SessionSASL")
+	}
+	if _, ok := sess.(imapserver.SessionNamespace); ok {
+		t.Errorf("adapted session implements SessionNamespace")
+	}
+	if _, ok := sess.(imapserver.SessionMove); ok {
+		t.Errorf("adapted session implements SessionMove")
+	}
+
+	sess = imapserver.AdaptLegacySession(&legacyIDSession{&legacyMemSession{memServer.NewSession()}})
+	if _, ok := sess.(imapserver.SessionID); !ok {
+		t.Errorf("adapted session doesn't implement SessionID")
+	}
+	if _, ok := sess.(imapserver.SessionSASL); ok {
+		t.Errorf("adapted session implements SessionSASL")
+	}
+}
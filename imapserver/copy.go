@@ -13,7 +13,17 @@ func (c *Conn) handleCopy(tag string, dec *imapwire.Decoder, numKind NumKind) er
 	if err := c.checkState(imap.ConnStateSelected); err != nil {
 		return err
 	}
-	data, err := c.session.Copy(numKind, seqSet, dest)
+
+	seqSet, err = c.resolveSeqSet(numKind, seqSet)
+	if err != nil {
+		return err
+	}
+	unlock, err := c.lockMailboxes(c.mailbox, dest)
+	if err != nil {
+		return err
+	}
+	data, err := c.session.Copy(c.ctx, numKind, seqSet, dest)
+	unlock()
 	if err != nil {
 		return err
 	}
@@ -38,7 +48,8 @@ func (c *Conn) writeCopyOK(tag string, data *imap.CopyData) error {
 	}
 
 	enc.Atom(tag).SP().Atom("OK").SP()
-	if data != nil {
+	// COPYUID cannot be sent if no message has been copied
+	if data != nil && len(data.DestUIDs) > 0 && c.server.options.caps().Has(imap.CapUIDPlus) {
 		enc.Special('[')
 		enc.Atom("COPYUID").SP().Number(data.UIDValidity).SP().SeqSet(data.SourceUIDs).SP().SeqSet(data.DestUIDs)
 		enc.Special(']').SP()
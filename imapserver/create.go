@@ -1,6 +1,7 @@
 package imapserver
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/emersion/go-imap/v2"
@@ -8,7 +9,7 @@ import (
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-func (c *Conn) handleCreate(dec *imapwire.Decoder) error {
+func (c *Conn) handleCreate(tag string, dec *imapwire.Decoder) error {
 	var (
 		name    string
 		options imap.CreateOptions
@@ -41,5 +42,82 @@ func (c *Conn) handleCreate(dec *imapwire.Decoder) error {
 	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
 		return err
 	}
-	return c.session.Create(name, &options)
+	if err := c.checkMailboxName(name); err != nil {
+		return err
+	}
+	if err := c.session.Create(c.ctx, name, &options); err != nil {
+		return err
+	}
+
+	var code imap.ResponseCode
+	if c.server.options.caps().Has(imap.CapObjectID) {
+		// The new mailbox ID is returned in the tagged response, see RFC 8474
+		// section 4.1
+		// The mailbox has been created at this point, so a failure to
+		// retrieve its ID must not turn into a NO response
+		data, err := c.session.Status(c.ctx, name, &imap.StatusOptions{MailboxID: true})
+		if err != nil {
+			c.logger.Error("failed to get mailbox ID after CREATE", "mailbox", name, "err", err)
+		} else if data.MailboxID != "" {
+			code = imap.ResponseCode(fmt.Sprintf("%v (%v)", imap.ResponseCodeMailboxID, data.MailboxID))
+		}
+	}
+	return c.writeStatusResp(tag, &imap.StatusResponse{
+		Type: imap.StatusResponseTypeOK,
+		Code: code,
+		Text: "CREATE completed",
+	})
+}
+
+// hierarchyDelim returns the mailbox hierarchy delimiter of the session. ok is
+// false if it's unknown.
+func (c *Conn) hierarchyDelim() (delim rune, ok bool, err error) {
+	switch session := c.session.(type) {
+	case SessionHierarchyDelim:
+		return session.HierarchyDelim(), true, nil
+	case SessionNamespace:
+		if !c.server.options.caps().Has(imap.CapNamespace) {
+			return 0, false, nil
+		}
+		data, err := session.Namespace(c.ctx)
+		if err != nil || len(data.Personal) == 0 {
+			return 0, false, err
+		}
+		return data.Personal[0].Delim, true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// checkMailboxName checks that a mailbox name is suitable for CREATE or
+// RENAME: it must not contain control characters nor empty hierarchy levels.
+// A trailing delimiter is allowed.
+func (c *Conn) checkMailboxName(name string) error {
+	for _, ch := range name {
+		if ch < 0x20 || ch == 0x7F {
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeCannot,
+				Text: "Mailbox name contains control characters",
+			}
+		}
+	}
+
+	delim, ok, err := c.hierarchyDelim()
+	if err != nil {
+		return err
+	} else if !ok || delim == 0 {
+		return nil
+	}
+	delimStr := string(delim)
+	for _, level := range strings.Split(strings.TrimSuffix(name, delimStr), delimStr) {
+		if level == "" {
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeCannot,
+				Text: fmt.Sprintf("Mailbox name contains an empty hierarchy level (the delimiter is %q)", delimStr),
+			}
+		}
+	}
+	return nil
 }
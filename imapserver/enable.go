@@ -1,6 +1,8 @@
 package imapserver
 
 import (
+	"strings"
+
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
@@ -22,18 +24,32 @@ func (c *Conn) handleEnable(dec *imapwire.Decoder) error {
 		return err
 	}
 
+	// Unknown or unavailable capabilities are silently ignored (see RFC 5161
+	// section 3.1)
+	available := make(imap.CapSet)
+	for _, cap := range c.availableCaps() {
+		available[cap] = struct{}{}
+	}
 	var enabled []imap.Cap
 	for _, req := range requested {
-		switch req {
-		case imap.CapIMAP4rev2:
-			enabled = append(enabled, req)
+		req = imap.Cap(strings.ToUpper(string(req)))
+		if !canEnable(req) || !available.Has(req) || containsCap(enabled, req) {
+			continue
+		}
+		if req == imap.CapQResync && !c.canQResync() {
+			continue
 		}
+		enabled = append(enabled, req)
 	}
 
 	c.mutex.Lock()
 	for _, e := range enabled {
 		c.enabled[e] = struct{}{}
 	}
+	if c.enabled.Has(imap.CapQResync) {
+		// QRESYNC implies CONDSTORE (see RFC 7162 section 3.2.3)
+		c.enabled[imap.CapCondStore] = struct{}{}
+	}
 	c.mutex.Unlock()
 
 	enc := newResponseEncoder(c)
@@ -44,3 +60,49 @@ func (c *Conn) handleEnable(dec *imapwire.Decoder) error {
 	}
 	return enc.CRLF()
 }
+
+// canEnable returns true if the capability is an extension which can be
+// enabled with the ENABLE command.
+func canEnable(c imap.Cap) bool {
+	switch c {
+	case imap.CapIMAP4rev2, imap.CapCondStore, imap.CapQResync, imap.CapUTF8Accept:
+		return true
+	default:
+		return false
+	}
+}
+
+func containsCap(l []imap.Cap, c imap.Cap) bool {
+	for _, cap := range l {
+		if cap == c {
+			return true
+		}
+	}
+	return false
+}
+
+// enableCondStore enables CONDSTORE for the rest of the connection.
+//
+// A number of commands implicitly enable CONDSTORE (see RFC 7162 section
+// 3.1). An error is returned if the server doesn't support CONDSTORE.
+//
+// This must be called while parsing a command, before it's executed.
+func (c *Conn) enableCondStore() error {
+	if !c.server.options.caps().Has(imap.CapCondStore) {
+		return newClientBugError("CONDSTORE is not supported")
+	}
+	if c.enabled.Has(imap.CapCondStore) {
+		return nil
+	}
+	// Commands running concurrently may read the set of enabled extensions
+	c.waitCommands()
+	c.mutex.Lock()
+	c.enabled[imap.CapCondStore] = struct{}{}
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *Conn) canQResync() bool {
+	_, ok := c.session.(SessionQResync)
+	return ok && c.server.options.caps().Has(imap.CapQResync)
+}
@@ -0,0 +1,34 @@
+package imapserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestEnable(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapCondStore: {},
+		},
+	})
+	tc.login()
+
+	tc.writeLine("E1 ENABLE condstore X-BOGUS QRESYNC CONDSTORE")
+	untagged := tc.expectOK("E1")
+	if len(untagged) != 1 || untagged[0] != "* ENABLED CONDSTORE" {
+		t.Errorf("expected only CONDSTORE to be enabled, got %q", untagged)
+	}
+}
+
+func TestEnableNotAuthenticated(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	tc.writeLine("E1 ENABLE CONDSTORE")
+	if resp, _ := tc.readTagged("E1"); !strings.HasPrefix(resp, "E1 BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+}
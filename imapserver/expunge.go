@@ -23,9 +23,29 @@ func (c *Conn) handleUIDExpunge(dec *imapwire.Decoder) error {
 func (c *Conn) expunge(uids *imap.SeqSet) error {
 	if err := c.checkState(imap.ConnStateSelected); err != nil {
 		return err
+	} else if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if uids != nil {
+		resolved, err := c.resolveSeqSet(NumKindUID, *uids)
+		if err != nil {
+			return err
+		}
+		uids = &resolved
+	}
+
+	unlock, err := c.lockMailboxes(c.mailbox)
+	if err != nil {
+		return err
 	}
+	defer unlock()
+
 	w := &ExpungeWriter{conn: c}
-	return c.session.Expunge(w, uids)
+	err = c.session.Expunge(c.ctx, w, uids)
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	return err
 }
 
 func (c *Conn) writeExpunge(seqNum uint32) error {
@@ -35,16 +55,81 @@ func (c *Conn) writeExpunge(seqNum uint32) error {
 	return enc.CRLF()
 }
 
+func (c *Conn) qresyncEnabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.enabled.Has(imap.CapQResync)
+}
+
+// writeExpungeUIDs writes an EXPUNGE response for each message, or a single
+// VANISHED response if the client has enabled QRESYNC.
+func (c *Conn) writeExpungeUIDs(seqNums, uids []uint32) error {
+	if !c.qresyncEnabled() {
+		for _, seqNum := range seqNums {
+			if err := c.writeExpunge(seqNum); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var uidSet imap.SeqSet
+	uidSet.AddNum(uids...)
+	return c.writeVanished(uidSet, false)
+}
+
+func (c *Conn) writeVanished(uids imap.SeqSet, earlier bool) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("VANISHED").SP()
+	if earlier {
+		enc.Atom("(EARLIER)").SP()
+	}
+	enc.Atom(uids.String())
+	return enc.CRLF()
+}
+
 // ExpungeWriter writes EXPUNGE updates.
 type ExpungeWriter struct {
-	conn *Conn
+	conn     *Conn
+	vanished imap.SeqSet // pending VANISHED UIDs
 }
 
 // WriteExpunge notifies the client that the message with the provided sequence
 // number has been deleted.
+//
+// Each EXPUNGE response decrements the sequence numbers of the following
+// messages. When multiple messages are deleted, the sequence numbers must
+// account for the previous responses, e.g. by writing them in descending
+// order.
 func (w *ExpungeWriter) WriteExpunge(seqNum uint32) error {
 	if w.conn == nil {
 		return nil
 	}
 	return w.conn.writeExpunge(seqNum)
 }
+
+// WriteExpungeUID notifies the client that the message with the provided
+// sequence number and UID has been deleted.
+//
+// If the client has enabled QRESYNC, a single VANISHED response covering all
+// expunged messages is written once the command completes instead of EXPUNGE.
+func (w *ExpungeWriter) WriteExpungeUID(seqNum, uid uint32) error {
+	if w.conn == nil {
+		return nil
+	}
+	if w.conn.qresyncEnabled() {
+		w.vanished.AddNum(uid)
+		return nil
+	}
+	return w.conn.writeExpunge(seqNum)
+}
+
+func (w *ExpungeWriter) flush() error {
+	if len(w.vanished) == 0 {
+		return nil
+	}
+	uids := w.vanished
+	w.vanished = nil
+	return w.conn.writeVanished(uids, false)
+}
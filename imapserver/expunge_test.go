@@ -0,0 +1,55 @@
+package imapserver_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpungeSeqNums(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	for i := 0; i < 5; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+	tc.selectMailbox("INBOX")
+
+	other := tc.newConn()
+	other.login()
+	other.selectMailbox("INBOX")
+
+	tc.writeLine(`A1 STORE 2,4 +FLAGS.SILENT (\Deleted)`)
+	tc.expectOK("A1")
+
+	// Each EXPUNGE response shifts the sequence numbers of the following
+	// messages, so messages are expunged from the highest sequence number
+	tc.writeLine("A2 EXPUNGE")
+	want := []string{"* 4 EXPUNGE", "* 2 EXPUNGE"}
+	if got := tc.expectOK("A2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("EXPUNGE: got %q, want %q", got, want)
+	}
+
+	other.writeLine("A3 NOOP")
+	var got []string
+	for _, line := range other.expectOK("A3") {
+		// Ignore flag updates
+		if strings.HasSuffix(line, " EXPUNGE") {
+			got = append(got, line)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NOOP in other session: got %q, want %q", got, want)
+	}
+
+	want = []string{
+		"* 1 FETCH (UID 1)",
+		"* 2 FETCH (UID 3)",
+		"* 3 FETCH (UID 5)",
+	}
+	for _, c := range []*testConn{tc, other} {
+		c.writeLine("A4 FETCH 1:* (UID)")
+		if got := c.expectOK("A4"); !reflect.DeepEqual(got, want) {
+			t.Errorf("FETCH after EXPUNGE: got %q, want %q", got, want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package imapserver
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"mime"
@@ -23,10 +24,10 @@ type fetchWriterOptions struct {
 	obsolete map[*imap.FetchItemBodySection]string
 }
 
-func (c *Conn) handleFetch(dec *imapwire.Decoder, numKind NumKind) error {
+func (c *Conn) handleFetch(dec *imapwire.Decoder, numKind NumKind) (exec func() error, err error) {
 	var seqSet imap.SeqSet
 	if !dec.ExpectSP() || !dec.ExpectSeqSet(&seqSet) || !dec.ExpectSP() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 
 	var options imap.FetchOptions
@@ -43,15 +44,16 @@ func (c *Conn) handleFetch(dec *imapwire.Decoder, numKind NumKind) error {
 		return handleFetchAtt(dec, name, &options, &writerOptions)
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !isList {
 		name, err := readFetchAttName(dec)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		// Handle macros
+		// Handle macros, which expand to a fixed list of items (RFC 3501
+		// section 6.4.5)
 		switch name {
 		case "ALL":
 			options.Flags = true
@@ -70,28 +72,69 @@ func (c *Conn) handleFetch(dec *imapwire.Decoder, numKind NumKind) error {
 			handleFetchBodyStructure(&options, &writerOptions, false)
 		default:
 			if err := handleFetchAtt(dec, name, &options, &writerOptions); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
-	if !dec.ExpectCRLF() {
-		return dec.Err()
+	if dec.SP() {
+		if err := readFetchModifiers(dec, &options); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := c.checkState(imap.ConnStateSelected); err != nil {
-		return err
+	if !dec.ExpectCRLF() {
+		return nil, dec.Err()
 	}
 
 	if numKind == NumKindUID {
 		options.UID = true
 	}
+	if options.HasChangedSince {
+		options.ModSeq = true
+	}
+	if options.ModSeq {
+		if err := c.enableCondStore(); err != nil {
+			return nil, err
+		}
+	}
 
-	w := &FetchWriter{conn: c, options: writerOptions}
-	if err := c.session.Fetch(w, numKind, seqSet, &options); err != nil {
-		return err
+	exec = func() error {
+		if err := c.checkState(imap.ConnStateSelected); err != nil {
+			return err
+		}
+
+		seqSet, err := c.resolveSeqSet(numKind, seqSet)
+		if err != nil {
+			return err
+		}
+
+		w := &FetchWriter{conn: c, options: writerOptions}
+		return c.session.Fetch(c.ctx, w, numKind, seqSet, &options)
 	}
-	return nil
+
+	if fetchSetsSeen(&options) {
+		// Setting the \Seen flag may affect the result of other commands
+		c.waitCommands()
+		return nil, exec()
+	}
+	return exec, nil
+}
+
+// fetchSetsSeen returns true if a FETCH command implicitly sets the \Seen
+// flag.
+func fetchSetsSeen(options *imap.FetchOptions) bool {
+	for _, bs := range options.BodySection {
+		if !bs.Peek {
+			return true
+		}
+	}
+	for _, bs := range options.BinarySection {
+		if !bs.Peek {
+			return true
+		}
+	}
+	return false
 }
 
 func handleFetchAtt(dec *imapwire.Decoder, attName string, options *imap.FetchOptions, writerOptions *fetchWriterOptions) error {
@@ -108,6 +151,14 @@ func handleFetchAtt(dec *imapwire.Decoder, attName string, options *imap.FetchOp
 		options.RFC822Size = true
 	case "UID":
 		options.UID = true
+	case "MODSEQ":
+		options.ModSeq = true
+	case "EMAILID":
+		options.EmailID = true
+	case "THREADID":
+		options.ThreadID = true
+	case "SAVEDATE":
+		options.SaveDate = true
 	case "RFC822": // equivalent to BODY[]
 		bs := &imap.FetchItemBodySection{}
 		writerOptions.obsolete[bs] = attName
@@ -182,6 +233,25 @@ func handleFetchAtt(dec *imapwire.Decoder, attName string, options *imap.FetchOp
 	return nil
 }
 
+func readFetchModifiers(dec *imapwire.Decoder, options *imap.FetchOptions) error {
+	return dec.ExpectList(func() error {
+		var name string
+		if !dec.ExpectAtom(&name) || !dec.ExpectSP() {
+			return dec.Err()
+		}
+		switch strings.ToUpper(name) {
+		case "CHANGEDSINCE":
+			if !dec.ExpectModSeq(&options.ChangedSince) {
+				return dec.Err()
+			}
+			options.HasChangedSince = true
+		default:
+			return newClientBugError("Unknown FETCH modifier")
+		}
+		return nil
+	})
+}
+
 func handleFetchBodyStructure(options *imap.FetchOptions, writerOptions *fetchWriterOptions, extended bool) {
 	if options.BodyStructure == nil || extended {
 		options.BodyStructure = &imap.FetchItemBodyStructure{Extended: extended}
@@ -330,11 +400,12 @@ type FetchWriter struct {
 func (cmd *FetchWriter) CreateMessage(seqNum uint32) *FetchResponseWriter {
 	enc := newResponseEncoder(cmd.conn)
 	enc.Atom("*").SP().Number(seqNum).SP().Atom("FETCH").SP().Special('(')
-	return &FetchResponseWriter{enc: enc, options: cmd.options}
+	return &FetchResponseWriter{conn: cmd.conn, enc: enc, options: cmd.options}
 }
 
 // FetchResponseWriter writes a single FETCH response for a message.
 type FetchResponseWriter struct {
+	conn    *Conn
 	enc     *responseEncoder
 	options fetchWriterOptions
 
@@ -362,6 +433,36 @@ func (w *FetchResponseWriter) WriteFlags(flags []imap.Flag) {
 	})
 }
 
+// WriteModSeq writes the message's modification sequence.
+//
+// This requires CONDSTORE.
+func (w *FetchResponseWriter) WriteModSeq(modSeq uint64) {
+	w.writeItemSep()
+	w.enc.Atom("MODSEQ").SP().Special('(').ModSeq(modSeq).Special(')')
+}
+
+// WriteEmailID writes the message's unique ID.
+//
+// This requires OBJECTID.
+func (w *FetchResponseWriter) WriteEmailID(id string) {
+	w.writeItemSep()
+	w.enc.Atom("EMAILID").SP().Special('(').Atom(id).Special(')')
+}
+
+// WriteThreadID writes the ID of the message's thread. If the server doesn't
+// support threads, the ID is empty.
+//
+// This requires OBJECTID.
+func (w *FetchResponseWriter) WriteThreadID(id string) {
+	w.writeItemSep()
+	w.enc.Atom("THREADID").SP()
+	if id == "" {
+		w.enc.NIL()
+	} else {
+		w.enc.Special('(').Atom(id).Special(')')
+	}
+}
+
 // WriteRFC822Size writes the message's full size.
 func (w *FetchResponseWriter) WriteRFC822Size(size int64) {
 	w.writeItemSep()
@@ -374,6 +475,20 @@ func (w *FetchResponseWriter) WriteInternalDate(t time.Time) {
 	w.enc.Atom("INTERNALDATE").SP().String(t.Format(internal.DateTimeLayout))
 }
 
+// WriteSaveDate writes the date when the message was saved in the mailbox.
+// A zero time indicates that the mailbox doesn't support save dates.
+//
+// This requires SAVEDATE.
+func (w *FetchResponseWriter) WriteSaveDate(t time.Time) {
+	w.writeItemSep()
+	w.enc.Atom("SAVEDATE").SP()
+	if t.IsZero() {
+		w.enc.NIL()
+	} else {
+		w.enc.String(t.Format(internal.DateTimeLayout))
+	}
+}
+
 // WriteBodySection writes a body section.
 //
 // The returned io.WriteCloser must be closed before writing any more message
@@ -389,9 +504,39 @@ func (w *FetchResponseWriter) WriteBodySection(section *imap.FetchItemBodySectio
 	}
 
 	enc.SP()
+	if transformer, ok := w.conn.session.(SessionFetchBodyTransformer); ok {
+		return &bodyTransformWriter{w: w, section: section, transformer: transformer}
+	}
 	return w.enc.Literal(size)
 }
 
+// bodyTransformWriter buffers a body section, and writes it once transformed
+// by the session.
+type bodyTransformWriter struct {
+	bytes.Buffer
+	w           *FetchResponseWriter
+	section     *imap.FetchItemBodySection
+	transformer SessionFetchBodyTransformer
+}
+
+func (tw *bodyTransformWriter) Close() error {
+	conn := tw.w.conn
+	body, err := tw.transformer.TransformBodySection(conn.ctx, tw.section, tw.Bytes(), conn.enabled.Has(imap.CapUTF8Accept))
+	if err != nil {
+		// The FETCH response has already been started, fall back to the
+		// original contents
+		conn.logger.Warn("failed to transform body section", "err", err)
+		body = tw.Bytes()
+	}
+
+	lw := tw.w.enc.Literal(int64(len(body)))
+	if _, err := lw.Write(body); err != nil {
+		lw.Close()
+		return err
+	}
+	return lw.Close()
+}
+
 func writeItemBodySection(enc *imapwire.Encoder, section *imap.FetchItemBodySection) {
 	enc.Atom("BODY")
 	enc.Special('[')
@@ -419,7 +564,7 @@ func writeItemBodySection(enc *imapwire.Encoder, section *imap.FetchItemBodySect
 	}
 	enc.Special(']')
 	if partial := section.Partial; partial != nil {
-		enc.Special('<').Number(uint32(partial.Offset)).Special('>')
+		enc.Special('<').Number64(partial.Offset).Special('>')
 	}
 }
 
@@ -433,13 +578,17 @@ func (w *FetchResponseWriter) WriteBinarySection(section *imap.FetchItemBinarySe
 
 	enc.Atom("BINARY").Special('[')
 	writeSectionPart(enc, section.Part)
-	enc.Special(']').SP()
+	enc.Special(']')
+	if partial := section.Partial; partial != nil {
+		enc.Special('<').Number64(partial.Offset).Special('>')
+	}
+	enc.SP()
 	enc.Special('~') // indicates literal8
 	return w.enc.Literal(size)
 }
 
 // WriteBinarySectionSize writes a binary section size.
-func (w *FetchResponseWriter) WriteBinarySectionSize(section *imap.FetchItemBinarySection, size uint32) {
+func (w *FetchResponseWriter) WriteBinarySectionSize(section *imap.FetchItemBinarySectionSize, size uint32) {
 	w.writeItemSep()
 	enc := w.enc.Encoder
 
@@ -623,9 +772,12 @@ func writeBodyType1part(enc *imapwire.Encoder, bs *imap.BodyStructureSinglePart,
 		return
 	}
 	ext := bs.Extended
+	if ext == nil {
+		ext = new(imap.BodyStructureSinglePartExt)
+	}
 
 	enc.SP()
-	enc.NIL() // MD5
+	writeNString(enc, ext.MD5)
 	enc.SP()
 	writeBodyFldDsp(enc, ext.Disposition)
 	enc.SP()
@@ -651,6 +803,9 @@ func writeBodyTypeMpart(enc *imapwire.Encoder, bs *imap.BodyStructureMultiPart,
 		return
 	}
 	ext := bs.Extended
+	if ext == nil {
+		ext = new(imap.BodyStructureMultiPartExt)
+	}
 
 	enc.SP()
 	writeBodyFldParam(enc, ext.Params)
@@ -663,7 +818,8 @@ func writeBodyTypeMpart(enc *imapwire.Encoder, bs *imap.BodyStructureMultiPart,
 }
 
 func writeBodyFldParam(enc *imapwire.Encoder, params map[string]string) {
-	if params == nil {
+	// An empty list isn't allowed by the grammar
+	if len(params) == 0 {
 		enc.NIL()
 		return
 	}
@@ -0,0 +1,252 @@
+package imapserver_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var fetchPartialTests = []struct {
+	name    string
+	command string
+	resp    string
+}{
+	{
+		name:    "section",
+		command: "FETCH 1 (BODY.PEEK[1]<0.10>)",
+		resp:    "* 1 FETCH (UID 1 BODY[1]<0> {10}\r\nWho are yo)",
+	},
+	{
+		name:    "offset",
+		command: "FETCH 1 (BODY.PEEK[TEXT]<4.3>)",
+		resp:    "* 1 FETCH (UID 1 BODY[TEXT]<4> {3}\r\nare)",
+	},
+	{
+		name:    "clamped",
+		command: "FETCH 1 (BODY.PEEK[1]<8.1024>)",
+		resp:    "* 1 FETCH (UID 1 BODY[1]<8> {6}\r\nyou?\r\n)",
+	},
+	{
+		name:    "past-eof",
+		command: "FETCH 1 (BODY.PEEK[1]<1000.10>)",
+		resp:    "* 1 FETCH (UID 1 BODY[1]<1000> {0}\r\n)",
+	},
+}
+
+func TestFetchPartial(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	for _, test := range fetchPartialTests {
+		tc.writeLine("F1 %v", test.command)
+		got := strings.Join(tc.expectOK("F1"), "\r\n")
+		if got != test.resp {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.resp)
+		}
+	}
+}
+
+// latin1Session transcodes ISO-8859-1 text to UTF-8 for clients which have
+// enabled UTF8=ACCEPT.
+type latin1Session struct {
+	imapserver.Session
+}
+
+func (sess *latin1Session) TransformBodySection(ctx context.Context, section *imap.FetchItemBodySection, body []byte, utf8Accept bool) ([]byte, error) {
+	if !utf8Accept || section.Specifier != imap.PartSpecifierText {
+		return body, nil
+	}
+	return charmap.ISO8859_1.NewDecoder().Bytes(body)
+}
+
+func TestFetchBodyTransform(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &latin1Session{memServer.NewSession()}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:  {},
+			imap.CapUTF8Accept: {},
+		},
+	})
+	tc.login()
+	tc.appendMessage("INBOX", "Content-Type: text/plain; charset=iso-8859-1\r\n\r\nCaf\xe9\r\n")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1 (BODY.PEEK[TEXT])")
+	want := "* 1 FETCH (UID 1 BODY[TEXT] {6}\r\nCaf\xe9\r\n)"
+	if got := strings.Join(tc.expectOK("F1"), "\r\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine("E1 ENABLE UTF8=ACCEPT")
+	tc.expectOK("E1")
+
+	tc.writeLine("F2 FETCH 1 (BODY.PEEK[TEXT])")
+	want = "* 1 FETCH (UID 1 BODY[TEXT] {7}\r\nCafé\r\n)"
+	if got := strings.Join(tc.expectOK("F2"), "\r\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+const envelopeTestMessage = "From: Mitsuha <mitsuha@example.org>\r\n" +
+	"To: Friends: tessie@example.org, \"Sayaka N.\" <sayaka@example.org>;, taki@example.org\r\n" +
+	"Cc: undisclosed-recipients:;\r\n" +
+	"Subject: =?ISO-8859-1?Q?Caf=E9?= tomorrow\r\n" +
+	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+	"Message-Id: <0000000@localhost/>\r\n" +
+	"\r\n" +
+	"Hi!\r\n"
+
+func TestFetchEnvelope(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", envelopeTestMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1 (ENVELOPE)")
+	got := tc.expectOK("F1")
+	want := `* 1 FETCH (UID 1 ENVELOPE ("Wed, 11 May 2016 14:31:59 +0000" "=?utf-8?q?Caf=C3=A9_tomorrow?=" ` +
+		`(("Mitsuha" NIL "mitsuha" "example.org")) (("Mitsuha" NIL "mitsuha" "example.org")) (("Mitsuha" NIL "mitsuha" "example.org")) ` +
+		`((NIL NIL "Friends" NIL) (NIL NIL "tessie" "example.org") ("Sayaka N." NIL "sayaka" "example.org") (NIL NIL NIL NIL) (NIL NIL "taki" "example.org")) ` +
+		`((NIL NIL "undisclosed-recipients" NIL) (NIL NIL NIL NIL)) NIL NIL "<0000000@localhost/>"))`
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+const attachmentTestMessage = "From: Mitsuha <mitsuha@example.org>\r\n" +
+	"Subject: Photo\r\n" +
+	"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+	"Content-Language: en\r\n" +
+	"\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=comet.png\r\n" +
+	"Content-MD5: Q2hlY2sgSW50ZWdyaXR5IQ==\r\n" +
+	"Content-Language: en, ja\r\n" +
+	"Content-Location: http://example.org/comet.png\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--frontier--\r\n"
+
+func TestFetchBodyStructure(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", attachmentTestMessage)
+	tc.selectMailbox("INBOX")
+
+	textPart := `"text" "plain" ("charset" "utf-8") NIL NIL "7BIT" 13 0`
+	imagePart := `"image" "png" NIL NIL NIL "BASE64" 12`
+	for _, tt := range []struct {
+		item, want string
+	}{
+		{
+			item: "BODY",
+			want: `BODY ((` + textPart + `) (` + imagePart + `) "mixed")`,
+		},
+		{
+			item: "BODYSTRUCTURE",
+			want: `BODYSTRUCTURE ((` + textPart + ` NIL NIL NIL NIL) ` +
+				`(` + imagePart + ` "Q2hlY2sgSW50ZWdyaXR5IQ==" ("attachment" ("filename" "comet.png")) ("en" "ja") "http://example.org/comet.png") ` +
+				`"mixed" ("boundary" "frontier") NIL ("en") NIL)`,
+		},
+	} {
+		tc.writeLine("F1 FETCH 1 (%v)", tt.item)
+		want := "* 1 FETCH (UID 1 " + tt.want + ")"
+		if got := tc.expectOK("F1"); len(got) != 1 || got[0] != want {
+			t.Errorf("%v: got %q, want %q", tt.item, got, want)
+		}
+	}
+}
+
+func TestFetchMacros(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	items := []string{"FLAGS (", "INTERNALDATE ", "RFC822.SIZE ", "ENVELOPE (", "BODY ("}
+	for _, test := range []struct {
+		macro string
+		want  int // number of items expected, from the start of the list
+	}{
+		{"FAST", 3},
+		{"ALL", 4},
+		{"FULL", 5},
+	} {
+		tc.writeLine("F1 FETCH 1 %v", test.macro)
+		untagged := tc.expectOK("F1")
+		if len(untagged) != 1 {
+			t.Errorf("%v: got %q, want a single FETCH response", test.macro, untagged)
+			continue
+		}
+		for i, item := range items {
+			if got := strings.Contains(untagged[0], " "+item); got != (i < test.want) {
+				t.Errorf("%v: got %q, want %q present: %v", test.macro, untagged[0], item, i < test.want)
+			}
+		}
+		if strings.Contains(untagged[0], "BODYSTRUCTURE") {
+			t.Errorf("%v: got %q, want BODY instead of BODYSTRUCTURE", test.macro, untagged[0])
+		}
+	}
+
+	// Macros can't be combined with other items
+	tc.writeLine("F2 FETCH 1 (FULL UID)")
+	if resp, _ := tc.readTagged("F2"); !strings.HasPrefix(resp, "F2 BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+}
+
+func TestFetchRFC822(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	header, text, _ := strings.Cut(testMessage, "\r\n\r\n")
+	header += "\r\n\r\n"
+
+	// RFC822.HEADER is equivalent to BODY.PEEK[HEADER], the legacy name is
+	// used in the response
+	tc.writeLine("F1 FETCH 1 RFC822.HEADER")
+	want := fmt.Sprintf("* 1 FETCH (UID 1 RFC822.HEADER {%v}\r\n%v)", len(header), header)
+	if got := strings.Join(tc.expectOK("F1"), "\r\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	tc.writeLine("F2 FETCH 1 FLAGS")
+	if got := tc.expectOK("F2"); len(got) != 1 || strings.Contains(got[0], `\Seen`) {
+		t.Errorf("RFC822.HEADER set the \\Seen flag: %q", got)
+	}
+
+	// RFC822.TEXT is equivalent to BODY[TEXT]. The FLAGS update caused by
+	// the implicit \Seen flag may follow the response.
+	tc.writeLine("F3 FETCH 1 RFC822.TEXT")
+	want = fmt.Sprintf("* 1 FETCH (UID 1 RFC822.TEXT {%v}\r\n%v)", len(text), text)
+	if got := strings.Join(tc.expectOK("F3"), "\r\n"); !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	tc.writeLine("F4 FETCH 1 FLAGS")
+	if got := tc.expectOK("F4"); len(got) != 1 || !strings.Contains(strings.ToLower(got[0]), `\seen`) {
+		t.Errorf("RFC822.TEXT didn't set the \\Seen flag: %q", got)
+	}
+
+	tc.writeLine("F5 FETCH 1 (RFC822.SIZE RFC822)")
+	want = fmt.Sprintf("* 1 FETCH (UID 1 RFC822.SIZE %v RFC822 {%v}\r\n%v)", len(testMessage), len(testMessage), testMessage)
+	if got := strings.Join(tc.expectOK("F5"), "\r\n"); !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package imapserver
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+const (
+	idMaxFields      = 30
+	idMaxFieldLen    = 30
+	idMaxFieldValLen = 1024
+)
+
+func (c *Conn) handleID(dec *imapwire.Decoder) (exec func() error, err error) {
+	if !dec.ExpectSP() {
+		return nil, dec.Err()
+	}
+
+	var clientParams map[string]*string
+	err = dec.ExpectNList(func() error {
+		var key string
+		if !dec.ExpectString(&key) || !dec.ExpectSP() {
+			return dec.Err()
+		}
+		value, err := readIDValue(dec)
+		if err != nil {
+			return err
+		}
+		if clientParams == nil {
+			clientParams = make(map[string]*string)
+		}
+		switch {
+		case len(clientParams) >= idMaxFields:
+			return newClientBugError("Too many ID fields")
+		case len(key) > idMaxFieldLen:
+			return newClientBugError("ID field name too long")
+		case value != nil && len(*value) > idMaxFieldValLen:
+			return newClientBugError("ID field value too long")
+		}
+		clientParams[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !dec.ExpectCRLF() {
+		return nil, dec.Err()
+	}
+
+	return func() error {
+		var serverParams map[string]*string
+		if session, ok := c.session.(SessionID); ok {
+			var err error
+			serverParams, err = session.ID(c.ctx, clientParams)
+			if err != nil {
+				return err
+			}
+		}
+
+		return c.writeID(serverParams)
+	}, nil
+}
+
+// readIDValue reads an ID field value. NIL is returned as a nil string.
+func readIDValue(dec *imapwire.Decoder) (*string, error) {
+	var s string
+	if dec.Atom(&s) {
+		if !dec.Expect(s == "NIL", "nstring") {
+			return nil, dec.Err()
+		}
+		return nil, nil
+	}
+	if !dec.ExpectString(&s) {
+		return nil, dec.Err()
+	}
+	return &s, nil
+}
+
+func (c *Conn) writeID(params map[string]*string) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+
+	enc.Atom("*").SP().Atom("ID").SP()
+	if len(params) == 0 {
+		enc.NIL()
+		return enc.CRLF()
+	}
+
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	enc.List(len(keys), func(i int) {
+		k := keys[i]
+		enc.String(k).SP()
+		if v := params[k]; v != nil {
+			enc.String(*v)
+		} else {
+			enc.NIL()
+		}
+	})
+	return enc.CRLF()
+}
@@ -0,0 +1,89 @@
+package imapserver_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+type idSession struct {
+	imapserver.Session
+	clientParams map[string]*string
+}
+
+func (sess *idSession) ID(ctx context.Context, clientParams map[string]*string) (map[string]*string, error) {
+	sess.clientParams = clientParams
+	name, version, empty := "imapserver", "1.0", ""
+	return map[string]*string{
+		"name":    &name,
+		"vendor":  nil,
+		"version": &version,
+		"support": &empty,
+	}, nil
+}
+
+func TestID(t *testing.T) {
+	var sess *idSession
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			sess = &idSession{Session: memServer.NewSession()}
+			return sess, nil, nil
+		},
+		Caps: imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapID: {}},
+	})
+
+	tc.writeLine(`I1 ID ("name" "test-client" "os" NIL "os-version" "")`)
+	untagged := tc.expectOK("I1")
+	want := `* ID ("name" "imapserver" "support" "" "vendor" NIL "version" "1.0")`
+	if len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+	if v := sess.clientParams["name"]; v == nil || *v != "test-client" {
+		t.Errorf("client name = %v, want %q", v, "test-client")
+	}
+	if v, ok := sess.clientParams["os"]; !ok || v != nil {
+		t.Errorf("client os = %v (present: %v), want NIL", v, ok)
+	}
+	if v := sess.clientParams["os-version"]; v == nil || *v != "" {
+		t.Errorf("client os-version = %v, want empty string", v)
+	}
+
+	tc.writeLine("I2 ID NIL")
+	tc.expectOK("I2")
+	if sess.clientParams != nil {
+		t.Errorf("client params = %v, want nil", sess.clientParams)
+	}
+}
+
+func TestID_unsupported(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	tc.writeLine(`I1 ID ("name" "test-client")`)
+	untagged := tc.expectOK("I1")
+	if len(untagged) != 1 || untagged[0] != "* ID NIL" {
+		t.Errorf("got %q, want %q", untagged, "* ID NIL")
+	}
+}
+
+func TestID_limits(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	var fields []string
+	for i := 0; i < 31; i++ {
+		fields = append(fields, fmt.Sprintf(`"key%v" "value"`, i))
+	}
+	tc.writeLine("I1 ID (%v)", strings.Join(fields, " "))
+	if resp, _ := tc.readTagged("I1"); !strings.HasPrefix(resp, "I1 BAD") {
+		t.Errorf("expected BAD for too many fields, got %q", resp)
+	}
+
+	tc.writeLine(`I2 ID ("name" "%v")`, strings.Repeat("a", 1025))
+	if resp, _ := tc.readTagged("I2"); !strings.HasPrefix(resp, "I2 BAD") {
+		t.Errorf("expected BAD for value too long, got %q", resp)
+	}
+}
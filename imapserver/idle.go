@@ -1,15 +1,19 @@
 package imapserver
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"runtime/debug"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-func (c *Conn) handleIdle(dec *imapwire.Decoder) error {
+func (c *Conn) handleIdle(tag string, dec *imapwire.Decoder) error {
 	if !dec.ExpectCRLF() {
 		return dec.Err()
 	}
@@ -24,27 +28,117 @@ func (c *Conn) handleIdle(dec *imapwire.Decoder) error {
 
 	stop := make(chan struct{})
 	done := make(chan error, 1)
+	searchUpdate := make(chan struct{}, 1)
 	go func() {
 		defer func() {
 			if v := recover(); v != nil {
-				c.server.logger().Printf("panic idling: %v\n%s", v, debug.Stack())
+				c.logger.Error("panic idling", "panic", v, "stack", string(debug.Stack()))
 				done <- fmt.Errorf("imapserver: panic idling")
 			}
 		}()
-		w := &UpdateWriter{conn: c, allowExpunge: true}
-		done <- c.session.Idle(w, stop)
+		w := &UpdateWriter{conn: c, allowExpunge: true, searchUpdate: searchUpdate}
+		done <- c.session.Idle(c.ctx, w, stop)
 	}()
 
-	c.setReadTimeout(idleReadTimeout)
-	line, isPrefix, err := c.br.ReadLine()
+	var keepaliveDone sync.WaitGroup
+	if interval := c.server.options.IdleKeepalive; interval > 0 {
+		keepaliveDone.Add(1)
+		go func() {
+			defer keepaliveDone.Done()
+			c.idleKeepalive(interval, stop)
+		}()
+	}
+	keepaliveDone.Add(1)
+	go func() {
+		defer keepaliveDone.Done()
+		c.idleSearchUpdates(searchUpdate, stop)
+	}()
+
+	c.setReadTimeout(c.server.options.Timeouts.IdleRead)
+	var (
+		line     []byte
+		isPrefix bool
+		err      error
+	)
+	read := c.beginIdleRead()
+	if read {
+		line, isPrefix, err = c.br.ReadLine()
+		c.endIdleRead()
+	}
 	close(stop)
+	keepaliveDone.Wait()
 	if err == io.EOF {
 		return nil
+	} else if !read || (err != nil && c.server.isShuttingDown()) {
+		// IDLE has been interrupted by a graceful shutdown before the client
+		// sent DONE: the connection is terminated with a BYE response,
+		// without completing the command
+		if err := <-done; err != nil {
+			c.logger.Error("failed to stop idling", "err", err)
+		}
+		return nil
+	} else if netErr := net.Error(nil); errors.As(err, &netErr) && netErr.Timeout() {
+		if err := <-done; err != nil {
+			return err
+		}
+		c.byeIdleTimeout()
+		return nil
 	} else if err != nil {
 		return err
 	} else if isPrefix || string(line) != "DONE" {
 		return newClientBugError("Syntax error: expected DONE to end IDLE command")
 	}
 
-	return <-done
+	if err := <-done; err != nil {
+		return err
+	}
+	select {
+	case <-searchUpdate:
+		if err := c.updateSearchContexts(); err != nil {
+			return err
+		}
+	default:
+	}
+	if err := c.poll("IDLE"); err != nil {
+		return err
+	}
+	return c.writeStatusResp(tag, &imap.StatusResponse{
+		Type: imap.StatusResponseTypeOK,
+		Text: "IDLE completed",
+	})
+}
+
+// idleSearchUpdates updates search contexts when Session.Idle reports new
+// messages.
+func (c *Conn) idleSearchUpdates(updates <-chan struct{}, stop <-chan struct{}) {
+	for {
+		select {
+		case <-updates:
+			if err := c.updateSearchContexts(); err != nil {
+				c.logger.Error("failed to update search contexts", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *Conn) idleKeepalive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := c.writeStatusResp("", &imap.StatusResponse{
+				Type: imap.StatusResponseTypeOK,
+				Text: "Still here",
+			})
+			if err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
 }
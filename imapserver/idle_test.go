@@ -0,0 +1,97 @@
+package imapserver_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestIdle(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+
+	idling := dialTestServer(t, addr)
+	idling.login()
+	idling.selectMailbox("INBOX")
+	idling.writeLine("I1 IDLE")
+	if line := idling.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+
+	other := dialTestServer(t, addr)
+	other.login()
+	other.appendMessage("INBOX", testMessage)
+
+	if line := idling.readLine(); line != "* 1 EXISTS" {
+		t.Errorf("expected EXISTS update while idling, got %q", line)
+	}
+
+	idling.writeLine("DONE")
+	if got := idling.expectOK("I1"); len(got) != 0 {
+		t.Errorf("unexpected untagged responses: %q", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Timeouts: imapserver.Timeouts{IdleRead: 100 * time.Millisecond},
+	})
+	tc.login()
+	tc.writeLine("I1 IDLE")
+	if line := tc.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.expectBye()
+}
+
+func TestIdleShutdown(t *testing.T) {
+	server, addr := startTestServer(t, nil)
+	tc := dialTestServer(t, addr)
+	tc.login()
+	tc.writeLine("I1 IDLE")
+	if line := tc.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+
+	go server.Shutdown(context.Background())
+
+	// The client hasn't sent DONE, so the command isn't completed
+	tc.expectBye()
+}
+
+func TestIdleKeepalive(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		IdleKeepalive: 20 * time.Millisecond,
+	})
+	tc.login()
+	tc.writeLine("I1 IDLE")
+	if line := tc.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	for i := 0; i < 3; i++ {
+		if line := tc.readLine(); line != "* OK Still here" {
+			t.Fatalf("expected keepalive, got %q", line)
+		}
+	}
+
+	tc.writeLine("DONE")
+	// Keepalives may have been sent before DONE was received
+	for {
+		line := tc.readLine()
+		if line == "* OK Still here" {
+			continue
+		} else if !strings.HasPrefix(line, "I1 OK ") {
+			t.Fatalf("expected OK response, got %q", line)
+		}
+		break
+	}
+
+	// No keepalive is sent outside of IDLE
+	time.Sleep(50 * time.Millisecond)
+	tc.writeLine("N1 NOOP")
+	if got := tc.expectOK("N1"); len(got) != 0 {
+		t.Errorf("unexpected untagged responses: %q", got)
+	}
+}
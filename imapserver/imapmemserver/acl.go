@@ -0,0 +1,109 @@
+package imapmemserver
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// aclLocked returns the ACL of the mailbox. By default, the owner has all
+// rights.
+func (mbox *Mailbox) aclLocked(owner string) map[string]imap.RightSet {
+	if mbox.acl == nil {
+		mbox.acl = map[string]imap.RightSet{owner: imap.AllRights}
+	}
+	return mbox.acl
+}
+
+func (u *User) MyRights(ctx context.Context, mailbox string) (*imap.MyRightsData, error) {
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	return &imap.MyRightsData{
+		Mailbox: mbox.name,
+		Rights:  mbox.aclLocked(u.username)[u.username],
+	}, nil
+}
+
+func (u *User) SetACL(ctx context.Context, mailbox, identifier string, mod imap.RightModification, rights imap.RightSet) error {
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	acl := mbox.aclLocked(u.username)
+	switch mod {
+	case imap.RightModificationAdd:
+		rights = acl[identifier].Add(rights)
+	case imap.RightModificationRemove:
+		rights = acl[identifier].Remove(rights)
+	}
+	if rights == "" {
+		delete(acl, identifier)
+	} else {
+		acl[identifier] = rights
+	}
+	return nil
+}
+
+func (u *User) DeleteACL(ctx context.Context, mailbox, identifier string) error {
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	delete(mbox.aclLocked(u.username), identifier)
+	return nil
+}
+
+func (u *User) GetACL(ctx context.Context, mailbox string) (*imap.ACLData, error) {
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	acl := mbox.aclLocked(u.username)
+	data := imap.ACLData{
+		Mailbox: mbox.name,
+		Rights:  make(map[string]imap.RightSet, len(acl)),
+	}
+	for identifier, rights := range acl {
+		data.Rights[identifier] = rights
+	}
+	return &data, nil
+}
+
+func (u *User) ListRights(ctx context.Context, mailbox, identifier string) (*imap.ListRightsData, error) {
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	// No right is implicitly granted, and all rights can be granted
+	// independently
+	data := imap.ListRightsData{
+		Mailbox:    mbox.name,
+		Identifier: identifier,
+	}
+	for i := 0; i < len(imap.AllRights); i++ {
+		data.OptionalRights = append(data.OptionalRights, imap.AllRights[i:i+1])
+	}
+	return &data, nil
+}
@@ -0,0 +1,120 @@
+package imapmemserver
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+var errBadURL = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Text: "Invalid or unsupported IMAP URL",
+}
+
+// ResolveURL returns the message data referenced by an IMAP URL. Only URLs
+// relative to the server (starting with a "/") are supported.
+func (u *User) ResolveURL(ctx context.Context, rawURL string) ([]byte, error) {
+	if !strings.HasPrefix(rawURL, "/") {
+		return nil, errBadURL
+	}
+
+	// Parse "/mailbox;UIDVALIDITY=n/;UID=n/;SECTION=x"
+	var (
+		section          string
+		uidValidity, uid uint64
+		hasUIDValidity   bool
+	)
+	// The mailbox name may contain the hierarchy separator, so it extends up
+	// to the first parameter
+	rawMbox, rawParams, _ := strings.Cut(rawURL[1:], ";")
+	mboxName, err := url.PathUnescape(strings.TrimSuffix(rawMbox, "/"))
+	if err != nil || mboxName == "" {
+		return nil, errBadURL
+	}
+	for _, param := range strings.Split(strings.ReplaceAll(rawParams, "/;", ";"), ";") {
+		k, v, ok := strings.Cut(strings.TrimSuffix(param, "/"), "=")
+		if !ok {
+			return nil, errBadURL
+		}
+		v, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, errBadURL
+		}
+		switch strings.ToUpper(k) {
+		case "UIDVALIDITY":
+			uidValidity, err = strconv.ParseUint(v, 10, 32)
+			hasUIDValidity = true
+		case "UID":
+			uid, err = strconv.ParseUint(v, 10, 32)
+		case "SECTION":
+			section = v
+		default:
+			return nil, errBadURL
+		}
+		if err != nil {
+			return nil, errBadURL
+		}
+	}
+	if uid == 0 {
+		return nil, errBadURL
+	}
+
+	item, err := parseURLSection(section)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox, err := u.mailbox(mboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	if hasUIDValidity && uint32(uidValidity) != mbox.uidValidity {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Text: "UIDVALIDITY mismatch",
+		}
+	}
+	for _, msg := range mbox.l {
+		if msg.uid == uint32(uid) {
+			return msg.bodySection(item), nil
+		}
+	}
+	return nil, &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Text: "No such message",
+	}
+}
+
+func parseURLSection(section string) (*imap.FetchItemBodySection, error) {
+	item := &imap.FetchItemBodySection{}
+	if section == "" {
+		return item, nil
+	}
+
+	for _, s := range strings.Split(section, ".") {
+		if item.Specifier != imap.PartSpecifierNone {
+			return nil, errBadURL
+		}
+		switch spec := imap.PartSpecifier(strings.ToUpper(s)); spec {
+		case imap.PartSpecifierHeader, imap.PartSpecifierMIME, imap.PartSpecifierText:
+			item.Specifier = spec
+		default:
+			num, err := strconv.ParseUint(s, 10, 32)
+			if err != nil || num == 0 {
+				return nil, errBadURL
+			}
+			item.Part = append(item.Part, int(num))
+		}
+	}
+	if item.Specifier == imap.PartSpecifierMIME && len(item.Part) == 0 {
+		return nil, errBadURL
+	}
+	return item, nil
+}
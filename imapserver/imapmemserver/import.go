@@ -0,0 +1,49 @@
+package imapmemserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// ImportDir appends the messages stored in a directory to a mailbox, which is
+// created if it doesn't exist.
+//
+// Each regular file with a ".eml" extension is imported as a message, in
+// lexical order. The file modification time is used as the internal date.
+func (u *User) ImportDir(mailbox, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		if err := u.Create(context.Background(), mailbox, nil); err != nil {
+			return err
+		}
+		if mbox, err = u.mailbox(mailbox); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".eml" {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		mbox.appendBytes(buf, &imap.AppendOptions{Time: info.ModTime()})
+	}
+
+	return nil
+}
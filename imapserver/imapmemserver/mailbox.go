@@ -2,8 +2,11 @@ package imapmemserver
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
@@ -17,12 +20,32 @@ import (
 type Mailbox struct {
 	tracker     *imapserver.MailboxTracker
 	uidValidity uint32
+	id          string // OBJECTID, stays the same across renames
 
 	mutex      sync.Mutex
 	name       string
 	subscribed bool
 	l          []*message
 	uidNext    uint32
+	modSeq     uint64 // highest mod-sequence
+	specialUse []imap.MailboxAttr
+	metadata   metadataStore
+	acl        map[string]imap.RightSet // nil means default ACL
+	vanished   []vanishedMessage
+}
+
+// vanishedMessage records an expunged message for QRESYNC.
+type vanishedMessage struct {
+	uid    uint32
+	modSeq uint64
+}
+
+var nextObjectID uint64 // atomic
+
+// newObjectID generates a new OBJECTID. IDs are unique across all mailboxes
+// and messages of the process.
+func newObjectID(prefix string) string {
+	return fmt.Sprintf("%v%v", prefix, atomic.AddUint64(&nextObjectID, 1))
 }
 
 // NewMailbox creates a new mailbox.
@@ -30,26 +53,32 @@ func NewMailbox(name string, uidValidity uint32) *Mailbox {
 	return &Mailbox{
 		tracker:     imapserver.NewMailboxTracker(0),
 		uidValidity: uidValidity,
+		id:          newObjectID("M"),
 		name:        name,
 		uidNext:     1,
+		modSeq:      1,
 	}
 }
 
-func (mbox *Mailbox) list(options *imap.ListOptions) *imap.ListData {
+func (mbox *Mailbox) list(options *imap.ListOptions, delim rune) *imap.ListData {
 	mbox.mutex.Lock()
 	defer mbox.mutex.Unlock()
 
 	if options.SelectSubscribed && !mbox.subscribed {
 		return nil
 	}
+	if options.SelectSpecialUse && len(mbox.specialUse) == 0 {
+		return nil
+	}
 
 	data := imap.ListData{
 		Mailbox: mbox.name,
-		Delim:   mailboxDelim,
+		Delim:   delim,
 	}
 	if mbox.subscribed {
 		data.Attrs = append(data.Attrs, imap.MailboxAttrSubscribed)
 	}
+	data.Attrs = append(data.Attrs, mbox.specialUse...)
 	if options.ReturnStatus != nil {
 		data.Status = mbox.statusDataLocked(options.ReturnStatus)
 	}
@@ -81,12 +110,31 @@ func (mbox *Mailbox) statusDataLocked(options *imap.StatusOptions) *imap.StatusD
 	}
 	if options.NumDeleted {
 		num := mbox.countByFlagLocked(imap.FlagDeleted)
-		data.NumUnseen = &num
+		data.NumDeleted = &num
 	}
 	if options.Size {
 		size := mbox.sizeLocked()
 		data.Size = &size
 	}
+	if options.NumRecent {
+		var num uint32
+		for _, msg := range mbox.l {
+			if msg.recent {
+				num++
+			}
+		}
+		data.NumRecent = &num
+	}
+	if options.DeletedStorage {
+		size := mbox.deletedSizeLocked()
+		data.DeletedStorage = &size
+	}
+	if options.HighestModSeq {
+		data.HighestModSeq = mbox.modSeq
+	}
+	if options.MailboxID {
+		data.MailboxID = mbox.id
+	}
 	return &data
 }
 
@@ -108,6 +156,16 @@ func (mbox *Mailbox) sizeLocked() int64 {
 	return size
 }
 
+func (mbox *Mailbox) deletedSizeLocked() int64 {
+	var size int64
+	for _, msg := range mbox.l {
+		if _, ok := msg.flags[canonicalFlag(imap.FlagDeleted)]; ok {
+			size += int64(len(msg.buf))
+		}
+	}
+	return size
+}
+
 func (mbox *Mailbox) appendLiteral(r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
 	var buf bytes.Buffer
 	if _, err := buf.ReadFrom(r); err != nil {
@@ -117,20 +175,27 @@ func (mbox *Mailbox) appendLiteral(r imap.LiteralReader, options *imap.AppendOpt
 }
 
 func (mbox *Mailbox) copyMsg(msg *message) *imap.AppendData {
-	return mbox.appendBytes(msg.buf, &imap.AppendOptions{
+	return mbox.appendMessage(msg.id, msg.buf, &imap.AppendOptions{
 		Time:  msg.t,
 		Flags: msg.flagList(),
 	})
 }
 
 func (mbox *Mailbox) appendBytes(buf []byte, options *imap.AppendOptions) *imap.AppendData {
+	return mbox.appendMessage(newObjectID("E"), buf, options)
+}
+
+func (mbox *Mailbox) appendMessage(id string, buf []byte, options *imap.AppendOptions) *imap.AppendData {
 	msg := &message{
-		flags: make(map[imap.Flag]struct{}),
-		buf:   buf,
+		id:     id,
+		flags:  make(map[imap.Flag]struct{}),
+		buf:    buf,
+		recent: true,
 	}
 
+	msg.saveDate = time.Now()
 	if options.Time.IsZero() {
-		msg.t = time.Now()
+		msg.t = msg.saveDate
 	} else {
 		msg.t = options.Time
 	}
@@ -144,6 +209,7 @@ func (mbox *Mailbox) appendBytes(buf []byte, options *imap.AppendOptions) *imap.
 
 	msg.uid = mbox.uidNext
 	mbox.uidNext++
+	mbox.touchLocked(msg)
 
 	mbox.l = append(mbox.l, msg)
 	mbox.tracker.QueueNumMessages(uint32(len(mbox.l)))
@@ -154,6 +220,12 @@ func (mbox *Mailbox) appendBytes(buf []byte, options *imap.AppendOptions) *imap.
 	}
 }
 
+// touchLocked assigns a new mod-sequence to a message.
+func (mbox *Mailbox) touchLocked(msg *message) {
+	mbox.modSeq++
+	msg.modSeq = mbox.modSeq
+}
+
 func (mbox *Mailbox) rename(newName string) {
 	mbox.mutex.Lock()
 	mbox.name = newName
@@ -167,19 +239,43 @@ func (mbox *Mailbox) SetSubscribed(subscribed bool) {
 	mbox.mutex.Unlock()
 }
 
-func (mbox *Mailbox) selectDataLocked() *imap.SelectData {
+func (mbox *Mailbox) selectDataLocked(readOnly bool) *imap.SelectData {
 	flags := mbox.flagsLocked()
 
 	permanentFlags := make([]imap.Flag, len(flags))
 	copy(permanentFlags, flags)
 	permanentFlags = append(permanentFlags, imap.FlagWildcard)
 
+	var firstUnseen uint32
+	for i, msg := range mbox.l {
+		if _, ok := msg.flags[canonicalFlag(imap.FlagSeen)]; !ok {
+			firstUnseen = uint32(i) + 1
+			break
+		}
+	}
+
+	// The \Recent flag is cleared by the first session which selects the
+	// mailbox read-write
+	var numRecent uint32
+	for _, msg := range mbox.l {
+		if msg.recent {
+			numRecent++
+			if !readOnly {
+				msg.recent = false
+			}
+		}
+	}
+
 	return &imap.SelectData{
-		Flags:          flags,
-		PermanentFlags: permanentFlags,
-		NumMessages:    uint32(len(mbox.l)),
-		UIDNext:        mbox.uidNext,
-		UIDValidity:    mbox.uidValidity,
+		Flags:             flags,
+		PermanentFlags:    permanentFlags,
+		NumMessages:       uint32(len(mbox.l)),
+		UIDNext:           mbox.uidNext,
+		UIDValidity:       mbox.uidValidity,
+		NumRecent:         numRecent,
+		FirstUnseenSeqNum: firstUnseen,
+		HighestModSeq:     mbox.modSeq,
+		MailboxID:         mbox.id,
 	}
 }
 
@@ -203,7 +299,7 @@ func (mbox *Mailbox) flagsLocked() []imap.Flag {
 	return l
 }
 
-func (mbox *Mailbox) Expunge(w *imapserver.ExpungeWriter, uids *imap.SeqSet) error {
+func (mbox *Mailbox) Expunge(ctx context.Context, w *imapserver.ExpungeWriter, uids *imap.SeqSet) error {
 	expunged := make(map[*message]struct{})
 	mbox.mutex.Lock()
 	for _, msg := range mbox.l {
@@ -237,7 +333,12 @@ func (mbox *Mailbox) expungeLocked(expunged map[*message]struct{}) (seqNums []ui
 		if _, ok := expunged[msg]; ok {
 			seqNum := uint32(i) + 1
 			seqNums = append(seqNums, seqNum)
-			mbox.tracker.QueueExpunge(seqNum)
+			mbox.tracker.QueueExpungeUID(seqNum, msg.uid)
+			mbox.modSeq++
+			mbox.vanished = append(mbox.vanished, vanishedMessage{
+				uid:    msg.uid,
+				modSeq: mbox.modSeq,
+			})
 		} else {
 			filtered = append(filtered, msg)
 		}
@@ -282,7 +383,7 @@ func (mbox *MailboxView) Close() {
 	mbox.tracker.Close()
 }
 
-func (mbox *MailboxView) Fetch(w *imapserver.FetchWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+func (mbox *MailboxView) Fetch(ctx context.Context, w *imapserver.FetchWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
 	markSeen := false
 	for _, bs := range options.BodySection {
 		if !bs.Peek {
@@ -290,6 +391,12 @@ func (mbox *MailboxView) Fetch(w *imapserver.FetchWriter, numKind imapserver.Num
 			break
 		}
 	}
+	for _, bs := range options.BinarySection {
+		if !bs.Peek {
+			markSeen = true
+			break
+		}
+	}
 
 	var err error
 	mbox.forEach(numKind, seqSet, func(seqNum uint32, msg *message) {
@@ -297,49 +404,37 @@ func (mbox *MailboxView) Fetch(w *imapserver.FetchWriter, numKind imapserver.Num
 			return
 		}
 
+		if options.HasChangedSince && msg.modSeq <= options.ChangedSince {
+			return
+		}
+
+		var binary *binaryData
+		binary, err = msg.decodeBinary(options)
+		if err != nil {
+			return
+		}
+
 		if markSeen {
 			msg.flags[canonicalFlag(imap.FlagSeen)] = struct{}{}
+			mbox.touchLocked(msg)
 			mbox.Mailbox.tracker.QueueMessageFlags(seqNum, msg.uid, msg.flagList(), nil)
 		}
 
 		respWriter := w.CreateMessage(mbox.tracker.EncodeSeqNum(seqNum))
-		err = msg.fetch(respWriter, options)
+		err = msg.fetch(respWriter, options, binary)
 	})
 	return err
 }
 
-func (mbox *MailboxView) Search(numKind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+func (mbox *MailboxView) Search(ctx context.Context, numKind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
 	mbox.mutex.Lock()
 	defer mbox.mutex.Unlock()
 
-	for _, seqSet := range criteria.SeqNum {
-		mbox.staticSeqSet(seqSet, imapserver.NumKindSeq)
-	}
-	for _, seqSet := range criteria.UID {
-		mbox.staticSeqSet(seqSet, imapserver.NumKindUID)
-	}
-
 	data := imap.SearchData{
 		UID: numKind == imapserver.NumKindUID,
 	}
 
-	for i, msg := range mbox.l {
-		seqNum := mbox.tracker.EncodeSeqNum(uint32(i) + 1)
-
-		if !msg.search(seqNum, criteria) {
-			continue
-		}
-
-		var num uint32
-		switch numKind {
-		case imapserver.NumKindSeq:
-			num = seqNum
-		case imapserver.NumKindUID:
-			num = msg.uid
-		}
-		if num == 0 {
-			continue
-		}
+	mbox.forEachMatchLocked(numKind, criteria, func(num uint32, msg *message) {
 		data.All.AddNum(num)
 		if data.Min == 0 || num < data.Min {
 			data.Min = num
@@ -348,27 +443,120 @@ func (mbox *MailboxView) Search(numKind imapserver.NumKind, criteria *imap.Searc
 			data.Max = num
 		}
 		data.Count++
-	}
+		if options.ReturnRelevancy {
+			// Fuzzy criteria are matched exactly
+			data.Relevancy = append(data.Relevancy, 100)
+		}
+	})
 
 	return &data, nil
 }
 
-func (mbox *MailboxView) Store(w *imapserver.FetchWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+func (mbox *MailboxView) Sort(ctx context.Context, numKind imapserver.NumKind, criteria *imap.SearchCriteria, sortCriteria []imap.SortCriterion) ([]uint32, error) {
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	type sortItem struct {
+		num  uint32
+		keys *sortKeys
+	}
+	var l []sortItem
+	mbox.forEachMatchLocked(numKind, criteria, func(num uint32, msg *message) {
+		l = append(l, sortItem{num: num, keys: msg.sortKeys()})
+	})
+
+	// Messages are already ordered by sequence number, which is the final
+	// tie-breaker
+	sort.SliceStable(l, func(i, j int) bool {
+		return compareSortKeys(l[i].keys, l[j].keys, sortCriteria) < 0
+	})
+
+	nums := make([]uint32, len(l))
+	for i, item := range l {
+		nums[i] = item.num
+	}
+	return nums, nil
+}
+
+func (mbox *MailboxView) Thread(ctx context.Context, numKind imapserver.NumKind, algorithm imap.ThreadAlgorithm, criteria *imap.SearchCriteria) ([]imap.ThreadData, error) {
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	var items []*threadItem
+	mbox.forEachMatchLocked(numKind, criteria, func(num uint32, msg *message) {
+		items = append(items, msg.threadItem(num))
+	})
+
+	switch algorithm {
+	case imap.ThreadOrderedSubject:
+		return threadOrderedSubject(items), nil
+	case imap.ThreadReferences:
+		return threadReferences(items), nil
+	default:
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeBad,
+			Text: "Unsupported threading algorithm",
+		}
+	}
+}
+
+func (mbox *MailboxView) Store(ctx context.Context, w *imapserver.FetchWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+	var updated, modified imap.SeqSet
 	mbox.forEach(numKind, seqSet, func(seqNum uint32, msg *message) {
+		var num uint32
+		switch numKind {
+		case imapserver.NumKindSeq:
+			num = mbox.tracker.EncodeSeqNum(seqNum)
+		case imapserver.NumKindUID:
+			num = msg.uid
+		}
+
+		if options.HasUnchangedSince && msg.modSeq > options.UnchangedSince {
+			modified.AddNum(num)
+			return
+		}
+
 		msg.store(flags)
+		mbox.touchLocked(msg)
 		mbox.Mailbox.tracker.QueueMessageFlags(seqNum, msg.uid, msg.flagList(), mbox.tracker)
+		updated.AddNum(num)
 	})
-	if !flags.Silent {
-		return mbox.Fetch(w, numKind, seqSet, &imap.FetchOptions{Flags: true})
+
+	// Conditional STORE always returns the new mod-sequences, even when silent
+	fetchOptions := imap.FetchOptions{
+		Flags:  !flags.Silent,
+		ModSeq: options.HasUnchangedSince,
+	}
+	if len(updated) > 0 && (fetchOptions.Flags || fetchOptions.ModSeq) {
+		if err := mbox.Fetch(ctx, w, numKind, updated, &fetchOptions); err != nil {
+			return err
+		}
+	}
+
+	if len(modified) > 0 {
+		return &imapserver.ModifiedError{Modified: modified}
 	}
 	return nil
 }
 
-func (mbox *MailboxView) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+func (mbox *MailboxView) Vanished(ctx context.Context, modSeq uint64, uids imap.SeqSet) (imap.SeqSet, error) {
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	var vanished imap.SeqSet
+	for _, v := range mbox.vanished {
+		if v.modSeq > modSeq && uids.Contains(v.uid) {
+			vanished.AddNum(v.uid)
+		}
+	}
+	return vanished, nil
+}
+
+func (mbox *MailboxView) Poll(ctx context.Context, w *imapserver.UpdateWriter, allowExpunge bool) error {
 	return mbox.tracker.Poll(w, allowExpunge)
 }
 
-func (mbox *MailboxView) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+func (mbox *MailboxView) Idle(ctx context.Context, w *imapserver.UpdateWriter, stop <-chan struct{}) error {
 	return mbox.tracker.Idle(w, stop)
 }
 
@@ -401,6 +589,37 @@ func (mbox *MailboxView) forEachLocked(numKind imapserver.NumKind, seqSet imap.S
 	}
 }
 
+// forEachMatchLocked calls f for each message matching the search criteria,
+// in sequence number order.
+func (mbox *MailboxView) forEachMatchLocked(numKind imapserver.NumKind, criteria *imap.SearchCriteria, f func(num uint32, msg *message)) {
+	for _, seqSet := range criteria.SeqNum {
+		mbox.staticSeqSet(seqSet, imapserver.NumKindSeq)
+	}
+	for _, seqSet := range criteria.UID {
+		mbox.staticSeqSet(seqSet, imapserver.NumKindUID)
+	}
+
+	for i, msg := range mbox.l {
+		seqNum := mbox.tracker.EncodeSeqNum(uint32(i) + 1)
+
+		if !msg.search(seqNum, criteria) {
+			continue
+		}
+
+		var num uint32
+		switch numKind {
+		case imapserver.NumKindSeq:
+			num = seqNum
+		case imapserver.NumKindUID:
+			num = msg.uid
+		}
+		if num == 0 {
+			continue
+		}
+		f(num, msg)
+	}
+}
+
 // staticSeqSet converts a dynamic sequence set into a static one.
 //
 // This is necessary to properly handle the special symbol "*", which
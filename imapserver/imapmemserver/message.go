@@ -3,9 +3,11 @@ package imapmemserver
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"mime"
+	"mime/quotedprintable"
 	netmail "net/mail"
 	"strings"
 	"time"
@@ -20,22 +22,69 @@ import (
 type message struct {
 	// immutable
 	uid uint32
+	id  string // OBJECTID, preserved by COPY and MOVE
 	buf []byte
 	t   time.Time
+	// date when the message was saved in the mailbox, set by APPEND, COPY
+	// and MOVE
+	saveDate time.Time
 
 	// mutable, protected by Mailbox.mutex
-	flags map[imap.Flag]struct{}
+	flags  map[imap.Flag]struct{}
+	modSeq uint64
+	recent bool // not yet reported to a session which selected the mailbox
 }
 
-func (msg *message) fetch(w *imapserver.FetchResponseWriter, options *imap.FetchOptions) error {
+// binaryData contains the decoded BINARY[] and BINARY.SIZE[] data items of
+// a FETCH command.
+type binaryData struct {
+	sections [][]byte
+	sizes    []uint32
+}
+
+// decodeBinary decodes the binary sections requested by a FETCH command.
+// This needs to happen before the FETCH response is started, because errors
+// cannot be reported in the middle of it.
+func (msg *message) decodeBinary(options *imap.FetchOptions) (*binaryData, error) {
+	var data binaryData
+	for _, bs := range options.BinarySection {
+		buf, err := msg.binarySection(bs.Part)
+		if err != nil {
+			return nil, err
+		}
+		data.sections = append(data.sections, extractPartial(buf, bs.Partial))
+	}
+	for _, bss := range options.BinarySectionSize {
+		buf, err := msg.binarySection(bss.Part)
+		if err != nil {
+			return nil, err
+		}
+		data.sizes = append(data.sizes, uint32(len(buf)))
+	}
+	return &data, nil
+}
+
+func (msg *message) fetch(w *imapserver.FetchResponseWriter, options *imap.FetchOptions, binary *binaryData) error {
 	w.WriteUID(msg.uid)
 
 	if options.Flags {
 		w.WriteFlags(msg.flagList())
 	}
+	if options.ModSeq {
+		w.WriteModSeq(msg.modSeq)
+	}
+	if options.EmailID {
+		w.WriteEmailID(msg.id)
+	}
+	if options.ThreadID {
+		w.WriteThreadID("")
+	}
 	if options.InternalDate {
 		w.WriteInternalDate(msg.t)
 	}
+	if options.SaveDate {
+		w.WriteSaveDate(msg.saveDate)
+	}
 	if options.RFC822Size {
 		w.WriteRFC822Size(int64(len(msg.buf)))
 	}
@@ -59,7 +108,22 @@ func (msg *message) fetch(w *imapserver.FetchResponseWriter, options *imap.Fetch
 		}
 	}
 
-	// TODO: BinarySection, BinarySectionSize
+	for i, bs := range options.BinarySection {
+		buf := binary.sections[i]
+		wc := w.WriteBinarySection(bs, int64(len(buf)))
+		_, writeErr := wc.Write(buf)
+		closeErr := wc.Close()
+		if writeErr != nil {
+			return writeErr
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+
+	for i, bss := range options.BinarySectionSize {
+		w.WriteBinarySectionSize(bss, binary.sizes[i])
+	}
 
 	return w.Close()
 }
@@ -93,29 +157,25 @@ func openMessagePart(header textproto.Header, body io.Reader, parentMediaType st
 	return header, body
 }
 
-func (msg *message) bodySection(item *imap.FetchItemBodySection) []byte {
-	var (
-		header textproto.Header
-		body   io.Reader
-	)
-
+// openPart looks up a message part. The returned body is the raw part body,
+// without any transfer encoding decoded.
+func (msg *message) openPart(part []int) (header textproto.Header, body io.Reader, parentMediaType string, ok bool) {
 	br := bufio.NewReader(bytes.NewReader(msg.buf))
 	header, err := textproto.ReadHeader(br)
 	if err != nil {
-		return nil
+		return header, nil, "", false
 	}
 	body = br
 
 	// First part of non-multipart message refers to the message itself
 	msgHeader := gomessage.Header{header}
 	mediaType, _, _ := msgHeader.ContentType()
-	partPath := item.Part
+	partPath := part
 	if !strings.HasPrefix(mediaType, "multipart/") && len(partPath) > 0 && partPath[0] == 1 {
 		partPath = partPath[1:]
 	}
 
 	// Find the requested part using the provided path
-	var parentMediaType string
 	for i := 0; i < len(partPath); i++ {
 		partNum := partPath[i]
 
@@ -125,7 +185,7 @@ func (msg *message) bodySection(item *imap.FetchItemBodySection) []byte {
 		mediaType, typeParams, _ := msgHeader.ContentType()
 		if !strings.HasPrefix(mediaType, "multipart/") {
 			if partNum != 1 {
-				return nil
+				return header, nil, "", false
 			}
 			continue
 		}
@@ -135,7 +195,7 @@ func (msg *message) bodySection(item *imap.FetchItemBodySection) []byte {
 		for j := 1; j <= partNum; j++ {
 			p, err := mr.NextPart()
 			if err != nil {
-				return nil
+				return header, nil, "", false
 			}
 
 			if j == partNum {
@@ -147,10 +207,19 @@ func (msg *message) bodySection(item *imap.FetchItemBodySection) []byte {
 			}
 		}
 		if !found {
-			return nil
+			return header, nil, "", false
 		}
 	}
 
+	return header, body, parentMediaType, true
+}
+
+func (msg *message) bodySection(item *imap.FetchItemBodySection) []byte {
+	header, body, parentMediaType, ok := msg.openPart(item.Part)
+	if !ok {
+		return nil
+	}
+
 	if len(item.Part) > 0 {
 		switch item.Specifier {
 		case imap.PartSpecifierHeader, imap.PartSpecifierText:
@@ -197,19 +266,72 @@ func (msg *message) bodySection(item *imap.FetchItemBodySection) []byte {
 		}
 	}
 
-	// Extract partial if any
-	b := buf.Bytes()
-	if partial := item.Partial; partial != nil {
-		end := partial.Offset + partial.Size
-		if partial.Offset > int64(len(b)) {
-			return nil
+	return extractPartial(buf.Bytes(), item.Partial)
+}
+
+// binarySection returns the contents of a message part with its transfer
+// encoding decoded.
+func (msg *message) binarySection(part []int) ([]byte, error) {
+	if len(part) == 0 {
+		return msg.buf, nil
+	}
+
+	header, body, _, ok := msg.openPart(part)
+	if !ok {
+		return nil, nil
+	}
+
+	// Transfer encodings don't apply to multipart bodies
+	msgHeader := gomessage.Header{header}
+	mediaType, _, _ := msgHeader.ContentType()
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		var err error
+		body, err = decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+		if err != nil {
+			return nil, err
 		}
-		if end > int64(len(b)) {
-			end = int64(len(b))
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeParse,
+			Text: fmt.Sprintf("Failed to decode message part: %v", err),
 		}
-		b = b[partial.Offset:end]
 	}
-	return b
+	return buf.Bytes(), nil
+}
+
+func decodeTransferEncoding(enc string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "", "7bit", "8bit", "binary":
+		return r, nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(r), nil
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	default:
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeUnknownCTE,
+			Text: fmt.Sprintf("Unknown Content-Transfer-Encoding %q", enc),
+		}
+	}
+}
+
+func extractPartial(b []byte, partial *imap.SectionPartial) []byte {
+	if partial == nil {
+		return b
+	}
+	end := partial.Offset + partial.Size
+	if partial.Offset > int64(len(b)) {
+		return nil
+	}
+	if end > int64(len(b)) {
+		end = int64(len(b))
+	}
+	return b[partial.Offset:end]
 }
 
 func (msg *message) flagList() []imap.Flag {
@@ -252,6 +374,15 @@ func (msg *message) search(seqNum uint32, criteria *imap.SearchCriteria) bool {
 	if !matchDate(msg.t, criteria.Since, criteria.Before) {
 		return false
 	}
+	if !criteria.Younger.IsZero() && msg.t.Before(criteria.Younger) {
+		return false
+	}
+	if !criteria.Older.IsZero() && !msg.t.Before(criteria.Older) {
+		return false
+	}
+	if !matchDate(msg.saveDate, criteria.SavedSince, criteria.SavedBefore) {
+		return false
+	}
 
 	for _, flag := range criteria.Flag {
 		if _, ok := msg.flags[canonicalFlag(flag)]; !ok {
@@ -288,6 +419,11 @@ func (msg *message) search(seqNum uint32, criteria *imap.SearchCriteria) bool {
 		}
 		found := false
 		for _, v := range header.Values(fieldCriteria.Key) {
+			// Match against the decoded value, falling back to the raw value
+			// for malformed encoded-words
+			if decoded, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+				v = decoded
+			}
 			found = strings.Contains(strings.ToLower(v), strings.ToLower(fieldCriteria.Value))
 			if found {
 				break
@@ -324,6 +460,11 @@ func (msg *message) search(seqNum uint32, criteria *imap.SearchCriteria) bool {
 			return false
 		}
 	}
+	for _, fuzzy := range criteria.Fuzzy {
+		if !msg.search(seqNum, &fuzzy) {
+			return false
+		}
+	}
 
 	return true
 }
@@ -359,7 +500,7 @@ func getEnvelope(h textproto.Header) *imap.Envelope {
 	date, _ := netmail.ParseDate(h.Get("Date"))
 	return &imap.Envelope{
 		Date:      date,
-		Subject:   h.Get("Subject"),
+		Subject:   decodeHeader(h.Get("Subject")),
 		From:      parseAddressList(h.Get("From")),
 		Sender:    parseAddressList(h.Get("Sender")),
 		ReplyTo:   parseAddressList(h.Get("Reply-To")),
@@ -371,13 +512,47 @@ func getEnvelope(h textproto.Header) *imap.Envelope {
 	}
 }
 
+// decodeHeader decodes RFC 2047 encoded-words. The raw value is returned if
+// it's malformed.
+func decodeHeader(s string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// parseAddressList parses an address list header field. Groups are
+// represented with start and end markers, as described in RFC 3501 section
+// 7.4.2.
 func parseAddressList(s string) []imap.Address {
-	if s == "" {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+
+	var l []imap.Address
+	for _, item := range splitAddressList(s) {
+		colon := indexTopLevel(item, ':')
+		if colon < 0 {
+			l = append(l, parseMailboxList(item)...)
+			continue
+		}
+
+		members := strings.TrimSpace(item[colon+1:])
+		members = strings.TrimSuffix(members, ";")
+		l = append(l, imap.Address{Mailbox: parsePhrase(item[:colon])})
+		l = append(l, parseMailboxList(members)...)
+		l = append(l, imap.Address{})
+	}
+	return l
+}
+
+func parseMailboxList(s string) []imap.Address {
+	if strings.TrimSpace(s) == "" {
 		return nil
 	}
 
 	// TODO: leave the quoted words unchanged
-	// TODO: handle groups
 	addrs, _ := mail.ParseAddressList(s)
 	var l []imap.Address
 	for _, addr := range addrs {
@@ -386,7 +561,7 @@ func parseAddressList(s string) []imap.Address {
 			continue
 		}
 		l = append(l, imap.Address{
-			Name:    mime.QEncoding.Encode("utf-8", addr.Name),
+			Name:    addr.Name,
 			Mailbox: mailbox,
 			Host:    host,
 		})
@@ -394,6 +569,192 @@ func parseAddressList(s string) []imap.Address {
 	return l
 }
 
+// parsePhrase decodes a display name, e.g. a group name.
+func parsePhrase(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		var sb strings.Builder
+		for i := 1; i < len(s)-1; i++ {
+			if s[i] == '\\' && i+1 < len(s)-1 {
+				i++
+			}
+			sb.WriteByte(s[i])
+		}
+		return sb.String()
+	}
+	return decodeHeader(s)
+}
+
+// splitAddressList splits an address list on commas, leaving groups intact.
+func splitAddressList(s string) []string {
+	var (
+		l       []string
+		inGroup bool
+		start   int
+	)
+	scanTopLevel(s, func(i int) {
+		switch s[i] {
+		case ':':
+			inGroup = true
+		case ';':
+			inGroup = false
+		case ',':
+			if !inGroup {
+				l = append(l, s[start:i])
+				start = i + 1
+			}
+		}
+	})
+	return append(l, s[start:])
+}
+
+// indexTopLevel returns the index of the first instance of ch outside of
+// quoted strings, comments and angle brackets, or -1.
+func indexTopLevel(s string, ch byte) int {
+	index := -1
+	scanTopLevel(s, func(i int) {
+		if index < 0 && s[i] == ch {
+			index = i
+		}
+	})
+	return index
+}
+
+// scanTopLevel calls f with the index of each byte of s which isn't part of a
+// quoted string, a comment or an angle address.
+func scanTopLevel(s string, f func(i int)) {
+	var (
+		quoted       bool
+		commentDepth int
+		angle        bool
+	)
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quoted:
+			if ch == '\\' {
+				i++
+			} else if ch == '"' {
+				quoted = false
+			}
+		case commentDepth > 0:
+			if ch == '\\' {
+				i++
+			} else if ch == '(' {
+				commentDepth++
+			} else if ch == ')' {
+				commentDepth--
+			}
+		case angle:
+			if ch == '>' {
+				angle = false
+			}
+		case ch == '"':
+			quoted = true
+		case ch == '(':
+			commentDepth++
+		case ch == '<':
+			angle = true
+		default:
+			f(i)
+		}
+	}
+}
+
+// sortKeys contains the values used to sort a message.
+type sortKeys struct {
+	arrival time.Time
+	date    time.Time
+	size    int64
+	subject string
+	from    string
+	to      string
+	cc      string
+}
+
+func (msg *message) sortKeys() *sortKeys {
+	keys := sortKeys{
+		arrival: msg.t,
+		date:    msg.t,
+		size:    int64(len(msg.buf)),
+	}
+
+	env := msg.envelope()
+	if env == nil {
+		return &keys
+	}
+	if !env.Date.IsZero() {
+		keys.date = env.Date
+	}
+	baseSubject, _ := imapserver.BaseSubject(env.Subject)
+	keys.subject = strings.ToUpper(baseSubject)
+	keys.from = sortAddrKey(env.From)
+	keys.to = sortAddrKey(env.To)
+	keys.cc = sortAddrKey(env.Cc)
+	return &keys
+}
+
+func sortAddrKey(addrs []imap.Address) string {
+	// Group markers are skipped
+	for _, addr := range addrs {
+		if addr.Host != "" {
+			return strings.ToUpper(addr.Mailbox)
+		}
+	}
+	return ""
+}
+
+func compareSortKeys(a, b *sortKeys, criteria []imap.SortCriterion) int {
+	for _, criterion := range criteria {
+		var cmp int
+		switch criterion.Key {
+		case imap.SortKeyArrival:
+			cmp = compareTime(a.arrival, b.arrival)
+		case imap.SortKeyDate:
+			cmp = compareTime(a.date, b.date)
+		case imap.SortKeySize:
+			cmp = compareInt64(a.size, b.size)
+		case imap.SortKeySubject:
+			cmp = strings.Compare(a.subject, b.subject)
+		case imap.SortKeyFrom:
+			cmp = strings.Compare(a.from, b.from)
+		case imap.SortKeyTo:
+			cmp = strings.Compare(a.to, b.to)
+		case imap.SortKeyCc:
+			cmp = strings.Compare(a.cc, b.cc)
+		}
+		if criterion.Reverse {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
 func canonicalFlag(flag imap.Flag) imap.Flag {
 	return imap.Flag(strings.ToLower(string(flag)))
 }
@@ -450,6 +811,7 @@ func getBodyStructure(rawHeader textproto.Header, r io.Reader, extended bool) im
 		}
 		if extended {
 			bs.Extended = &imap.BodyStructureSinglePartExt{
+				MD5:         header.Get("Content-MD5"),
 				Disposition: getContentDisposition(header),
 				Language:    getContentLanguage(header),
 				Location:    header.Get("Content-Location"),
@@ -0,0 +1,88 @@
+package imapmemserver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// metadataStore contains METADATA entries. Keys are lower-case entry names.
+type metadataStore map[string][]byte
+
+func (store metadataStore) get(entries []string, depth imap.GetMetadataDepth) map[string]*[]byte {
+	values := make(map[string]*[]byte)
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		for name, value := range store {
+			if name != entry && !isMetadataDescendant(name, entry, depth) {
+				continue
+			}
+			v := append([]byte(nil), value...)
+			values[name] = &v
+		}
+	}
+	return values
+}
+
+func (store metadataStore) set(entries map[string]*[]byte) {
+	for name, value := range entries {
+		name = strings.ToLower(name)
+		if value == nil {
+			delete(store, name)
+		} else {
+			store[name] = append([]byte(nil), *value...)
+		}
+	}
+}
+
+func isMetadataDescendant(name, entry string, depth imap.GetMetadataDepth) bool {
+	if depth == imap.GetMetadataDepthZero || !strings.HasPrefix(name, entry+"/") {
+		return false
+	}
+	rel := strings.TrimPrefix(name, entry+"/")
+	return depth == imap.GetMetadataDepthInfinity || !strings.Contains(rel, "/")
+}
+
+func (u *User) GetMetadata(ctx context.Context, mailbox string, entries []string, options *imap.GetMetadataOptions) (*imap.GetMetadataData, error) {
+	data := imap.GetMetadataData{Mailbox: mailbox}
+	if mailbox == "" {
+		u.mutex.Lock()
+		data.EntryValues = u.metadata.get(entries, options.Depth)
+		u.mutex.Unlock()
+		return &data, nil
+	}
+
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	mbox.mutex.Lock()
+	data.EntryValues = mbox.metadata.get(entries, options.Depth)
+	mbox.mutex.Unlock()
+	return &data, nil
+}
+
+func (u *User) SetMetadata(ctx context.Context, mailbox string, entries map[string]*[]byte) error {
+	if mailbox == "" {
+		u.mutex.Lock()
+		if u.metadata == nil {
+			u.metadata = make(metadataStore)
+		}
+		u.metadata.set(entries)
+		u.mutex.Unlock()
+		return nil
+	}
+
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return err
+	}
+	mbox.mutex.Lock()
+	if mbox.metadata == nil {
+		mbox.metadata = make(metadataStore)
+	}
+	mbox.metadata.set(entries)
+	mbox.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,190 @@
+package imapmemserver
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// notifier keeps track of the mailboxes watched via NOTIFY.
+//
+// Mailboxes are resolved when the NOTIFY command is received: mailboxes
+// created afterwards aren't watched.
+type notifier struct {
+	updates   chan struct{}
+	mailboxes []*notifyMailbox
+
+	// mutex protects the last status of each mailbox, since concurrent
+	// commands may poll at the same time
+	mutex sync.Mutex
+}
+
+type notifyMailbox struct {
+	mbox    *Mailbox
+	options imap.StatusOptions
+	status  *imap.StatusData // last status sent to the client, protected by notifier.mutex
+}
+
+func (n *notifier) close() {
+	for _, nm := range n.mailboxes {
+		nm.mbox.tracker.Unwatch(n.updates)
+	}
+}
+
+func (n *notifier) watches(mbox *Mailbox) bool {
+	for _, nm := range n.mailboxes {
+		if nm.mbox == mbox {
+			return true
+		}
+	}
+	return false
+}
+
+// poll writes a STATUS response for each watched mailbox which has changed.
+// The selected mailbox is skipped, since its updates are sent via EXISTS,
+// EXPUNGE and FETCH responses.
+func (n *notifier) poll(w *imapserver.UpdateWriter, selected *Mailbox) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, nm := range n.mailboxes {
+		if nm.mbox == selected {
+			continue
+		}
+		status := nm.mbox.StatusData(&nm.options)
+		if statusEqual(status, nm.status) {
+			continue
+		}
+		nm.status = status
+		if err := w.WriteMailboxStatus(status, &nm.options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sess *UserSession) Notify(ctx context.Context, w *imapserver.UpdateWriter, options *imap.NotifyOptions) error {
+	if sess.notifier != nil {
+		sess.notifier.close()
+		sess.notifier = nil
+	}
+	if options == nil {
+		return nil
+	}
+
+	var selected *Mailbox
+	if sess.mailbox != nil {
+		selected = sess.mailbox.Mailbox
+	}
+
+	n := &notifier{updates: make(chan struct{}, 1)}
+	watched := make(map[*Mailbox]bool)
+	for _, item := range options.Items {
+		statusOptions := notifyStatusOptions(item.Events)
+		for _, mbox := range sess.user.notifyMailboxes(&item) {
+			// The first event group matching a mailbox takes precedence
+			if watched[mbox] {
+				continue
+			}
+			watched[mbox] = true
+			if statusOptions == nil {
+				continue
+			}
+
+			nm := &notifyMailbox{mbox: mbox, options: *statusOptions}
+			nm.status = mbox.StatusData(&nm.options)
+			mbox.tracker.Watch(n.updates)
+			n.mailboxes = append(n.mailboxes, nm)
+
+			if options.Status && mbox != selected {
+				if err := w.WriteMailboxStatus(nm.status, &nm.options); err != nil {
+					n.close()
+					return err
+				}
+			}
+		}
+	}
+
+	sess.notifier = n
+	return nil
+}
+
+// notifyStatusOptions returns the STATUS items to send for a set of NOTIFY
+// events, or nil if no STATUS response is needed.
+func notifyStatusOptions(events []imap.NotifyEvent) *imap.StatusOptions {
+	var options imap.StatusOptions
+	for _, ev := range events {
+		switch ev {
+		case imap.NotifyEventMessageNew, imap.NotifyEventMessageExpunge:
+			options.NumMessages = true
+			options.UIDNext = true
+		case imap.NotifyEventFlagChange:
+			options.NumUnseen = true
+		}
+	}
+	if options == (imap.StatusOptions{}) {
+		return nil
+	}
+	return &options
+}
+
+// notifyMailboxes returns the mailboxes matched by a NOTIFY event group.
+// Selected mailbox specifiers don't match any mailbox, these are handled by
+// the mailbox tracker.
+func (u *User) notifyMailboxes(item *imap.NotifyItem) []*Mailbox {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	var l []*Mailbox
+	switch item.MailboxSpecifier {
+	case imap.NotifyInboxes:
+		if mbox := u.mailboxes["INBOX"]; mbox != nil {
+			l = append(l, mbox)
+		}
+	case imap.NotifyPersonal:
+		for _, mbox := range u.mailboxes {
+			l = append(l, mbox)
+		}
+	case imap.NotifySubscribed:
+		for _, mbox := range u.mailboxes {
+			mbox.mutex.Lock()
+			subscribed := mbox.subscribed
+			mbox.mutex.Unlock()
+			if subscribed {
+				l = append(l, mbox)
+			}
+		}
+	case imap.NotifySubtree:
+		for name, mbox := range u.mailboxes {
+			for _, root := range item.Mailboxes {
+				if name == root || strings.HasPrefix(name, root+string(u.delim)) {
+					l = append(l, mbox)
+					break
+				}
+			}
+		}
+	case imap.NotifyMailboxes:
+		for _, name := range item.Mailboxes {
+			if mbox := u.mailboxes[name]; mbox != nil {
+				l = append(l, mbox)
+			}
+		}
+	}
+	return l
+}
+
+func statusEqual(a, b *imap.StatusData) bool {
+	return a.UIDNext == b.UIDNext &&
+		uint32PtrEqual(a.NumMessages, b.NumMessages) &&
+		uint32PtrEqual(a.NumUnseen, b.NumUnseen)
+}
+
+func uint32PtrEqual(a, b *uint32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
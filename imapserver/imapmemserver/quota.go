@@ -0,0 +1,123 @@
+package imapmemserver
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// quotaRoot is the name of the single quota root of a user. It covers all of
+// the user's mailboxes.
+const quotaRoot = ""
+
+func (u *User) GetQuota(ctx context.Context, root string) (*imap.QuotaData, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if root != quotaRoot || len(u.quotaLimits) == 0 {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeNonExistent,
+			Text: "No such quota root",
+		}
+	}
+	return u.quotaDataLocked(), nil
+}
+
+func (u *User) GetQuotaRoot(ctx context.Context, mailbox string) ([]imap.QuotaData, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if _, err := u.mailboxLocked(mailbox); err != nil {
+		return nil, err
+	}
+	if len(u.quotaLimits) == 0 {
+		return nil, nil
+	}
+	return []imap.QuotaData{*u.quotaDataLocked()}, nil
+}
+
+func (u *User) SetQuota(ctx context.Context, root string, limits map[imap.QuotaResourceType]int64) error {
+	if root != quotaRoot {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeNonExistent,
+			Text: "No such quota root",
+		}
+	}
+
+	l := make(map[imap.QuotaResourceType]int64, len(limits))
+	for t, limit := range limits {
+		switch t {
+		case imap.QuotaResourceStorage, imap.QuotaResourceMessage:
+			l[t] = limit
+		default:
+			return &imap.Error{
+				Type: imap.StatusResponseTypeBad,
+				Text: "Unsupported quota resource",
+			}
+		}
+	}
+
+	u.mutex.Lock()
+	u.quotaLimits = l
+	u.mutex.Unlock()
+	return nil
+}
+
+func (u *User) quotaDataLocked() *imap.QuotaData {
+	size, n := u.usageLocked()
+	data := imap.QuotaData{
+		Root:      quotaRoot,
+		Resources: make(map[imap.QuotaResourceType]imap.QuotaResourceData),
+	}
+	for t, limit := range u.quotaLimits {
+		var usage int64
+		switch t {
+		case imap.QuotaResourceStorage:
+			usage = (size + 1023) / 1024 // in units of 1024 octets
+		case imap.QuotaResourceMessage:
+			usage = int64(n)
+		}
+		data.Resources[t] = imap.QuotaResourceData{Usage: usage, Limit: limit}
+	}
+	return &data
+}
+
+func (u *User) usageLocked() (size int64, n int) {
+	for _, mbox := range u.mailboxes {
+		mbox.mutex.Lock()
+		size += mbox.sizeLocked()
+		n += len(mbox.l)
+		mbox.mutex.Unlock()
+	}
+	return size, n
+}
+
+// checkQuota returns an error if adding n messages totalling size bytes would
+// exceed the user's quota.
+func (u *User) checkQuota(size int64, n int) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if len(u.quotaLimits) == 0 {
+		return nil
+	}
+
+	usedSize, usedN := u.usageLocked()
+	over := false
+	if limit, ok := u.quotaLimits[imap.QuotaResourceStorage]; ok && usedSize+size > limit*1024 {
+		over = true
+	}
+	if limit, ok := u.quotaLimits[imap.QuotaResourceMessage]; ok && int64(usedN+n) > limit {
+		over = true
+	}
+	if over {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeOverQuota,
+			Text: "Quota exceeded",
+		}
+	}
+	return nil
+}
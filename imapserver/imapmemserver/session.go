@@ -1,6 +1,7 @@
 package imapmemserver
 
 import (
+	"context"
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 )
@@ -17,9 +18,22 @@ type (
 type UserSession struct {
 	*user    // immutable
 	*mailbox // may be nil
+
+	notifier *notifier // may be nil
 }
 
-var _ imapserver.SessionIMAP4rev2 = (*UserSession)(nil)
+var (
+	_ imapserver.SessionIMAP4rev2   = (*UserSession)(nil)
+	_ imapserver.SessionSort        = (*UserSession)(nil)
+	_ imapserver.SessionThread      = (*UserSession)(nil)
+	_ imapserver.SessionQResync     = (*UserSession)(nil)
+	_ imapserver.SessionQuota       = (*UserSession)(nil)
+	_ imapserver.SessionMetadata    = (*UserSession)(nil)
+	_ imapserver.SessionCatenate    = (*UserSession)(nil)
+	_ imapserver.SessionMultiAppend = (*UserSession)(nil)
+	_ imapserver.SessionNotify      = (*UserSession)(nil)
+	_ imapserver.SessionACL         = (*UserSession)(nil)
+)
 
 // NewUserSession creates a new user session.
 func NewUserSession(user *User) *UserSession {
@@ -30,27 +44,30 @@ func (sess *UserSession) Close() error {
 	if sess != nil && sess.mailbox != nil {
 		sess.mailbox.Close()
 	}
+	if sess != nil && sess.notifier != nil {
+		sess.notifier.close()
+	}
 	return nil
 }
 
-func (sess *UserSession) Select(name string, options *imap.SelectOptions) (*imap.SelectData, error) {
-	mbox, err := sess.user.mailbox(name)
+func (sess *UserSession) Select(ctx context.Context, name string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	mbox, err := sess.user.selectableMailbox(name)
 	if err != nil {
 		return nil, err
 	}
 	mbox.mutex.Lock()
 	defer mbox.mutex.Unlock()
 	sess.mailbox = mbox.NewView()
-	return mbox.selectDataLocked(), nil
+	return mbox.selectDataLocked(options.ReadOnly), nil
 }
 
-func (sess *UserSession) Unselect() error {
+func (sess *UserSession) Unselect(ctx context.Context) error {
 	sess.mailbox.Close()
 	sess.mailbox = nil
 	return nil
 }
 
-func (sess *UserSession) Copy(numKind imapserver.NumKind, seqSet imap.SeqSet, destName string) (*imap.CopyData, error) {
+func (sess *UserSession) Copy(ctx context.Context, numKind imapserver.NumKind, seqSet imap.SeqSet, destName string) (*imap.CopyData, error) {
 	dest, err := sess.user.mailbox(destName)
 	if err != nil {
 		return nil, &imap.Error{
@@ -65,6 +82,18 @@ func (sess *UserSession) Copy(numKind imapserver.NumKind, seqSet imap.SeqSet, de
 		}
 	}
 
+	var (
+		size int64
+		n    int
+	)
+	sess.mailbox.forEach(numKind, seqSet, func(seqNum uint32, msg *message) {
+		size += int64(len(msg.buf))
+		n++
+	})
+	if err := sess.user.checkQuota(size, n); err != nil {
+		return nil, err
+	}
+
 	var sourceUIDs, destUIDs imap.SeqSet
 	sess.mailbox.forEach(numKind, seqSet, func(seqNum uint32, msg *message) {
 		appendData := dest.copyMsg(msg)
@@ -79,7 +108,7 @@ func (sess *UserSession) Copy(numKind imapserver.NumKind, seqSet imap.SeqSet, de
 	}, nil
 }
 
-func (sess *UserSession) Move(w *imapserver.MoveWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, destName string) error {
+func (sess *UserSession) Move(ctx context.Context, w *imapserver.MoveWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, destName string) error {
 	dest, err := sess.user.mailbox(destName)
 	if err != nil {
 		return &imap.Error{
@@ -105,7 +134,6 @@ func (sess *UserSession) Move(w *imapserver.MoveWriter, numKind imapserver.NumKi
 		destUIDs.AddNum(appendData.UID)
 		expunged[msg] = struct{}{}
 	})
-	seqNums := sess.mailbox.expungeLocked(expunged)
 
 	err = w.WriteCopyData(&imap.CopyData{
 		UIDValidity: dest.uidValidity,
@@ -116,25 +144,50 @@ func (sess *UserSession) Move(w *imapserver.MoveWriter, numKind imapserver.NumKi
 		return err
 	}
 
-	for _, seqNum := range seqNums {
-		if err := w.WriteExpunge(sess.mailbox.tracker.EncodeSeqNum(seqNum)); err != nil {
+	// The EXPUNGE responses are queued in the mailbox tracker, and sent to
+	// the client before the tagged OK response
+	sess.mailbox.expungeLocked(expunged)
+	return nil
+}
+
+func (sess *UserSession) Poll(ctx context.Context, w *imapserver.UpdateWriter, allowExpunge bool) error {
+	var selected *Mailbox
+	if sess.mailbox != nil {
+		if err := sess.mailbox.Poll(ctx, w, allowExpunge); err != nil {
 			return err
 		}
+		selected = sess.mailbox.Mailbox
+	}
+	if sess.notifier != nil {
+		return sess.notifier.poll(w, selected)
 	}
-
 	return nil
 }
 
-func (sess *UserSession) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
-	if sess.mailbox == nil {
-		return nil
+func (sess *UserSession) Idle(ctx context.Context, w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	if sess.notifier == nil {
+		if sess.mailbox == nil {
+			return nil // TODO
+		}
+		return sess.mailbox.Idle(ctx, w, stop)
 	}
-	return sess.mailbox.Poll(w, allowExpunge)
-}
 
-func (sess *UserSession) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
-	if sess.mailbox == nil {
-		return nil // TODO
+	// Watch the selected mailbox too, so that a single loop handles updates
+	// for all mailboxes
+	if sess.mailbox != nil && !sess.notifier.watches(sess.mailbox.Mailbox) {
+		tracker := sess.mailbox.Mailbox.tracker
+		tracker.Watch(sess.notifier.updates)
+		defer tracker.Unwatch(sess.notifier.updates)
+	}
+
+	for {
+		if err := sess.Poll(ctx, w, true); err != nil {
+			return err
+		}
+		select {
+		case <-sess.notifier.updates:
+		case <-stop:
+			return nil
+		}
 	}
-	return sess.mailbox.Idle(w, stop)
 }
@@ -0,0 +1,316 @@
+package imapmemserver
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	netmail "net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-message/textproto"
+)
+
+// threadItem contains the information needed to thread a message.
+type threadItem struct {
+	num       uint32
+	date      time.Time
+	subject   string // upper-cased base subject
+	isReply   bool
+	messageID string
+	refs      []string
+}
+
+func (msg *message) threadItem(num uint32) *threadItem {
+	item := threadItem{num: num, date: msg.t}
+
+	br := bufio.NewReader(bytes.NewReader(msg.buf))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return &item
+	}
+
+	if date, err := netmail.ParseDate(header.Get("Date")); err == nil {
+		item.date = date
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+	subject, item.isReply = imapserver.BaseSubject(subject)
+	item.subject = strings.ToUpper(subject)
+
+	if ids := parseMsgIDList(header.Get("Message-Id")); len(ids) > 0 {
+		item.messageID = ids[0]
+	}
+	item.refs = parseMsgIDList(header.Get("References"))
+	if len(item.refs) == 0 {
+		if ids := parseMsgIDList(header.Get("In-Reply-To")); len(ids) > 0 {
+			item.refs = ids[:1]
+		}
+	}
+
+	return &item
+}
+
+func parseMsgIDList(s string) []string {
+	var l []string
+	for {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			break
+		}
+		l = append(l, s[start+1:start+end])
+		s = s[start+end+1:]
+	}
+	return l
+}
+
+func compareThreadItems(a, b *threadItem) bool {
+	if !a.date.Equal(b.date) {
+		return a.date.Before(b.date)
+	}
+	return a.num < b.num
+}
+
+// threadOrderedSubject implements the ORDEREDSUBJECT threading algorithm, see
+// RFC 5256 section 3.
+func threadOrderedSubject(items []*threadItem) []imap.ThreadData {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].subject != items[j].subject {
+			return items[i].subject < items[j].subject
+		}
+		return compareThreadItems(items[i], items[j])
+	})
+
+	var groups [][]*threadItem
+	for i, item := range items {
+		if i == 0 || item.subject != items[i-1].subject {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], item)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return compareThreadItems(groups[i][0], groups[j][0])
+	})
+
+	threads := make([]imap.ThreadData, len(groups))
+	for i, group := range groups {
+		thread := imap.ThreadData{Chain: []uint32{group[0].num}}
+		children := group[1:]
+		if len(children) == 1 {
+			thread.Chain = append(thread.Chain, children[0].num)
+		} else {
+			for _, child := range children {
+				thread.SubThreads = append(thread.SubThreads, imap.ThreadData{
+					Chain: []uint32{child.num},
+				})
+			}
+		}
+		threads[i] = thread
+	}
+	return threads
+}
+
+// threadContainer is a node in the tree built by the REFERENCES threading
+// algorithm.
+type threadContainer struct {
+	item     *threadItem // nil for dummy containers
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+// first returns the item used to represent the container: either its own
+// item, or the item of its first child for dummy containers.
+func (c *threadContainer) first() *threadItem {
+	for c.item == nil {
+		if len(c.children) == 0 {
+			return nil
+		}
+		c = c.children[0]
+	}
+	return c.item
+}
+
+func (c *threadContainer) isAncestorOf(other *threadContainer) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *threadContainer) setParent(parent *threadContainer) {
+	if c.parent != nil {
+		siblings := c.parent.children
+		for i, sibling := range siblings {
+			if sibling == c {
+				c.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	c.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, c)
+	}
+}
+
+func (c *threadContainer) threadData() imap.ThreadData {
+	var data imap.ThreadData
+	for {
+		if c.item != nil {
+			data.Chain = append(data.Chain, c.item.num)
+		}
+		if len(c.children) != 1 {
+			break
+		}
+		c = c.children[0]
+	}
+	for _, child := range c.children {
+		data.SubThreads = append(data.SubThreads, child.threadData())
+	}
+	return data
+}
+
+// threadReferences implements the REFERENCES threading algorithm, see RFC
+// 5256 section 3.
+func threadReferences(items []*threadItem) []imap.ThreadData {
+	// Step 1: link messages together
+	var containers []*threadContainer
+	byID := make(map[string]*threadContainer)
+	getContainer := func(id string) *threadContainer {
+		c := byID[id]
+		if c == nil {
+			c = &threadContainer{}
+			byID[id] = c
+			containers = append(containers, c)
+		}
+		return c
+	}
+	for _, item := range items {
+		var c *threadContainer
+		if existing, ok := byID[item.messageID]; item.messageID != "" && (!ok || existing.item == nil) {
+			c = getContainer(item.messageID)
+		} else {
+			// Missing or duplicate Message-ID: use a unique ID
+			c = &threadContainer{}
+			containers = append(containers, c)
+		}
+		c.item = item
+
+		var parent *threadContainer
+		for _, ref := range item.refs {
+			ref := getContainer(ref)
+			if parent != nil && ref.parent == nil && !ref.isAncestorOf(parent) {
+				ref.setParent(parent)
+			}
+			parent = ref
+		}
+		if parent != nil && c.isAncestorOf(parent) {
+			// Linking would introduce a loop
+			continue
+		}
+		c.setParent(parent)
+	}
+
+	// Step 2: gather the root set
+	var roots []*threadContainer
+	for _, c := range containers {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+
+	// Steps 3 and 4: prune dummy containers and sort the root set
+	roots = pruneThreadContainers(roots, true)
+	sortThreadContainers(roots)
+
+	// Step 5: group the root set by base subject
+	subjects := make(map[string]*threadContainer)
+	for _, c := range roots {
+		item := c.first()
+		if item.subject == "" {
+			continue
+		}
+		old := subjects[item.subject]
+		if old == nil || (c.item == nil && old.item != nil) || (old.item != nil && old.item.isReply && c.item != nil && !item.isReply) {
+			subjects[item.subject] = c
+		}
+	}
+	merged := roots[:0]
+	for _, c := range roots {
+		item := c.first()
+		t := subjects[item.subject]
+		if item.subject == "" || t == nil || t == c {
+			merged = append(merged, c)
+			continue
+		}
+
+		if t.item != nil && (c.item == nil || t.item.isReply || !c.item.isReply) {
+			// Turn t into a dummy, so that it can hold both threads
+			moved := &threadContainer{item: t.item}
+			for _, child := range append([]*threadContainer(nil), t.children...) {
+				child.setParent(moved)
+			}
+			t.item = nil
+			moved.setParent(t)
+		}
+		if c.item == nil && t.item == nil {
+			for _, child := range append([]*threadContainer(nil), c.children...) {
+				child.setParent(t)
+			}
+		} else {
+			c.setParent(t)
+		}
+	}
+	roots = merged
+
+	// Step 6: sort siblings
+	sortThreadContainers(roots)
+
+	threads := make([]imap.ThreadData, len(roots))
+	for i, c := range roots {
+		threads[i] = c.threadData()
+	}
+	return threads
+}
+
+// pruneThreadContainers removes dummy containers without children, and
+// promotes the children of dummy containers unless they would end up in the
+// root set while there are more than one.
+func pruneThreadContainers(l []*threadContainer, root bool) []*threadContainer {
+	var pruned []*threadContainer
+	for _, c := range l {
+		c.children = pruneThreadContainers(c.children, false)
+		if c.item == nil && (len(c.children) == 0 || !root || len(c.children) == 1) {
+			for _, child := range c.children {
+				child.parent = c.parent
+			}
+			pruned = append(pruned, c.children...)
+			continue
+		}
+		pruned = append(pruned, c)
+	}
+	return pruned
+}
+
+// sortThreadContainers recursively sorts containers by sent date.
+func sortThreadContainers(l []*threadContainer) {
+	for _, c := range l {
+		sortThreadContainers(c.children)
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return compareThreadItems(l[i].first(), l[j].first())
+	})
+}
@@ -1,7 +1,10 @@
 package imapmemserver
 
 import (
+	"bytes"
+	"context"
 	"crypto/subtle"
+	"io"
 	"sort"
 	"strings"
 	"sync"
@@ -10,25 +13,43 @@ import (
 	"github.com/emersion/go-imap/v2/imapserver"
 )
 
-const mailboxDelim rune = '/'
+// defaultMailboxDelim is the default mailbox hierarchy delimiter.
+const defaultMailboxDelim rune = '/'
 
 type User struct {
 	username, password string
+	delim              rune // immutable
 
 	mutex           sync.Mutex
 	mailboxes       map[string]*Mailbox
+	deleted         map[string]struct{} // deleted mailboxes which had children
 	prevUidValidity uint32
+	quotaLimits     map[imap.QuotaResourceType]int64
+	metadata        metadataStore // server entries
 }
 
 func NewUser(username, password string) *User {
 	return &User{
 		username:  username,
 		password:  password,
+		delim:     defaultMailboxDelim,
 		mailboxes: make(map[string]*Mailbox),
+		deleted:   make(map[string]struct{}),
 	}
 }
 
-func (u *User) Login(username, password string) error {
+// SetHierarchyDelim sets the mailbox hierarchy delimiter. It defaults to "/".
+// It must be called before the user is added to a server.
+func (u *User) SetHierarchyDelim(delim rune) {
+	u.delim = delim
+}
+
+// HierarchyDelim returns the mailbox hierarchy delimiter.
+func (u *User) HierarchyDelim() rune {
+	return u.delim
+}
+
+func (u *User) Login(ctx context.Context, username, password string) error {
 	if username != u.username {
 		return imapserver.ErrAuthFailed
 	}
@@ -41,11 +62,7 @@ func (u *User) Login(username, password string) error {
 func (u *User) mailboxLocked(name string) (*Mailbox, error) {
 	mbox := u.mailboxes[name]
 	if mbox == nil {
-		return nil, &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeNonExistent,
-			Text: "No such mailbox",
-		}
+		return nil, imapserver.ErrNoSuchMailbox
 	}
 	return mbox, nil
 }
@@ -56,7 +73,42 @@ func (u *User) mailbox(name string) (*Mailbox, error) {
 	return u.mailboxLocked(name)
 }
 
-func (u *User) Status(name string, options *imap.StatusOptions) (*imap.StatusData, error) {
+// selectableMailbox is like mailbox, but returns ErrMailboxNoSelect for nodes
+// of the mailbox hierarchy.
+func (u *User) selectableMailbox(name string) (*Mailbox, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, ok := u.hierarchyNodesLocked()[name]; ok {
+		return nil, imapserver.ErrMailboxNoSelect
+	}
+	return u.mailboxLocked(name)
+}
+
+// hierarchyNodesLocked returns the names which don't refer to a mailbox, but
+// have children, along with their LIST attribute.
+func (u *User) hierarchyNodesLocked() map[string]imap.MailboxAttr {
+	nodes := make(map[string]imap.MailboxAttr)
+	for name := range u.mailboxes {
+		for {
+			i := strings.LastIndex(name, string(u.delim))
+			if i <= 0 {
+				break
+			}
+			name = name[:i]
+			if u.mailboxes[name] != nil {
+				continue
+			}
+			if _, ok := u.deleted[name]; ok {
+				nodes[name] = imap.MailboxAttrNonExistent
+			} else {
+				nodes[name] = imap.MailboxAttrNoSelect
+			}
+		}
+	}
+	return nodes
+}
+
+func (u *User) Status(ctx context.Context, name string, options *imap.StatusOptions) (*imap.StatusData, error) {
 	mbox, err := u.mailbox(name)
 	if err != nil {
 		return nil, err
@@ -64,7 +116,7 @@ func (u *User) Status(name string, options *imap.StatusOptions) (*imap.StatusDat
 	return mbox.StatusData(options), nil
 }
 
-func (u *User) List(w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+func (u *User) List(ctx context.Context, w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
@@ -73,27 +125,69 @@ func (u *User) List(w *imapserver.ListWriter, ref string, patterns []string, opt
 	if len(patterns) == 0 {
 		return w.WriteList(&imap.ListData{
 			Attrs: []imap.MailboxAttr{imap.MailboxAttrNoSelect},
-			Delim: mailboxDelim,
+			Delim: u.delim,
 		})
 	}
 
+	match := func(name string) bool {
+		for _, pattern := range patterns {
+			if imapserver.MatchList(name, u.delim, ref, pattern) {
+				return true
+			}
+		}
+		return false
+	}
+
 	var l []imap.ListData
+	for name, attr := range u.hierarchyNodesLocked() {
+		if !match(name) {
+			continue
+		}
+		data := &imap.ListData{
+			Mailbox: name,
+			Attrs:   []imap.MailboxAttr{attr},
+			Delim:   u.delim,
+		}
+		if options.SelectSubscribed || options.SelectSpecialUse {
+			if !options.SelectRecursiveMatch || !u.hasSubscribedChildLocked(name) {
+				continue
+			}
+			data.ChildInfo = &imap.ListDataChildInfo{Subscribed: true}
+		}
+		if options.ReturnChildren {
+			data.Attrs = append(data.Attrs, imap.MailboxAttrHasChildren)
+		}
+		l = append(l, *data)
+	}
+
 	for name, mbox := range u.mailboxes {
-		match := false
-		for _, pattern := range patterns {
-			match = imapserver.MatchList(name, mailboxDelim, ref, pattern)
-			if match {
-				break
+		if !match(name) {
+			continue
+		}
+
+		data := mbox.list(options, u.delim)
+		if data == nil && options.SelectRecursiveMatch && u.hasSubscribedChildLocked(name) {
+			// The mailbox doesn't match the selection criteria, but one of
+			// its children does (see RFC 5258 section 3.5)
+			data = &imap.ListData{
+				Mailbox:   name,
+				Delim:     u.delim,
+				ChildInfo: &imap.ListDataChildInfo{Subscribed: true},
 			}
 		}
-		if !match {
+		if data == nil {
 			continue
 		}
 
-		data := mbox.list(options)
-		if data != nil {
-			l = append(l, *data)
+		if options.ReturnChildren {
+			if u.hasChildrenLocked(name) {
+				data.Attrs = append(data.Attrs, imap.MailboxAttrHasChildren)
+			} else {
+				data.Attrs = append(data.Attrs, imap.MailboxAttrHasNoChildren)
+			}
 		}
+
+		l = append(l, *data)
 	}
 
 	sort.Slice(l, func(i, j int) bool {
@@ -109,7 +203,33 @@ func (u *User) List(w *imapserver.ListWriter, ref string, patterns []string, opt
 	return nil
 }
 
-func (u *User) Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+func (u *User) hasChildrenLocked(name string) bool {
+	prefix := name + string(u.delim)
+	for childName := range u.mailboxes {
+		if strings.HasPrefix(childName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) hasSubscribedChildLocked(name string) bool {
+	prefix := name + string(u.delim)
+	for childName, child := range u.mailboxes {
+		if !strings.HasPrefix(childName, prefix) {
+			continue
+		}
+		child.mutex.Lock()
+		subscribed := child.subscribed
+		child.mutex.Unlock()
+		if subscribed {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) Append(ctx context.Context, mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
 	mbox, err := u.mailbox(mailbox)
 	if err != nil {
 		return nil, &imap.Error{
@@ -118,31 +238,99 @@ func (u *User) Append(mailbox string, r imap.LiteralReader, options *imap.Append
 			Text: "No such mailbox",
 		}
 	}
+	if err := u.checkQuota(r.Size(), 1); err != nil {
+		return nil, err
+	}
 	return mbox.appendLiteral(r, options)
 }
 
-func (u *User) Create(name string, options *imap.CreateOptions) error {
+func (u *User) MultiAppend(ctx context.Context, mailbox string, r *imapserver.MultiAppendReader) ([]*imap.AppendData, error) {
+	mbox, err := u.mailbox(mailbox)
+	if err != nil {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTryCreate,
+			Text: "No such mailbox",
+		}
+	}
+
+	// Read all messages before appending any of them, so that a failure
+	// leaves the mailbox untouched
+	var (
+		size     int64
+		bufs     [][]byte
+		messages []*imapserver.AppendMessage
+	)
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(msg.Literal); err != nil {
+			return nil, err
+		}
+		bufs = append(bufs, buf.Bytes())
+		messages = append(messages, msg)
+		size += int64(buf.Len())
+	}
+	if err := u.checkQuota(size, len(messages)); err != nil {
+		return nil, err
+	}
+
+	data := make([]*imap.AppendData, len(messages))
+	for i, msg := range messages {
+		data[i] = mbox.appendBytes(bufs[i], msg.Options)
+	}
+	return data, nil
+}
+
+func (u *User) Create(ctx context.Context, name string, options *imap.CreateOptions) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
-	name = strings.TrimRight(name, string(mailboxDelim))
+	name = strings.TrimRight(name, string(u.delim))
 
 	if u.mailboxes[name] != nil {
-		return &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeAlreadyExists,
-			Text: "Mailbox already exists",
+		return imapserver.ErrMailboxAlreadyExists
+	}
+
+	if options != nil {
+		for _, attr := range options.SpecialUse {
+			if !isSpecialUseAttr(attr) {
+				return &imap.Error{
+					Type: imap.StatusResponseTypeNo,
+					Code: imap.ResponseCodeUseAttr,
+					Text: "Unsupported special-use attribute",
+				}
+			}
 		}
 	}
 
 	// UIDVALIDITY must change if a mailbox is deleted and re-created with the
 	// same name.
 	u.prevUidValidity++
-	u.mailboxes[name] = NewMailbox(name, u.prevUidValidity)
+	mbox := NewMailbox(name, u.prevUidValidity)
+	if options != nil {
+		mbox.specialUse = options.SpecialUse
+	}
+	u.mailboxes[name] = mbox
+	delete(u.deleted, name)
 	return nil
 }
 
-func (u *User) Delete(name string) error {
+func isSpecialUseAttr(attr imap.MailboxAttr) bool {
+	switch attr {
+	case imap.MailboxAttrAll, imap.MailboxAttrArchive, imap.MailboxAttrDrafts, imap.MailboxAttrFlagged, imap.MailboxAttrJunk, imap.MailboxAttrSent, imap.MailboxAttrTrash:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *User) Delete(ctx context.Context, name string) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
@@ -151,14 +339,22 @@ func (u *User) Delete(name string) error {
 	}
 
 	delete(u.mailboxes, name)
+	if u.hasChildrenLocked(name) {
+		u.deleted[name] = struct{}{}
+	}
+	for deletedName := range u.deleted {
+		if !u.hasChildrenLocked(deletedName) {
+			delete(u.deleted, deletedName)
+		}
+	}
 	return nil
 }
 
-func (u *User) Rename(oldName, newName string) error {
+func (u *User) Rename(ctx context.Context, oldName, newName string) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 
-	newName = strings.TrimRight(newName, string(mailboxDelim))
+	newName = strings.TrimRight(newName, string(u.delim))
 
 	mbox, err := u.mailboxLocked(oldName)
 	if err != nil {
@@ -166,20 +362,17 @@ func (u *User) Rename(oldName, newName string) error {
 	}
 
 	if u.mailboxes[newName] != nil {
-		return &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeAlreadyExists,
-			Text: "Mailbox already exists",
-		}
+		return imapserver.ErrMailboxAlreadyExists
 	}
 
 	mbox.rename(newName)
 	u.mailboxes[newName] = mbox
+	delete(u.deleted, newName)
 	delete(u.mailboxes, oldName)
 	return nil
 }
 
-func (u *User) Subscribe(name string) error {
+func (u *User) Subscribe(ctx context.Context, name string) error {
 	mbox, err := u.mailbox(name)
 	if err != nil {
 		return err
@@ -188,7 +381,7 @@ func (u *User) Subscribe(name string) error {
 	return nil
 }
 
-func (u *User) Unsubscribe(name string) error {
+func (u *User) Unsubscribe(ctx context.Context, name string) error {
 	mbox, err := u.mailbox(name)
 	if err != nil {
 		return err
@@ -197,8 +390,8 @@ func (u *User) Unsubscribe(name string) error {
 	return nil
 }
 
-func (u *User) Namespace() (*imap.NamespaceData, error) {
+func (u *User) Namespace(ctx context.Context) (*imap.NamespaceData, error) {
 	return &imap.NamespaceData{
-		Personal: []imap.NamespaceDescriptor{{Delim: mailboxDelim}},
+		Personal: []imap.NamespaceDescriptor{{Delim: u.delim}},
 	}, nil
 }
@@ -0,0 +1,323 @@
+package imapserver
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-sasl"
+)
+
+// LegacySession is an IMAP session whose methods don't take a context.
+//
+// This is the shape of the Session interface before contexts were introduced.
+// Use AdaptLegacySession to turn it into a Session.
+type LegacySession interface {
+	Close() error
+
+	// Not authenticated state
+	Login(username, password string) error
+
+	// Authenticated state
+	Select(mailbox string, options *imap.SelectOptions) (*imap.SelectData, error)
+	Create(mailbox string, options *imap.CreateOptions) error
+	Delete(mailbox string) error
+	Rename(mailbox, newName string) error
+	Subscribe(mailbox string) error
+	Unsubscribe(mailbox string) error
+	List(w *ListWriter, ref string, patterns []string, options *imap.ListOptions) error
+	Status(mailbox string, options *imap.StatusOptions) (*imap.StatusData, error)
+	Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error)
+	Poll(w *UpdateWriter, allowExpunge bool) error
+	Idle(w *UpdateWriter, stop <-chan struct{}) error
+
+	// Selected state
+	Unselect() error
+	Expunge(w *ExpungeWriter, uids *imap.SeqSet) error
+	Search(kind NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error)
+	Fetch(w *FetchWriter, kind NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error
+	Store(w *FetchWriter, kind NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error
+	Copy(kind NumKind, seqSet imap.SeqSet, dest string) (*imap.CopyData, error)
+}
+
+type (
+	legacySessionNamespace interface {
+		Namespace() (*imap.NamespaceData, error)
+	}
+	legacySessionMove interface {
+		Move(w *MoveWriter, kind NumKind, seqSet imap.SeqSet, dest string) error
+	}
+	legacySessionID interface {
+		ID(clientParams map[string]*string) (serverParams map[string]*string, err error)
+	}
+	legacySessionSASL interface {
+		AuthenticateMechanisms() []string
+		Authenticate(mech string) (sasl.Server, error)
+	}
+)
+
+// AdaptLegacySession wraps a LegacySession into a Session. Contexts passed to
+// the Session methods are ignored.
+//
+// The returned Session implements SessionNamespace, SessionMove, SessionID
+// and SessionSASL only if the legacy session implements the corresponding
+// methods with their context-less signature.
+//
+// No other optional interface is adapted: the extensions they enable are
+// advertised based on the interfaces implemented by the session, so each
+// combination requires its own wrapper type. Sessions relying on other
+// optional interfaces need to be migrated to the context-aware signatures.
+func AdaptLegacySession(sess LegacySession) Session {
+	base := &legacySession{sess}
+
+	var (
+		mask       int
+		namespace  legacyNamespace
+		move       legacyMove
+		id         legacyID
+		saslServer legacySASL
+	)
+	if sess, ok := sess.(legacySessionNamespace); ok {
+		mask |= legacyHasNamespace
+		namespace = legacyNamespace{sess}
+	}
+	if sess, ok := sess.(legacySessionMove); ok {
+		mask |= legacyHasMove
+		move = legacyMove{sess}
+	}
+	if sess, ok := sess.(legacySessionID); ok {
+		mask |= legacyHasID
+		id = legacyID{sess}
+	}
+	if sess, ok := sess.(legacySessionSASL); ok {
+		mask |= legacyHasSASL
+		saslServer = legacySASL{sess}
+	}
+
+	const (
+		n  = legacyHasNamespace
+		m  = legacyHasMove
+		i  = legacyHasID
+		sa = legacyHasSASL
+	)
+	// Extensions are advertised only if the session implements the
+	// corresponding interface, so a wrapper type is needed for each subset
+	switch mask {
+	case 0:
+		return base
+	case n:
+		return struct {
+			*legacySession
+			legacyNamespace
+		}{base, namespace}
+	case m:
+		return struct {
+			*legacySession
+			legacyMove
+		}{base, move}
+	case i:
+		return struct {
+			*legacySession
+			legacyID
+		}{base, id}
+	case sa:
+		return struct {
+			*legacySession
+			legacySASL
+		}{base, saslServer}
+	case n | m:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacyMove
+		}{base, namespace, move}
+	case n | i:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacyID
+		}{base, namespace, id}
+	case n | sa:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacySASL
+		}{base, namespace, saslServer}
+	case m | i:
+		return struct {
+			*legacySession
+			legacyMove
+			legacyID
+		}{base, move, id}
+	case m | sa:
+		return struct {
+			*legacySession
+			legacyMove
+			legacySASL
+		}{base, move, saslServer}
+	case i | sa:
+		return struct {
+			*legacySession
+			legacyID
+			legacySASL
+		}{base, id, saslServer}
+	case n | m | i:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacyMove
+			legacyID
+		}{base, namespace, move, id}
+	case n | m | sa:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacyMove
+			legacySASL
+		}{base, namespace, move, saslServer}
+	case n | i | sa:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacyID
+			legacySASL
+		}{base, namespace, id, saslServer}
+	case m | i | sa:
+		return struct {
+			*legacySession
+			legacyMove
+			legacyID
+			legacySASL
+		}{base, move, id, saslServer}
+	default:
+		return struct {
+			*legacySession
+			legacyNamespace
+			legacyMove
+			legacyID
+			legacySASL
+		}{base, namespace, move, id, saslServer}
+	}
+}
+
+const (
+	legacyHasNamespace = 1 << iota
+	legacyHasMove
+	legacyHasID
+	legacyHasSASL
+)
+
+type legacySession struct {
+	sess LegacySession
+}
+
+func (s *legacySession) Close() error {
+	return s.sess.Close()
+}
+
+func (s *legacySession) Login(ctx context.Context, username, password string) error {
+	return s.sess.Login(username, password)
+}
+
+func (s *legacySession) Select(ctx context.Context, mailbox string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	return s.sess.Select(mailbox, options)
+}
+
+func (s *legacySession) Create(ctx context.Context, mailbox string, options *imap.CreateOptions) error {
+	return s.sess.Create(mailbox, options)
+}
+
+func (s *legacySession) Delete(ctx context.Context, mailbox string) error {
+	return s.sess.Delete(mailbox)
+}
+
+func (s *legacySession) Rename(ctx context.Context, mailbox, newName string) error {
+	return s.sess.Rename(mailbox, newName)
+}
+
+func (s *legacySession) Subscribe(ctx context.Context, mailbox string) error {
+	return s.sess.Subscribe(mailbox)
+}
+
+func (s *legacySession) Unsubscribe(ctx context.Context, mailbox string) error {
+	return s.sess.Unsubscribe(mailbox)
+}
+
+func (s *legacySession) List(ctx context.Context, w *ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	return s.sess.List(w, ref, patterns, options)
+}
+
+func (s *legacySession) Status(ctx context.Context, mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	return s.sess.Status(mailbox, options)
+}
+
+func (s *legacySession) Append(ctx context.Context, mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	return s.sess.Append(mailbox, r, options)
+}
+
+func (s *legacySession) Poll(ctx context.Context, w *UpdateWriter, allowExpunge bool) error {
+	return s.sess.Poll(w, allowExpunge)
+}
+
+func (s *legacySession) Idle(ctx context.Context, w *UpdateWriter, stop <-chan struct{}) error {
+	return s.sess.Idle(w, stop)
+}
+
+func (s *legacySession) Unselect(ctx context.Context) error {
+	return s.sess.Unselect()
+}
+
+func (s *legacySession) Expunge(ctx context.Context, w *ExpungeWriter, uids *imap.SeqSet) error {
+	return s.sess.Expunge(w, uids)
+}
+
+func (s *legacySession) Search(ctx context.Context, kind NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	return s.sess.Search(kind, criteria, options)
+}
+
+func (s *legacySession) Fetch(ctx context.Context, w *FetchWriter, kind NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	return s.sess.Fetch(w, kind, seqSet, options)
+}
+
+func (s *legacySession) Store(ctx context.Context, w *FetchWriter, kind NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+	return s.sess.Store(w, kind, seqSet, flags, options)
+}
+
+func (s *legacySession) Copy(ctx context.Context, kind NumKind, seqSet imap.SeqSet, dest string) (*imap.CopyData, error) {
+	return s.sess.Copy(kind, seqSet, dest)
+}
+
+type legacyNamespace struct {
+	sess legacySessionNamespace
+}
+
+func (s legacyNamespace) Namespace(ctx context.Context) (*imap.NamespaceData, error) {
+	return s.sess.Namespace()
+}
+
+type legacyMove struct {
+	sess legacySessionMove
+}
+
+func (s legacyMove) Move(ctx context.Context, w *MoveWriter, kind NumKind, seqSet imap.SeqSet, dest string) error {
+	return s.sess.Move(w, kind, seqSet, dest)
+}
+
+type legacyID struct {
+	sess legacySessionID
+}
+
+func (s legacyID) ID(ctx context.Context, clientParams map[string]*string) (map[string]*string, error) {
+	return s.sess.ID(clientParams)
+}
+
+type legacySASL struct {
+	sess legacySessionSASL
+}
+
+func (s legacySASL) AuthenticateMechanisms() []string {
+	return s.sess.AuthenticateMechanisms()
+}
+
+func (s legacySASL) Authenticate(ctx context.Context, mech string) (sasl.Server, error) {
+	return s.sess.Authenticate(mech)
+}
@@ -9,47 +9,66 @@ import (
 	"github.com/emersion/go-imap/v2/internal/utf7"
 )
 
-func (c *Conn) handleList(dec *imapwire.Decoder) error {
+func (c *Conn) handleList(dec *imapwire.Decoder) (exec func() error, err error) {
 	ref, pattern, options, returnRecent, err := readListCmd(dec)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
-		return err
-	}
+	return func() error {
+		if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+			return err
+		}
 
-	w := &ListWriter{
-		conn:         c,
-		options:      options,
-		returnRecent: returnRecent,
-	}
-	return c.session.List(w, ref, pattern, options)
+		w := &ListWriter{
+			conn:         c,
+			options:      options,
+			returnRecent: returnRecent,
+			delim:        c.sessionHierarchyDelim(),
+		}
+		if len(pattern) > 1 {
+			// A mailbox matching several patterns must be returned once
+			w.seen = make(map[string]struct{})
+		}
+		return c.session.List(c.ctx, w, ref, pattern, options)
+	}, nil
 }
 
-func (c *Conn) handleLSub(dec *imapwire.Decoder) error {
+func (c *Conn) handleLSub(dec *imapwire.Decoder) (exec func() error, err error) {
 	var ref string
 	if !dec.ExpectSP() || !dec.ExpectMailbox(&ref) || !dec.ExpectSP() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 	pattern, err := readListMailbox(dec)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !dec.ExpectCRLF() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 
-	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
-		return err
-	}
+	return func() error {
+		if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+			return err
+		}
+
+		options := &imap.ListOptions{SelectSubscribed: true}
+		w := &ListWriter{
+			conn:  c,
+			lsub:  true,
+			delim: c.sessionHierarchyDelim(),
+		}
+		return c.session.List(c.ctx, w, ref, []string{pattern}, options)
+	}, nil
+}
 
-	options := &imap.ListOptions{SelectSubscribed: true}
-	w := &ListWriter{
-		conn: c,
-		lsub: true,
+// sessionHierarchyDelim returns the delimiter of sessions implementing
+// SessionHierarchyDelim, or zero.
+func (c *Conn) sessionHierarchyDelim() rune {
+	if session, ok := c.session.(SessionHierarchyDelim); ok {
+		return session.HierarchyDelim()
 	}
-	return c.session.List(w, ref, []string{pattern}, options)
+	return 0
 }
 
 func (c *Conn) writeList(data *imap.ListData) error {
@@ -136,6 +155,8 @@ func readListCmd(dec *imapwire.Decoder) (ref string, patterns []string, options
 			options.SelectRemote = true
 		case "RECURSIVEMATCH":
 			options.SelectRecursiveMatch = true
+		case "SPECIAL-USE":
+			options.SelectSpecialUse = true
 		default:
 			return newClientBugError("Unknown LIST select option")
 		}
@@ -230,6 +251,8 @@ func readReturnOption(dec *imapwire.Decoder, options *imap.ListOptions, recent *
 		options.ReturnSubscribed = true
 	case "CHILDREN":
 		options.ReturnChildren = true
+	case "SPECIAL-USE":
+		options.ReturnSpecialUse = true
 	case "STATUS":
 		if !dec.ExpectSP() {
 			return dec.Err()
@@ -254,10 +277,32 @@ type ListWriter struct {
 	options      *imap.ListOptions
 	returnRecent bool
 	lsub         bool
+	delim        rune
+	seen         map[string]struct{} // mailboxes already written, if any
 }
 
 // WriteList writes a single LIST response for a mailbox.
+//
+// If data.Delim is zero and the session implements SessionHierarchyDelim,
+// the session's delimiter is used. Set data.NoDelim to report a mailbox
+// without a hierarchy delimiter.
+//
+// When the command has multiple patterns, mailboxes which have already been
+// written are skipped, so that sessions can handle each pattern separately.
 func (w *ListWriter) WriteList(data *imap.ListData) error {
+	if w.seen != nil {
+		if _, ok := w.seen[data.Mailbox]; ok {
+			return nil
+		}
+		w.seen[data.Mailbox] = struct{}{}
+	}
+
+	if data.Delim == 0 && !data.NoDelim && w.delim != 0 {
+		dataCopy := *data
+		dataCopy.Delim = w.delim
+		data = &dataCopy
+	}
+
 	if w.lsub {
 		return w.conn.writeLSub(data)
 	}
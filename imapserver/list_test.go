@@ -1,9 +1,15 @@
 package imapserver_test
 
 import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
 )
 
 var matchListTests = []struct {
@@ -49,3 +55,299 @@ func TestMatchList(t *testing.T) {
 		}
 	}
 }
+
+func newListTestConn(t *testing.T) *testConn {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:    {},
+			imap.CapListExtended: {},
+		},
+	})
+	tc.login()
+	for _, name := range []string{"Archive", "Archive/2023", "Drafts"} {
+		tc.writeLine("C1 CREATE %v", name)
+		tc.expectOK("C1")
+	}
+	for _, name := range []string{"INBOX", "Archive/2023"} {
+		tc.writeLine("U1 SUBSCRIBE %v", name)
+		tc.expectOK("U1")
+	}
+	return tc
+}
+
+func TestListReturnSubscribed(t *testing.T) {
+	tc := newListTestConn(t)
+
+	tc.writeLine(`L2 LIST "" "*" RETURN (SUBSCRIBED)`)
+	got := tc.expectOK("L2")
+	want := []string{
+		`* LIST () "/" "Archive"`,
+		`* LIST (\Subscribed) "/" "Archive/2023"`,
+		`* LIST () "/" "Drafts"`,
+		`* LIST (\Subscribed) "/" INBOX`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestListRecursiveMatch(t *testing.T) {
+	tc := newListTestConn(t)
+
+	tc.writeLine(`L2 LIST (SUBSCRIBED RECURSIVEMATCH) "" "%%" RETURN (CHILDREN)`)
+	got := tc.expectOK("L2")
+	want := []string{
+		`* LIST (\HasChildren) "/" "Archive" (CHILDINFO ("SUBSCRIBED"))`,
+		`* LIST (\Subscribed \HasNoChildren) "/" INBOX`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestListSpecialUse(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:        {},
+			imap.CapListExtended:     {},
+			imap.CapSpecialUse:       {},
+			imap.CapCreateSpecialUse: {},
+		},
+	})
+	tc.login()
+
+	tc.writeLine(`C1 CREATE Sent (USE (\Sent))`)
+	tc.expectOK("C1")
+	tc.writeLine(`C2 CREATE Trash (USE (\Trash))`)
+	tc.expectOK("C2")
+	tc.writeLine(`C3 CREATE Notes`)
+	tc.expectOK("C3")
+	tc.writeLine(`C4 CREATE Bogus (USE (\Bogus))`)
+	if resp, _ := tc.readTagged("C4"); !strings.HasPrefix(resp, "C4 NO [USEATTR] ") {
+		t.Errorf("expected NO [USEATTR], got %q", resp)
+	}
+
+	tc.writeLine(`L2 LIST (SPECIAL-USE) "" "*"`)
+	got := tc.expectOK("L2")
+	want := []string{
+		`* LIST (\Sent) "/" "Sent"`,
+		`* LIST (\Trash) "/" "Trash"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine(`L3 LIST "" "*" RETURN (SPECIAL-USE)`)
+	got = tc.expectOK("L3")
+	want = []string{
+		`* LIST () "/" INBOX`,
+		`* LIST () "/" "Notes"`,
+		`* LIST (\Sent) "/" "Sent"`,
+		`* LIST (\Trash) "/" "Trash"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHierarchyDelim(t *testing.T) {
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(testUsername, testPassword)
+	user.SetHierarchyDelim('.')
+	user.Create(context.Background(), "INBOX", nil)
+	memServer.AddUser(user)
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+	})
+	tc.login()
+
+	for _, name := range []string{"Work", "Work.Projects", "Work.Projects.Go", "Archive."} {
+		tc.writeLine("A1 CREATE %q", name)
+		tc.expectOK("A1")
+	}
+
+	tc.writeLine(`A2 LIST "" "Work.%%"`)
+	want := []string{`* LIST () "." "Work.Projects"`}
+	if got := tc.expectOK("A2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LIST = %q, want %q", got, want)
+	}
+	tc.writeLine(`A3 LIST "" ""`)
+	want = []string{`* LIST (\Noselect) "." ""`}
+	if got := tc.expectOK("A3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LIST = %q, want %q", got, want)
+	}
+
+	tc.writeLine("A4 RENAME Work.Projects.Go Work.Go")
+	tc.expectOK("A4")
+
+	for _, cmd := range []string{
+		`CREATE "Work..Empty"`,
+		`CREATE ".Work"`,
+		`CREATE "Work.."`,
+		`RENAME Work.Go "Work..Go"`,
+		`CREATE "Tab&AAk-Name"`, // modified UTF-7 for "Tab\tName"
+	} {
+		tc.writeLine("A5 %v", cmd)
+		if resp, _ := tc.readTagged("A5"); !strings.HasPrefix(resp, "A5 NO [CANNOT] ") {
+			t.Errorf("%v: got %q, want NO [CANNOT]", cmd, resp)
+		}
+	}
+
+	tc.writeLine("A6 CREATE \"Tab\tName\"")
+	if resp, _ := tc.readTagged("A6"); !strings.HasPrefix(resp, "A6 BAD ") {
+		t.Errorf("CREATE with a control character: got %q, want BAD", resp)
+	}
+}
+
+func TestListNoSelect(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+
+	for _, name := range []string{"Work/Projects/Go", "Archive", "Archive/2024"} {
+		tc.writeLine("A1 CREATE %q", name)
+		tc.expectOK("A1")
+	}
+	tc.writeLine("A2 DELETE Archive")
+	tc.expectOK("A2")
+
+	tc.writeLine(`A3 LIST "" "*"`)
+	want := []string{
+		`* LIST (\NonExistent) "/" "Archive"`,
+		`* LIST () "/" "Archive/2024"`,
+		`* LIST () "/" INBOX`,
+		`* LIST (\Noselect) "/" "Work"`,
+		`* LIST (\Noselect) "/" "Work/Projects"`,
+		`* LIST () "/" "Work/Projects/Go"`,
+	}
+	if got := tc.expectOK("A3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LIST = %q, want %q", got, want)
+	}
+
+	tc.writeLine(`A4 LIST "" "%%"`)
+	want = []string{
+		`* LIST (\NonExistent) "/" "Archive"`,
+		`* LIST () "/" INBOX`,
+		`* LIST (\Noselect) "/" "Work"`,
+	}
+	if got := tc.expectOK("A4"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LIST = %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"Work", "Work/Projects", "Archive"} {
+		tc.writeLine("A5 SELECT %q", name)
+		if resp, _ := tc.readTagged("A5"); !strings.HasPrefix(resp, "A5 NO [CANNOT] ") {
+			t.Errorf("SELECT %v: got %q, want NO [CANNOT]", name, resp)
+		}
+	}
+
+	tc.writeLine("A6 CREATE Work")
+	tc.expectOK("A6")
+	tc.writeLine("A7 SELECT Work")
+	tc.expectOK("A7")
+}
+
+// perPatternListSession lists each pattern separately, which may write the
+// same mailbox multiple times.
+type perPatternListSession struct {
+	imapserver.Session
+}
+
+func (sess *perPatternListSession) List(ctx context.Context, w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	for _, pattern := range patterns {
+		if err := sess.Session.List(ctx, w, ref, []string{pattern}, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestListMultiplePatterns(t *testing.T) {
+	memServer := newTestMemServer()
+	for _, newSession := range []func() imapserver.Session{
+		func() imapserver.Session {
+			return memServer.NewSession()
+		},
+		func() imapserver.Session {
+			return &perPatternListSession{memServer.NewSession()}
+		},
+	} {
+		tc := newTestServer(t, &imapserver.Options{
+			NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+				return newSession(), nil, nil
+			},
+			Caps: imap.CapSet{
+				imap.CapIMAP4rev1:    {},
+				imap.CapListExtended: {},
+			},
+		})
+		tc.login()
+		if !hasCap(tc.capabilities(), string(imap.CapListExtended)) {
+			t.Errorf("LIST-EXTENDED capability not advertised")
+		}
+
+		for _, name := range []string{"Sent", "Drafts", "Archive"} {
+			tc.writeLine("A1 CREATE %v", name)
+			if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 OK ") && !strings.HasPrefix(resp, "A1 NO [ALREADYEXISTS] ") {
+				t.Fatalf("CREATE %v: got %q", name, resp)
+			}
+		}
+
+		tc.writeLine(`A2 LIST "" ("INBOX" "Sent" "Drafts")`)
+		want := []string{
+			`* LIST () "/" INBOX`,
+			`* LIST () "/" "Sent"`,
+			`* LIST () "/" "Drafts"`,
+		}
+		got := tc.expectOK("A2")
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LIST = %q, want %q", got, want)
+		}
+
+		// Mailboxes matching several patterns are listed once
+		tc.writeLine(`A3 LIST "" ("Sent" "*nt" "Drafts")`)
+		want = []string{
+			`* LIST () "/" "Drafts"`,
+			`* LIST () "/" "Sent"`,
+		}
+		got = tc.expectOK("A3")
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LIST = %q, want %q", got, want)
+		}
+	}
+}
+
+type flatMailboxSession struct {
+	imapserver.Session
+}
+
+func (sess *flatMailboxSession) HierarchyDelim() rune {
+	return '/'
+}
+
+func (sess *flatMailboxSession) List(ctx context.Context, w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	if err := w.WriteList(&imap.ListData{Mailbox: "INBOX"}); err != nil {
+		return err
+	}
+	return w.WriteList(&imap.ListData{Mailbox: "Flat", NoDelim: true})
+}
+
+func TestListNoDelim(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &flatMailboxSession{memServer.NewSession()}, nil, nil
+		},
+	})
+	tc.login()
+
+	tc.writeLine(`A1 LIST "" "*"`)
+	want := []string{`* LIST () "/" INBOX`, `* LIST () NIL "Flat"`}
+	if got := tc.expectOK("A1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LIST = %q, want %q", got, want)
+	}
+}
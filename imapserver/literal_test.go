@@ -0,0 +1,159 @@
+package imapserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestAppendLargeLiteral(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		MaxCommandLiteralSize: map[string]int64{"APPEND": 16 * 1024 * 1024},
+	})
+	tc.login()
+
+	const size = 10 * 1024 * 1024
+	header := "From: <root@nsa.gov>\r\n\r\n"
+	body := header + strings.Repeat("a", size-len(header))
+
+	tc.writeLine("A1 APPEND INBOX {%v}", size)
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.writeString(body + "\r\n")
+	tc.expectOK("A1")
+}
+
+func TestAppendLiteralTooBig(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		MaxCommandLiteralSize: map[string]int64{"APPEND": 1024},
+	})
+	tc.login()
+
+	tc.writeLine("A1 APPEND INBOX {2048}")
+	resp, _ := tc.readTagged("A1")
+	if !strings.HasPrefix(resp, "A1 NO [TOOBIG]") {
+		t.Errorf("expected NO [TOOBIG], got %q", resp)
+	}
+}
+
+func TestLoginLiteralTooBig(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		MaxCommandLiteralSize: map[string]int64{"APPEND": 16 * 1024 * 1024},
+	})
+
+	tc.writeLine("L1 LOGIN {5000}")
+	resp, _ := tc.readTagged("L1")
+	if !strings.HasPrefix(resp, "L1 NO [TOOBIG]") {
+		t.Errorf("expected NO [TOOBIG], got %q", resp)
+	}
+
+	// The connection must still be usable
+	tc.login()
+}
+
+func TestMaxLiteralSize(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		MaxLiteralSize: 8192,
+	})
+
+	password := strings.Repeat("a", 5000)
+	tc.writeLine("L1 LOGIN %v {%v}", testUsername, len(password))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.writeString(password + "\r\n")
+	resp, _ := tc.readTagged("L1")
+	if !strings.HasPrefix(resp, "L1 NO [AUTHENTICATIONFAILED]") {
+		t.Errorf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+	}
+
+	// APPEND is subject to MaxLiteralSize too
+	tc.login()
+	tc.writeLine("A1 APPEND INBOX {10000}")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [TOOBIG]") {
+		t.Errorf("expected NO [TOOBIG], got %q", resp)
+	}
+}
+
+// newLargeTestMessage returns a message larger than the LITERAL- limit.
+func newLargeTestMessage() string {
+	return testMessage + strings.Repeat("a", 5000) + "\r\n"
+}
+
+func TestLiteralMinus(t *testing.T) {
+	// LITERAL+ in Caps doesn't lift the limit
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:   {},
+			imap.CapLiteralPlus: {},
+		},
+	})
+	caps := tc.capabilities()
+	if !hasCap(caps, "LITERAL-") || hasCap(caps, "LITERAL+") {
+		t.Errorf("expected LITERAL- only, got %v", caps)
+	}
+	tc.login()
+
+	// Small non-synchronizing literals don't need a continuation request
+	tc.writeLine("A1 APPEND INBOX {%v+}\r\n%v", len(testMessage), testMessage)
+	tc.expectOK("A1")
+
+	msg := newLargeTestMessage()
+	tc.writeLine("A2 APPEND INBOX {%v+}", len(msg))
+	if resp, _ := tc.readTagged("A2"); !strings.HasPrefix(resp, "A2 BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+}
+
+func TestLiteralPlus(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		AllowUnlimitedNonSyncLiterals: true,
+	})
+	caps := tc.capabilities()
+	if !hasCap(caps, "LITERAL+") || hasCap(caps, "LITERAL-") {
+		t.Errorf("expected LITERAL+ only, got %v", caps)
+	}
+	tc.login()
+
+	msg := newLargeTestMessage()
+	tc.writeLine("A1 APPEND INBOX {%v+}\r\n%v", len(msg), msg)
+	tc.expectOK("A1")
+
+	// The command-specific limits still apply
+	password := strings.Repeat("a", 5000)
+	tc.writeLine("L1 LOGIN %v {%v+}", testUsername, len(password))
+	if resp, _ := tc.readTagged("L1"); !strings.HasPrefix(resp, "L1 NO [TOOBIG]") {
+		t.Errorf("expected NO [TOOBIG], got %q", resp)
+	}
+}
+
+func TestLoginMultipleLiterals(t *testing.T) {
+	tc := newTestServer(t, nil)
+
+	// Each synchronizing literal needs its own continuation request
+	tc.writeLine("L1 LOGIN {%v}", len(testUsername))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request for the username, got %q", line)
+	}
+	tc.writeLine("%v {%v}", testUsername, len(testPassword))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request for the password, got %q", line)
+	}
+	tc.writeLine("%v", testPassword)
+	tc.expectOK("L1")
+
+	// A second literal can be rejected after the first one was accepted
+	tc = newTestServer(t, nil)
+	tc.writeLine("L2 LOGIN {%v}", len(testUsername))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request for the username, got %q", line)
+	}
+	tc.writeLine("%v {5000}", testUsername)
+	if resp, _ := tc.readTagged("L2"); !strings.HasPrefix(resp, "L2 NO [TOOBIG]") {
+		t.Errorf("expected NO [TOOBIG], got %q", resp)
+	}
+	tc.login()
+}
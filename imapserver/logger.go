@@ -0,0 +1,70 @@
+package imapserver
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// legacyLogHandler is a slog.Handler which formats records as text lines and
+// prints them to a Logger.
+type legacyLogHandler struct {
+	logger Logger
+	attrs  string // pre-formatted attributes
+	prefix string // group prefix
+}
+
+var _ slog.Handler = (*legacyLogHandler)(nil)
+
+func (h *legacyLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *legacyLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+	r.Attrs(func(attr slog.Attr) bool {
+		writeLegacyLogAttr(&sb, h.prefix, attr)
+		return true
+	})
+	h.logger.Printf("%s", sb.String())
+	return nil
+}
+
+func (h *legacyLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+	sb.WriteString(h.attrs)
+	for _, attr := range attrs {
+		writeLegacyLogAttr(&sb, h.prefix, attr)
+	}
+	return &legacyLogHandler{logger: h.logger, attrs: sb.String(), prefix: h.prefix}
+}
+
+func (h *legacyLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &legacyLogHandler{logger: h.logger, attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+func writeLegacyLogAttr(sb *strings.Builder, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, attr := range attr.Value.Group() {
+			writeLegacyLogAttr(sb, prefix, attr)
+		}
+		return
+	}
+	sb.WriteString(" ")
+	sb.WriteString(prefix)
+	sb.WriteString(attr.Key)
+	sb.WriteString("=")
+	sb.WriteString(attr.Value.String())
+}
@@ -0,0 +1,90 @@
+package imapserver_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+type failingFetchSession struct {
+	imapserver.Session
+}
+
+func (sess *failingFetchSession) Fetch(ctx context.Context, w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	return errors.New("disk on fire")
+}
+
+// logBuffer is a thread-safe log output.
+type logBuffer struct {
+	mutex sync.Mutex
+	sb    strings.Builder
+}
+
+func (buf *logBuffer) Write(b []byte) (int, error) {
+	buf.mutex.Lock()
+	defer buf.mutex.Unlock()
+	return buf.sb.Write(b)
+}
+
+func (buf *logBuffer) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(buf, format+"\n", args...)
+}
+
+func (buf *logBuffer) String() string {
+	buf.mutex.Lock()
+	defer buf.mutex.Unlock()
+	return buf.sb.String()
+}
+
+func testCommandErrorLog(t *testing.T, options *imapserver.Options) {
+	memServer := newTestMemServer()
+	options.NewSession = func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+		return &failingFetchSession{memServer.NewSession()}, nil, nil
+	}
+	tc := newTestServer(t, options)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("F1 FETCH 1 (FLAGS)")
+	if resp, _ := tc.readTagged("F1"); !strings.HasPrefix(resp, "F1 NO [SERVERBUG]") {
+		t.Errorf("expected NO [SERVERBUG], got %q", resp)
+	}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	var buf logBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	testCommandErrorLog(t, &imapserver.Options{StructuredLogger: logger})
+
+	out := buf.String()
+	for _, s := range []string{
+		`msg="failed to handle command"`,
+		"conn=1",
+		"remote_addr=127.0.0.1:",
+		"tag=F1",
+		"command=FETCH",
+		`err="disk on fire"`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("log output doesn't contain %q: %q", s, out)
+		}
+	}
+}
+
+func TestLegacyLogger(t *testing.T) {
+	var buf logBuffer
+	testCommandErrorLog(t, &imapserver.Options{Logger: &buf})
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "failed to handle command conn=1 remote_addr=127.0.0.1:") || !strings.HasSuffix(out, " tag=F1 command=FETCH err=disk on fire\n") {
+		t.Errorf("unexpected log output: %q", out)
+	}
+}
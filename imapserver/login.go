@@ -20,8 +20,8 @@ func (c *Conn) handleLogin(tag string, dec *imapwire.Decoder) error {
 			Text: "TLS is required to authenticate",
 		}
 	}
-	if err := c.session.Login(username, password); err != nil {
-		return err
+	if err := c.session.Login(c.ctx, username, password); err != nil {
+		return loginError(err)
 	}
 	c.state = imap.ConnStateAuthenticated
 	return c.writeCapabilityStatus(tag, imap.StatusResponseTypeOK, "Logged in")
@@ -0,0 +1,158 @@
+package imapserver
+
+import (
+	"bufio"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MailboxLocks is a set of per-mailbox locks. It can be embedded in a session
+// to implement SessionMailboxLocker.
+//
+// Mailbox names are per-user, so all sessions of a user should share the
+// same MailboxLocks. The zero value is ready to use.
+type MailboxLocks struct {
+	mutex sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// LockMailbox implements SessionMailboxLocker.
+func (l *MailboxLocks) LockMailbox(ctx context.Context, mailbox string) error {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]chan struct{})
+	}
+	ch, ok := l.locks[mailbox]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.locks[mailbox] = ch
+	}
+	l.mutex.Unlock()
+
+	select {
+	case ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UnlockMailbox implements SessionMailboxLocker.
+func (l *MailboxLocks) UnlockMailbox(mailbox string) {
+	l.mutex.Lock()
+	ch := l.locks[mailbox]
+	l.mutex.Unlock()
+
+	<-ch
+}
+
+// lockMailboxes locks the provided mailboxes if the session implements
+// SessionMailboxLocker. The returned function unlocks them.
+//
+// Responses are held in memory while the mailboxes are locked, so that a
+// client which is slow to read them doesn't stall other connections.
+func (c *Conn) lockMailboxes(mailboxes ...string) (unlock func(), err error) {
+	locker, ok := c.session.(SessionMailboxLocker)
+	if !ok {
+		return func() {}, nil
+	}
+
+	// Lock in a consistent order to avoid deadlocks between connections
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range mailboxes {
+		if strings.EqualFold(name, "INBOX") {
+			name = "INBOX"
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	unlockAll := func() {
+		for i := len(names) - 1; i >= 0; i-- {
+			locker.UnlockMailbox(names[i])
+		}
+	}
+	for i, name := range names {
+		if err := locker.LockMailbox(c.ctx, name); err != nil {
+			names = names[:i]
+			unlockAll()
+			return nil, err
+		}
+	}
+
+	release := c.holdResponses()
+	return func() {
+		unlockAll()
+		release()
+	}, nil
+}
+
+// holdResponses buffers responses in memory instead of writing them to the
+// connection, until the returned function is called.
+//
+// If the buffered responses exceed Options.MaxWriteBuffer, they are written
+// to the connection and the following responses aren't held anymore.
+func (c *Conn) holdResponses() (release func()) {
+	c.encMutex.Lock()
+	c.holds++
+	if c.held == nil {
+		c.held = bufio.NewWriter(heldWriter{c})
+	}
+	c.encMutex.Unlock()
+
+	return func() {
+		c.encMutex.Lock()
+		defer c.encMutex.Unlock()
+
+		c.holds--
+		c.held.Flush()
+		if c.holds > 0 {
+			return
+		}
+		c.holdOverflow = false
+		if c.heldBuf.Len() == 0 {
+			return
+		}
+
+		// Write errors are reported when writing the next response
+		c.setWriteTimeout(c.server.options.Timeouts.ResponseWrite)
+		c.bw.Write(c.heldBuf.Bytes())
+		c.bw.Flush()
+		c.setWriteTimeout(0)
+		c.heldBuf.Reset()
+	}
+}
+
+// heldWriter writes held responses to Conn.heldBuf. It's only used with
+// Conn.encMutex locked.
+type heldWriter struct {
+	conn *Conn
+}
+
+func (w heldWriter) Write(b []byte) (int, error) {
+	c := w.conn
+	if !c.holdOverflow {
+		if c.heldBuf.Len()+len(b) <= c.server.options.maxHeldResponses() {
+			return c.heldBuf.Write(b)
+		}
+
+		// Too much data is held, give up and write it to the connection
+		c.holdOverflow = true
+		if _, err := c.bw.Write(c.heldBuf.Bytes()); err != nil {
+			return 0, err
+		}
+		c.heldBuf.Reset()
+	}
+
+	n, err := c.bw.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.bw.Flush()
+}
@@ -0,0 +1,269 @@
+package imapserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+func (c *Conn) handleGetMetadata(tag string, dec *imapwire.Decoder) error {
+	var (
+		mailbox string
+		entries []string
+		options imap.GetMetadataOptions
+	)
+	if !dec.ExpectSP() {
+		return dec.Err()
+	}
+
+	// RFC 5464 puts the options before the mailbox in the formal syntax, but
+	// after the mailbox in the examples: accept both
+	hasOptions, err := dec.List(func() error {
+		var name string
+		if !dec.ExpectAtom(&name) {
+			return dec.Err()
+		}
+		return readGetMetadataOption(dec, name, &options)
+	})
+	if err != nil {
+		return fmt.Errorf("in getmetadata-options: %w", err)
+	}
+	if hasOptions && !dec.ExpectSP() {
+		return dec.Err()
+	}
+
+	if !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+
+	isList, err := dec.List(func() error {
+		var name string
+		if !dec.ExpectAString(&name) {
+			return dec.Err()
+		}
+		if len(entries) == 0 && isGetMetadataOption(name) {
+			return readGetMetadataOption(dec, name, &options)
+		}
+		entries = append(entries, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if isList && len(entries) == 0 {
+		// The list contained options, the entries follow
+		if !dec.ExpectSP() {
+			return dec.Err()
+		}
+		isList, err = dec.List(func() error {
+			var name string
+			if !dec.ExpectAString(&name) {
+				return dec.Err()
+			}
+			entries = append(entries, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !isList {
+		var name string
+		if !dec.ExpectAString(&name) {
+			return dec.Err()
+		}
+		entries = append(entries, name)
+	}
+
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	for _, entry := range entries {
+		if err := checkMetadataEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	session, err := c.metadataSession(mailbox)
+	if err != nil {
+		return err
+	}
+
+	data, err := session.GetMetadata(c.ctx, mailbox, entries, &options)
+	if err != nil {
+		return err
+	}
+
+	var longEntries uint32
+	values := make(map[string][]byte, len(data.EntryValues))
+	for name, value := range data.EntryValues {
+		if value == nil {
+			continue
+		}
+		if size := uint32(len(*value)); options.MaxSize != nil && size > *options.MaxSize {
+			if size > longEntries {
+				longEntries = size
+			}
+			continue
+		}
+		values[name] = *value
+	}
+
+	if len(values) > 0 {
+		if err := c.writeMetadata(mailbox, values); err != nil {
+			return err
+		}
+	}
+
+	resp := &imap.StatusResponse{
+		Type: imap.StatusResponseTypeOK,
+		Text: "GETMETADATA completed",
+	}
+	if longEntries > 0 {
+		resp.Code = imap.ResponseCode(fmt.Sprintf("METADATA LONGENTRIES %v", longEntries))
+	}
+	return c.writeStatusResp(tag, resp)
+}
+
+func isGetMetadataOption(name string) bool {
+	switch strings.ToUpper(name) {
+	case "MAXSIZE", "DEPTH":
+		return true
+	default:
+		return false
+	}
+}
+
+func readGetMetadataOption(dec *imapwire.Decoder, name string, options *imap.GetMetadataOptions) error {
+	if !dec.ExpectSP() {
+		return dec.Err()
+	}
+	switch strings.ToUpper(name) {
+	case "MAXSIZE":
+		var maxSize uint32
+		if !dec.ExpectNumber(&maxSize) {
+			return dec.Err()
+		}
+		options.MaxSize = &maxSize
+	case "DEPTH":
+		var depth string
+		if !dec.ExpectAtom(&depth) {
+			return dec.Err()
+		}
+		switch strings.ToLower(depth) {
+		case "0":
+			options.Depth = imap.GetMetadataDepthZero
+		case "1":
+			options.Depth = imap.GetMetadataDepthOne
+		case "infinity":
+			options.Depth = imap.GetMetadataDepthInfinity
+		default:
+			return newClientBugError("Invalid GETMETADATA depth")
+		}
+	default:
+		return newClientBugError("Unknown GETMETADATA option")
+	}
+	return nil
+}
+
+func (c *Conn) handleSetMetadata(dec *imapwire.Decoder) error {
+	var mailbox string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+
+	entries := make(map[string]*[]byte)
+	err := dec.ExpectList(func() error {
+		var name string
+		if !dec.ExpectAString(&name) || !dec.ExpectSP() {
+			return dec.Err()
+		}
+
+		var (
+			value *[]byte
+			s     string
+		)
+		if dec.Atom(&s) {
+			if !dec.Expect(strings.EqualFold(s, "NIL"), "nstring") {
+				return dec.Err()
+			}
+		} else if !dec.ExpectString(&s) {
+			return dec.Err()
+		} else {
+			b := []byte(s)
+			value = &b
+		}
+		entries[name] = value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	for name := range entries {
+		if err := checkMetadataEntry(name); err != nil {
+			return err
+		}
+	}
+
+	session, err := c.metadataSession(mailbox)
+	if err != nil {
+		return err
+	}
+
+	return session.SetMetadata(c.ctx, mailbox, entries)
+}
+
+func (c *Conn) metadataSession(mailbox string) (SessionMetadata, error) {
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return nil, err
+	}
+
+	caps := c.server.options.caps()
+	supported := caps.Has(imap.CapMetadata)
+	if mailbox == "" {
+		supported = supported || caps.Has(imap.CapMetadataServer)
+	}
+	session, ok := c.session.(SessionMetadata)
+	if !ok || !supported {
+		return nil, newClientBugError("METADATA is not supported")
+	}
+	return session, nil
+}
+
+// checkMetadataEntry checks that an entry name is in the /private or /shared
+// hierarchy (see RFC 5464 section 3.2).
+func checkMetadataEntry(name string) error {
+	lower := strings.ToLower(name)
+	if !strings.HasPrefix(lower, "/private/") && !strings.HasPrefix(lower, "/shared/") {
+		return newClientBugError("Metadata entry names must start with /private/ or /shared/")
+	}
+	if strings.HasSuffix(name, "/") || strings.Contains(name, "//") || strings.ContainsAny(name, "*%") {
+		return newClientBugError("Invalid metadata entry name")
+	}
+	return nil
+}
+
+func (c *Conn) writeMetadata(mailbox string, values map[string][]byte) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("METADATA").SP().Mailbox(mailbox).SP()
+	enc.List(len(names), func(i int) {
+		enc.String(names[i]).SP().String(string(values[names[i]]))
+	})
+	return enc.CRLF()
+}
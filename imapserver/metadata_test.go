@@ -0,0 +1,89 @@
+package imapserver_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func newMetadataTestConn(t *testing.T) *testConn {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:      {},
+			imap.CapMetadata:       {},
+			imap.CapMetadataServer: {},
+		},
+	})
+	tc.login()
+	return tc
+}
+
+func TestMetadata(t *testing.T) {
+	tc := newMetadataTestConn(t)
+
+	tc.writeLine(`M1 SETMETADATA INBOX (/private/comment "My comment")`)
+	tc.expectOK("M1")
+
+	tc.writeLine(`M2 GETMETADATA INBOX /private/comment`)
+	want := []string{`* METADATA INBOX ("/private/comment" "My comment")`}
+	if got := tc.expectOK("M2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine(`M3 SETMETADATA INBOX (/private/comment NIL)`)
+	tc.expectOK("M3")
+
+	tc.writeLine(`M4 GETMETADATA INBOX (/private/comment)`)
+	if got := tc.expectOK("M4"); len(got) != 0 {
+		t.Errorf("expected no METADATA response after removal, got %q", got)
+	}
+}
+
+func TestMetadataMaxSize(t *testing.T) {
+	tc := newMetadataTestConn(t)
+
+	tc.writeLine(`M1 SETMETADATA INBOX (/private/comment "My comment" /shared/comment "Hi")`)
+	tc.expectOK("M1")
+
+	for _, cmd := range []string{
+		`M2 GETMETADATA (MAXSIZE 5) INBOX (/private/comment /shared/comment)`,
+		`M2 GETMETADATA INBOX (MAXSIZE 5) (/private/comment /shared/comment)`,
+	} {
+		tc.writeLine(cmd)
+		resp, untagged := tc.readTagged("M2")
+		if want := "M2 OK [METADATA LONGENTRIES 10] GETMETADATA completed"; resp != want {
+			t.Errorf("got %q, want %q", resp, want)
+		}
+		want := []string{`* METADATA INBOX ("/shared/comment" "Hi")`}
+		if !reflect.DeepEqual(untagged, want) {
+			t.Errorf("got %q, want %q", untagged, want)
+		}
+	}
+}
+
+func TestMetadataServerDepth(t *testing.T) {
+	tc := newMetadataTestConn(t)
+
+	tc.writeLine(`M1 SETMETADATA "" (/shared/vendor/a "1" /shared/vendor/a/b "2")`)
+	tc.expectOK("M1")
+
+	tc.writeLine(`M2 GETMETADATA "" (DEPTH 1) /shared/vendor`)
+	want := []string{`* METADATA "" ("/shared/vendor/a" "1")`}
+	if got := tc.expectOK("M2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine(`M3 GETMETADATA "" (DEPTH infinity) /shared/vendor`)
+	want = []string{`* METADATA "" ("/shared/vendor/a" "1" "/shared/vendor/a/b" "2")`}
+	if got := tc.expectOK("M3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tc.writeLine(`M4 SETMETADATA "" (/vendor/a "1")`)
+	if resp, _ := tc.readTagged("M4"); !strings.HasPrefix(resp, "M4 BAD ") {
+		t.Errorf("expected BAD for invalid entry name, got %q", resp)
+	}
+}
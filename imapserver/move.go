@@ -1,6 +1,8 @@
 package imapserver
 
 import (
+	"fmt"
+
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
@@ -12,21 +14,42 @@ func (c *Conn) handleMove(dec *imapwire.Decoder, numKind NumKind) error {
 	}
 	if err := c.checkState(imap.ConnStateSelected); err != nil {
 		return err
+	} else if err := c.checkWritable(); err != nil {
+		return err
+	}
+
+	seqSet, err = c.resolveSeqSet(numKind, seqSet)
+	if err != nil {
+		return err
 	}
 	session, ok := c.session.(SessionMove)
 	if !ok {
 		return newClientBugError("MOVE is not supported")
 	}
+	unlock, err := c.lockMailboxes(c.mailbox, dest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	w := &MoveWriter{conn: c}
-	return session.Move(w, numKind, seqSet, dest)
+	err = session.Move(c.ctx, w, numKind, seqSet, dest)
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	return err
 }
 
 // MoveWriter writes responses for the MOVE command.
 //
-// Servers must first call WriteCopyData once, then call WriteExpunge any
-// number of times.
+// Servers must first call WriteCopyData once, then call WriteExpungeUID (or
+// WriteExpunge) any number of times.
+//
+// Sessions using a MailboxTracker can queue the expunged messages via
+// MailboxTracker.QueueExpungeUID instead of calling WriteExpungeUID: pending
+// updates are written before the tagged response.
 type MoveWriter struct {
-	conn *Conn
+	conn     *Conn
+	vanished imap.SeqSet // pending VANISHED UIDs
 }
 
 // WriteCopyData writes the untagged COPYUID response for a MOVE command.
@@ -35,6 +58,34 @@ func (w *MoveWriter) WriteCopyData(data *imap.CopyData) error {
 }
 
 // WriteExpunge writes an EXPUNGE response for a MOVE command.
+//
+// If the client has enabled QRESYNC, a VANISHED response must be sent
+// instead: WriteExpungeUID needs to be used.
 func (w *MoveWriter) WriteExpunge(seqNum uint32) error {
+	if w.conn.qresyncEnabled() {
+		return fmt.Errorf("imapserver: MoveWriter.WriteExpunge cannot be used with QRESYNC, use WriteExpungeUID")
+	}
+	return w.conn.writeExpunge(seqNum)
+}
+
+// WriteExpungeUID writes an EXPUNGE response for a MOVE command, for a
+// message with a known UID.
+//
+// If the client has enabled QRESYNC, a single VANISHED response covering all
+// moved messages is written once the command completes instead of EXPUNGE.
+func (w *MoveWriter) WriteExpungeUID(seqNum, uid uint32) error {
+	if w.conn.qresyncEnabled() {
+		w.vanished.AddNum(uid)
+		return nil
+	}
 	return w.conn.writeExpunge(seqNum)
 }
+
+func (w *MoveWriter) flush() error {
+	if len(w.vanished) == 0 {
+		return nil
+	}
+	uids := w.vanished
+	w.vanished = nil
+	return w.conn.writeVanished(uids, false)
+}
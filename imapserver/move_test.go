@@ -0,0 +1,129 @@
+package imapserver_test
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func newMoveTestConn(t *testing.T) *testConn {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapMove:      {},
+			imap.CapUIDPlus:   {},
+		},
+	})
+	tc.login()
+	for i := 0; i < 5; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+	tc.writeLine("C1 CREATE Archive")
+	tc.expectOK("C1")
+	tc.selectMailbox("INBOX")
+	return tc
+}
+
+func TestMove(t *testing.T) {
+	tc := newMoveTestConn(t)
+
+	tc.writeLine("M1 MOVE 2,4:5 Archive")
+	untagged := tc.expectOK("M1")
+	want := []string{
+		"* OK [COPYUID 2 2,4:5 1:3] COPY completed",
+		"* 5 EXPUNGE",
+		"* 4 EXPUNGE",
+		"* 2 EXPUNGE",
+	}
+	if len(untagged) != len(want) {
+		t.Fatalf("got %q, want %q", untagged, want)
+	}
+	for i := range want {
+		if untagged[i] != want[i] {
+			t.Errorf("response #%v: got %q, want %q", i, untagged[i], want[i])
+		}
+	}
+
+	// Expunges must not be sent a second time
+	tc.writeLine("N1 NOOP")
+	if untagged := tc.expectOK("N1"); len(untagged) != 0 {
+		t.Errorf("unexpected responses after MOVE: %q", untagged)
+	}
+
+	tc.writeLine("S2 STATUS Archive (MESSAGES)")
+	if untagged := tc.expectOK("S2"); len(untagged) != 1 || untagged[0] != `* STATUS "Archive" (MESSAGES 3)` {
+		t.Errorf("unexpected STATUS response: %q", untagged)
+	}
+}
+
+func TestUIDMove(t *testing.T) {
+	tc := newMoveTestConn(t)
+
+	tc.writeLine("M1 UID MOVE 1:2 Archive")
+	untagged := tc.expectOK("M1")
+	if len(untagged) != 3 {
+		t.Fatalf("expected COPYUID and 2 EXPUNGE responses, got %q", untagged)
+	}
+	if !regexp.MustCompile(`^\* OK \[COPYUID [0-9]+ 1:2 1:2\] `).MatchString(untagged[0]) {
+		t.Errorf("expected COPYUID, got %q", untagged[0])
+	}
+	if untagged[1] != "* 2 EXPUNGE" || untagged[2] != "* 1 EXPUNGE" {
+		t.Errorf("unexpected EXPUNGE responses: %q", untagged[1:])
+	}
+}
+
+// expungeWriterMoveSession reports moved messages with MoveWriter instead of
+// a MailboxTracker.
+type expungeWriterMoveSession struct {
+	imapserver.SessionQResync
+}
+
+func (sess *expungeWriterMoveSession) Move(ctx context.Context, w *imapserver.MoveWriter, numKind imapserver.NumKind, seqSet imap.SeqSet, dest string) error {
+	if err := w.WriteCopyData(&imap.CopyData{UIDValidity: 1, SourceUIDs: imap.SeqSetNum(1, 2), DestUIDs: imap.SeqSetNum(1, 2)}); err != nil {
+		return err
+	}
+	for _, n := range []uint32{2, 1} {
+		if err := w.WriteExpungeUID(n, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMoveQResync(t *testing.T) {
+	memServer := newTestMemServer()
+	for _, qresync := range []bool{false, true} {
+		tc := newTestServer(t, &imapserver.Options{
+			NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+				return &expungeWriterMoveSession{memServer.NewSession().(imapserver.SessionQResync)}, nil, nil
+			},
+			Caps: imap.CapSet{
+				imap.CapIMAP4rev1: {},
+				imap.CapMove:      {},
+				imap.CapCondStore: {},
+				imap.CapQResync:   {},
+			},
+		})
+		tc.login()
+		want := []string{"* 2 EXPUNGE", "* 1 EXPUNGE"}
+		if qresync {
+			tc.writeLine("E1 ENABLE QRESYNC")
+			tc.expectOK("E1")
+			want = []string{"* VANISHED 1:2"}
+		}
+		tc.selectMailbox("INBOX")
+
+		tc.writeLine("M1 MOVE 1:2 Archive")
+		untagged := tc.expectOK("M1")
+		if len(untagged) == 0 || !strings.HasPrefix(untagged[0], "* OK ") {
+			t.Fatalf("qresync=%v: expected copy data, got %q", qresync, untagged)
+		}
+		if got := untagged[1:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("qresync=%v: got %q, want %q", qresync, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package imapserver_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var testMultiAppendCaps = imap.CapSet{
+	imap.CapIMAP4rev1:   {},
+	imap.CapUIDPlus:     {},
+	imap.CapMultiAppend: {},
+	imap.CapCatenate:    {},
+}
+
+func TestMultiAppend(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{Caps: testMultiAppendCaps})
+	tc.login()
+
+	var uidValidity uint32
+	for _, line := range tc.selectMailbox("INBOX") {
+		if _, err := fmt.Sscanf(line, "* OK [UIDVALIDITY %d]", &uidValidity); err == nil {
+			break
+		}
+	}
+
+	lit := fmt.Sprintf("{%v+}\r\n%v", len(testMessage), testMessage)
+	tc.writeLine("A2 APPEND INBOX %v (\\Seen) %v \"05-Sep-2016 19:00:00 +0900\" %v", lit, lit, lit)
+	resp, untagged := tc.readTagged("A2")
+	if want := fmt.Sprintf("A2 OK [APPENDUID %v 1:3] ", uidValidity); !strings.HasPrefix(resp, want) {
+		t.Fatalf("expected %q, got %q", want, resp)
+	}
+	if len(untagged) == 0 || untagged[len(untagged)-1] != "* 3 EXISTS" {
+		t.Errorf("unexpected untagged responses: %q", untagged)
+	}
+
+	tc.writeLine("F1 FETCH 2 FLAGS")
+	if got := tc.expectOK("F1"); len(got) != 1 || got[0] != `* 2 FETCH (UID 2 FLAGS (\seen))` {
+		t.Errorf("unexpected FETCH response: %q", got)
+	}
+
+	// If one of the messages cannot be appended, none of them must be
+	tc.writeLine(`A3 APPEND INBOX %v CATENATE (URL "/INBOX;UIDVALIDITY=%v/;UID=42")`, lit, uidValidity)
+	if resp, _ := tc.readTagged("A3"); !strings.HasPrefix(resp, "A3 NO [BADURL ") {
+		t.Errorf("expected NO [BADURL], got %q", resp)
+	}
+
+	tc.writeLine("N1 NOOP")
+	if got := tc.expectOK("N1"); len(got) != 0 {
+		t.Errorf("expected no message to be appended, got %q", got)
+	}
+}
+
+func TestMultiAppendNotAuthenticated(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{Caps: testMultiAppendCaps})
+
+	// The command must be rejected before the literal is accepted
+	tc.writeLine("A1 APPEND INBOX {%v}", len(testMessage))
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "A1 NO ") && !strings.HasPrefix(resp, "A1 BAD ") {
+		t.Fatalf("expected A1 to be rejected, got %q", resp)
+	}
+}
+
+func TestMultiAppendLimits(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps:                   testMultiAppendCaps,
+		MaxMultiAppendMessages: 2,
+		MaxMultiAppendSize:     int64(3 * len(testMessage)),
+	})
+	tc.login()
+	tc.selectMailbox("INBOX")
+
+	lit := fmt.Sprintf("{%v+}\r\n%v", len(testMessage), testMessage)
+	syncLit := fmt.Sprintf("{%v}", len(testMessage))
+
+	tc.writeLine("A2 APPEND INBOX %v %v %v", lit, lit, syncLit)
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "A2 NO [LIMIT] ") {
+		t.Errorf("expected NO [LIMIT], got %q", resp)
+	}
+
+	tc.writeLine("A3 APPEND INBOX %v (\\Seen) {%v}", lit, 2*len(testMessage)+1)
+	if resp := tc.readLine(); !strings.HasPrefix(resp, "A3 NO [TOOBIG] ") {
+		t.Errorf("expected NO [TOOBIG], got %q", resp)
+	}
+
+	tc.writeLine("N1 NOOP")
+	if got := tc.expectOK("N1"); len(got) != 0 {
+		t.Errorf("expected no message to be appended, got %q", got)
+	}
+}
+
+type noMultiAppendSession struct {
+	imapserver.Session
+}
+
+func TestMultiAppendUnsupportedSession(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &noMultiAppendSession{memServer.NewSession()}, nil, nil
+		},
+		Caps: testMultiAppendCaps,
+	})
+	tc.login()
+
+	if hasCap(tc.capabilities(), string(imap.CapMultiAppend)) {
+		t.Errorf("MULTIAPPEND advertised without SessionMultiAppend")
+	}
+	tc.appendMessage("INBOX", testMessage)
+}
@@ -5,38 +5,40 @@ import (
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-func (c *Conn) handleNamespace(dec *imapwire.Decoder) error {
+func (c *Conn) handleNamespace(dec *imapwire.Decoder) (exec func() error, err error) {
 	if !dec.ExpectCRLF() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 
-	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
-		return err
-	}
+	return func() error {
+		if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+			return err
+		}
 
-	session, ok := c.session.(SessionNamespace)
-	if !ok {
-		return newClientBugError("NAMESPACE is not supported")
-	}
+		session, ok := c.session.(SessionNamespace)
+		if !ok {
+			return newClientBugError("NAMESPACE is not supported")
+		}
 
-	data, err := session.Namespace()
-	if err != nil {
-		return err
-	}
+		data, err := session.Namespace(c.ctx)
+		if err != nil {
+			return err
+		}
 
-	enc := newResponseEncoder(c)
-	defer enc.end()
-	enc.Atom("*").SP().Atom("NAMESPACE").SP()
-	writeNamespace(enc.Encoder, data.Personal)
-	enc.SP()
-	writeNamespace(enc.Encoder, data.Other)
-	enc.SP()
-	writeNamespace(enc.Encoder, data.Shared)
-	return enc.CRLF()
+		enc := newResponseEncoder(c)
+		defer enc.end()
+		enc.Atom("*").SP().Atom("NAMESPACE").SP()
+		writeNamespace(enc.Encoder, data.Personal)
+		enc.SP()
+		writeNamespace(enc.Encoder, data.Other)
+		enc.SP()
+		writeNamespace(enc.Encoder, data.Shared)
+		return enc.CRLF()
+	}, nil
 }
 
 func writeNamespace(enc *imapwire.Encoder, l []imap.NamespaceDescriptor) {
-	if l == nil {
+	if len(l) == 0 {
 		enc.NIL()
 		return
 	}
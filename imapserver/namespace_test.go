@@ -0,0 +1,52 @@
+package imapserver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+type namespaceSession struct {
+	imapserver.Session
+	data imap.NamespaceData
+}
+
+func (sess *namespaceSession) Namespace(ctx context.Context) (*imap.NamespaceData, error) {
+	return &sess.data, nil
+}
+
+func testNamespace(t *testing.T, data imap.NamespaceData, want string) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &namespaceSession{Session: memServer.NewSession(), data: data}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapNamespace: {},
+		},
+	})
+	tc.login()
+
+	tc.writeLine("N1 NAMESPACE")
+	untagged := tc.expectOK("N1")
+	if len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	testNamespace(t, imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Prefix: "", Delim: '/'}},
+		Shared:   []imap.NamespaceDescriptor{{Prefix: "Shared/", Delim: '/'}},
+	}, `* NAMESPACE (("" "/")) NIL (("Shared/" "/"))`)
+}
+
+func TestNamespaceEmpty(t *testing.T) {
+	testNamespace(t, imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Prefix: "", Delim: '/'}},
+		Other:    []imap.NamespaceDescriptor{},
+	}, `* NAMESPACE (("" "/")) NIL NIL`)
+}
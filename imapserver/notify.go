@@ -0,0 +1,190 @@
+package imapserver
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// notifyEvents is the list of events which can be requested with NOTIFY.
+var notifyEvents = []imap.NotifyEvent{
+	imap.NotifyEventMessageNew,
+	imap.NotifyEventMessageExpunge,
+	imap.NotifyEventFlagChange,
+	imap.NotifyEventAnnotationChange,
+	imap.NotifyEventMailboxName,
+	imap.NotifyEventSubscriptionChange,
+	imap.NotifyEventMailboxMetadataChange,
+	imap.NotifyEventServerMetadataChange,
+}
+
+func (c *Conn) handleNotify(dec *imapwire.Decoder) error {
+	var name string
+	if !dec.ExpectSP() || !dec.ExpectAtom(&name) {
+		return dec.Err()
+	}
+
+	var options *imap.NotifyOptions
+	switch strings.ToUpper(name) {
+	case "NONE":
+		// no-op
+	case "SET":
+		options = new(imap.NotifyOptions)
+		if err := readNotifySet(dec, options); err != nil {
+			return err
+		}
+	default:
+		return newClientBugError("Unknown NOTIFY subcommand")
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return err
+	}
+	session, ok := c.session.(SessionNotify)
+	if !ok || !c.server.options.caps().Has(imap.CapNotify) {
+		return newClientBugError("NOTIFY is not supported")
+	}
+
+	w := &UpdateWriter{conn: c, allowExpunge: true}
+	return session.Notify(c.ctx, w, options)
+}
+
+func readNotifySet(dec *imapwire.Decoder, options *imap.NotifyOptions) error {
+	if !dec.ExpectSP() || !dec.ExpectSpecial('(') {
+		return dec.Err()
+	}
+
+	var name string
+	if !dec.ExpectAtom(&name) {
+		return dec.Err()
+	}
+	if strings.EqualFold(name, "STATUS") {
+		options.Status = true
+		if !dec.ExpectSpecial(')') || !dec.ExpectSP() || !dec.ExpectSpecial('(') || !dec.ExpectAtom(&name) {
+			return dec.Err()
+		}
+	}
+
+	for {
+		item, err := readNotifyEventGroup(dec, name)
+		if err != nil {
+			return err
+		}
+		options.Items = append(options.Items, *item)
+
+		if !dec.SP() {
+			return nil
+		}
+		if !dec.ExpectSpecial('(') || !dec.ExpectAtom(&name) {
+			return dec.Err()
+		}
+	}
+}
+
+// readNotifyEventGroup reads an event group. The opening parenthesis and the
+// mailbox specifier name have already been consumed.
+func readNotifyEventGroup(dec *imapwire.Decoder, name string) (*imap.NotifyItem, error) {
+	var item imap.NotifyItem
+	switch spec := imap.NotifyMailboxSpecifier(strings.ToUpper(name)); spec {
+	case imap.NotifySelected, imap.NotifySelectedDelayed, imap.NotifyInboxes, imap.NotifyPersonal, imap.NotifySubscribed:
+		item.MailboxSpecifier = spec
+	case imap.NotifySubtree, imap.NotifyMailboxes:
+		item.MailboxSpecifier = spec
+		if !dec.ExpectSP() {
+			return nil, dec.Err()
+		}
+		isList, err := dec.List(func() error {
+			var mailbox string
+			if !dec.ExpectMailbox(&mailbox) {
+				return dec.Err()
+			}
+			item.Mailboxes = append(item.Mailboxes, mailbox)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		} else if !isList {
+			var mailbox string
+			if !dec.ExpectMailbox(&mailbox) {
+				return nil, dec.Err()
+			}
+			item.Mailboxes = []string{mailbox}
+		}
+	default:
+		return nil, newClientBugError("Unknown NOTIFY mailbox specifier")
+	}
+
+	if !dec.ExpectSP() {
+		return nil, dec.Err()
+	}
+	var atom string
+	if dec.Atom(&atom) {
+		if !strings.EqualFold(atom, "NONE") {
+			return nil, newClientBugError("Expected NONE or a list of NOTIFY events")
+		}
+	} else {
+		var badEvent bool
+		err := dec.ExpectList(func() error {
+			var name string
+			if !dec.ExpectAtom(&name) {
+				return dec.Err()
+			}
+			ev, ok := lookupNotifyEvent(name)
+			if !ok {
+				badEvent = true
+			} else {
+				item.Events = append(item.Events, ev)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if badEvent {
+			return nil, &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeBadEvent,
+				Text: "Unsupported NOTIFY event",
+			}
+		}
+		if err := checkNotifyEvents(item.Events); err != nil {
+			return nil, err
+		}
+	}
+
+	if !dec.ExpectSpecial(')') {
+		return nil, dec.Err()
+	}
+	return &item, nil
+}
+
+func lookupNotifyEvent(name string) (imap.NotifyEvent, bool) {
+	for _, ev := range notifyEvents {
+		if strings.EqualFold(string(ev), name) {
+			return ev, true
+		}
+	}
+	return "", false
+}
+
+// checkNotifyEvents checks the event dependencies described in RFC 5465
+// section 5.
+func checkNotifyEvents(events []imap.NotifyEvent) error {
+	has := make(map[imap.NotifyEvent]bool)
+	for _, ev := range events {
+		has[ev] = true
+	}
+
+	msgNew, msgExpunge := has[imap.NotifyEventMessageNew], has[imap.NotifyEventMessageExpunge]
+	if msgNew != msgExpunge {
+		return newClientBugError("MessageNew and MessageExpunge must be requested together")
+	}
+	if (has[imap.NotifyEventFlagChange] || has[imap.NotifyEventAnnotationChange]) && !msgNew {
+		return newClientBugError("FlagChange and AnnotationChange require MessageNew and MessageExpunge")
+	}
+	return nil
+}
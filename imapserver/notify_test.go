@@ -0,0 +1,79 @@
+package imapserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var testNotifyCaps = imap.CapSet{
+	imap.CapIMAP4rev1: {},
+	imap.CapNotify:    {},
+}
+
+func TestNotify(t *testing.T) {
+	_, addr := startTestServer(t, &imapserver.Options{Caps: testNotifyCaps})
+
+	tc := dialTestServer(t, addr)
+	tc.login()
+	tc.writeLine("C1 CREATE Archive")
+	tc.expectOK("C1")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`N1 NOTIFY SET (STATUS) (selected (MessageNew MessageExpunge)) (mailboxes "Archive" (MessageNew MessageExpunge))`)
+	got := tc.expectOK("N1")
+	if want := `* STATUS "Archive" (MESSAGES 0 UIDNEXT 1)`; len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	other := dialTestServer(t, addr)
+	other.login()
+	other.appendMessage("Archive", testMessage)
+
+	tc.writeLine("N2 NOOP")
+	got = tc.expectOK("N2")
+	if want := `* STATUS "Archive" (MESSAGES 1 UIDNEXT 2)`; len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Updates are pushed while idling
+	tc.writeLine("I1 IDLE")
+	if line := tc.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	other.appendMessage("Archive", testMessage)
+	if line, want := tc.readLine(), `* STATUS "Archive" (MESSAGES 2 UIDNEXT 3)`; line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+	other.appendMessage("INBOX", testMessage)
+	if line, want := tc.readLine(), "* 1 EXISTS"; line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+	tc.writeLine("DONE")
+	tc.expectOK("I1")
+
+	tc.writeLine("N3 NOTIFY NONE")
+	tc.expectOK("N3")
+	other.appendMessage("Archive", testMessage)
+	tc.writeLine("N4 NOOP")
+	if got := tc.expectOK("N4"); len(got) != 0 {
+		t.Errorf("expected no update after NOTIFY NONE, got %q", got)
+	}
+}
+
+func TestNotifyBadEvent(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{Caps: testNotifyCaps})
+	tc.login()
+
+	tc.writeLine(`N1 NOTIFY SET (personal (MessageNew))`)
+	if resp, _ := tc.readTagged("N1"); !strings.HasPrefix(resp, "N1 BAD ") {
+		t.Errorf("expected BAD for MessageNew without MessageExpunge, got %q", resp)
+	}
+
+	tc.writeLine(`N2 NOTIFY SET (personal (MessageNew MessageExpunge Bogus))`)
+	if resp, _ := tc.readTagged("N2"); !strings.HasPrefix(resp, "N2 NO [BADEVENT] ") {
+		t.Errorf("expected NO [BADEVENT], got %q", resp)
+	}
+}
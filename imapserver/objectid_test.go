@@ -0,0 +1,95 @@
+package imapserver_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var (
+	mailboxIDRegexp = regexp.MustCompile(`\[MAILBOXID \(([A-Za-z0-9_-]+)\)\]`)
+	emailIDRegexp   = regexp.MustCompile(`EMAILID \(([A-Za-z0-9_-]+)\)`)
+)
+
+func TestObjectID(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapObjectID:  {},
+		},
+	})
+	tc.login()
+
+	if caps := tc.capabilities(); !hasCap(caps, "OBJECTID") {
+		t.Errorf("expected OBJECTID to be advertised, got %v", caps)
+	}
+
+	tc.writeLine("C1 CREATE Archive")
+	resp, _ := tc.readTagged("C1")
+	createdID := findSubmatch(t, []string{resp}, mailboxIDRegexp)
+
+	tc.writeLine("T1 STATUS Archive (MAILBOXID)")
+	untagged := tc.expectOK("T1")
+	if want := "* STATUS \"Archive\" (MAILBOXID (" + createdID + "))"; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+
+	tc.appendMessage("INBOX", testMessage)
+	inboxID := findSubmatch(t, tc.selectMailbox("INBOX"), mailboxIDRegexp)
+	if inboxID == createdID {
+		t.Errorf("INBOX and Archive have the same MAILBOXID %q", inboxID)
+	}
+
+	tc.writeLine("F1 FETCH 1 (EMAILID THREADID)")
+	untagged = tc.expectOK("F1")
+	emailID := findSubmatch(t, untagged, emailIDRegexp)
+	if want := "* 1 FETCH (UID 1 EMAILID (" + emailID + ") THREADID NIL)"; untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged[0], want)
+	}
+
+	// The EMAILID must be preserved by COPY, see RFC 8474 section 5.1
+	tc.writeLine("C2 COPY 1 Archive")
+	tc.expectOK("C2")
+	tc.selectMailbox("Archive")
+	tc.writeLine("F2 FETCH 1 (EMAILID)")
+	if got := findSubmatch(t, tc.expectOK("F2"), emailIDRegexp); got != emailID {
+		t.Errorf("EMAILID changed after COPY: got %q, want %q", got, emailID)
+	}
+}
+
+type failingStatusSession struct {
+	imapserver.Session
+}
+
+func (sess *failingStatusSession) Status(ctx context.Context, mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	return nil, fmt.Errorf("status unavailable")
+}
+
+func TestObjectIDCreateStatusError(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &failingStatusSession{memServer.NewSession()}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapObjectID:  {},
+		},
+		StructuredLogger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	tc.login()
+
+	// The mailbox has been created, so the command must succeed even if its
+	// ID can't be retrieved
+	tc.writeLine("C1 CREATE Archive")
+	if resp, _ := tc.readTagged("C1"); resp != "C1 OK CREATE completed" {
+		t.Errorf("got %q, want a plain OK", resp)
+	}
+	tc.selectMailbox("Archive")
+}
@@ -0,0 +1,172 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// maxParseDepth is the maximum nesting level of parenthesized lists accepted
+// by ParseCommand.
+const maxParseDepth = 64
+
+// ParsedCommand is a command decoded by ParseCommand.
+type ParsedCommand struct {
+	Tag string
+	// Command name in upper-case, e.g. "FETCH" or "UID FETCH"
+	Name string
+	Args []CommandArg
+}
+
+// CommandArgKind describes the type of a command argument.
+type CommandArgKind int
+
+const (
+	// CommandArgAtom is an unquoted token, such as a flag, a sequence set or
+	// a FETCH item with its section (e.g. "BODY.PEEK[HEADER.FIELDS (To)]").
+	CommandArgAtom CommandArgKind = iota + 1
+	// CommandArgString is a quoted string or a literal.
+	CommandArgString
+	// CommandArgList is a parenthesized list.
+	CommandArgList
+)
+
+// CommandArg is an argument of a command decoded by ParseCommand.
+type CommandArg struct {
+	Kind CommandArgKind
+	// Value contains the contents of atoms and strings
+	Value string
+	// List contains the elements of lists
+	List []CommandArg
+}
+
+// ParseCommand decodes a single command, including the trailing CRLF.
+// Literals must immediately follow the line announcing them, without waiting
+// for a continuation request.
+//
+// ParseCommand only checks the generic command syntax: command-specific
+// arguments are split into atoms, strings and lists, but not interpreted.
+// Malformed input results in an *imap.Error of type BAD.
+func ParseCommand(b []byte) (*ParsedCommand, error) {
+	dec := imapwire.NewDecoder(bufio.NewReader(bytes.NewReader(b)), imapwire.ConnSideServer)
+	dec.StrictCRLF = true
+
+	var cmd ParsedCommand
+	if !dec.ExpectAtom(&cmd.Tag) || !dec.ExpectSP() || !dec.ExpectAtom(&cmd.Name) {
+		return nil, parseError(dec.Err())
+	}
+	cmd.Name = strings.ToUpper(cmd.Name)
+	if cmd.Name == "UID" {
+		var subName string
+		if !dec.ExpectSP() || !dec.ExpectAtom(&subName) {
+			return nil, parseError(dec.Err())
+		}
+		cmd.Name += " " + strings.ToUpper(subName)
+	}
+
+	for dec.SP() {
+		arg, err := parseCommandArg(dec, 0)
+		if err != nil {
+			return nil, parseError(err)
+		}
+		cmd.Args = append(cmd.Args, *arg)
+	}
+	if !dec.ExpectCRLF() {
+		return nil, parseError(dec.Err())
+	}
+	if !dec.EOF() {
+		return nil, parseError(errors.New("unexpected data after command"))
+	}
+	return &cmd, nil
+}
+
+func parseCommandArg(dec *imapwire.Decoder, depth int) (*CommandArg, error) {
+	var s string
+	if dec.String(&s) {
+		return &CommandArg{Kind: CommandArgString, Value: s}, nil
+	} else if err := dec.Err(); err != nil {
+		return nil, err
+	}
+
+	if dec.Special('(') {
+		if depth >= maxParseDepth {
+			return nil, fmt.Errorf("lists nested too deeply")
+		}
+		arg := &CommandArg{Kind: CommandArgList}
+		if dec.Special(')') {
+			return arg, nil
+		}
+		for {
+			elem, err := parseCommandArg(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			arg.List = append(arg.List, *elem)
+			if dec.Special(')') {
+				return arg, nil
+			} else if !dec.ExpectSP() {
+				return nil, dec.Err()
+			}
+		}
+	}
+
+	// An atom may be followed by a section, which can contain spaces and
+	// lists, and then by more atom characters, e.g. "BODY[1.MIME]<0.42>"
+	var sb strings.Builder
+	for {
+		if dec.Func(&s, isParseAtomChar) {
+			sb.WriteString(s)
+		}
+		if dec.Err() != nil {
+			return nil, dec.Err()
+		}
+		if !dec.Special('[') {
+			break
+		}
+		sb.WriteByte('[')
+		if dec.Func(&s, isParseSectionChar) {
+			sb.WriteString(s)
+		}
+		if !dec.ExpectSpecial(']') {
+			return nil, dec.Err()
+		}
+		sb.WriteByte(']')
+	}
+	if !dec.Expect(sb.Len() > 0, "value") {
+		return nil, dec.Err()
+	}
+	return &CommandArg{Kind: CommandArgAtom, Value: sb.String()}, nil
+}
+
+// isParseAtomChar accepts the characters allowed in atoms, flags, sequence
+// sets and LIST patterns.
+func isParseAtomChar(ch byte) bool {
+	switch ch {
+	case '(', ')', '{', ' ', '"', '[':
+		return false
+	default:
+		return ch >= 0x20 && ch != 0x7F
+	}
+}
+
+func isParseSectionChar(ch byte) bool {
+	return ch != ']' && ch != '\r' && ch != '\n'
+}
+
+func parseError(err error) error {
+	var decErr *imapwire.DecoderExpectError
+	text := err.Error()
+	if errors.As(err, &decErr) {
+		text = decErr.Message
+	}
+	return &imap.Error{
+		Type: imap.StatusResponseTypeBad,
+		Code: imap.ResponseCodeClientBug,
+		Text: "Syntax error: " + text,
+	}
+}
@@ -0,0 +1,116 @@
+package imapserver_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func atomArg(s string) imapserver.CommandArg {
+	return imapserver.CommandArg{Kind: imapserver.CommandArgAtom, Value: s}
+}
+
+func stringArg(s string) imapserver.CommandArg {
+	return imapserver.CommandArg{Kind: imapserver.CommandArgString, Value: s}
+}
+
+func listArg(elems ...imapserver.CommandArg) imapserver.CommandArg {
+	return imapserver.CommandArg{Kind: imapserver.CommandArgList, List: elems}
+}
+
+var parseCommandTests = []struct {
+	raw  string
+	want *imapserver.ParsedCommand
+}{
+	{
+		raw:  "A1 NOOP\r\n",
+		want: &imapserver.ParsedCommand{Tag: "A1", Name: "NOOP"},
+	},
+	{
+		raw: "A2 login joe \"pass \\\"word\\\"\"\r\n",
+		want: &imapserver.ParsedCommand{Tag: "A2", Name: "LOGIN", Args: []imapserver.CommandArg{
+			atomArg("joe"),
+			stringArg(`pass "word"`),
+		}},
+	},
+	{
+		raw: "A3 UID FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (To From)]<0.42>)\r\n",
+		want: &imapserver.ParsedCommand{Tag: "A3", Name: "UID FETCH", Args: []imapserver.CommandArg{
+			atomArg("1:*"),
+			listArg(atomArg("FLAGS"), atomArg("BODY.PEEK[HEADER.FIELDS (To From)]<0.42>")),
+		}},
+	},
+	{
+		raw: "A4 APPEND INBOX (\\Seen) {5+}\r\nHello\r\n",
+		want: &imapserver.ParsedCommand{Tag: "A4", Name: "APPEND", Args: []imapserver.CommandArg{
+			atomArg("INBOX"),
+			listArg(atomArg(`\Seen`)),
+			stringArg("Hello"),
+		}},
+	},
+	{
+		raw: "A5 LIST \"\" %\r\n",
+		want: &imapserver.ParsedCommand{Tag: "A5", Name: "LIST", Args: []imapserver.CommandArg{
+			stringArg(""),
+			atomArg("%"),
+		}},
+	},
+	{
+		raw: "A6 SEARCH (OR SEEN (DELETED))\r\n",
+		want: &imapserver.ParsedCommand{Tag: "A6", Name: "SEARCH", Args: []imapserver.CommandArg{
+			listArg(atomArg("OR"), atomArg("SEEN"), listArg(atomArg("DELETED"))),
+		}},
+	},
+	{raw: ""},
+	{raw: "A1\r\n"},
+	{raw: "A1 NOOP"},
+	{raw: "A1 NOOP\n"},
+	{raw: "A1 NOOP \r\n"},
+	{raw: "A1 NOOP\r\nA2 NOOP\r\n"},
+	{raw: "A1 LOGIN \"joe\r\n"},
+	{raw: "A1 LOGIN \"jo\ne\" pass\r\n"},
+	{raw: "A1 APPEND INBOX {10}\r\nHello\r\n"},
+	{raw: "A1 APPEND INBOX {99999999999999999999}\r\n"},
+	{raw: "A1 FETCH 1 (FLAGS\r\n"},
+	{raw: "A1 FETCH 1 BODY[HEADER\r\n"},
+	{raw: "A1 SEARCH " + strings.Repeat("(", 1000) + strings.Repeat(")", 1000) + "\r\n"},
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range parseCommandTests {
+		cmd, err := imapserver.ParseCommand([]byte(tc.raw))
+		if tc.want == nil {
+			var imapErr *imap.Error
+			if !errors.As(err, &imapErr) || imapErr.Type != imap.StatusResponseTypeBad {
+				t.Errorf("ParseCommand(%q) = %v, %v, want a BAD error", tc.raw, cmd, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCommand(%q) = %v", tc.raw, err)
+		} else if !reflect.DeepEqual(cmd, tc.want) {
+			t.Errorf("ParseCommand(%q) = %+v, want %+v", tc.raw, cmd, tc.want)
+		}
+	}
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, tc := range parseCommandTests {
+		f.Add([]byte(tc.raw))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cmd, err := imapserver.ParseCommand(b)
+		if err != nil {
+			var imapErr *imap.Error
+			if !errors.As(err, &imapErr) || imapErr.Type != imap.StatusResponseTypeBad {
+				t.Errorf("ParseCommand(%q) returned an unstructured error: %v", b, err)
+			}
+		} else if cmd.Tag == "" || cmd.Name == "" {
+			t.Errorf("ParseCommand(%q) = %+v, missing tag or name", b, cmd)
+		}
+	})
+}
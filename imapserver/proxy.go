@@ -0,0 +1,241 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Sig is the signature of a PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header,
+// including the CRLF.
+const proxyV1MaxLen = 107
+
+// ProxyListener wraps a listener to accept connections from the proxies
+// listed in Options.TrustedProxies. Since the PROXY header is sent before the
+// TLS handshake, it must be used to accept proxied connections on a TLS
+// listener:
+//
+//	ln = tls.NewListener(server.ProxyListener(ln), tlsConfig)
+//
+// ListenAndServeTLS does this automatically. Listeners without TLS don't need
+// to be wrapped.
+func (s *Server) ProxyListener(ln net.Listener) net.Listener {
+	return &proxyListener{Listener: ln, server: s}
+}
+
+type proxyListener struct {
+	net.Listener
+	server *Server
+}
+
+func (ln *proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil || !ln.server.isTrustedProxy(conn) {
+		return conn, err
+	}
+	// The header is read by the connection goroutine, not to block Accept
+	return &proxyConn{Conn: conn, server: ln.server}, nil
+}
+
+// proxyConn is a connection whose remote address is read from a PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	server *Server
+
+	once       sync.Once
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+// readHeader reads the PROXY header, if it hasn't been read yet.
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.server.options.Timeouts.CommandRead))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.br = bufio.NewReader(c.Conn)
+		c.remoteAddr, c.err = readProxyHeader(c.br)
+		if c.err != nil {
+			c.err = fmt.Errorf("invalid PROXY header: %w", c.err)
+		}
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() != nil || c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// isTrustedProxy checks whether the remote end of a connection is listed in
+// Options.TrustedProxies.
+func (s *Server) isTrustedProxy(conn net.Conn) bool {
+	if len(s.options.TrustedProxies) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	for _, prefix := range s.options.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxy reads the PROXY protocol header sent by a trusted proxy and
+// returns a connection reporting the original client address. Connections
+// accepted by a ProxyListener are returned as-is, once their header has been
+// read.
+func (s *Server) acceptProxy(conn net.Conn) (net.Conn, error) {
+	rawConn := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		rawConn = tlsConn.NetConn()
+	}
+	if pc, ok := rawConn.(*proxyConn); ok {
+		return conn, pc.readHeader()
+	}
+
+	if !s.isTrustedProxy(conn) {
+		return conn, nil
+	}
+	if rawConn != conn {
+		return conn, errors.New("PROXY header sent over TLS, the listener must be wrapped with Server.ProxyListener")
+	}
+	pc := &proxyConn{Conn: conn, server: s}
+	return pc, pc.readHeader()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. A nil address is
+// returned if the header doesn't contain the client address (e.g. for health
+// checks).
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	b, err := br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2Header(br)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyV1Header(br)
+	}
+	return nil, errors.New("missing PROXY header")
+}
+
+func readProxyV1Header(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		} else if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	switch fields[1] {
+	case "TCP4":
+		if !ip.Is4() {
+			return nil, errors.New("expected an IPv4 address")
+		}
+	case "TCP6":
+		if !ip.Is6() {
+			return nil, errors.New("expected an IPv6 address")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2Header(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %v", verCmd>>4)
+	}
+	switch verCmd & 0xF {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+		// handled below
+	default:
+		return nil, fmt.Errorf("unsupported command %v", verCmd&0xF)
+	}
+
+	var ipLen int
+	switch fam {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		return nil, nil
+	}
+	// Addresses are followed by the ports: src, dst, src port, dst port
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("v2 address block too short")
+	}
+	ip, _ := netip.AddrFromSlice(payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
@@ -0,0 +1,130 @@
+package imapserver_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// startProxyTestServer starts a server trusting PROXY headers from the
+// loopback network. The client addresses are sent to the returned channel.
+func startProxyTestServer(t *testing.T) (addr string, remoteAddrs <-chan net.Addr) {
+	memServer := newTestMemServer()
+	ch := make(chan net.Addr, 1)
+	_, addr = startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			ch <- conn.RemoteAddr()
+			return memServer.NewSession(), nil, nil
+		},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+	return addr, ch
+}
+
+func dialProxy(t *testing.T, addr, header string) *bufio.Reader {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if _, err := io.WriteString(conn, header); err != nil {
+		t.Fatalf("failed to write PROXY header: %v", err)
+	}
+	return bufio.NewReader(conn)
+}
+
+func TestProxyV1(t *testing.T) {
+	addr, remoteAddrs := startProxyTestServer(t)
+
+	br := dialProxy(t, addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 143\r\n")
+	if greeting, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q, %v", greeting, err)
+	}
+	if got := (<-remoteAddrs).String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr() = %v, want 192.0.2.1:56324", got)
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	addr, remoteAddrs := startProxyTestServer(t)
+
+	header := "\r\n\r\n\x00\r\nQUIT\n" +
+		"\x21\x11\x00\x0c" + // PROXY command, TCP over IPv4, 12 bytes
+		"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + // 192.0.2.1, 198.51.100.1
+		"\xdc\x04" + "\x00\x8f" // 56324, 143
+	br := dialProxy(t, addr, header)
+	if greeting, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q, %v", greeting, err)
+	}
+	if got := (<-remoteAddrs).String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr() = %v, want 192.0.2.1:56324", got)
+	}
+}
+
+func TestProxyMalformed(t *testing.T) {
+	addr, _ := startProxyTestServer(t)
+
+	br := dialProxy(t, addr, "PROXY TCP4 not-an-ip\r\n")
+	if line, err := br.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be dropped, got %q, %v", line, err)
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	memServer := newTestMemServer()
+	infos := make(chan *imapserver.ConnInfo, 1)
+	tlsConfig := newTestTLSConfig(t)
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			infos <- conn.Info()
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:           imap.CapSet{imap.CapIMAP4rev1: {}},
+		TLSConfig:      tlsConfig,
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	go server.Serve(tls.NewListener(server.ProxyListener(ln), tlsConfig))
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	rawConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	defer rawConn.Close()
+	if _, err := io.WriteString(rawConn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 993\r\n"); err != nil {
+		t.Fatalf("failed to write PROXY header: %v", err)
+	}
+	conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true})
+
+	br := bufio.NewReader(conn)
+	greeting, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q, %v", greeting, err)
+	}
+	if strings.Contains(greeting, "LOGINDISABLED") || strings.Contains(greeting, "STARTTLS") {
+		t.Errorf("TLS connection isn't detected: %q", greeting)
+	}
+
+	info := <-infos
+	if got := info.RemoteAddr.String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr = %v, want 192.0.2.1:56324", got)
+	}
+	if info.TLS == nil {
+		t.Errorf("missing TLS connection state")
+	}
+}
@@ -0,0 +1,162 @@
+package imapserver_test
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var (
+	uidValidityRegexp   = regexp.MustCompile(`\[UIDVALIDITY ([0-9]+)\]`)
+	highestModSeqRegexp = regexp.MustCompile(`\[HIGHESTMODSEQ ([0-9]+)\]`)
+)
+
+func findSubmatch(t *testing.T, lines []string, re *regexp.Regexp) string {
+	t.Helper()
+	for _, line := range lines {
+		if m := re.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	t.Fatalf("no line matching %v in %q", re, lines)
+	return ""
+}
+
+func newQResyncTestServer(t *testing.T) *testConn {
+	return newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapCondStore: {},
+			imap.CapQResync:   {},
+		},
+	})
+}
+
+func TestSelectQResync(t *testing.T) {
+	tc := newQResyncTestServer(t)
+	tc.login()
+	for i := 0; i < 3; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+
+	tc.writeLine("E1 ENABLE QRESYNC")
+	if untagged := tc.expectOK("E1"); len(untagged) != 1 || untagged[0] != "* ENABLED QRESYNC" {
+		t.Fatalf("unexpected ENABLE response: %q", untagged)
+	}
+	untagged := tc.selectMailbox("INBOX")
+	uidValidity := findSubmatch(t, untagged, uidValidityRegexp)
+	modSeq := findSubmatch(t, untagged, highestModSeqRegexp)
+
+	// Another client deletes two messages and flags the last one while the
+	// first client is offline
+	tc.writeLine("U1 UNSELECT")
+	tc.expectOK("U1")
+	other := tc.newConn()
+	other.login()
+	other.selectMailbox("INBOX")
+	other.writeLine("T1 STORE 1:2 +FLAGS.SILENT (\\Deleted)")
+	other.expectOK("T1")
+	other.writeLine("X1 EXPUNGE")
+	other.expectOK("X1")
+	other.writeLine("T2 STORE 1 +FLAGS.SILENT (\\Flagged)")
+	other.expectOK("T2")
+
+	tc.writeLine("S2 SELECT INBOX (QRESYNC (%v %v))", uidValidity, modSeq)
+	untagged = tc.expectOK("S2")
+
+	var vanished, fetch []string
+	for _, line := range untagged {
+		switch {
+		case strings.HasPrefix(line, "* VANISHED "):
+			vanished = append(vanished, line)
+		case strings.Contains(line, " FETCH "):
+			fetch = append(fetch, line)
+		}
+	}
+	if len(vanished) != 1 || vanished[0] != "* VANISHED (EARLIER) 1:2" {
+		t.Errorf("expected VANISHED (EARLIER) 1:2, got %q", vanished)
+	}
+	if len(fetch) != 1 || !strings.HasPrefix(fetch[0], "* 1 FETCH ") || !strings.Contains(fetch[0], "UID 3") || !strings.Contains(strings.ToLower(fetch[0]), `\flagged`) || !strings.Contains(fetch[0], "MODSEQ") {
+		t.Errorf("expected a single FETCH for UID 3 with \\Flagged, got %q", fetch)
+	}
+}
+
+func TestSelectQResyncUIDValidityMismatch(t *testing.T) {
+	tc := newQResyncTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("E1 ENABLE QRESYNC")
+	tc.expectOK("E1")
+	uidValidity, err := strconv.ParseUint(findSubmatch(t, tc.selectMailbox("INBOX"), uidValidityRegexp), 10, 32)
+	if err != nil {
+		t.Fatalf("failed to parse UIDVALIDITY: %v", err)
+	}
+
+	tc.writeLine("S2 SELECT INBOX (QRESYNC (%v 1))", uidValidity+1)
+	for _, line := range tc.expectOK("S2") {
+		if strings.HasPrefix(line, "* VANISHED ") || strings.Contains(line, " FETCH ") {
+			t.Errorf("unexpected response for mismatched UIDVALIDITY: %q", line)
+		}
+	}
+}
+
+func TestSelectQResyncNotEnabled(t *testing.T) {
+	tc := newQResyncTestServer(t)
+	tc.login()
+
+	tc.writeLine("S1 SELECT INBOX (QRESYNC (1 1))")
+	if resp, _ := tc.readTagged("S1"); !strings.HasPrefix(resp, "S1 BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+}
+
+func TestExpungeVanished(t *testing.T) {
+	tc := newQResyncTestServer(t)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("E1 ENABLE QRESYNC")
+	tc.expectOK("E1")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 STORE 2 +FLAGS.SILENT (\\Deleted)")
+	tc.expectOK("T1")
+	tc.writeLine("X1 EXPUNGE")
+	untagged := tc.expectOK("X1")
+	if len(untagged) != 1 || untagged[0] != "* VANISHED 2" {
+		t.Errorf("expected VANISHED 2, got %q", untagged)
+	}
+}
+
+func TestUIDExpungeVanished(t *testing.T) {
+	tc := newQResyncTestServer(t)
+	tc.login()
+	for i := 0; i < 6; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+
+	tc.writeLine("E1 ENABLE QRESYNC")
+	tc.expectOK("E1")
+	tc.selectMailbox("INBOX")
+
+	// Message 6 is marked as deleted but isn't part of the UID set
+	tc.writeLine("T1 STORE 2:6 +FLAGS.SILENT (\\Deleted)")
+	tc.expectOK("T1")
+	tc.writeLine("X1 UID EXPUNGE 1:5")
+	untagged := tc.expectOK("X1")
+	if len(untagged) != 1 || untagged[0] != "* VANISHED 2:5" {
+		t.Errorf("expected VANISHED 2:5, got %q", untagged)
+	}
+
+	tc.writeLine("F1 UID FETCH 1:* (FLAGS)")
+	untagged = tc.expectOK("F1")
+	if len(untagged) != 2 || !strings.HasPrefix(untagged[1], "* 2 FETCH (UID 6 ") {
+		t.Errorf("expected messages 1 and 6 to remain, got %q", untagged)
+	}
+}
@@ -0,0 +1,182 @@
+package imapserver
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// quotaResourceTypes is the list of resource types which can be advertised
+// via QUOTA=RES-* capabilities.
+var quotaResourceTypes = []imap.QuotaResourceType{
+	imap.QuotaResourceStorage,
+	imap.QuotaResourceMessage,
+	imap.QuotaResourceMailbox,
+	imap.QuotaResourceAnnotationStorage,
+}
+
+func (c *Conn) handleGetQuota(dec *imapwire.Decoder) error {
+	var root string
+	if !dec.ExpectSP() || !dec.ExpectAString(&root) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.quotaSession()
+	if err != nil {
+		return err
+	}
+
+	data, err := session.GetQuota(c.ctx, root)
+	if err != nil {
+		return err
+	}
+	return c.writeQuota(data)
+}
+
+func (c *Conn) handleGetQuotaRoot(dec *imapwire.Decoder) error {
+	var mailbox string
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.quotaSession()
+	if err != nil {
+		return err
+	}
+
+	l, err := session.GetQuotaRoot(c.ctx, mailbox)
+	if err != nil {
+		return err
+	}
+	return c.writeQuotaRootData(mailbox, l)
+}
+
+// writeSelectQuota writes the quota roots of a mailbox being selected, if
+// supported. Errors from the session don't fail the SELECT command.
+func (c *Conn) writeSelectQuota(mailbox string) error {
+	session, ok := c.session.(SessionQuota)
+	if !ok || !c.server.options.caps().Has(imap.CapQuota) {
+		return nil
+	}
+	l, err := session.GetQuotaRoot(c.ctx, mailbox)
+	if err != nil {
+		c.logger.Warn("failed to get quota root", "mailbox", mailbox, "err", err)
+		return nil
+	}
+	return c.writeQuotaRootData(mailbox, l)
+}
+
+// writeStatusOverQuota warns the client with an untagged OVERQUOTA response if
+// a quota root of a mailbox has reached one of its limits, see RFC 9208
+// section 4.3. Errors from the session don't fail the STATUS command.
+func (c *Conn) writeStatusOverQuota(mailbox string) error {
+	session, ok := c.session.(SessionQuota)
+	if !ok || !c.server.options.caps().Has(imap.CapQuota) {
+		return nil
+	}
+	l, err := session.GetQuotaRoot(c.ctx, mailbox)
+	if err != nil {
+		c.logger.Warn("failed to get quota root", "mailbox", mailbox, "err", err)
+		return nil
+	}
+	for _, data := range l {
+		for _, res := range data.Resources {
+			if res.Usage >= res.Limit {
+				return c.writeStatusResp("", &imap.StatusResponse{
+					Type: imap.StatusResponseTypeNo,
+					Code: imap.ResponseCodeOverQuota,
+					Text: "Mailbox is over quota",
+				})
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Conn) handleSetQuota(dec *imapwire.Decoder) error {
+	var root string
+	if !dec.ExpectSP() || !dec.ExpectAString(&root) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+	limits := make(map[imap.QuotaResourceType]int64)
+	err := dec.ExpectList(func() error {
+		var (
+			name  string
+			limit int64
+		)
+		if !dec.ExpectAtom(&name) || !dec.ExpectSP() || !dec.ExpectNumber64(&limit) {
+			return dec.Err()
+		}
+		limits[imap.QuotaResourceType(name)] = limit
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.quotaSession()
+	if err != nil {
+		return err
+	}
+	if !c.server.options.caps().Has(imap.CapQuotaSet) {
+		return newClientBugError("SETQUOTA is not supported")
+	}
+
+	return session.SetQuota(c.ctx, root, limits)
+}
+
+func (c *Conn) quotaSession() (SessionQuota, error) {
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return nil, err
+	}
+	session, ok := c.session.(SessionQuota)
+	if !ok || !c.server.options.caps().Has(imap.CapQuota) {
+		return nil, newClientBugError("QUOTA is not supported")
+	}
+	return session, nil
+}
+
+func (c *Conn) writeQuotaRootData(mailbox string, l []imap.QuotaData) error {
+	if err := c.writeQuotaRoot(mailbox, l); err != nil {
+		return err
+	}
+	for i := range l {
+		if err := c.writeQuota(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) writeQuotaRoot(mailbox string, l []imap.QuotaData) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("QUOTAROOT").SP().Mailbox(mailbox)
+	for _, data := range l {
+		enc.SP().String(data.Root)
+	}
+	return enc.CRLF()
+}
+
+func (c *Conn) writeQuota(data *imap.QuotaData) error {
+	types := make([]imap.QuotaResourceType, 0, len(data.Resources))
+	for t := range data.Resources {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("QUOTA").SP().String(data.Root).SP()
+	enc.List(len(types), func(i int) {
+		res := data.Resources[types[i]]
+		enc.Atom(string(types[i])).SP().Number64(res.Usage).SP().Number64(res.Limit)
+	})
+	return enc.CRLF()
+}
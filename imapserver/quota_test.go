@@ -0,0 +1,154 @@
+package imapserver_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var testQuotaCaps = imap.CapSet{
+	imap.CapIMAP4rev1:   {},
+	imap.CapQuota:       {},
+	imap.CapQuotaSet:    {},
+	"QUOTA=RES-STORAGE": {},
+	"QUOTA=RES-MESSAGE": {},
+}
+
+// multiQuotaSession is a session where every mailbox belongs to two quota
+// roots.
+type multiQuotaSession struct {
+	imapserver.SessionQuota
+}
+
+func (sess *multiQuotaSession) GetQuotaRoot(ctx context.Context, mailbox string) ([]imap.QuotaData, error) {
+	return []imap.QuotaData{
+		{
+			Root: "user",
+			Resources: map[imap.QuotaResourceType]imap.QuotaResourceData{
+				imap.QuotaResourceStorage: {Usage: 10, Limit: 512},
+				imap.QuotaResourceMessage: {Usage: 3, Limit: 100},
+			},
+		},
+		{
+			Root: "domain",
+			Resources: map[imap.QuotaResourceType]imap.QuotaResourceData{
+				imap.QuotaResourceStorage: {Usage: 2048, Limit: 65536},
+			},
+		},
+	}, nil
+}
+
+func TestGetQuotaRoot(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			sess := memServer.NewSession().(imapserver.SessionQuota)
+			return &multiQuotaSession{sess}, nil, nil
+		},
+		Caps: testQuotaCaps,
+	})
+	tc.login()
+
+	tc.writeLine("Q1 GETQUOTAROOT INBOX")
+	got := tc.expectOK("Q1")
+	want := []string{
+		`* QUOTAROOT INBOX "user" "domain"`,
+		`* QUOTA "user" (MESSAGE 3 100 STORAGE 10 512)`,
+		`* QUOTA "domain" (STORAGE 2048 65536)`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{Caps: testQuotaCaps})
+	tc.login()
+
+	caps := tc.capabilities()
+	for _, c := range []string{"QUOTA", "QUOTASET", "QUOTA=RES-STORAGE", "QUOTA=RES-MESSAGE"} {
+		if !hasCap(caps, c) {
+			t.Errorf("expected %v to be advertised, got %v", c, caps)
+		}
+	}
+
+	tc.writeLine("Q1 GETQUOTAROOT INBOX")
+	if got := tc.expectOK("Q1"); len(got) != 1 || got[0] != "* QUOTAROOT INBOX" {
+		t.Errorf("expected no quota root, got %q", got)
+	}
+
+	tc.writeLine(`Q2 SETQUOTA "" (STORAGE 1 MESSAGE 10)`)
+	tc.expectOK("Q2")
+	tc.appendMessage("INBOX", testMessage)
+
+	tc.writeLine(`Q3 GETQUOTA ""`)
+	if got := tc.expectOK("Q3"); len(got) != 1 || got[0] != `* QUOTA "" (MESSAGE 1 10 STORAGE 1 1)` {
+		t.Errorf("unexpected GETQUOTA response: %q", got)
+	}
+
+	msg := testMessage + strings.Repeat("a", 1024)
+	tc.writeLine("A2 APPEND INBOX {%v+}\r\n%v", len(msg), msg)
+	if resp, _ := tc.readTagged("A2"); !strings.HasPrefix(resp, "A2 NO [OVERQUOTA] ") {
+		t.Errorf("expected NO [OVERQUOTA], got %q", resp)
+	}
+}
+
+func TestSelectQuota(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps:        testQuotaCaps,
+		SelectQuota: true,
+	})
+	tc.login()
+
+	tc.writeLine(`Q1 SETQUOTA "" (MESSAGE 2)`)
+	tc.expectOK("Q1")
+	tc.appendMessage("INBOX", testMessage)
+
+	var got []string
+	for _, line := range tc.selectMailbox("INBOX") {
+		if strings.HasPrefix(line, "* QUOTA") {
+			got = append(got, line)
+		}
+	}
+	want := []string{`* QUOTAROOT INBOX ""`, `* QUOTA "" (MESSAGE 1 2)`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Quota state is up-to-date right after SELECT
+	tc.appendMessage("INBOX", testMessage)
+	tc.writeLine("Q2 GETQUOTAROOT INBOX")
+	want = []string{`* QUOTAROOT INBOX ""`, `* QUOTA "" (MESSAGE 2 2)`}
+	if got := tc.expectOK("Q2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	tc.writeLine("A1 APPEND INBOX {%v+}\r\n%v", len(testMessage), testMessage)
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [OVERQUOTA] ") {
+		t.Errorf("expected NO [OVERQUOTA], got %q", resp)
+	}
+}
+
+func TestStatusOverQuota(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{Caps: testQuotaCaps})
+	tc.login()
+
+	tc.writeLine(`Q1 SETQUOTA "" (MESSAGE 2)`)
+	tc.expectOK("Q1")
+	tc.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("S1 STATUS INBOX (MESSAGES)")
+	if got := tc.expectOK("S1"); len(got) != 1 || got[0] != "* STATUS INBOX (MESSAGES 1)" {
+		t.Errorf("unexpected STATUS response under quota: %q", got)
+	}
+
+	tc.appendMessage("INBOX", testMessage)
+	tc.writeLine("S2 STATUS INBOX (MESSAGES)")
+	want := []string{"* STATUS INBOX (MESSAGES 2)", "* NO [OVERQUOTA] Mailbox is over quota"}
+	if got := tc.expectOK("S2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+package imapserver_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+const testReferralURL = "imap://test-user@other.example.org/"
+
+// referralSession redirects the "moved" users to another server.
+type referralSession struct {
+	imapserver.Session
+}
+
+func (sess *referralSession) Login(ctx context.Context, username, password string) error {
+	switch username {
+	case "moved":
+		return &imapserver.ReferralError{URL: testReferralURL}
+	case "moved-folder":
+		return &imapserver.ReferralError{URL: testReferralURL + "Other [Folder]"}
+	}
+	return sess.Session.Login(ctx, username, password)
+}
+
+func TestLoginReferral(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &referralSession{memServer.NewSession()}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:      {},
+			imap.CapLoginReferrals: {},
+		},
+	})
+
+	if caps := tc.capabilities(); !hasCap(caps, "LOGIN-REFERRALS") {
+		t.Errorf("expected LOGIN-REFERRALS to be advertised, got %v", caps)
+	}
+
+	want := "NO [REFERRAL " + testReferralURL + "] "
+	tc.writeLine("L1 LOGIN moved password")
+	if resp, _ := tc.readTagged("L1"); !strings.HasPrefix(resp, "L1 "+want) {
+		t.Errorf("expected %q, got %q", want, resp)
+	}
+
+	tc.writeLine("A1 AUTHENTICATE PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00moved\x00password")))
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 "+want) {
+		t.Errorf("expected %q, got %q", want, resp)
+	}
+
+	// The URL can't end the response code early
+	want = "NO [REFERRAL " + testReferralURL + "Other%20[Folder%5D] "
+	tc.writeLine("L2 LOGIN moved-folder password")
+	if resp, _ := tc.readTagged("L2"); !strings.HasPrefix(resp, "L2 "+want) {
+		t.Errorf("expected %q, got %q", want, resp)
+	}
+
+	// The connection stays open, so the client can retry
+	tc.login()
+}
@@ -0,0 +1,420 @@
+package imapserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/text/secure/precis"
+)
+
+// NewCRAMMD5Server creates a SASL server for the CRAM-MD5 mechanism, defined
+// in RFC 2195. It can be returned by SessionSASL.Authenticate.
+//
+// The hostname is used to build the challenge. The password function returns
+// the password of a user, or ErrAuthFailed if the user doesn't exist. login is
+// called once the client has proven it knows the password. Usernames are
+// normalized with the PRECIS OpaqueString profile (RFC 8265), which
+// supersedes SASLprep, before being passed to these functions.
+func NewCRAMMD5Server(hostname string, password func(username string) (string, error), login func(username string) error) sasl.Server {
+	return &cramMD5Server{hostname: hostname, password: password, login: login}
+}
+
+type cramMD5Server struct {
+	hostname  string
+	password  func(username string) (string, error)
+	login     func(username string) error
+	challenge []byte
+}
+
+func (s *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.challenge == nil {
+		if len(response) > 0 {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		nonce, err := randomUint64()
+		if err != nil {
+			return nil, false, err
+		}
+		s.challenge = []byte(fmt.Sprintf("<%v.%v@%v>", nonce, time.Now().Unix(), s.hostname))
+		return s.challenge, false, nil
+	}
+
+	i := bytes.LastIndexByte(response, ' ')
+	if i < 0 {
+		return nil, false, newClientBugError("Malformed CRAM-MD5 response")
+	}
+	username, err := saslPrep(string(response[:i]))
+	if err != nil {
+		return nil, false, err
+	}
+	digest := response[i+1:]
+
+	// Unknown users go through the same steps as known users, so that they
+	// can't be told apart
+	password, err := s.password(username)
+	unknownUser := errors.Is(err, errAuthFailed)
+	if err != nil && !unknownUser {
+		return nil, false, err
+	}
+	mac := hmac.New(md5.New, []byte(password))
+	mac.Write(s.challenge)
+	expected := []byte(hex.EncodeToString(mac.Sum(nil)))
+	if subtle.ConstantTimeCompare(bytes.ToLower(digest), expected) != 1 || unknownUser {
+		return nil, false, errAuthFailed
+	}
+
+	return nil, true, s.login(username)
+}
+
+// XOAuth2 is the name of the XOAUTH2 SASL mechanism.
+const XOAuth2 = "XOAUTH2"
+
+// NewXOAuth2Server creates a SASL server for the XOAUTH2 mechanism, used by
+// Gmail and Outlook. It can be returned by SessionSASL.Authenticate.
+//
+// The authenticate function checks the OAuth 2.0 bearer token of a user and
+// logs the user in. If it returns ErrAuthFailed, the failure is reported to
+// the client in a challenge, and the command fails once the client has
+// replied.
+func NewXOAuth2Server(authenticate func(username, token string) error) sasl.Server {
+	return &xoauth2Server{authenticate: authenticate}
+}
+
+type xoauth2Server struct {
+	authenticate func(username, token string) error
+	started      bool
+	failed       bool
+}
+
+func (s *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.failed {
+		// The client acknowledged the error challenge
+		return nil, false, errAuthFailed
+	}
+	if !s.started {
+		s.started = true
+		if len(response) == 0 {
+			// XOAUTH2 is a client-first mechanism
+			return []byte{}, false, nil
+		}
+	}
+
+	// The response is "user=<username>^Aauth=Bearer <token>^A^A"
+	fields, ok := strings.CutSuffix(string(response), "\x01\x01")
+	if !ok {
+		return nil, false, newClientBugError("Malformed XOAUTH2 response")
+	}
+	var username, token string
+	for _, field := range strings.Split(fields, "\x01") {
+		k, v, _ := strings.Cut(field, "=")
+		switch k {
+		case "user":
+			username = v
+		case "auth":
+			scheme, t, _ := strings.Cut(v, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = t
+			}
+		}
+	}
+	if username == "" || token == "" {
+		return nil, false, newClientBugError("Malformed XOAUTH2 response")
+	}
+
+	if err := s.authenticate(username, token); errors.Is(err, errAuthFailed) {
+		s.failed = true
+		return []byte(`{"status":"401","schemes":"bearer"}`), false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// SCRAMCredentials contains the credentials stored by a server for SCRAM
+// authentication, as defined in RFC 5802 section 3. The password itself
+// doesn't need to be stored.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMSHA256Credentials derives SCRAM-SHA-256 credentials from a
+// password. RFC 7677 recommends at least 4096 iterations.
+//
+// The password is normalized with the PRECIS OpaqueString profile (RFC 8265),
+// which supersedes SASLprep. If this fails, the password is used as-is.
+func NewSCRAMSHA256Credentials(password string, salt []byte, iterations int) *SCRAMCredentials {
+	if prepared, err := saslPrep(password); err == nil {
+		password = prepared
+	}
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(saltedPassword, []byte("Server Key")),
+	}
+}
+
+// NewSCRAMSHA256Server creates a SASL server for the SCRAM-SHA-256
+// mechanism, defined in RFC 7677. It can be returned by
+// SessionSASL.Authenticate. Channel binding and authorization identities
+// aren't supported.
+//
+// The credentials function returns the stored credentials of a user, or
+// ErrAuthFailed if the user doesn't exist: in this case the exchange goes on
+// with fake credentials and fails at the end, so that clients can't find out
+// which users exist. login is called once the client has proven it knows the
+// password. Usernames are normalized with the PRECIS OpaqueString profile
+// (RFC 8265), which supersedes SASLprep, before being passed to these
+// functions.
+func NewSCRAMSHA256Server(credentials func(username string) (*SCRAMCredentials, error), login func(username string) error) sasl.Server {
+	return &scramServer{credentials: credentials, login: login}
+}
+
+type scramServer struct {
+	credentials func(username string) (*SCRAMCredentials, error)
+	login       func(username string) error
+
+	step            int
+	username        string
+	creds           *SCRAMCredentials
+	unknownUser     bool
+	gs2Header       string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+}
+
+func (s *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		if len(response) == 0 {
+			// SCRAM is a client-first mechanism
+			return []byte{}, false, nil
+		}
+		challenge, err = s.handleClientFirst(string(response))
+	case 1:
+		challenge, err = s.handleClientFinal(string(response))
+	case 2:
+		// The client acknowledges the server signature
+		if len(response) > 0 {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		if err := s.login(s.username); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s.step++
+	return challenge, false, nil
+}
+
+func (s *scramServer) handleClientFirst(msg string) ([]byte, error) {
+	// gs2-header is "n,," or "y,,", followed by client-first-message-bare
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, newClientBugError("Malformed SCRAM client-first-message")
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+		// no channel binding
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, newClientBugError("SCRAM channel binding not supported")
+	default:
+		return nil, newClientBugError("Malformed SCRAM GS2 header")
+	}
+	if parts[1] != "" {
+		return nil, errAuthorizationIdentity
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) > 0 && strings.HasPrefix(attrs[0], "m=") {
+		// Mandatory extensions must be rejected if they aren't supported, see
+		// RFC 5802 section 5.1
+		return nil, newClientBugError("SCRAM mandatory extensions not supported")
+	}
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, newClientBugError("Malformed SCRAM client-first-message")
+	}
+	username, err := decodeSCRAMName(strings.TrimPrefix(attrs[0], "n="))
+	if err != nil {
+		return nil, err
+	}
+	username, err = saslPrep(username)
+	if err != nil {
+		return nil, err
+	}
+	clientNonce := strings.TrimPrefix(attrs[1], "r=")
+	if clientNonce == "" {
+		return nil, newClientBugError("Empty SCRAM nonce")
+	}
+
+	creds, err := s.credentials(username)
+	if errors.Is(err, errAuthFailed) {
+		s.unknownUser = true
+		creds, err = fakeSCRAMCredentials(username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+
+	s.username = username
+	s.creds = creds
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%v,s=%v,i=%v", s.nonce, base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) handleClientFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, newClientBugError("Malformed SCRAM client-final-message")
+	}
+	withoutProof, encodedProof := msg[:i], msg[i+len(",p="):]
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, newClientBugError("Malformed SCRAM client-final-message")
+	}
+	if attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, errAuthFailed
+	}
+	if attrs[1] != "r="+s.nonce {
+		return nil, errAuthFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(encodedProof)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, newClientBugError("Malformed SCRAM client proof")
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(s.creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.creds.StoredKey) != 1 || s.unknownUser {
+		return nil, errAuthFailed
+	}
+
+	serverSignature := hmacSHA256(s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+var (
+	fakeSCRAMKeyOnce sync.Once
+	fakeSCRAMKey     []byte
+	fakeSCRAMKeyErr  error
+)
+
+// fakeSCRAMCredentials returns credentials for a user which doesn't exist. The
+// salt is derived from the username and a random key, so that it's stable
+// across attempts.
+func fakeSCRAMCredentials(username string) (*SCRAMCredentials, error) {
+	fakeSCRAMKeyOnce.Do(func() {
+		fakeSCRAMKey = make([]byte, sha256.Size)
+		_, fakeSCRAMKeyErr = rand.Read(fakeSCRAMKey)
+	})
+	if fakeSCRAMKeyErr != nil {
+		return nil, fakeSCRAMKeyErr
+	}
+	return &SCRAMCredentials{
+		Salt:       hmacSHA256(fakeSCRAMKey, []byte("salt:"+username))[:16],
+		Iterations: 4096,
+		StoredKey:  hmacSHA256(fakeSCRAMKey, []byte("stored-key:"+username)),
+		ServerKey:  hmacSHA256(fakeSCRAMKey, []byte("server-key:"+username)),
+	}, nil
+}
+
+// saslPrep prepares a username or password for comparison. SASLprep (RFC
+// 4013) has been superseded by the PRECIS OpaqueString profile (RFC 8265),
+// which is used instead.
+func saslPrep(s string) (string, error) {
+	prepared, err := precis.OpaqueString.String(s)
+	if err != nil {
+		return "", newClientBugError("Invalid characters in SASL credentials")
+	}
+	return prepared, nil
+}
+
+// decodeSCRAMName decodes a saslname, see RFC 5802 section 5.1.
+func decodeSCRAMName(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			sb.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			sb.WriteByte('=')
+		default:
+			return "", newClientBugError("Malformed SCRAM username")
+		}
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA-256, for a key of
+// the same size as the hash.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+func randomUint64() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
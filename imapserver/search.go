@@ -2,94 +2,229 @@ package imapserver
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
+	"golang.org/x/text/encoding"
 )
 
-func (c *Conn) handleSearch(tag string, dec *imapwire.Decoder, numKind NumKind) error {
+func (c *Conn) handleSearch(tag string, dec *imapwire.Decoder, numKind NumKind) (exec func() error, err error) {
 	if !dec.ExpectSP() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 	var (
 		atom     string
 		options  imap.SearchOptions
 		extended bool
+		update   bool
 	)
 	if maybeReadSearchKeyAtom(dec, &atom) && strings.EqualFold(atom, "RETURN") {
-		if err := readSearchReturnOpts(dec, &options); err != nil {
-			return fmt.Errorf("in search-return-opts: %w", err)
+		if err := readSearchReturnOpts(dec, &options, &update); err != nil {
+			return nil, fmt.Errorf("in search-return-opts: %w", err)
+		}
+		if update && !c.server.options.caps().Has(imap.CapContextSearch) {
+			return nil, newClientBugError("CONTEXT=SEARCH is not supported")
+		}
+		if options.ReturnRelevancy && !c.server.options.caps().Has(imap.CapSearchFuzzy) {
+			return nil, newClientBugError("SEARCH=FUZZY is not supported")
 		}
 		if !dec.ExpectSP() {
-			return dec.Err()
+			return nil, dec.Err()
 		}
 		extended = true
 		atom = ""
 		maybeReadSearchKeyAtom(dec, &atom)
 	}
+	var charsetEnc encoding.Encoding
 	if strings.EqualFold(atom, "CHARSET") {
 		var charset string
 		if !dec.ExpectSP() || !dec.ExpectAString(&charset) || !dec.ExpectSP() {
-			return dec.Err()
+			return nil, dec.Err()
 		}
-		switch strings.ToUpper(charset) {
-		case "US-ASCII", "UTF-8":
-			// nothing to do
-		default:
-			return &imap.Error{
-				Type: imap.StatusResponseTypeNo,
-				Code: imap.ResponseCodeBadCharset, // TODO: return list of supported charsets
-				Text: "Only US-ASCII and UTF-8 are supported SEARCH charsets",
-			}
+		if c.enabled.Has(imap.CapUTF8Accept) {
+			// See RFC 6855 section 3
+			return nil, newClientBugError("SEARCH CHARSET is not allowed when UTF8=ACCEPT is enabled")
+		}
+		if charsetEnc, err = c.searchCharset(charset); err != nil {
+			return nil, err
 		}
 		atom = ""
 		maybeReadSearchKeyAtom(dec, &atom)
 	}
 
 	var criteria imap.SearchCriteria
-	for {
-		var err error
-		if atom != "" {
-			err = readSearchKeyWithAtom(&criteria, dec, atom)
-			atom = ""
-		} else {
-			err = readSearchKey(&criteria, dec)
+	if err := c.readSearchKeyList(&criteria, dec, atom); err != nil {
+		return nil, err
+	}
+	if err := decodeSearchCriteria(&criteria, charsetEnc); err != nil {
+		return nil, err
+	}
+
+	if !dec.ExpectCRLF() {
+		return nil, dec.Err()
+	}
+
+	// If no return option is specified, ALL is assumed
+	if !hasSearchReturnData(&options) && !options.ReturnSave && !update {
+		options.ReturnAll = true
+	}
+
+	exec = func() error {
+		if err := c.checkState(imap.ConnStateSelected); err != nil {
+			return err
+		}
+
+		if err := c.resolveSearchCriteria(&criteria); err != nil {
+			return err
+		}
+
+		data, err := c.session.Search(c.ctx, numKind, &criteria, &options)
+		if options.ReturnSave {
+			if err != nil {
+				// A failed SEARCH resets the saved result
+				c.setSearchRes(nil)
+			} else if err := c.saveSearchRes(numKind, data, &options); err != nil {
+				return err
+			}
 		}
 		if err != nil {
-			return fmt.Errorf("in search-key: %w", err)
+			return err
 		}
 
-		if !dec.SP() {
-			break
+		if update {
+			if err := c.addSearchContext(tag, numKind, &criteria, nil); err != nil {
+				return err
+			}
 		}
-	}
 
-	if !dec.ExpectCRLF() {
-		return dec.Err()
+		if c.enabled.Has(imap.CapIMAP4rev2) || extended {
+			if !hasSearchReturnData(&options) && !update {
+				// Only SAVE has been requested
+				return nil
+			}
+			return c.writeESearch(tag, data, &options)
+		} else {
+			return c.writeSearch(data.All)
+		}
 	}
 
-	if err := c.checkState(imap.ConnStateSelected); err != nil {
-		return err
+	if options.ReturnSave {
+		// The saved result may be referenced by the next commands
+		c.waitCommands()
+		return nil, exec()
 	}
+	return exec, nil
+}
 
-	// If no return option is specified, ALL is assumed
-	if !options.ReturnMin && !options.ReturnMax && !options.ReturnAll && !options.ReturnCount {
-		options.ReturnAll = true
+// hasSearchReturnData returns true if SEARCH return options which produce an
+// ESEARCH response are set.
+func hasSearchReturnData(options *imap.SearchOptions) bool {
+	return options.ReturnMin || options.ReturnMax || options.ReturnAll || options.ReturnCount || options.ReturnRelevancy
+}
+
+func (c *Conn) setSearchRes(uids imap.SeqSet) {
+	c.mutex.Lock()
+	c.searchRes = uids
+	c.mutex.Unlock()
+}
+
+// saveSearchRes stores the result of a SEARCH command for later reference via
+// "$" (see RFC 5182). The result is stored as UIDs, so that expunged messages
+// are implicitly removed.
+func (c *Conn) saveSearchRes(numKind NumKind, data *imap.SearchData, options *imap.SearchOptions) error {
+	var seqSet imap.SeqSet
+	if (options.ReturnMin || options.ReturnMax) && !options.ReturnAll && !options.ReturnCount {
+		// Only the returned messages are saved
+		if options.ReturnMin && data.Min > 0 {
+			seqSet.AddNum(data.Min)
+		}
+		if options.ReturnMax && data.Max > 0 {
+			seqSet.AddNum(data.Max)
+		}
+	} else {
+		seqSet = data.All
 	}
 
-	data, err := c.session.Search(numKind, &criteria, &options)
+	uids, err := c.convertSeqSet(numKind, NumKindUID, seqSet)
 	if err != nil {
 		return err
 	}
+	c.setSearchRes(uids)
+	return nil
+}
 
-	if c.enabled.Has(imap.CapIMAP4rev2) || extended {
-		return c.writeESearch(tag, data, &options)
-	} else {
-		return c.writeSearch(data.All)
+// resolveSeqSet replaces a reference to the saved SEARCH result with the
+// actual sequence numbers or UIDs.
+func (c *Conn) resolveSeqSet(numKind NumKind, seqSet imap.SeqSet) (imap.SeqSet, error) {
+	if !imap.IsSearchRes(seqSet) {
+		return seqSet, nil
+	}
+
+	c.mutex.Lock()
+	uids := c.searchRes
+	c.mutex.Unlock()
+
+	return c.convertSeqSet(NumKindUID, numKind, uids)
+}
+
+func (c *Conn) resolveSearchCriteria(criteria *imap.SearchCriteria) error {
+	for i, seqSet := range criteria.SeqNum {
+		seqSet, err := c.resolveSeqSet(NumKindSeq, seqSet)
+		if err != nil {
+			return err
+		}
+		criteria.SeqNum[i] = seqSet
+	}
+	for i, seqSet := range criteria.UID {
+		seqSet, err := c.resolveSeqSet(NumKindUID, seqSet)
+		if err != nil {
+			return err
+		}
+		criteria.UID[i] = seqSet
 	}
+	for i := range criteria.Not {
+		if err := c.resolveSearchCriteria(&criteria.Not[i]); err != nil {
+			return err
+		}
+	}
+	for i := range criteria.Fuzzy {
+		if err := c.resolveSearchCriteria(&criteria.Fuzzy[i]); err != nil {
+			return err
+		}
+	}
+	for i := range criteria.Or {
+		for j := range criteria.Or[i] {
+			if err := c.resolveSearchCriteria(&criteria.Or[i][j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertSeqSet converts a set of sequence numbers into a set of UIDs, or the
+// other way around.
+func (c *Conn) convertSeqSet(from, to NumKind, seqSet imap.SeqSet) (imap.SeqSet, error) {
+	if from == to || len(seqSet) == 0 {
+		return seqSet, nil
+	}
+
+	var criteria imap.SearchCriteria
+	switch from {
+	case NumKindSeq:
+		criteria.SeqNum = []imap.SeqSet{seqSet}
+	case NumKindUID:
+		criteria.UID = []imap.SeqSet{seqSet}
+	}
+	data, err := c.session.Search(c.ctx, to, &criteria, &imap.SearchOptions{ReturnAll: true})
+	if err != nil {
+		return nil, err
+	}
+	return data.All, nil
 }
 
 func (c *Conn) writeESearch(tag string, data *imap.SearchData, options *imap.SearchOptions) error {
@@ -98,14 +233,12 @@ func (c *Conn) writeESearch(tag string, data *imap.SearchData, options *imap.Sea
 
 	enc.Atom("*").SP().Atom("ESEARCH")
 	if tag != "" {
-		enc.SP().Special('(').Atom("TAG").SP().Atom(tag).Special(')')
+		enc.SP().Special('(').Atom("TAG").SP().Quoted(tag).Special(')')
 	}
 	if data.UID {
 		enc.SP().Atom("UID")
 	}
-	if options.ReturnAll && len(data.All) > 0 {
-		enc.SP().Atom("ALL").SP().SeqSet(data.All)
-	}
+	// MIN and MAX must be omitted if there are no matching messages
 	if options.ReturnMin && data.Min > 0 {
 		enc.SP().Atom("MIN").SP().Number(data.Min)
 	}
@@ -115,6 +248,14 @@ func (c *Conn) writeESearch(tag string, data *imap.SearchData, options *imap.Sea
 	if options.ReturnCount {
 		enc.SP().Atom("COUNT").SP().Number(data.Count)
 	}
+	if options.ReturnAll && len(data.All) > 0 {
+		enc.SP().Atom("ALL").SP().SeqSet(data.All)
+	}
+	if options.ReturnRelevancy && len(data.Relevancy) > 0 {
+		enc.SP().Atom("RELEVANCY").SP().List(len(data.Relevancy), func(i int) {
+			enc.Number(uint32(data.Relevancy[i]))
+		})
+	}
 	return enc.CRLF()
 }
 
@@ -134,7 +275,104 @@ func (c *Conn) writeSearch(seqSet imap.SeqSet) error {
 	return enc.CRLF()
 }
 
-func readSearchReturnOpts(dec *imapwire.Decoder, options *imap.SearchOptions) error {
+// searchCharset looks up a SEARCH charset. A nil encoding is returned for
+// charsets which don't need to be converted.
+func (c *Conn) searchCharset(charset string) (encoding.Encoding, error) {
+	charset = strings.ToUpper(charset)
+	switch charset {
+	case "US-ASCII", "UTF-8":
+		return nil, nil
+	}
+	if enc, ok := c.server.options.SearchCharsets[charset]; ok {
+		return enc, nil
+	}
+
+	supported := make([]string, 0, len(c.server.options.SearchCharsets))
+	for name := range c.server.options.SearchCharsets {
+		supported = append(supported, name)
+	}
+	sort.Strings(supported)
+	supported = append([]string{"UTF-8", "US-ASCII"}, supported...)
+	return nil, &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCode(fmt.Sprintf("%v (%v)", imap.ResponseCodeBadCharset, strings.Join(supported, " "))),
+		Text: "Unsupported SEARCH charset",
+	}
+}
+
+// decodeSearchCriteria converts the strings of a search criteria from the
+// specified charset to UTF-8.
+func decodeSearchCriteria(criteria *imap.SearchCriteria, enc encoding.Encoding) error {
+	if enc == nil {
+		return nil
+	}
+
+	dec := enc.NewDecoder()
+	decodeStrings := func(l []string) error {
+		for i, s := range l {
+			var err error
+			if l[i], err = dec.String(s); err != nil {
+				return newClientBugError("Invalid string in SEARCH charset")
+			}
+		}
+		return nil
+	}
+
+	for i := range criteria.Header {
+		hdr := &criteria.Header[i]
+		var err error
+		if hdr.Value, err = dec.String(hdr.Value); err != nil {
+			return newClientBugError("Invalid string in SEARCH charset")
+		}
+	}
+	if err := decodeStrings(criteria.Body); err != nil {
+		return err
+	}
+	if err := decodeStrings(criteria.Text); err != nil {
+		return err
+	}
+	for i := range criteria.Not {
+		if err := decodeSearchCriteria(&criteria.Not[i], enc); err != nil {
+			return err
+		}
+	}
+	for i := range criteria.Fuzzy {
+		if err := decodeSearchCriteria(&criteria.Fuzzy[i], enc); err != nil {
+			return err
+		}
+	}
+	for i := range criteria.Or {
+		for j := range criteria.Or[i] {
+			if err := decodeSearchCriteria(&criteria.Or[i][j], enc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSearchKeyList reads a space-separated list of search keys. If atom is
+// non-empty, it's used as the first search key atom.
+func (c *Conn) readSearchKeyList(criteria *imap.SearchCriteria, dec *imapwire.Decoder, atom string) error {
+	for {
+		var err error
+		if atom != "" {
+			err = c.readSearchKeyWithAtom(criteria, dec, atom)
+			atom = ""
+		} else {
+			err = c.readSearchKey(criteria, dec)
+		}
+		if err != nil {
+			return fmt.Errorf("in search-key: %w", err)
+		}
+
+		if !dec.SP() {
+			return nil
+		}
+	}
+}
+
+func readSearchReturnOpts(dec *imapwire.Decoder, options *imap.SearchOptions, update *bool) error {
 	if !dec.ExpectSP() {
 		return dec.Err()
 	}
@@ -152,6 +390,12 @@ func readSearchReturnOpts(dec *imapwire.Decoder, options *imap.SearchOptions) er
 			options.ReturnAll = true
 		case "COUNT":
 			options.ReturnCount = true
+		case "SAVE":
+			options.ReturnSave = true
+		case "UPDATE":
+			*update = true
+		case "RELEVANCY":
+			options.ReturnRelevancy = true
 		default:
 			return newClientBugError("unknown SEARCH RETURN option")
 		}
@@ -165,21 +409,23 @@ func maybeReadSearchKeyAtom(dec *imapwire.Decoder, ptr *string) bool {
 	})
 }
 
-func readSearchKey(criteria *imap.SearchCriteria, dec *imapwire.Decoder) error {
+func (c *Conn) readSearchKey(criteria *imap.SearchCriteria, dec *imapwire.Decoder) error {
 	var key string
 	if maybeReadSearchKeyAtom(dec, &key) {
-		return readSearchKeyWithAtom(criteria, dec, key)
+		return c.readSearchKeyWithAtom(criteria, dec, key)
 	}
 	return dec.ExpectList(func() error {
-		return readSearchKey(criteria, dec)
+		return c.readSearchKey(criteria, dec)
 	})
 }
 
-func readSearchKeyWithAtom(criteria *imap.SearchCriteria, dec *imapwire.Decoder, key string) error {
+func (c *Conn) readSearchKeyWithAtom(criteria *imap.SearchCriteria, dec *imapwire.Decoder, key string) error {
 	key = strings.ToUpper(key)
 	switch key {
 	case "ALL":
 		// nothing to do
+	case "$":
+		criteria.SeqNum = append(criteria.SeqNum, imap.SearchRes())
 	case "UID":
 		var seqSet imap.SeqSet
 		if !dec.ExpectSP() || !dec.ExpectSeqSet(&seqSet) {
@@ -203,6 +449,8 @@ func readSearchKeyWithAtom(criteria *imap.SearchCriteria, dec *imapwire.Decoder,
 		flag, err := internal.ExpectFlag(dec)
 		if err != nil {
 			return err
+		} else if strings.HasPrefix(string(flag), "\\") {
+			return newClientBugError("Expected a keyword, got a system flag")
 		}
 		switch key {
 		case "KEYWORD":
@@ -254,6 +502,52 @@ func readSearchKeyWithAtom(criteria *imap.SearchCriteria, dec *imapwire.Decoder,
 			dateCriteria.SentBefore = t.Add(24 * time.Hour)
 		}
 		criteria.And(&dateCriteria)
+	case "SAVEDSINCE", "SAVEDBEFORE", "SAVEDON":
+		if !c.server.options.caps().Has(imap.CapSaveDate) {
+			return newClientBugError("SAVEDATE is not supported")
+		}
+		if !dec.ExpectSP() {
+			return dec.Err()
+		}
+		t, err := internal.ExpectDate(dec)
+		if err != nil {
+			return err
+		}
+		var dateCriteria imap.SearchCriteria
+		switch key {
+		case "SAVEDSINCE":
+			dateCriteria.SavedSince = t
+		case "SAVEDBEFORE":
+			dateCriteria.SavedBefore = t
+		case "SAVEDON":
+			dateCriteria.SavedSince = t
+			dateCriteria.SavedBefore = t.Add(24 * time.Hour)
+		}
+		criteria.And(&dateCriteria)
+	case "SAVEDATESUPPORTED":
+		if !c.server.options.caps().Has(imap.CapSaveDate) {
+			return newClientBugError("SAVEDATE is not supported")
+		}
+		criteria.SaveDateSupported = true
+	case "OLDER", "YOUNGER":
+		if !c.server.options.caps().Has(imap.CapWithin) {
+			return newClientBugError("WITHIN is not supported")
+		}
+		var n int64
+		if !dec.ExpectSP() || !dec.ExpectNumber64(&n) {
+			return dec.Err()
+		}
+		interval := time.Duration(n) * time.Second
+		if n <= 0 || interval/time.Second != time.Duration(n) {
+			return newClientBugError("Invalid search interval")
+		}
+		t := c.server.options.now().Add(-interval)
+		switch key {
+		case "OLDER":
+			criteria.And(&imap.SearchCriteria{Older: t})
+		case "YOUNGER":
+			criteria.And(&imap.SearchCriteria{Younger: t})
+		}
 	case "BODY":
 		var body string
 		if !dec.ExpectSP() || !dec.ExpectAString(&body) {
@@ -282,8 +576,8 @@ func readSearchKeyWithAtom(criteria *imap.SearchCriteria, dec *imapwire.Decoder,
 			return dec.Err()
 		}
 		var not imap.SearchCriteria
-		if err := readSearchKey(&not, dec); err != nil {
-			return nil
+		if err := c.readSearchKey(&not, dec); err != nil {
+			return err
 		}
 		criteria.Not = append(criteria.Not, not)
 	case "OR":
@@ -291,16 +585,28 @@ func readSearchKeyWithAtom(criteria *imap.SearchCriteria, dec *imapwire.Decoder,
 			return dec.Err()
 		}
 		var or [2]imap.SearchCriteria
-		if err := readSearchKey(&or[0], dec); err != nil {
-			return nil
+		if err := c.readSearchKey(&or[0], dec); err != nil {
+			return err
 		}
 		if !dec.ExpectSP() {
 			return dec.Err()
 		}
-		if err := readSearchKey(&or[1], dec); err != nil {
-			return nil
+		if err := c.readSearchKey(&or[1], dec); err != nil {
+			return err
 		}
 		criteria.Or = append(criteria.Or, or)
+	case "FUZZY":
+		if !c.server.options.caps().Has(imap.CapSearchFuzzy) {
+			return newClientBugError("SEARCH=FUZZY is not supported")
+		}
+		if !dec.ExpectSP() {
+			return dec.Err()
+		}
+		var fuzzy imap.SearchCriteria
+		if err := c.readSearchKey(&fuzzy, dec); err != nil {
+			return err
+		}
+		criteria.Fuzzy = append(criteria.Fuzzy, fuzzy)
 	default:
 		seqSet, err := imap.ParseSeqSet(key)
 		if err != nil {
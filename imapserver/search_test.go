@@ -0,0 +1,456 @@
+package imapserver_test
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func newSearchTestConn(t *testing.T) *testConn {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapESearch:   {},
+			imap.CapSearchRes: {},
+		},
+	})
+	tc.login()
+	for i := 0; i < 4; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+	tc.selectMailbox("INBOX")
+	tc.writeLine("T0 STORE 2,4 +FLAGS.SILENT (\\Flagged)")
+	tc.expectOK("T0")
+	return tc
+}
+
+var searchReturnTests = []struct {
+	name    string
+	command string
+	resp    string
+}{
+	{
+		name:    "all",
+		command: "SEARCH RETURN (MIN MAX COUNT ALL) FLAGGED",
+		resp:    `* ESEARCH (TAG "T1") MIN 2 MAX 4 COUNT 2 ALL 2,4`,
+	},
+	{
+		name:    "uid",
+		command: "UID SEARCH RETURN (COUNT) UNFLAGGED",
+		resp:    `* ESEARCH (TAG "T1") UID COUNT 2`,
+	},
+	{
+		name:    "default",
+		command: "SEARCH RETURN () 1:3",
+		resp:    `* ESEARCH (TAG "T1") ALL 1:3`,
+	},
+	{
+		name:    "empty",
+		command: "SEARCH RETURN (MIN MAX COUNT ALL) KEYWORD foo",
+		resp:    `* ESEARCH (TAG "T1") COUNT 0`,
+	},
+	{
+		name:    "empty-min-max",
+		command: "SEARCH RETURN (MIN MAX) KEYWORD foo",
+		resp:    `* ESEARCH (TAG "T1")`,
+	},
+}
+
+func TestSearchReturn(t *testing.T) {
+	for _, test := range searchReturnTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			tc := newSearchTestConn(t)
+			tc.writeLine("T1 %v", test.command)
+			untagged := tc.expectOK("T1")
+			if len(untagged) != 1 || untagged[0] != test.resp {
+				t.Errorf("got %q, want %q", untagged, test.resp)
+			}
+		})
+	}
+}
+
+func TestSearchSave(t *testing.T) {
+	tc := newSearchTestConn(t)
+
+	tc.writeLine("T1 SEARCH RETURN (SAVE) FLAGGED")
+	if untagged := tc.expectOK("T1"); len(untagged) != 0 {
+		t.Errorf("unexpected response to SEARCH RETURN (SAVE): %q", untagged)
+	}
+
+	tc.writeLine("F1 FETCH $ (UID)")
+	untagged := tc.expectOK("F1")
+	if len(untagged) != 2 || !strings.HasPrefix(untagged[0], "* 2 FETCH") || !strings.HasPrefix(untagged[1], "* 4 FETCH") {
+		t.Errorf("unexpected response to FETCH $: %q", untagged)
+	}
+
+	// Expunged messages are removed from the saved result
+	tc.writeLine("T2 STORE 2 +FLAGS.SILENT (\\Deleted)")
+	tc.expectOK("T2")
+	tc.writeLine("E1 EXPUNGE")
+	tc.expectOK("E1")
+
+	tc.writeLine("T3 SEARCH RETURN (ALL) $")
+	untagged = tc.expectOK("T3")
+	if want := `* ESEARCH (TAG "T3") ALL 3`; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+
+	// MIN and MAX only save the returned messages
+	tc.writeLine("T4 UID SEARCH RETURN (SAVE MIN) ALL")
+	tc.expectOK("T4")
+	tc.writeLine("T5 UID SEARCH RETURN (ALL) UID $")
+	untagged = tc.expectOK("T5")
+	if want := `* ESEARCH (TAG "T5") UID ALL 1`; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+}
+
+func TestSearchCharset(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		SearchCharsets: map[string]encoding.Encoding{
+			"ISO-8859-1": charmap.ISO8859_1,
+		},
+	})
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", "Subject: Café\r\n\r\nHi!\r\n")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 SEARCH CHARSET ISO-8859-1 SUBJECT {4}")
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.writeString("Caf\xe9\r\n")
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != "* SEARCH 2" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2")
+	}
+
+	tc.writeLine("T2 SEARCH CHARSET KOI8-R SUBJECT foo")
+	want := "T2 NO [BADCHARSET (UTF-8 US-ASCII ISO-8859-1)] Unsupported SEARCH charset"
+	if resp, _ := tc.readTagged("T2"); resp != want {
+		t.Errorf("got %q, want %q", resp, want)
+	}
+}
+
+func TestSearchKeyword(t *testing.T) {
+	tc := newSearchTestConn(t)
+
+	tc.writeLine("T1 STORE 3 +FLAGS.SILENT ($Important)")
+	tc.expectOK("T1")
+
+	tc.writeLine("T2 SEARCH KEYWORD $Important")
+	if untagged := tc.expectOK("T2"); len(untagged) != 1 || untagged[0] != "* SEARCH 3" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 3")
+	}
+	tc.writeLine("T3 SEARCH UNKEYWORD $Important FLAGGED")
+	if untagged := tc.expectOK("T3"); len(untagged) != 1 || untagged[0] != "* SEARCH 2 4" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2 4")
+	}
+
+	tc.writeLine("T4 STORE 3 -FLAGS.SILENT ($Important)")
+	tc.expectOK("T4")
+	tc.writeLine("T5 SEARCH KEYWORD $Important")
+	if untagged := tc.expectOK("T5"); len(untagged) != 1 || untagged[0] != "* SEARCH" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH")
+	}
+
+	// System flags aren't keywords
+	tc.writeLine("T6 SEARCH KEYWORD \\Seen")
+	if resp, _ := tc.readTagged("T6"); !strings.HasPrefix(resp, "T6 BAD ") {
+		t.Errorf("expected BAD response, got %q", resp)
+	}
+	tc.writeLine("T7 STORE 1 +FLAGS (\\*)")
+	if resp, _ := tc.readTagged("T7"); !strings.HasPrefix(resp, "T7 BAD ") {
+		t.Errorf("expected BAD response, got %q", resp)
+	}
+
+	// Arbitrary keywords can be stored
+	untagged := tc.selectMailbox("INBOX")
+	re := regexp.MustCompile(`^\* OK \[PERMANENTFLAGS \((.*)\)\]`)
+	if flags := strings.Fields(findSubmatch(t, untagged, re)); len(flags) == 0 || flags[len(flags)-1] != `\*` {
+		t.Errorf("expected \\* in PERMANENTFLAGS, got %q", flags)
+	}
+}
+
+func TestSearchWithin(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapWithin:    {},
+		},
+		Now: func() time.Time {
+			return now
+		},
+	})
+	tc.login()
+	if !hasCap(tc.capabilities(), string(imap.CapWithin)) {
+		t.Errorf("WITHIN isn't advertised")
+	}
+	for _, d := range []time.Duration{2 * time.Hour, 30 * time.Minute, 10 * time.Second} {
+		date := now.Add(-d).Format("02-Jan-2006 15:04:05 -0700")
+		tc.writeLine("A1 APPEND INBOX \"%v\" {%v+}\r\n%v", date, len(testMessage), testMessage)
+		tc.expectOK("A1")
+	}
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 SEARCH YOUNGER 3600")
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != "* SEARCH 2 3" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2 3")
+	}
+	tc.writeLine("T2 SEARCH OLDER 3600")
+	if untagged := tc.expectOK("T2"); len(untagged) != 1 || untagged[0] != "* SEARCH 1" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 1")
+	}
+	tc.writeLine("T3 SEARCH OLDER 60 YOUNGER 3600")
+	if untagged := tc.expectOK("T3"); len(untagged) != 1 || untagged[0] != "* SEARCH 2" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2")
+	}
+
+	for _, cmd := range []string{"SEARCH YOUNGER 0", "SEARCH NOT OLDER 0", "SEARCH OLDER -1"} {
+		tc.writeLine("T4 %v", cmd)
+		if resp, _ := tc.readTagged("T4"); !strings.HasPrefix(resp, "T4 BAD ") {
+			t.Errorf("%v: expected BAD response, got %q", cmd, resp)
+		}
+	}
+}
+
+func TestSearchWithinUnsupported(t *testing.T) {
+	tc := newSearchTestConn(t)
+
+	tc.writeLine("T1 SEARCH YOUNGER 3600")
+	if resp, _ := tc.readTagged("T1"); !strings.HasPrefix(resp, "T1 BAD ") {
+		t.Errorf("expected BAD response, got %q", resp)
+	}
+}
+
+func TestSearchResStore(t *testing.T) {
+	tc := newSearchTestConn(t)
+
+	// No saved result yet: "$" is the empty set
+	tc.writeLine("T1 STORE $ +FLAGS.SILENT (\\Seen)")
+	tc.expectOK("T1")
+	tc.writeLine("T2 FETCH $ (FLAGS)")
+	if untagged := tc.expectOK("T2"); len(untagged) != 0 {
+		t.Errorf("unexpected response to FETCH $: %q", untagged)
+	}
+
+	tc.writeLine("T3 SEARCH RETURN (SAVE) FLAGGED")
+	tc.expectOK("T3")
+	tc.writeLine("T4 STORE $ +FLAGS.SILENT (\\Seen)")
+	tc.expectOK("T4")
+	tc.writeLine("T5 UID STORE $ +FLAGS.SILENT ($Important)")
+	tc.expectOK("T5")
+
+	tc.writeLine("T6 SEARCH SEEN KEYWORD $Important")
+	if untagged := tc.expectOK("T6"); len(untagged) != 1 || untagged[0] != "* SEARCH 2 4" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2 4")
+	}
+	tc.writeLine("T7 SEARCH UNSEEN")
+	if untagged := tc.expectOK("T7"); len(untagged) != 1 || untagged[0] != "* SEARCH 1 3" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 1 3")
+	}
+}
+
+type searchRecorderSession struct {
+	imapserver.Session
+
+	criteria *imap.SearchCriteria
+	options  *imap.SearchOptions
+}
+
+func (sess *searchRecorderSession) Search(ctx context.Context, kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	sess.criteria = criteria
+	sess.options = options
+	return sess.Session.Search(ctx, kind, criteria, options)
+}
+
+func TestSearchFuzzy(t *testing.T) {
+	memServer := newTestMemServer()
+	sessions := make(chan *searchRecorderSession, 1)
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			sess := &searchRecorderSession{Session: memServer.NewSession()}
+			sessions <- sess
+			return sess, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:   {},
+			imap.CapESearch:     {},
+			imap.CapSearchFuzzy: {},
+		},
+	})
+	sess := <-sessions
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	if caps := tc.capabilities(); !hasCap(caps, "SEARCH=FUZZY") {
+		t.Errorf("SEARCH=FUZZY isn't advertised: %v", caps)
+	}
+
+	tc.writeLine(`T1 SEARCH FUZZY SUBJECT "Your Name"`)
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != "* SEARCH 1" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 1")
+	}
+	want := &imap.SearchCriteria{
+		Fuzzy: []imap.SearchCriteria{{
+			Header: []imap.SearchCriteriaHeaderField{{Key: "Subject", Value: "Your Name"}},
+		}},
+	}
+	if !reflect.DeepEqual(sess.criteria, want) {
+		t.Errorf("got criteria %#v, want %#v", sess.criteria, want)
+	}
+
+	tc.writeLine(`T2 SEARCH RETURN (ALL RELEVANCY) FUZZY TEXT "who"`)
+	const resp = `* ESEARCH (TAG "T2") ALL 1 RELEVANCY (100)`
+	if untagged := tc.expectOK("T2"); len(untagged) != 1 || untagged[0] != resp {
+		t.Errorf("got %q, want %q", untagged, resp)
+	}
+	if !sess.options.ReturnRelevancy {
+		t.Errorf("ReturnRelevancy wasn't passed to the session")
+	}
+}
+
+func TestSearchFuzzyIMAP4rev2(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev2:   {},
+			imap.CapSearchFuzzy: {},
+		},
+	})
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "SEARCH=FUZZY") {
+		t.Errorf("SEARCH=FUZZY isn't advertised: %v", caps)
+	}
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`T1 SEARCH RETURN (ALL RELEVANCY) FUZZY SUBJECT "Your Name"`)
+	const resp = `* ESEARCH (TAG "T1") ALL 1 RELEVANCY (100)`
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != resp {
+		t.Errorf("got %q, want %q", untagged, resp)
+	}
+}
+
+func TestSearchFuzzyUnsupported(t *testing.T) {
+	tc := newSearchTestConn(t)
+
+	for _, cmd := range []string{`SEARCH FUZZY SUBJECT "Your Name"`, "SEARCH RETURN (RELEVANCY) ALL"} {
+		tc.writeLine("T1 %v", cmd)
+		if resp, _ := tc.readTagged("T1"); !strings.HasPrefix(resp, "T1 BAD ") {
+			t.Errorf("%v: expected BAD response, got %q", cmd, resp)
+		}
+	}
+}
+
+func TestSearchHeader(t *testing.T) {
+	memServer := newTestMemServer()
+	sessions := make(chan *searchRecorderSession, 1)
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			sess := &searchRecorderSession{Session: memServer.NewSession()}
+			sessions <- sess
+			return sess, nil, nil
+		},
+	})
+	sess := <-sessions
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", "Subject: =?ISO-8859-1?Q?M=FCnchen?=\r\nX-Foo: Some BAR\r\n\r\nHi!\r\n")
+	tc.appendMessage("INBOX", "Subject: =?UTF-8?B?R3LDvMOfZSBhdXMgTcO8bmNoZW4=?=\r\n\r\nHi!\r\n")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`T1 SEARCH HEADER X-Foo "bar"`)
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != "* SEARCH 2" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2")
+	}
+	want := &imap.SearchCriteria{
+		Header: []imap.SearchCriteriaHeaderField{{Key: "X-Foo", Value: "bar"}},
+	}
+	if !reflect.DeepEqual(sess.criteria, want) {
+		t.Errorf("got criteria %#v, want %#v", sess.criteria, want)
+	}
+
+	const value = "München"
+	tc.writeLine("T2 SEARCH CHARSET UTF-8 HEADER Subject {%v}", len(value))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.writeString(value + "\r\n")
+	if untagged := tc.expectOK("T2"); len(untagged) != 1 || untagged[0] != "* SEARCH 2 3" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2 3")
+	}
+
+	// An empty value matches all messages with the header field
+	tc.writeLine(`T3 SEARCH HEADER x-foo ""`)
+	if untagged := tc.expectOK("T3"); len(untagged) != 1 || untagged[0] != "* SEARCH 2" {
+		t.Errorf("got %q, want %q", untagged, "* SEARCH 2")
+	}
+}
+
+func TestSaveDate(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapSaveDate:  {},
+		},
+	})
+	tc.login()
+	if !hasCap(tc.capabilities(), string(imap.CapSaveDate)) {
+		t.Errorf("SAVEDATE capability not advertised")
+	}
+	tc.writeLine("A1 APPEND INBOX \"11-Feb-2001 10:00:00 +0000\" {%v+}\r\n%v", len(testMessage), testMessage)
+	tc.expectOK("A1")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 FETCH 1 (INTERNALDATE SAVEDATE)")
+	untagged := tc.expectOK("T1")
+	if len(untagged) != 1 {
+		t.Fatalf("got %q, want a single FETCH response", untagged)
+	}
+	_, saveDate, ok := strings.Cut(untagged[0], "SAVEDATE \"")
+	if !ok || !strings.Contains(untagged[0], `INTERNALDATE "11-Feb-2001 10:00:00 +0000"`) {
+		t.Fatalf("got %q, want INTERNALDATE and SAVEDATE", untagged[0])
+	}
+	saveDate, _, _ = strings.Cut(saveDate, "\"")
+	saved, err := time.Parse("_2-Jan-2006 15:04:05 -0700", saveDate)
+	if err != nil {
+		t.Fatalf("invalid SAVEDATE %q: %v", saveDate, err)
+	} else if d := time.Since(saved); d < -time.Minute || d > time.Minute {
+		t.Errorf("got SAVEDATE %v, want the current time", saved)
+	}
+
+	yesterday := time.Now().Add(-24 * time.Hour).Format("02-Jan-2006")
+	for _, tt := range []struct {
+		criteria, want string
+	}{
+		{"SAVEDSINCE " + yesterday, "* SEARCH 1"},
+		{"SAVEDBEFORE " + yesterday, "* SEARCH"},
+		{"SINCE " + yesterday, "* SEARCH"},
+		{"SAVEDATESUPPORTED", "* SEARCH 1"},
+	} {
+		tc.writeLine("T2 SEARCH %v", tt.criteria)
+		if untagged := tc.expectOK("T2"); len(untagged) != 1 || untagged[0] != tt.want {
+			t.Errorf("SEARCH %v: got %q, want %q", tt.criteria, untagged, tt.want)
+		}
+	}
+}
+
+func TestSaveDateUnsupported(t *testing.T) {
+	tc := newSearchTestConn(t)
+
+	tc.writeLine("T1 SEARCH SAVEDSINCE 1-Feb-2001")
+	if resp, _ := tc.readTagged("T1"); !strings.HasPrefix(resp, "T1 BAD ") {
+		t.Errorf("expected BAD response, got %q", resp)
+	}
+}
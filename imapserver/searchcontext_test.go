@@ -0,0 +1,166 @@
+package imapserver_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestSearchContextUpdate(t *testing.T) {
+	_, addr := startTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:     {},
+			imap.CapESearch:       {},
+			imap.CapSort:          {},
+			imap.CapESort:         {},
+			imap.CapContextSearch: {},
+			imap.CapContextSort:   {},
+		},
+	})
+	otherMessage := strings.Replace(testMessage, "Subject: Your Name.", "Subject: Weathering with You", 1)
+
+	tc := dialTestServer(t, addr)
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "CONTEXT=SEARCH") || !hasCap(caps, "CONTEXT=SORT") {
+		t.Errorf("CONTEXT=SEARCH and CONTEXT=SORT aren't advertised: %v", caps)
+	}
+	tc.appendMessage("INBOX", otherMessage)
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`A1 SEARCH RETURN (ALL UPDATE) SUBJECT "Your Name"`)
+	if untagged := tc.expectOK("A1"); len(untagged) != 1 || untagged[0] != `* ESEARCH (TAG "A1") ALL 2` {
+		t.Errorf("unexpected SEARCH response: %q", untagged)
+	}
+	tc.writeLine(`A2 UID SORT RETURN (UPDATE) (REVERSE ARRIVAL) UTF-8 SUBJECT "Your Name"`)
+	if untagged := tc.expectOK("A2"); len(untagged) != 1 || untagged[0] != `* ESEARCH (TAG "A2") UID` {
+		t.Errorf("unexpected SORT response: %q", untagged)
+	}
+
+	tc.writeLine("A3 IDLE")
+	if line := tc.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+
+	other := tc.newConn()
+	other.login()
+	other.appendMessage("INBOX", testMessage)
+
+	for _, want := range []string{
+		"* 3 EXISTS",
+		`* ESEARCH (TAG "A1") ADDTO (0 3)`,
+		`* ESEARCH (TAG "A2") UID ADDTO (1 3)`,
+	} {
+		if line := tc.readLine(); line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	}
+
+	tc.writeLine("DONE")
+	tc.expectOK("A3")
+
+	// Messages which don't match don't produce updates
+	other.appendMessage("INBOX", otherMessage)
+	tc.writeLine("A4 NOOP")
+	if untagged := tc.expectOK("A4"); len(untagged) != 1 || untagged[0] != "* 4 EXISTS" {
+		t.Errorf("unexpected updates: %q", untagged)
+	}
+
+	tc.writeLine(`A5 CANCELUPDATE "A1" "A2"`)
+	tc.expectOK("A5")
+	other.appendMessage("INBOX", testMessage)
+	tc.writeLine("A6 NOOP")
+	if untagged := tc.expectOK("A6"); len(untagged) != 1 || untagged[0] != "* 5 EXISTS" {
+		t.Errorf("unexpected updates after CANCELUPDATE: %q", untagged)
+	}
+}
+
+func TestSearchContextIMAP4rev2(t *testing.T) {
+	_, addr := startTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev2:     {},
+			imap.CapSort:          {},
+			imap.CapESort:         {},
+			imap.CapContextSearch: {},
+			imap.CapContextSort:   {},
+		},
+	})
+
+	tc := dialTestServer(t, addr)
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "CONTEXT=SEARCH") || !hasCap(caps, "CONTEXT=SORT") {
+		t.Errorf("CONTEXT=SEARCH and CONTEXT=SORT aren't advertised: %v", caps)
+	}
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`A1 SEARCH RETURN (ALL UPDATE) SUBJECT "Your Name"`)
+	if untagged := tc.expectOK("A1"); len(untagged) != 1 || untagged[0] != `* ESEARCH (TAG "A1")` {
+		t.Errorf("unexpected SEARCH response: %q", untagged)
+	}
+
+	other := tc.newConn()
+	other.login()
+	other.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("A2 NOOP")
+	untagged := tc.expectOK("A2")
+	want := []string{"* 1 EXISTS", `* ESEARCH (TAG "A1") ADDTO (0 1)`}
+	if strings.Join(untagged, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+}
+
+// pollLockingSession holds a lock while polling, like backends which guard their
+// state with a mutex.
+type pollLockingSession struct {
+	imapserver.Session
+	mutex sync.Mutex
+}
+
+func (sess *pollLockingSession) Poll(ctx context.Context, w *imapserver.UpdateWriter, allowExpunge bool) error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return sess.Session.Poll(ctx, w, allowExpunge)
+}
+
+func (sess *pollLockingSession) Search(ctx context.Context, kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return sess.Session.Search(ctx, kind, criteria, options)
+}
+
+func TestSearchContextUpdateNotReentrant(t *testing.T) {
+	memServer := newTestMemServer()
+	_, addr := startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &pollLockingSession{Session: memServer.NewSession()}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:     {},
+			imap.CapESearch:       {},
+			imap.CapContextSearch: {},
+		},
+	})
+
+	tc := dialTestServer(t, addr)
+	tc.login()
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine(`A1 SEARCH RETURN (ALL UPDATE) SUBJECT "Your Name"`)
+	tc.expectOK("A1")
+
+	other := tc.newConn()
+	other.login()
+	other.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("A2 NOOP")
+	untagged := tc.expectOK("A2")
+	want := []string{"* 1 EXISTS", `* ESEARCH (TAG "A1") ADDTO (0 1)`}
+	if strings.Join(untagged, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+}
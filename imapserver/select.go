@@ -2,6 +2,7 @@ package imapserver
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
@@ -9,16 +10,31 @@ import (
 
 func (c *Conn) handleSelect(tag string, dec *imapwire.Decoder, readOnly bool) error {
 	var mailbox string
-	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectCRLF() {
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) {
+		return dec.Err()
+	}
+	options := imap.SelectOptions{ReadOnly: readOnly}
+	if dec.SP() {
+		err := dec.ExpectList(func() error {
+			return readSelectParam(dec, &options)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !dec.ExpectCRLF() {
 		return dec.Err()
 	}
 
 	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
 		return err
 	}
+	if options.QResync != nil && !c.enabled.Has(imap.CapQResync) {
+		return newClientBugError("QRESYNC must be enabled")
+	}
 
 	if c.state == imap.ConnStateSelected {
-		if err := c.session.Unselect(); err != nil {
+		if err := c.session.Unselect(c.ctx); err != nil {
 			return err
 		}
 		c.state = imap.ConnStateAuthenticated
@@ -32,8 +48,13 @@ func (c *Conn) handleSelect(tag string, dec *imapwire.Decoder, readOnly bool) er
 		}
 	}
 
-	options := imap.SelectOptions{ReadOnly: readOnly}
-	data, err := c.session.Select(mailbox, &options)
+	if options.CondStore {
+		if err := c.enableCondStore(); err != nil {
+			return err
+		}
+	}
+
+	data, err := c.session.Select(c.ctx, mailbox, &options)
 	if err != nil {
 		return err
 	}
@@ -42,9 +63,14 @@ func (c *Conn) handleSelect(tag string, dec *imapwire.Decoder, readOnly bool) er
 		return err
 	}
 	if !c.enabled.Has(imap.CapIMAP4rev2) {
-		if err := c.writeObsoleteRecent(); err != nil {
+		if err := c.writeRecent(data.NumRecent); err != nil {
 			return err
 		}
+		if data.FirstUnseenSeqNum > 0 {
+			if err := c.writeFirstUnseen(data.FirstUnseenSeqNum); err != nil {
+				return err
+			}
+		}
 	}
 	if err := c.writeUIDValidity(data.UIDValidity); err != nil {
 		return err
@@ -63,10 +89,33 @@ func (c *Conn) handleSelect(tag string, dec *imapwire.Decoder, readOnly bool) er
 			return err
 		}
 	}
+	if c.server.options.caps().Has(imap.CapCondStore) {
+		if err := c.writeHighestModSeq(data.HighestModSeq); err != nil {
+			return err
+		}
+	}
+	if data.MailboxID != "" && c.server.options.caps().Has(imap.CapObjectID) {
+		if err := c.writeMailboxID(data.MailboxID); err != nil {
+			return err
+		}
+	}
+	if c.server.options.SelectQuota {
+		if err := c.writeSelectQuota(mailbox); err != nil {
+			return err
+		}
+	}
 
 	c.state = imap.ConnStateSelected
-	// TODO: forbid write commands in read-only mode
+	c.mailbox = mailbox
+	c.readOnly = readOnly
+	c.setSearchRes(nil)
+	c.resetSearchContexts()
 
+	if options.QResync != nil && options.QResync.UIDValidity == data.UIDValidity {
+		if err := c.writeQResync(options.QResync); err != nil {
+			return err
+		}
+	}
 	var (
 		cmdName string
 		code    imap.ResponseCode
@@ -85,6 +134,87 @@ func (c *Conn) handleSelect(tag string, dec *imapwire.Decoder, readOnly bool) er
 	})
 }
 
+func readSelectParam(dec *imapwire.Decoder, options *imap.SelectOptions) error {
+	var name string
+	if !dec.ExpectAtom(&name) {
+		return dec.Err()
+	}
+	switch strings.ToUpper(name) {
+	case "CONDSTORE":
+		options.CondStore = true
+	case "QRESYNC":
+		if !dec.ExpectSP() {
+			return dec.Err()
+		}
+		var qresync imap.SelectQResyncOptions
+		if err := readSelectQResyncParam(dec, &qresync); err != nil {
+			return err
+		}
+		options.QResync = &qresync
+	default:
+		return newClientBugError("Unknown SELECT parameter")
+	}
+	return nil
+}
+
+func readSelectQResyncParam(dec *imapwire.Decoder, options *imap.SelectQResyncOptions) error {
+	if !dec.ExpectSpecial('(') || !dec.ExpectNumber(&options.UIDValidity) || !dec.ExpectSP() || !dec.ExpectModSeq(&options.ModSeq) {
+		return dec.Err()
+	}
+	if options.UIDValidity == 0 || options.ModSeq == 0 {
+		return newClientBugError("Invalid QRESYNC parameter")
+	}
+	if dec.SP() {
+		hasSeqMatch := dec.Special('(')
+		if !hasSeqMatch {
+			if !dec.ExpectSeqSet(&options.KnownUIDs) {
+				return dec.Err()
+			}
+			hasSeqMatch = dec.SP() && dec.ExpectSpecial('(')
+		}
+		if hasSeqMatch {
+			if !dec.ExpectSeqSet(&options.KnownSeqNums) || !dec.ExpectSP() || !dec.ExpectSeqSet(&options.KnownSeqNumUIDs) || !dec.ExpectSpecial(')') {
+				return dec.Err()
+			}
+		}
+	}
+	if !dec.ExpectSpecial(')') {
+		return dec.Err()
+	}
+	return nil
+}
+
+// writeQResync writes the VANISHED (EARLIER) and FETCH responses needed by
+// the client to resynchronize its cache of the mailbox.
+func (c *Conn) writeQResync(options *imap.SelectQResyncOptions) error {
+	session := c.session.(SessionQResync)
+
+	knownUIDs := options.KnownUIDs
+	if len(knownUIDs) == 0 {
+		knownUIDs = imap.SeqSet{imap.Seq{Start: 1, Stop: 0}}
+	}
+
+	vanished, err := session.Vanished(c.ctx, options.ModSeq, knownUIDs)
+	if err != nil {
+		return err
+	}
+	if len(vanished) > 0 {
+		if err := c.writeVanished(vanished, true); err != nil {
+			return err
+		}
+	}
+
+	fetchOptions := imap.FetchOptions{
+		UID:             true,
+		Flags:           true,
+		ModSeq:          true,
+		ChangedSince:    options.ModSeq,
+		HasChangedSince: true,
+	}
+	w := &FetchWriter{conn: c}
+	return c.session.Fetch(c.ctx, w, NumKindUID, knownUIDs, &fetchOptions)
+}
+
 func (c *Conn) handleUnselect(dec *imapwire.Decoder, expunge bool) error {
 	if !dec.ExpectCRLF() {
 		return dec.Err()
@@ -94,18 +224,27 @@ func (c *Conn) handleUnselect(dec *imapwire.Decoder, expunge bool) error {
 		return err
 	}
 
-	if expunge {
+	// CLOSE doesn't expunge messages if the mailbox was opened with EXAMINE
+	if expunge && !c.readOnly {
+		unlock, err := c.lockMailboxes(c.mailbox)
+		if err != nil {
+			return err
+		}
 		w := &ExpungeWriter{}
-		if err := c.session.Expunge(w, nil); err != nil {
+		err = c.session.Expunge(c.ctx, w, nil)
+		unlock()
+		if err != nil {
 			return err
 		}
 	}
 
-	if err := c.session.Unselect(); err != nil {
+	if err := c.session.Unselect(c.ctx); err != nil {
 		return err
 	}
 
 	c.state = imap.ConnStateAuthenticated
+	c.setSearchRes(nil)
+	c.resetSearchContexts()
 	return nil
 }
 
@@ -115,10 +254,19 @@ func (c *Conn) writeExists(numMessages uint32) error {
 	return enc.Atom("*").SP().Number(numMessages).SP().Atom("EXISTS").CRLF()
 }
 
-func (c *Conn) writeObsoleteRecent() error {
+func (c *Conn) writeRecent(numRecent uint32) error {
 	enc := newResponseEncoder(c)
 	defer enc.end()
-	return enc.Atom("*").SP().Number(0).SP().Atom("RECENT").CRLF()
+	return enc.Atom("*").SP().Number(numRecent).SP().Atom("RECENT").CRLF()
+}
+
+func (c *Conn) writeFirstUnseen(seqNum uint32) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	enc.Special('[').Atom("UNSEEN").SP().Number(seqNum).Special(']')
+	enc.SP().Text(fmt.Sprintf("Message %v is first unseen", seqNum))
+	return enc.CRLF()
 }
 
 func (c *Conn) writeUIDValidity(uidValidity uint32) error {
@@ -139,6 +287,29 @@ func (c *Conn) writeUIDNext(uidNext uint32) error {
 	return enc.CRLF()
 }
 
+func (c *Conn) writeHighestModSeq(highestModSeq uint64) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	if highestModSeq > 0 {
+		enc.Special('[').Atom("HIGHESTMODSEQ").SP().ModSeq(highestModSeq).Special(']')
+		enc.SP().Text("Highest")
+	} else {
+		enc.Special('[').Atom("NOMODSEQ").Special(']')
+		enc.SP().Text("No permanent modification sequences")
+	}
+	return enc.CRLF()
+}
+
+func (c *Conn) writeMailboxID(id string) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	enc.Special('[').Atom("MAILBOXID").SP().Special('(').Atom(id).Special(')').Special(']')
+	enc.SP().Text("Mailbox ID")
+	return enc.CRLF()
+}
+
 func (c *Conn) writeFlags(flags []imap.Flag) error {
 	enc := newResponseEncoder(c)
 	defer enc.end()
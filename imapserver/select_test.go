@@ -0,0 +1,227 @@
+package imapserver_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// expectExists selects a mailbox and checks its number of messages.
+func (tc *testConn) expectExists(mailbox string, want string) {
+	tc.t.Helper()
+	for _, line := range tc.selectMailbox(mailbox) {
+		if line == want {
+			return
+		}
+	}
+	tc.t.Errorf("expected %q in SELECT response", want)
+}
+
+func TestUnselect(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	if caps := tc.capabilities(); !hasCap(caps, "UNSELECT") {
+		t.Errorf("expected UNSELECT to be advertised, got %v", caps)
+	}
+
+	tc.selectMailbox("INBOX")
+	tc.writeLine(`T1 STORE 1 +FLAGS.SILENT (\Deleted)`)
+	tc.expectOK("T1")
+
+	// UNSELECT must not expunge deleted messages
+	tc.writeLine("U1 UNSELECT")
+	if got := tc.expectOK("U1"); len(got) != 0 {
+		t.Errorf("unexpected untagged responses: %q", got)
+	}
+	tc.expectExists("INBOX", "* 1 EXISTS")
+
+	// Neither must CLOSE if the mailbox was opened with EXAMINE
+	tc.writeLine("E1 EXAMINE INBOX")
+	tc.expectOK("E1")
+	tc.writeLine("C1 CLOSE")
+	tc.expectOK("C1")
+	tc.expectExists("INBOX", "* 1 EXISTS")
+
+	tc.writeLine("C2 CLOSE")
+	if got := tc.expectOK("C2"); len(got) != 0 {
+		t.Errorf("unexpected untagged responses: %q", got)
+	}
+	tc.expectExists("INBOX", "* 0 EXISTS")
+}
+
+func TestSelectResponses(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.writeLine(`A1 APPEND INBOX (\Seen) {%v+}`, len(testMessage))
+	tc.writeString(testMessage + "\r\n")
+	tc.expectOK("A1")
+	tc.appendMessage("INBOX", testMessage)
+
+	want := []string{
+		"* 2 EXISTS",
+		"", // RECENT
+		"* OK [UNSEEN 2] ",
+		"* OK [UIDVALIDITY ",
+		"* OK [UIDNEXT 3] ",
+		"* FLAGS (",
+		"* OK [PERMANENTFLAGS (",
+	}
+	for _, cmd := range []struct {
+		name, recent, status string
+	}{
+		{"SELECT", "* 2 RECENT", "S1 OK [READ-WRITE] "},
+		{"EXAMINE", "* 0 RECENT", "S1 OK [READ-ONLY] "},
+	} {
+		want[1] = cmd.recent
+		tc.writeLine("S1 %v INBOX", cmd.name)
+		status, untagged := tc.readTagged("S1")
+		if !strings.HasPrefix(status, cmd.status) {
+			t.Errorf("%v: got status %q, want prefix %q", cmd.name, status, cmd.status)
+		}
+		if len(untagged) != len(want) {
+			t.Fatalf("%v: got %q, want %v untagged responses", cmd.name, untagged, len(want))
+		}
+		for i, prefix := range want {
+			if !strings.HasPrefix(untagged[i], prefix) {
+				t.Errorf("%v: got %q, want prefix %q", cmd.name, untagged[i], prefix)
+			}
+		}
+		tc.writeLine("U1 UNSELECT")
+		tc.expectOK("U1")
+	}
+}
+
+func TestExamineReadOnly(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.writeLine("T0 CREATE Archive")
+	tc.expectOK("T0")
+
+	tc.writeLine("T1 EXAMINE INBOX")
+	tc.expectOK("T1")
+
+	for _, cmd := range []string{
+		"EXPUNGE",
+		"UID EXPUNGE 1",
+		`STORE 1 +FLAGS (\Deleted)`,
+		`UID STORE 1 FLAGS.SILENT (\Seen)`,
+		"MOVE 1 Archive",
+	} {
+		tc.writeLine("T2 %v", cmd)
+		if resp, _ := tc.readTagged("T2"); !strings.HasPrefix(resp, "T2 NO [READ-ONLY] ") {
+			t.Errorf("%v: expected NO [READ-ONLY], got %q", cmd, resp)
+		}
+	}
+
+	// Copying out of a read-only mailbox is allowed
+	tc.writeLine("T3 COPY 1 Archive")
+	tc.expectOK("T3")
+
+	// The mailbox is writable again once selected with SELECT
+	tc.selectMailbox("INBOX")
+	tc.writeLine(`T4 STORE 1 +FLAGS.SILENT (\Deleted)`)
+	tc.expectOK("T4")
+	tc.writeLine("T5 EXPUNGE")
+	if untagged := tc.expectOK("T5"); len(untagged) != 1 || untagged[0] != "* 1 EXPUNGE" {
+		t.Errorf("got %q, want %q", untagged, "* 1 EXPUNGE")
+	}
+}
+
+func TestSelectRecent(t *testing.T) {
+	_, addr := startTestServer(t, nil)
+	tc := dialTestServer(t, addr)
+	tc.login()
+
+	other := dialTestServer(t, addr)
+	other.login()
+	other.appendMessage("INBOX", testMessage)
+
+	for _, step := range []struct {
+		cmd, want string
+	}{
+		// EXAMINE doesn't clear the \Recent flag
+		{"EXAMINE", "* 1 RECENT"},
+		{"SELECT", "* 1 RECENT"},
+		{"SELECT", "* 0 RECENT"},
+	} {
+		tc.writeLine("S1 %v INBOX", step.cmd)
+		untagged := tc.expectOK("S1")
+		var recent string
+		for _, line := range untagged {
+			if strings.HasSuffix(line, " RECENT") {
+				recent = line
+			}
+		}
+		if recent != step.want {
+			t.Errorf("%v: got %q, want %q", step.cmd, recent, step.want)
+		}
+		tc.writeLine("U1 UNSELECT")
+		tc.expectOK("U1")
+	}
+}
+
+// wrapErrSession wraps errors returned by Select and Create.
+type wrapErrSession struct {
+	imapserver.Session
+}
+
+func (sess *wrapErrSession) Select(ctx context.Context, mailbox string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	data, err := sess.Session.Select(ctx, mailbox, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select %q: %w", mailbox, err)
+	}
+	return data, nil
+}
+
+func (sess *wrapErrSession) Create(ctx context.Context, mailbox string, options *imap.CreateOptions) error {
+	if err := sess.Session.Create(ctx, mailbox, options); err != nil {
+		return fmt.Errorf("failed to create %q: %w", mailbox, err)
+	}
+	return nil
+}
+
+func TestMailboxResponseCodes(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wrap=%v", wrap), func(t *testing.T) {
+			memServer := newTestMemServer()
+			tc := newTestServer(t, &imapserver.Options{
+				NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+					var sess imapserver.Session = memServer.NewSession()
+					if wrap {
+						sess = &wrapErrSession{sess}
+					}
+					return sess, nil, nil
+				},
+			})
+			tc.login()
+
+			for _, tt := range []struct {
+				cmd, want string
+			}{
+				{"SELECT Missing", "A1 NO [NONEXISTENT] "},
+				{"EXAMINE Missing", "A1 NO [NONEXISTENT] "},
+				{"STATUS Missing (MESSAGES)", "A1 NO [NONEXISTENT] "},
+				{"CREATE INBOX", "A1 NO [ALREADYEXISTS] "},
+			} {
+				tc.writeLine("A1 %v", tt.cmd)
+				if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, tt.want) {
+					t.Errorf("%v: got %q, want prefix %q", tt.cmd, resp, tt.want)
+				}
+			}
+
+			tc.writeLine("A2 CREATE Archive")
+			tc.expectOK("A2")
+			tc.writeLine("A3 RENAME Archive INBOX")
+			if resp, _ := tc.readTagged("A3"); !strings.HasPrefix(resp, "A3 NO [ALREADYEXISTS] ") {
+				t.Errorf("RENAME: got %q", resp)
+			}
+		})
+	}
+}
@@ -2,21 +2,45 @@
 package imapserver
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
+	"golang.org/x/text/encoding"
+)
+
+const (
+	defaultMaxLiteralSize     = 4096
+	defaultAppendLimit        = 100 * 1024 * 1024 // 100MiB
+	defaultMaxCommandLineSize = 8192              // see RFC 7162 section 4
+	defaultMaxMultiAppend     = 100
+	defaultMaxHeldResponses   = 1024 * 1024 // 1MiB
+	maxLiteralMinusSize       = 4096        // see RFC 7888 section 5
+
+	defaultCommandReadTimeout   = 30 * time.Second
+	defaultIdleReadTimeout      = 35 * time.Minute // section 5.4 says 30min minimum
+	defaultLiteralReadTimeout   = 5 * time.Minute
+	defaultResponseWriteTimeout = 30 * time.Second
+	defaultLiteralWriteTimeout  = 5 * time.Minute
 )
 
 var errClosed = errors.New("imapserver: server closed")
 
 // Logger is a facility to log error messages.
+//
+// New code should use Options.StructuredLogger instead.
 type Logger interface {
 	Printf(format string, args ...interface{})
 }
@@ -40,15 +64,188 @@ type Options struct {
 	//   - LIST-STATUS
 	//   - MOVE
 	//   - STATUS=SIZE
+	//
+	// LITERAL+ and LITERAL- are ignored: AllowUnlimitedNonSyncLiterals
+	// selects the advertised one.
 	Caps imap.CapSet
-	// Logger is a logger to print error messages. If nil, log.Default is used.
+	// StructuredLogger is a logger to print error messages. Messages are
+	// annotated with the connection ID, the remote address and, for errors
+	// related to a command, the command tag and name. If nil, Logger is used.
+	StructuredLogger *slog.Logger
+	// Logger is a logger to print error messages. It's ignored if
+	// StructuredLogger is set. If both are nil, slog.Default is used.
 	Logger Logger
 	// TLSConfig is a TLS configuration for STARTTLS. If nil, STARTTLS is
 	// disabled.
+	//
+	// The same configuration is used for STARTTLS and ListenAndServeTLS, so
+	// GetCertificate and GetConfigForClient can be used to select a
+	// certificate based on the SNI server name.
 	TLSConfig *tls.Config
 	// InsecureAuth allows clients to authenticate without TLS. In this mode,
 	// the server is susceptible to man-in-the-middle attacks.
 	InsecureAuth bool
+	// MaxLiteralSize is the maximum size in bytes of a literal which needs to
+	// be buffered in memory while decoding a command (e.g. the password in a
+	// LOGIN command). If zero, 4096 is used, except for APPEND.
+	MaxLiteralSize int64
+	// MaxCommandLiteralSize overrides MaxLiteralSize for specific commands.
+	// Keys are upper-case command names, e.g. "LOGIN" or "UID SEARCH".
+	//
+	// The "APPEND" entry limits the size of the message payload, which is
+	// streamed to Session.Append instead of being buffered. If unset, APPEND
+	// payloads are limited to MaxLiteralSize, or 100MiB if MaxLiteralSize is
+	// zero.
+	//
+	// If the bare APPENDLIMIT capability is enabled, limits are per-mailbox:
+	// the APPENDLIMIT returned by Session.Status is enforced, and mailboxes
+	// without one are subject to the APPEND limit.
+	MaxCommandLiteralSize map[string]int64
+	// AllowUnlimitedNonSyncLiterals advertises LITERAL+ instead of LITERAL-.
+	// Non-synchronizing literals are then only limited by MaxLiteralSize and
+	// MaxCommandLiteralSize, instead of 4096 bytes.
+	AllowUnlimitedNonSyncLiterals bool
+	// MaxMultiAppendMessages is the maximum number of messages in a single
+	// APPEND command when MULTIAPPEND is supported. If zero, 100 is used.
+	MaxMultiAppendMessages int
+	// MaxMultiAppendSize is the maximum total size in bytes of the messages
+	// in a single APPEND command when MULTIAPPEND is supported. If zero, the
+	// APPEND literal size limit is used.
+	MaxMultiAppendSize int64
+	// MaxCommandLineSize is the maximum size in bytes of a command line,
+	// excluding the contents of literals. Commands exceeding the limit are
+	// rejected with a BAD response with the TOOBIG code. If zero, 8192 is
+	// used.
+	MaxCommandLineSize int64
+	// AllowBareLF accepts command lines terminated by a lone LF instead of
+	// CRLF, for compatibility with legacy clients. Literals are unaffected.
+	//
+	// This is disabled by default: peers disagreeing on line endings can
+	// lead to command smuggling.
+	AllowBareLF bool
+	// MaxConcurrentCommands is the maximum number of commands executed
+	// concurrently for a single connection. If zero or one, commands are
+	// executed sequentially.
+	//
+	// Only commands which don't alter the connection state (e.g. FETCH,
+	// SEARCH, LIST, STATUS) are executed concurrently. Other commands wait
+	// for all pending commands to complete. When this is enabled, the Session
+	// methods Fetch, Search, List, Status, Namespace, ID and Poll may be
+	// called concurrently.
+	MaxConcurrentCommands int
+	// MaxConns is the maximum number of simultaneous connections. If zero,
+	// the number of connections is unlimited.
+	//
+	// Connections exceeding the limit are rejected with a BYE response.
+	MaxConns int
+	// MaxConnsPerIP is the maximum number of simultaneous connections from a
+	// single IP address. If zero, the number of connections per IP address is
+	// unlimited.
+	//
+	// Connections exceeding the limit are rejected with a BYE response.
+	MaxConnsPerIP int
+	// MaxAuthFailures is the maximum number of failed LOGIN and AUTHENTICATE
+	// commands on a single connection. The connection is closed with a BYE
+	// response once the limit is reached. If zero, the number of failures
+	// is unlimited.
+	MaxAuthFailures int
+	// AuthFailureDelay slows down clients guessing credentials: failed LOGIN
+	// and AUTHENTICATE commands are answered after this delay multiplied by
+	// the number of failures on the connection so far. If zero, failures are
+	// answered immediately.
+	AuthFailureDelay time.Duration
+	// TrustedProxies is a list of networks allowed to send a PROXY protocol
+	// v1 or v2 header. Connections from these networks must start with such
+	// a header, otherwise they are dropped. The client address it contains
+	// is then used for connection limits and logging.
+	//
+	// Listeners passed to Serve which perform the TLS handshake must be
+	// wrapped with Server.ProxyListener.
+	TrustedProxies []netip.Prefix
+	// Greeting is the human-readable text of the greeting sent to clients
+	// when they connect. If empty, "IMAP server ready" is used.
+	Greeting string
+	// OmitGreetingCaps removes the CAPABILITY response code from the
+	// greeting, e.g. to avoid revealing server details to unauthenticated
+	// clients. Clients can still query capabilities via the CAPABILITY
+	// command.
+	OmitGreetingCaps bool
+	// StartTLSCapability sends an untagged CAPABILITY response right after
+	// the TLS handshake triggered by STARTTLS, so that clients don't need to
+	// issue a CAPABILITY command to discover the capabilities available on
+	// the secure connection.
+	StartTLSCapability bool
+	// MaxWriteBuffer is the maximum size in bytes of the operating system
+	// send buffer of each connection. A smaller buffer limits the amount of
+	// response data queued for a client which stopped reading, so that it's
+	// detected and disconnected once Timeouts.ResponseWrite or
+	// Timeouts.LiteralWrite expire. If zero, the system default is used.
+	//
+	// TLS, PROXY and WebSocket connections are unwrapped to set the buffer
+	// size of the underlying connection, e.g. a *net.TCPConn.
+	//
+	// MaxWriteBuffer also limits the responses held in memory while
+	// mailboxes are locked, see SessionMailboxLocker. If zero, up to 1MiB is
+	// held.
+	MaxWriteBuffer int
+	// Timeouts contains the connection I/O timeouts. Zero fields are set to
+	// their default value.
+	Timeouts Timeouts
+	// IdleKeepalive is the interval at which an untagged OK response is sent
+	// to clients running the IDLE command, to prevent middleboxes from
+	// dropping inactive connections. If zero, no keepalive is sent.
+	IdleKeepalive time.Duration
+	// SearchCharsets contains additional charsets accepted by SEARCH, SORT
+	// and THREAD, indexed by upper-case charset name. Search strings are
+	// converted to UTF-8 before being passed to the session. US-ASCII and
+	// UTF-8 are always supported.
+	SearchCharsets map[string]encoding.Encoding
+	// DefaultInternalDate returns the internal date of a message appended
+	// without an explicit date, e.g. by parsing its Date header field. If it's
+	// nil or returns the zero time, the session picks the date (usually the
+	// current time).
+	//
+	// When set, such messages are buffered in memory before being passed to
+	// Session.Append.
+	DefaultInternalDate func(msg []byte) time.Time
+	// Now returns the current time. It's used to evaluate the OLDER and
+	// YOUNGER search keys. If nil, time.Now is used.
+	Now func() time.Time
+	// OnCommand is called after each command has been executed. It can be
+	// used to collect metrics. It may be called concurrently when
+	// MaxConcurrentCommands is set.
+	OnCommand func(info CommandInfo)
+	// OnRawCommand is called with the first line of each command before it's
+	// executed, without the trailing CRLF. Literal contents aren't included:
+	// the line stops at the first literal header, e.g. "A1 LOGIN {4}". Lines
+	// longer than 4096 bytes are truncated.
+	//
+	// If it returns an error, the command is rejected with a BAD response.
+	// The error text is sent to the client unless it's an *imap.Error, in
+	// which case it's used as the response as-is.
+	//
+	// Note, the line may contain sensitive information such as credentials.
+	OnRawCommand func(conn *Conn, line string) error
+	// SelectQuota reports the quota roots of a mailbox and their usage in
+	// responses to SELECT and EXAMINE, like GETQUOTAROOT does. It requires
+	// the QUOTA capability and SessionQuota.
+	SelectQuota bool
+	// DisabledCommands contains upper-case names of commands rejected with a
+	// NO response and the CANNOT code, e.g. "IDLE" or "DELETE". Disabling a
+	// command also disables its UID variant. Capabilities which only provide
+	// a disabled command aren't advertised.
+	DisabledCommands map[string]bool
+	// CapabilityFilter is called with the capabilities advertised to a
+	// client, and returns the capabilities to advertise instead. It can be
+	// used to hide capabilities or to add custom ones, e.g. "X-FOO". The
+	// result is used in the greeting, in CAPABILITY responses and response
+	// codes, and by ENABLE. The function may modify and return caps.
+	CapabilityFilter func(caps []imap.Cap) []imap.Cap
+	// CheckWebSocketOrigin returns true if a WebSocket connection from a
+	// browser should be accepted, see Server.WebSocketHandler. If nil,
+	// requests with an Origin header field are only accepted if the origin's
+	// host matches the request's Host header field.
+	CheckWebSocketOrigin func(req *http.Request) bool
 	// Raw ingress and egress data will be written to this writer, if any.
 	// Note, this may include sensitive information such as credentials used
 	// during authentication.
@@ -68,6 +265,78 @@ func (options *Options) wrapReadWriter(rw io.ReadWriter) io.ReadWriter {
 	}
 }
 
+func (options *Options) maxLiteralSize(cmd string) int64 {
+	if size, ok := options.MaxCommandLiteralSize[cmd]; ok {
+		return size
+	}
+	if options.MaxLiteralSize > 0 {
+		return options.MaxLiteralSize
+	}
+	if cmd == "APPEND" {
+		return defaultAppendLimit
+	}
+	return defaultMaxLiteralSize
+}
+
+// appendLimit returns the maximum size of messages uploaded with APPEND. A
+// limit advertised with an "APPENDLIMIT=<n>" capability is enforced too.
+func (options *Options) appendLimit() int64 {
+	limit := options.maxLiteralSize("APPEND")
+	if capLimit, _ := options.caps().AppendLimit(); capLimit != nil {
+		limit = min(limit, int64(*capLimit))
+	}
+	return limit
+}
+
+// appendLimitUint32 returns appendLimit as advertised by APPENDLIMIT.
+func (options *Options) appendLimitUint32() *uint32 {
+	limit := uint32(min(options.appendLimit(), math.MaxUint32))
+	return &limit
+}
+
+func (options *Options) maxMultiAppendMessages() int {
+	if options.MaxMultiAppendMessages > 0 {
+		return options.MaxMultiAppendMessages
+	}
+	return defaultMaxMultiAppend
+}
+
+func (options *Options) maxMultiAppendSize() int64 {
+	if options.MaxMultiAppendSize > 0 {
+		return options.MaxMultiAppendSize
+	}
+	return options.maxLiteralSize("APPEND")
+}
+
+func (options *Options) maxHeldResponses() int {
+	if options.MaxWriteBuffer > 0 {
+		return options.MaxWriteBuffer
+	}
+	return defaultMaxHeldResponses
+}
+
+func (options *Options) maxCommandLineSize() int64 {
+	if options.MaxCommandLineSize > 0 {
+		return options.MaxCommandLineSize
+	}
+	return defaultMaxCommandLineSize
+}
+
+func (options *Options) commandDisabled(name string) bool {
+	if options.DisabledCommands[name] {
+		return true
+	}
+	subName, ok := strings.CutPrefix(name, "UID ")
+	return ok && options.DisabledCommands[subName]
+}
+
+func (options *Options) now() time.Time {
+	if options.Now != nil {
+		return options.Now()
+	}
+	return time.Now()
+}
+
 func (options *Options) caps() imap.CapSet {
 	if options.Caps != nil {
 		return options.Caps
@@ -75,16 +344,65 @@ func (options *Options) caps() imap.CapSet {
 	return imap.CapSet{imap.CapIMAP4rev1: {}}
 }
 
+// Timeouts contains I/O timeouts for IMAP connections.
+type Timeouts struct {
+	// CommandRead is the maximum duration to read a command. It's also the
+	// maximum duration a client can stay inactive before authenticating.
+	// Defaults to 30 seconds.
+	CommandRead time.Duration
+	// IdleRead is the maximum duration an authenticated client can stay
+	// inactive, including during IDLE. Defaults to 35 minutes.
+	IdleRead time.Duration
+	// LiteralRead is the maximum duration to read a large literal, e.g. an
+	// APPEND payload. Defaults to 5 minutes.
+	LiteralRead time.Duration
+	// ResponseWrite is the maximum duration to write a response. Defaults to
+	// 30 seconds.
+	ResponseWrite time.Duration
+	// LiteralWrite is the maximum duration to write a literal, e.g. a FETCH
+	// body section. Defaults to 5 minutes.
+	LiteralWrite time.Duration
+}
+
+func (t *Timeouts) withDefaults() Timeouts {
+	out := *t
+	setDefaultDuration(&out.CommandRead, defaultCommandReadTimeout)
+	setDefaultDuration(&out.IdleRead, defaultIdleReadTimeout)
+	setDefaultDuration(&out.LiteralRead, defaultLiteralReadTimeout)
+	setDefaultDuration(&out.ResponseWrite, defaultResponseWriteTimeout)
+	setDefaultDuration(&out.LiteralWrite, defaultLiteralWriteTimeout)
+	return out
+}
+
+func setDefaultDuration(ptr *time.Duration, def time.Duration) {
+	if *ptr == 0 {
+		*ptr = def
+	}
+}
+
 // Server is an IMAP server.
 type Server struct {
 	options Options
 
+	ctx    context.Context // cancelled when the server is closed
+	cancel context.CancelFunc
+
+	logger *slog.Logger
+
 	listenerWaitGroup sync.WaitGroup
+	connWaitGroup     sync.WaitGroup
+
+	nextConnID uint64 // atomic
+
+	shutdown int32 // set to 1 when a graceful shutdown is in progress
 
 	mutex     sync.Mutex
 	listeners map[net.Listener]struct{}
 	conns     map[*Conn]struct{}
 	closed    bool
+
+	numConns   int
+	connsPerIP map[string]int
 }
 
 // New creates a new server.
@@ -92,18 +410,25 @@ func New(options *Options) *Server {
 	if caps := options.caps(); !caps.Has(imap.CapIMAP4rev2) && !caps.Has(imap.CapIMAP4rev1) {
 		panic("imapserver: at least IMAP4rev1 must be supported")
 	}
-	return &Server{
-		options:   *options,
-		listeners: make(map[net.Listener]struct{}),
-		conns:     make(map[*Conn]struct{}),
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		options:    *options,
+		ctx:        ctx,
+		cancel:     cancel,
+		listeners:  make(map[net.Listener]struct{}),
+		conns:      make(map[*Conn]struct{}),
+		connsPerIP: make(map[string]int),
 	}
-}
-
-func (s *Server) logger() Logger {
-	if s.options.Logger == nil {
-		return log.Default()
+	s.options.Timeouts = options.Timeouts.withDefaults()
+	switch {
+	case options.StructuredLogger != nil:
+		s.logger = options.StructuredLogger
+	case options.Logger != nil:
+		s.logger = slog.New(&legacyLogHandler{logger: options.Logger})
+	default:
+		s.logger = slog.Default()
 	}
-	return s.options.Logger
+	return s
 }
 
 // Serve accepts incoming connections on the listener ln.
@@ -139,7 +464,7 @@ func (s *Server) Serve(ln net.Listener) error {
 			if max := 1 * time.Second; delay > max {
 				delay = max
 			}
-			s.logger().Printf("accept error (retrying in %v): %v", delay, err)
+			s.logger.Warn("accept error", "err", err, "retry_delay", delay)
 			time.Sleep(delay)
 			continue
 		} else if errors.Is(err, net.ErrClosed) {
@@ -149,10 +474,73 @@ func (s *Server) Serve(ln net.Listener) error {
 		}
 
 		delay = 0
-		go newConn(conn, s).serve()
+		s.connWaitGroup.Add(1)
+		go func() {
+			defer s.connWaitGroup.Done()
+			conn, err := s.acceptProxy(conn)
+			if err != nil {
+				s.logger.Warn("dropping proxied connection", "remote_addr", conn.RemoteAddr().String(), "err", err)
+				conn.Close()
+				return
+			}
+			s.serveConn(conn)
+		}()
 	}
 }
 
+// serveConn serves an IMAP connection, unless the connection limits have been
+// reached.
+func (s *Server) serveConn(conn net.Conn) {
+	ip := remoteIP(conn)
+	if !s.acquireConn(ip) {
+		newConn(conn, s).byeOverloaded()
+		return
+	}
+	defer s.releaseConn(ip)
+	newConn(conn, s).serve()
+}
+
+// acquireConn reserves a connection slot for the provided IP address. It
+// returns false if the connection limits have been reached.
+func (s *Server) acquireConn(ip string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if max := s.options.MaxConns; max > 0 && s.numConns >= max {
+		return false
+	}
+	if max := s.options.MaxConnsPerIP; max > 0 && s.connsPerIP[ip] >= max {
+		return false
+	}
+	s.numConns++
+	s.connsPerIP[ip]++
+	return true
+}
+
+// releaseConn releases a connection slot reserved with acquireConn.
+func (s *Server) releaseConn(ip string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.numConns--
+	if s.connsPerIP[ip] <= 1 {
+		delete(s.connsPerIP, ip)
+	} else {
+		s.connsPerIP[ip]--
+	}
+}
+
+// remoteIP returns the IP address of the remote end of the connection. The
+// full address is returned if it isn't a host-port pair.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
 // ListenAndServe listens on the TCP network address addr and then calls Serve.
 //
 // If addr is empty, ":143" is used.
@@ -176,11 +564,14 @@ func (s *Server) ListenAndServeTLS(addr string) error {
 	if addr == "" {
 		addr = ":993"
 	}
-	ln, err := tls.Listen("tcp", addr, s.options.TLSConfig)
+	if config := s.options.TLSConfig; config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return errors.New("imapserver: missing certificate in Options.TLSConfig")
+	}
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	return s.Serve(ln)
+	return s.Serve(tls.NewListener(s.ProxyListener(ln), s.options.TLSConfig))
 }
 
 // Close immediately closes all active listeners and connections.
@@ -191,30 +582,90 @@ func (s *Server) ListenAndServeTLS(addr string) error {
 // Once Close has been called on a server, it may not be reused; future calls
 // to methods such as Serve will return an error.
 func (s *Server) Close() error {
-	var err error
+	ok, err := s.closeListeners()
+
+	s.listenerWaitGroup.Wait()
+	s.cancel()
+	s.closeConns()
 
-	s.mutex.Lock()
-	ok := !s.closed
-	if ok {
-		s.closed = true
-		for l := range s.listeners {
-			if closeErr := l.Close(); closeErr != nil && err == nil {
-				err = closeErr
-			}
-		}
-	}
-	s.mutex.Unlock()
 	if !ok {
 		return errClosed
 	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server without interrupting in-flight
+// commands.
+//
+// Shutdown first closes all listeners. Connections waiting for a command
+// (including connections in the IDLE state) are then terminated with a BYE
+// response. Connections executing a command are terminated once the command
+// completes. Shutdown waits for all connections to be terminated.
+//
+// If the context expires before all connections have been terminated, the
+// remaining connections are closed and the context's error is returned.
+//
+// Once Shutdown has been called on a server, it may not be reused; future
+// calls to methods such as Serve will return an error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shutdown, 1)
 
+	ok, err := s.closeListeners()
+	if !ok {
+		return errClosed
+	}
 	s.listenerWaitGroup.Wait()
 
 	s.mutex.Lock()
 	for c := range s.conns {
-		c.conn.Close()
+		c.interruptIdleRead()
 	}
 	s.mutex.Unlock()
 
+	done := make(chan struct{})
+	go func() {
+		s.connWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.cancel()
+	s.closeConns()
 	return err
 }
+
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shutdown) != 0
+}
+
+// closeListeners marks the server as closed and closes all listeners. It
+// returns false if the server was already closed.
+func (s *Server) closeListeners() (ok bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false, nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return true, err
+}
+
+func (s *Server) closeConns() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for c := range s.conns {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,667 @@
+package imapserver_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+const (
+	testUsername = "test-user"
+	testPassword = "test-password"
+
+	testMessage = "From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+		"To: Taki Tachibana <taki.tachibana@example.org>\r\n" +
+		"Subject: Your Name.\r\n" +
+		"Date: Mon, 05 Sep 2016 19:00:00 +0900\r\n" +
+		"Message-Id: <42@example.org>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Who are you?\r\n"
+)
+
+// testConn is a raw client connection to a test server.
+type testConn struct {
+	t    *testing.T
+	addr string
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// newTestMemServer creates an in-memory server with a single test user.
+func newTestMemServer() *imapmemserver.Server {
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(testUsername, testPassword)
+	user.Create(context.Background(), "INBOX", nil)
+	memServer.AddUser(user)
+	return memServer
+}
+
+// newTestServer starts a server backed by imapmemserver and returns a raw
+// connection to it. The greeting has already been consumed.
+func newTestServer(t *testing.T, options *imapserver.Options) *testConn {
+	t.Helper()
+	_, addr := startTestServer(t, options)
+	return dialTestServer(t, addr)
+}
+
+// startTestServer starts a server backed by imapmemserver and returns its
+// address.
+func startTestServer(t *testing.T, options *imapserver.Options) (*imapserver.Server, string) {
+	t.Helper()
+
+	memServer := newTestMemServer()
+	if options == nil {
+		options = &imapserver.Options{}
+	}
+	if options.NewSession == nil {
+		options.NewSession = func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		}
+	}
+	if options.Caps == nil {
+		options.Caps = imap.CapSet{imap.CapIMAP4rev1: {}}
+	}
+	if options.TLSConfig == nil {
+		options.InsecureAuth = true
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+
+	server := imapserver.New(options)
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server, ln.Addr().String()
+}
+
+func dialTestServer(t *testing.T, addr string) *testConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	tc := &testConn{t: t, addr: addr, conn: conn, br: bufio.NewReader(conn)}
+	if greeting := tc.readLine(); !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+	return tc
+}
+
+// newConn opens another connection to the same test server.
+func (tc *testConn) newConn() *testConn {
+	tc.t.Helper()
+	return dialTestServer(tc.t, tc.addr)
+}
+
+func (tc *testConn) writeString(s string) {
+	tc.t.Helper()
+	if _, err := tc.conn.Write([]byte(s)); err != nil {
+		tc.t.Fatalf("failed to write: %v", err)
+	}
+}
+
+func (tc *testConn) writeLine(format string, args ...interface{}) {
+	tc.t.Helper()
+	tc.writeString(fmt.Sprintf(format, args...) + "\r\n")
+}
+
+func (tc *testConn) readLine() string {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := tc.br.ReadString('\n')
+	if err != nil {
+		tc.t.Fatalf("failed to read line: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// readTagged reads lines until the tagged response for tag is received. It
+// returns the tagged response and the untagged responses received before it.
+func (tc *testConn) readTagged(tag string) (resp string, untagged []string) {
+	tc.t.Helper()
+	for {
+		line := tc.readLine()
+		if strings.HasPrefix(line, tag+" ") {
+			return line, untagged
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+// expectOK reads the tagged response for tag and checks that it's OK.
+func (tc *testConn) expectOK(tag string) []string {
+	tc.t.Helper()
+	resp, untagged := tc.readTagged(tag)
+	if !strings.HasPrefix(resp, tag+" OK") {
+		tc.t.Fatalf("expected OK for %v, got %q", tag, resp)
+	}
+	return untagged
+}
+
+func (tc *testConn) login() {
+	tc.t.Helper()
+	tc.writeLine("L1 LOGIN %v %v", testUsername, testPassword)
+	tc.expectOK("L1")
+}
+
+func (tc *testConn) appendMessage(mailbox, msg string) {
+	tc.t.Helper()
+	tc.writeLine("A1 APPEND %v {%v+}\r\n%v", mailbox, len(msg), msg)
+	tc.expectOK("A1")
+}
+
+func (tc *testConn) selectMailbox(mailbox string) []string {
+	tc.t.Helper()
+	tc.writeLine("S1 SELECT %v", mailbox)
+	return tc.expectOK("S1")
+}
+
+func TestCommandReadTimeout(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Timeouts: imapserver.Timeouts{CommandRead: 100 * time.Millisecond},
+	})
+
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tc.br.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected EOF after command read timeout, got %v", err)
+	}
+}
+
+func TestLiteralReadTimeout(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Timeouts: imapserver.Timeouts{
+			CommandRead: 100 * time.Millisecond,
+			LiteralRead: 5 * time.Second,
+		},
+	})
+	tc.login()
+
+	tc.writeLine("A1 APPEND INBOX {%v}", len(testMessage))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	// Upload the literal slower than the command read timeout
+	chunkSize := len(testMessage)/3 + 1
+	for msg := testMessage; msg != ""; {
+		n := min(chunkSize, len(msg))
+		time.Sleep(60 * time.Millisecond)
+		tc.writeString(msg[:n])
+		msg = msg[n:]
+	}
+	tc.writeString("\r\n")
+	tc.expectOK("A1")
+}
+
+func TestResponseWriteTimeout(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Timeouts: imapserver.Timeouts{
+			ResponseWrite: 100 * time.Millisecond,
+			LiteralWrite:  100 * time.Millisecond,
+		},
+		MaxWriteBuffer: 4096,
+	})
+	tc.conn.(*net.TCPConn).SetReadBuffer(4096)
+	tc.login()
+
+	msg := testMessage + strings.Repeat("Who are you?\r\n", 64*1024)
+	tc.writeLine("A0 APPEND INBOX {%v}", len(msg))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.writeString(msg + "\r\n")
+	tc.expectOK("A0")
+	tc.selectMailbox("INBOX")
+
+	// Read a single byte of the response, then stop reading
+	tc.writeLine("A1 FETCH 1 BODY[]")
+	if _, err := tc.br.ReadByte(); err != nil {
+		t.Fatalf("ReadByte() = %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// The server must have given up: draining the socket doesn't complete
+	// the response
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := tc.br.ReadString('\n')
+		if strings.HasPrefix(line, "A1 ") {
+			t.Fatalf("unexpected tagged response: %q", line)
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatalf("connection wasn't closed: %v", err)
+		} else if err != nil {
+			break
+		}
+	}
+}
+
+func TestMaxCommandLineSize(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.selectMailbox("INBOX")
+
+	huge := strings.Repeat("a", 1024*1024)
+	tc.writeLine("A1 SEARCH SUBJECT %v", huge)
+	if resp, _ := tc.readTagged("A1"); resp != "A1 BAD [TOOBIG] Command line too long" {
+		t.Errorf("unexpected response for a long command: %q", resp)
+	}
+
+	tc.writeLine("%v NOOP", huge)
+	if line := tc.readLine(); line != "* BAD [TOOBIG] Command line too long" {
+		t.Errorf("unexpected response for a long tag: %q", line)
+	}
+
+	// The connection is still usable
+	tc.writeLine("A2 NOOP")
+	tc.expectOK("A2")
+}
+
+func TestBareLF(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.writeString("A1 NOOP\n")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 BAD ") {
+		t.Errorf("expected BAD response for bare LF, got %q", resp)
+	}
+	tc.writeLine("A2 NOOP")
+	tc.expectOK("A2")
+
+	tc = newTestServer(t, &imapserver.Options{AllowBareLF: true})
+	tc.writeString("A1 NOOP\n")
+	tc.expectOK("A1")
+	tc.writeLine("A2 NOOP")
+	tc.expectOK("A2")
+}
+
+func TestGreeting(t *testing.T) {
+	tests := []struct {
+		name    string
+		options imapserver.Options
+		want    string
+	}{
+		{
+			name:    "default",
+			options: imapserver.Options{},
+			want:    "* OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready",
+		},
+		{
+			name:    "custom",
+			options: imapserver.Options{Greeting: "Example Mail ready"},
+			want:    "* OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] Example Mail ready",
+		},
+		{
+			name: "omit-caps",
+			options: imapserver.Options{
+				Greeting:         "Ready",
+				OmitGreetingCaps: true,
+			},
+			want: "* OK Ready",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startTestServer(t, &tt.options)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("net.Dial() = %v", err)
+			}
+			defer conn.Close()
+
+			greeting, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read greeting: %v", err)
+			}
+			if greeting = strings.TrimSuffix(greeting, "\r\n"); greeting != tt.want {
+				t.Errorf("got %q, want %q", greeting, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnRawCommand(t *testing.T) {
+	lines := make(chan string, 16)
+	tc := newTestServer(t, &imapserver.Options{
+		OnRawCommand: func(conn *imapserver.Conn, line string) error {
+			lines <- line
+			if fields := strings.Fields(line); len(fields) >= 2 && strings.EqualFold(fields[1], "DELETE") {
+				return fmt.Errorf("DELETE is disabled")
+			}
+			return nil
+		},
+	})
+
+	tc.writeLine("A1 LOGIN {%v}", len(testUsername))
+	if line := tc.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	tc.writeLine("%v %v", testUsername, testPassword)
+	tc.expectOK("A1")
+	if line, want := <-lines, "A1 LOGIN {9}"; line != want {
+		t.Errorf("got line %q, want %q", line, want)
+	}
+
+	tc.writeLine("A2 CREATE Archive")
+	tc.expectOK("A2")
+	<-lines
+
+	tc.writeLine("A3 delete Archive")
+	if resp, _ := tc.readTagged("A3"); resp != "A3 BAD DELETE is disabled" {
+		t.Errorf("got %q, want %q", resp, "A3 BAD DELETE is disabled")
+	}
+	if line, want := <-lines, "A3 delete Archive"; line != want {
+		t.Errorf("got line %q, want %q", line, want)
+	}
+
+	// The mailbox must still exist
+	tc.writeLine("A4 STATUS Archive (MESSAGES)")
+	tc.expectOK("A4")
+}
+
+func TestCapabilityFilter(t *testing.T) {
+	_, addr := startTestServer(t, &imapserver.Options{
+		CapabilityFilter: func(caps []imap.Cap) []imap.Cap {
+			filtered := []imap.Cap{"X-FOO"}
+			for _, c := range caps {
+				if c != imap.CapIdle {
+					filtered = append(filtered, c)
+				}
+			}
+			return filtered
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	defer conn.Close()
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	} else if !strings.Contains(greeting, " X-FOO") {
+		t.Errorf("X-FOO isn't advertised in the greeting: %q", greeting)
+	}
+
+	tc := dialTestServer(t, addr)
+	if caps := tc.capabilities(); !hasCap(caps, "X-FOO") {
+		t.Errorf("X-FOO isn't advertised: %v", caps)
+	}
+	tc.login()
+	caps := tc.capabilities()
+	if !hasCap(caps, "X-FOO") || !hasCap(caps, "UNSELECT") {
+		t.Errorf("X-FOO or UNSELECT isn't advertised: %v", caps)
+	}
+	if hasCap(caps, "IDLE") {
+		t.Errorf("IDLE is advertised: %v", caps)
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	tc := newTestServer(t, &imapserver.Options{
+		MaxAuthFailures:  4,
+		AuthFailureDelay: delay,
+	})
+
+	for i := 1; i <= 3; i++ {
+		start := time.Now()
+		tc.writeLine("L%v LOGIN %v wrong", i, testUsername)
+		resp, _ := tc.readTagged(fmt.Sprintf("L%v", i))
+		if !strings.HasPrefix(resp, fmt.Sprintf("L%v NO [AUTHENTICATIONFAILED]", i)) {
+			t.Fatalf("expected NO [AUTHENTICATIONFAILED], got %q", resp)
+		}
+		if d := time.Since(start); d < time.Duration(i)*delay {
+			t.Errorf("failure #%v answered after %v, want at least %v", i, d, time.Duration(i)*delay)
+		}
+	}
+
+	// AUTHENTICATE failures count as well, and the limit closes the
+	// connection
+	tc.writeLine("L4 AUTHENTICATE PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00"+testUsername+"\x00wrong")))
+	if resp, _ := tc.readTagged("L4"); !strings.HasPrefix(resp, "L4 NO ") {
+		t.Fatalf("expected NO, got %q", resp)
+	}
+	if line := tc.readLine(); !strings.HasPrefix(line, "* BYE ") {
+		t.Errorf("expected BYE, got %q", line)
+	}
+	if _, err := tc.br.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// Successful logins aren't delayed
+	tc = newTestServer(t, &imapserver.Options{
+		MaxAuthFailures:  1,
+		AuthFailureDelay: time.Hour,
+	})
+	tc.login()
+}
+
+func TestDisabledCommands(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		DisabledCommands: map[string]bool{"IDLE": true, "MOVE": true},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapMove:      {},
+		},
+	})
+	tc.login()
+
+	caps := tc.capabilities()
+	if hasCap(caps, "IDLE") || hasCap(caps, "MOVE") {
+		t.Errorf("disabled commands are advertised: %v", caps)
+	}
+	if !hasCap(caps, "UNSELECT") {
+		t.Errorf("UNSELECT isn't advertised: %v", caps)
+	}
+
+	tc.selectMailbox("INBOX")
+	for _, cmd := range []string{"IDLE", "UID MOVE 1 Archive"} {
+		tc.writeLine("A1 %v", cmd)
+		if resp, _ := tc.readTagged("A1"); resp != "A1 NO [CANNOT] Command disabled" {
+			t.Errorf("%v: got %q, want NO [CANNOT]", cmd, resp)
+		}
+	}
+	tc.writeLine("A2 NOOP")
+	tc.expectOK("A2")
+}
+
+// hijackSession takes over the connection after LOGIN, and answers "PING"
+// lines with "PONG".
+type hijackSession struct {
+	imapserver.Session
+	conn *imapserver.Conn
+}
+
+func (sess *hijackSession) Login(ctx context.Context, username, password string) error {
+	if err := sess.Session.Login(ctx, username, password); err != nil {
+		return err
+	}
+	conn, rw, err := sess.conn.Hijack()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil || line != "PING\r\n" {
+				return
+			}
+			rw.WriteString("PONG\r\n")
+			rw.Flush()
+		}
+	}()
+	return nil
+}
+
+func TestHijack(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &hijackSession{Session: memServer.NewSession(), conn: conn}, nil, nil
+		},
+	})
+
+	// Data pipelined after LOGIN is buffered by the server, and must be
+	// handed over
+	tc.writeString(fmt.Sprintf("A1 LOGIN %v %v\r\nPING\r\n", testUsername, testPassword))
+	if line := tc.readLine(); line != "PONG" {
+		t.Fatalf("got %q, want PONG", line)
+	}
+	tc.writeString("PING\r\n")
+	if line := tc.readLine(); line != "PONG" {
+		t.Fatalf("got %q, want PONG", line)
+	}
+
+	tc.writeString("QUIT\r\n")
+	if _, err := tc.br.ReadByte(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestPreAuth(t *testing.T) {
+	memServer := newTestMemServer()
+	_, addr := startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			sess := memServer.NewSession()
+			if err := sess.Login(conn.Context(), testUsername, testPassword); err != nil {
+				return nil, nil, err
+			}
+			return sess, &imapserver.GreetingData{PreAuth: true}, nil
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	defer conn.Close()
+	tc := &testConn{t: t, addr: addr, conn: conn, br: bufio.NewReader(conn)}
+
+	greeting := tc.readLine()
+	if !strings.HasPrefix(greeting, "* PREAUTH ") {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+	if strings.Contains(greeting, "AUTH=") || strings.Contains(greeting, "LOGINDISABLED") {
+		t.Errorf("greeting advertises authentication capabilities: %q", greeting)
+	}
+
+	// Mailbox commands are available without LOGIN
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("A1 LOGIN %v %v", testUsername, testPassword)
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 BAD ") {
+		t.Errorf("expected LOGIN to be rejected, got %q", resp)
+	}
+}
+
+// writeBufferListener records the send buffer sizes set on its connections.
+type writeBufferListener struct {
+	net.Listener
+	sizes chan int
+}
+
+func (ln *writeBufferListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeBufferConn{conn, ln.sizes}, nil
+}
+
+type writeBufferConn struct {
+	net.Conn
+	sizes chan<- int
+}
+
+func (conn *writeBufferConn) SetWriteBuffer(bytes int) error {
+	conn.sizes <- bytes
+	return nil
+}
+
+func TestMaxWriteBufferWrappedConn(t *testing.T) {
+	newServer := func() *imapserver.Server {
+		memServer := newTestMemServer()
+		return imapserver.New(&imapserver.Options{
+			NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+				return memServer.NewSession(), nil, nil
+			},
+			InsecureAuth:   true,
+			MaxWriteBuffer: 4096,
+		})
+	}
+	newListener := func() *writeBufferListener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() = %v", err)
+		}
+		return &writeBufferListener{ln, make(chan int, 1)}
+	}
+	expectSize := func(sizes <-chan int) {
+		t.Helper()
+		select {
+		case n := <-sizes:
+			if n != 4096 {
+				t.Errorf("got write buffer size %v, want 4096", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("write buffer size wasn't set")
+		}
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		tlsConfig := newTestTLSConfig(t)
+		server := newServer()
+		ln := newListener()
+		go server.Serve(tls.NewListener(ln, tlsConfig))
+		t.Cleanup(func() {
+			server.Close()
+		})
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("tls.Dial() = %v", err)
+		}
+		defer conn.Close()
+		expectSize(ln.sizes)
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		server := newServer()
+		ln := newListener()
+		httpServer := httptest.NewUnstartedServer(server.WebSocketHandler())
+		httpServer.Listener.Close()
+		httpServer.Listener = ln
+		httpServer.Start()
+		t.Cleanup(func() {
+			httpServer.Close()
+			server.Close()
+		})
+
+		wc, _ := dialWebSocket(t, httpServer.URL, "imap")
+		defer wc.conn.Close()
+		expectSize(ln.sizes)
+	})
+}
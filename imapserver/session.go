@@ -1,7 +1,10 @@
 package imapserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-sasl"
@@ -16,8 +19,84 @@ var errAuthFailed = &imap.Error{
 // ErrAuthFailed is returned by Session.Login on authentication failure.
 var ErrAuthFailed = errAuthFailed
 
+// ErrNoSuchMailbox can be returned by Session methods when the mailbox
+// doesn't exist. The client gets a NO response with the NONEXISTENT response
+// code (RFC 5530), even if the error is wrapped.
+var ErrNoSuchMailbox error = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeNonExistent,
+	Text: "No such mailbox",
+}
+
+// ErrMailboxAlreadyExists can be returned by Session.Create and
+// Session.Rename when the target mailbox already exists. The client gets a
+// NO response with the ALREADYEXISTS response code (RFC 5530), even if the
+// error is wrapped.
+var ErrMailboxAlreadyExists error = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeAlreadyExists,
+	Text: "Mailbox already exists",
+}
+
+// ErrMailboxNoSelect can be returned by Session.Select when the mailbox
+// cannot be selected, e.g. because it only exists as a node in the mailbox
+// hierarchy. Such mailboxes should have the \Noselect or \NonExistent
+// attribute in LIST responses. The client gets a NO response with the CANNOT
+// response code (RFC 5530), even if the error is wrapped.
+var ErrMailboxNoSelect error = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeCannot,
+	Text: "Mailbox cannot be selected",
+}
+
+// ReferralError is returned by Session.Login or by a SASL server when the
+// account lives on another server. The client is redirected to the IMAP URL
+// with a REFERRAL response code (RFC 2221).
+//
+// Characters which cannot appear in a response code (spaces, "]" and control
+// characters) are percent-encoded in the URL.
+type ReferralError struct {
+	URL string
+}
+
+func (err *ReferralError) Error() string {
+	return fmt.Sprintf("imapserver: account is located on %v", err.URL)
+}
+
+// loginError converts a ReferralError into an IMAP error.
+func loginError(err error) error {
+	var referralErr *ReferralError
+	if !errors.As(err, &referralErr) {
+		return err
+	}
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCode(fmt.Sprintf("%v %v", imap.ResponseCodeReferral, escapeReferralURL(referralErr.URL))),
+		Text: "Account is located on another server",
+	}
+}
+
+// escapeReferralURL percent-encodes the characters of an URL which would
+// terminate a REFERRAL response code or split it into several URLs.
+func escapeReferralURL(url string) string {
+	var sb strings.Builder
+	for i := 0; i < len(url); i++ {
+		ch := url[i]
+		if ch <= ' ' || ch == ']' || ch >= 0x7F {
+			fmt.Fprintf(&sb, "%%%02X", ch)
+		} else {
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
 // GreetingData is the data associated with an IMAP greeting.
 type GreetingData struct {
+	// PreAuth indicates that the connection is already authenticated, e.g.
+	// via a TLS client certificate. The server greets the client with
+	// PREAUTH and starts in the authenticated state: the session must be
+	// ready to handle commands without a prior call to Login.
 	PreAuth bool
 }
 
@@ -43,32 +122,55 @@ func (kind NumKind) String() string {
 }
 
 // Session is an IMAP session.
+//
+// The context passed to Session methods is cancelled when the connection is
+// closed or when the server shuts down. Implementations performing slow
+// operations should abort them when the context is done.
+//
+// Session methods are called sequentially, except with
+// Options.MaxConcurrentCommands and with CONTEXT=SEARCH or CONTEXT=SORT: in
+// the latter case, Search and SessionSort.Sort may be called while Idle is
+// running, to update search results when new messages are reported.
 type Session interface {
 	Close() error
 
 	// Not authenticated state
-	Login(username, password string) error
+	Login(ctx context.Context, username, password string) error
 
 	// Authenticated state
-	Select(mailbox string, options *imap.SelectOptions) (*imap.SelectData, error)
-	Create(mailbox string, options *imap.CreateOptions) error
-	Delete(mailbox string) error
-	Rename(mailbox, newName string) error
-	Subscribe(mailbox string) error
-	Unsubscribe(mailbox string) error
-	List(w *ListWriter, ref string, patterns []string, options *imap.ListOptions) error
-	Status(mailbox string, options *imap.StatusOptions) (*imap.StatusData, error)
-	Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error)
-	Poll(w *UpdateWriter, allowExpunge bool) error
-	Idle(w *UpdateWriter, stop <-chan struct{}) error
+	Select(ctx context.Context, mailbox string, options *imap.SelectOptions) (*imap.SelectData, error)
+	Create(ctx context.Context, mailbox string, options *imap.CreateOptions) error
+	Delete(ctx context.Context, mailbox string) error
+	Rename(ctx context.Context, mailbox, newName string) error
+	Subscribe(ctx context.Context, mailbox string) error
+	Unsubscribe(ctx context.Context, mailbox string) error
+	List(ctx context.Context, w *ListWriter, ref string, patterns []string, options *imap.ListOptions) error
+	Status(ctx context.Context, mailbox string, options *imap.StatusOptions) (*imap.StatusData, error)
+	Append(ctx context.Context, mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error)
+	Poll(ctx context.Context, w *UpdateWriter, allowExpunge bool) error
+	Idle(ctx context.Context, w *UpdateWriter, stop <-chan struct{}) error
 
 	// Selected state
-	Unselect() error
-	Expunge(w *ExpungeWriter, uids *imap.SeqSet) error
-	Search(kind NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error)
-	Fetch(w *FetchWriter, kind NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error
-	Store(w *FetchWriter, kind NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error
-	Copy(kind NumKind, seqSet imap.SeqSet, dest string) (*imap.CopyData, error)
+	Unselect(ctx context.Context) error
+	Expunge(ctx context.Context, w *ExpungeWriter, uids *imap.SeqSet) error
+	Search(ctx context.Context, kind NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error)
+	Fetch(ctx context.Context, w *FetchWriter, kind NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error
+	Store(ctx context.Context, w *FetchWriter, kind NumKind, seqSet imap.SeqSet, flags *imap.StoreFlags, options *imap.StoreOptions) error
+	Copy(ctx context.Context, kind NumKind, seqSet imap.SeqSet, dest string) (*imap.CopyData, error)
+}
+
+// SessionHierarchyDelim is an IMAP session which exposes its mailbox
+// hierarchy delimiter. The server uses it to validate the names passed to
+// CREATE and RENAME, and as the default delimiter of LIST responses, see
+// ListWriter.WriteList.
+//
+// Sessions which don't implement this interface but support NAMESPACE get
+// their delimiter from the first personal namespace.
+type SessionHierarchyDelim interface {
+	Session
+
+	// Authenticated state. Returns zero if there is no hierarchy.
+	HierarchyDelim() rune
 }
 
 // SessionNamespace is an IMAP session which supports NAMESPACE.
@@ -76,7 +178,7 @@ type SessionNamespace interface {
 	Session
 
 	// Authenticated state
-	Namespace() (*imap.NamespaceData, error)
+	Namespace(ctx context.Context) (*imap.NamespaceData, error)
 }
 
 // SessionMove is an IMAP session which supports MOVE.
@@ -84,7 +186,209 @@ type SessionMove interface {
 	Session
 
 	// Selected state
-	Move(w *MoveWriter, kind NumKind, seqSet imap.SeqSet, dest string) error
+	Move(ctx context.Context, w *MoveWriter, kind NumKind, seqSet imap.SeqSet, dest string) error
+}
+
+// SessionSort is an IMAP session which supports SORT.
+type SessionSort interface {
+	Session
+
+	// Selected state
+	Sort(ctx context.Context, kind NumKind, criteria *imap.SearchCriteria, sortCriteria []imap.SortCriterion) ([]uint32, error)
+}
+
+// SessionThread is an IMAP session which supports THREAD.
+type SessionThread interface {
+	Session
+
+	// Selected state
+	Thread(ctx context.Context, kind NumKind, algorithm imap.ThreadAlgorithm, criteria *imap.SearchCriteria) ([]imap.ThreadData, error)
+}
+
+// SessionQResync is an IMAP session which supports QRESYNC.
+type SessionQResync interface {
+	Session
+
+	// Selected state
+
+	// Vanished returns the UIDs of the messages in uids which have been
+	// expunged since the provided mod-sequence.
+	Vanished(ctx context.Context, modSeq uint64, uids imap.SeqSet) (imap.SeqSet, error)
+}
+
+// SessionQuota is an IMAP session which supports QUOTA.
+type SessionQuota interface {
+	Session
+
+	// Authenticated state
+
+	// GetQuota returns the usage and limits of a quota root.
+	GetQuota(ctx context.Context, root string) (*imap.QuotaData, error)
+	// GetQuotaRoot returns the list of quota roots for a mailbox, along
+	// with their usage and limits.
+	GetQuotaRoot(ctx context.Context, mailbox string) ([]imap.QuotaData, error)
+	// SetQuota changes the limits of a quota root. It's only called if the
+	// QUOTASET capability is advertised.
+	SetQuota(ctx context.Context, root string, limits map[imap.QuotaResourceType]int64) error
+}
+
+// SessionMetadata is an IMAP session which supports METADATA.
+type SessionMetadata interface {
+	Session
+
+	// Authenticated state
+
+	// GetMetadata returns the values of the requested entries. The mailbox is
+	// empty for server entries. Entries which don't exist should be omitted.
+	//
+	// Implementations must handle options.Depth. options.MaxSize is handled
+	// by the server.
+	GetMetadata(ctx context.Context, mailbox string, entries []string, options *imap.GetMetadataOptions) (*imap.GetMetadataData, error)
+	// SetMetadata sets the values of the provided entries. A nil value
+	// removes the entry.
+	SetMetadata(ctx context.Context, mailbox string, entries map[string]*[]byte) error
+}
+
+// SessionCatenate is an IMAP session which supports CATENATE.
+type SessionCatenate interface {
+	Session
+
+	// Authenticated state
+
+	// ResolveURL returns the contents of the message or message section
+	// referenced by an IMAP URL (RFC 5092). The URL may be relative to the
+	// server, e.g. "/INBOX;UIDVALIDITY=42/;UID=1/;SECTION=TEXT".
+	//
+	// If an *imap.Error is returned, the APPEND command fails with a BADURL
+	// response code.
+	ResolveURL(ctx context.Context, url string) ([]byte, error)
+}
+
+// SessionMultiAppend is an IMAP session which supports MULTIAPPEND.
+type SessionMultiAppend interface {
+	Session
+
+	// Authenticated state
+
+	// MultiAppend appends multiple messages to a mailbox. The operation must
+	// be atomic: if any message cannot be appended, none of them must be.
+	//
+	// Messages are decoded from the connection on demand: MultiAppend must
+	// call r.Next until it returns io.EOF, and read each message before
+	// asking for the next one. This is also used for APPEND commands with a
+	// single message.
+	MultiAppend(ctx context.Context, mailbox string, r *MultiAppendReader) ([]*imap.AppendData, error)
+}
+
+// SessionNotify is an IMAP session which supports NOTIFY.
+type SessionNotify interface {
+	Session
+
+	// Authenticated state
+
+	// Notify replaces the set of events the client is interested in. A nil
+	// options disables notifications (NOTIFY NONE).
+	//
+	// Notifications for mailboxes other than the selected one are typically
+	// written as STATUS responses via UpdateWriter.WriteMailboxStatus in
+	// Session.Poll and Session.Idle.
+	Notify(ctx context.Context, w *UpdateWriter, options *imap.NotifyOptions) error
+}
+
+// SessionACL is an IMAP session which supports ACL.
+type SessionACL interface {
+	Session
+
+	// Authenticated state
+
+	// MyRights returns the rights of the current user on a mailbox. The
+	// administer right is required to call the other methods.
+	MyRights(ctx context.Context, mailbox string) (*imap.MyRightsData, error)
+	SetACL(ctx context.Context, mailbox, identifier string, mod imap.RightModification, rights imap.RightSet) error
+	DeleteACL(ctx context.Context, mailbox, identifier string) error
+	GetACL(ctx context.Context, mailbox string) (*imap.ACLData, error)
+	ListRights(ctx context.Context, mailbox, identifier string) (*imap.ListRightsData, error)
+}
+
+// SessionURLAuth is an IMAP session which supports URLAUTH (RFC 4467),
+// including the URLFETCH command.
+//
+// URLs are signed by the server with the INTERNAL mechanism, using a mailbox
+// access key supplied by the session. GENURLAUTH only signs URLs owned by the
+// authenticated user, but URLFETCH resolves URLs owned by any user, as long
+// as the access identifier of the URL grants access to the authenticated user
+// (e.g. "submit+<user>" for a submission server).
+type SessionURLAuth interface {
+	Session
+
+	// Authenticated state
+
+	// Username returns the name of the authenticated user.
+	Username() string
+	// URLAuthKey returns the access key of a mailbox owned by the specified
+	// user. The key should be generated on first use and kept until
+	// ResetURLAuthKey is called. If the user or the mailbox doesn't exist,
+	// an *imap.Error should be returned.
+	URLAuthKey(ctx context.Context, owner, mailbox string) ([]byte, error)
+	// ResetURLAuthKey discards the access key of a mailbox, or of all
+	// mailboxes if mailbox is empty. URLs signed with the previous key
+	// become invalid.
+	ResetURLAuthKey(ctx context.Context, mailbox string) error
+	// FetchURL returns the contents referenced by a server-relative IMAP
+	// URL in the mailboxes of the specified user, see
+	// SessionCatenate.ResolveURL. It's called by URLFETCH once the URL has
+	// been authorized, and the owner may be another user than the
+	// authenticated one.
+	FetchURL(ctx context.Context, owner, url string) ([]byte, error)
+}
+
+// SessionFetchBodyTransformer is an IMAP session which transforms the
+// contents of body sections returned by FETCH, e.g. to transcode text to
+// UTF-8.
+//
+// Body sections written with FetchResponseWriter.WriteBodySection are
+// buffered in memory and passed to TransformBodySection, so the size passed
+// to WriteBodySection is ignored.
+type SessionFetchBodyTransformer interface {
+	Session
+
+	// TransformBodySection returns the contents to send for a body section.
+	// For partial fetches, body only contains the requested range.
+	// utf8Accept indicates whether the client has enabled UTF8=ACCEPT.
+	TransformBodySection(ctx context.Context, section *imap.FetchItemBodySection, body []byte, utf8Accept bool) ([]byte, error)
+}
+
+// SessionMailboxLocker is an IMAP session which serializes commands mutating
+// a mailbox across connections.
+//
+// The server locks the affected mailboxes around calls to Copy, Move, Expunge,
+// Store, Append and MultiAppend. Responses written by these calls are sent to
+// the client once the locks have been released.
+//
+// The lock isn't held while reading from the client: appended messages are
+// read in memory before locking the mailbox, instead of being streamed.
+//
+// MailboxLocks can be used to implement this interface.
+type SessionMailboxLocker interface {
+	Session
+
+	// LockMailbox blocks until the mailbox is locked or the context is
+	// cancelled. INBOX is always passed in upper-case.
+	LockMailbox(ctx context.Context, mailbox string) error
+	// UnlockMailbox releases a lock acquired with LockMailbox.
+	UnlockMailbox(mailbox string)
+}
+
+// SessionID is an IMAP session which supports ID.
+type SessionID interface {
+	Session
+
+	// ID exchanges implementation information with the client. The client
+	// parameters are nil if the client sent NIL. NIL values are represented
+	// as nil strings, and are distinct from empty strings.
+	//
+	// This method may be called in any state.
+	ID(ctx context.Context, clientParams map[string]*string) (serverParams map[string]*string, err error)
 }
 
 // SessionIMAP4rev2 is an IMAP session which supports IMAP4rev2.
@@ -96,8 +400,17 @@ type SessionIMAP4rev2 interface {
 
 // SessionSASL is an IMAP session which supports its own set of SASL
 // authentication mechanisms.
+//
+// Each mechanism returned by AuthenticateMechanisms is advertised as an AUTH=
+// capability. Mechanisms which report errors via a challenge, such as
+// OAUTHBEARER (RFC 7628), are supported: the SASL server can return the
+// error in a challenge and then fail once the client has replied.
+//
+// Authenticate acts as a registry of mechanisms: it can return servers from
+// the go-sasl package, or the ones created by NewCRAMMD5Server,
+// NewSCRAMSHA256Server and NewXOAuth2Server.
 type SessionSASL interface {
 	Session
 	AuthenticateMechanisms() []string
-	Authenticate(mech string) (sasl.Server, error)
+	Authenticate(ctx context.Context, mech string) (sasl.Server, error)
 }
@@ -0,0 +1,150 @@
+package imapserver_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// gatedFetchSession blocks FETCH commands and the end of IDLE commands until
+// the gate is opened or the context is cancelled.
+type gatedFetchSession struct {
+	imapserver.Session
+	fetching    chan<- struct{}
+	idleStopped chan<- struct{}
+	gate        <-chan struct{}
+}
+
+func (sess *gatedFetchSession) Fetch(ctx context.Context, w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	sess.fetching <- struct{}{}
+	select {
+	case <-sess.gate:
+		return sess.Session.Fetch(ctx, w, kind, seqSet, options)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sess *gatedFetchSession) Idle(ctx context.Context, w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	if err := sess.Session.Idle(ctx, w, stop); err != nil {
+		return err
+	}
+	sess.idleStopped <- struct{}{}
+	select {
+	case <-sess.gate:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func startGatedFetchServer(t *testing.T) (server *imapserver.Server, addr string, fetching, idleStopped <-chan struct{}, gate chan<- struct{}) {
+	fetchingCh := make(chan struct{}, 1)
+	idleStoppedCh := make(chan struct{}, 1)
+	gateCh := make(chan struct{})
+	memServer := newTestMemServer()
+	server, addr = startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &gatedFetchSession{
+				Session:     memServer.NewSession(),
+				fetching:    fetchingCh,
+				idleStopped: idleStoppedCh,
+				gate:        gateCh,
+			}, nil, nil
+		},
+	})
+	return server, addr, fetchingCh, idleStoppedCh, gateCh
+}
+
+func (tc *testConn) expectBye() {
+	tc.t.Helper()
+	if line := tc.readLine(); !strings.HasPrefix(line, "* BYE ") {
+		tc.t.Fatalf("expected BYE, got %q", line)
+	}
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tc.br.ReadString('\n'); err != io.EOF {
+		tc.t.Errorf("expected EOF after BYE, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, addr, fetching, idleStopped, gate := startGatedFetchServer(t)
+
+	idle := dialTestServer(t, addr)
+	idle.login()
+
+	// The IDLE command is still in-flight when the server shuts down
+	idling := dialTestServer(t, addr)
+	idling.login()
+	idling.writeLine("I1 IDLE")
+	if line := idling.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected continuation request, got %q", line)
+	}
+	idling.writeLine("DONE")
+	<-idleStopped
+
+	busy := dialTestServer(t, addr)
+	busy.login()
+	busy.appendMessage("INBOX", testMessage)
+	busy.selectMailbox("INBOX")
+	busy.writeLine("F1 FETCH 1 (FLAGS)")
+	<-fetching
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+
+	idle.expectBye()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown() = %v before in-flight command completed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gate)
+	idling.expectOK("I1")
+	idling.expectBye()
+	busy.expectOK("F1")
+	busy.expectBye()
+
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("server still accepts connections after Shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, addr, fetching, _, _ := startGatedFetchServer(t)
+
+	tc := dialTestServer(t, addr)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+	tc.writeLine("F1 FETCH 1 (FLAGS)")
+	<-fetching
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(tc.br); err != nil {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
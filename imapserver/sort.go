@@ -0,0 +1,348 @@
+package imapserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+func (c *Conn) handleSort(tag string, dec *imapwire.Decoder, numKind NumKind) (exec func() error, err error) {
+	var (
+		sortCriteria []imap.SortCriterion
+		charset      string
+		options      *sortReturnOptions
+	)
+	if !dec.ExpectSP() {
+		return nil, dec.Err()
+	}
+	var atom string
+	if dec.Atom(&atom) {
+		if !strings.EqualFold(atom, "RETURN") {
+			return nil, newClientBugError("Expected RETURN or sort criteria")
+		}
+		if !c.server.options.caps().Has(imap.CapESort) {
+			return nil, newClientBugError("ESORT is not supported")
+		}
+		options, err = readSortReturnOpts(dec)
+		if err != nil {
+			return nil, fmt.Errorf("in sort-return-opts: %w", err)
+		}
+		if options.update && !c.server.options.caps().Has(imap.CapContextSort) {
+			return nil, newClientBugError("CONTEXT=SORT is not supported")
+		}
+		if !dec.ExpectSP() {
+			return nil, dec.Err()
+		}
+	}
+	err = dec.ExpectList(func() error {
+		criterion, err := readSortCriterion(dec)
+		if err != nil {
+			return err
+		}
+		sortCriteria = append(sortCriteria, *criterion)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !dec.ExpectSP() || !dec.ExpectAString(&charset) || !dec.ExpectSP() {
+		return nil, dec.Err()
+	}
+	charsetEnc, err := c.searchCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	var criteria imap.SearchCriteria
+	if err := c.readSearchKeyList(&criteria, dec, ""); err != nil {
+		return nil, err
+	}
+	if err := decodeSearchCriteria(&criteria, charsetEnc); err != nil {
+		return nil, err
+	}
+
+	if !dec.ExpectCRLF() {
+		return nil, dec.Err()
+	}
+
+	return func() error {
+		if err := c.checkState(imap.ConnStateSelected); err != nil {
+			return err
+		}
+
+		session, ok := c.session.(SessionSort)
+		if !ok {
+			return newClientBugError("SORT is not supported")
+		}
+
+		if err := c.resolveSearchCriteria(&criteria); err != nil {
+			return err
+		}
+
+		nums, err := session.Sort(c.ctx, numKind, &criteria, sortCriteria)
+		if err != nil {
+			return err
+		}
+
+		if options != nil && options.update {
+			if err := c.addSearchContext(tag, numKind, &criteria, sortCriteria); err != nil {
+				return err
+			}
+		}
+
+		if options != nil {
+			return c.writeESort(tag, numKind, nums, options)
+		}
+		return c.writeSort(nums)
+	}, nil
+}
+
+// sortReturnOptions contains the ESORT return options, defined in RFC 5267
+// section 3.
+type sortReturnOptions struct {
+	min, max, all, count bool
+	partial              *imap.Seq // nil if PARTIAL isn't requested
+	update               bool
+}
+
+func readSortReturnOpts(dec *imapwire.Decoder) (*sortReturnOptions, error) {
+	var options sortReturnOptions
+	if !dec.ExpectSP() {
+		return nil, dec.Err()
+	}
+	err := dec.ExpectList(func() error {
+		var name string
+		if !dec.ExpectAtom(&name) {
+			return dec.Err()
+		}
+		switch strings.ToUpper(name) {
+		case "MIN":
+			options.min = true
+		case "MAX":
+			options.max = true
+		case "ALL":
+			options.all = true
+		case "COUNT":
+			options.count = true
+		case "PARTIAL":
+			var s string
+			if !dec.ExpectSP() || !dec.ExpectAtom(&s) {
+				return dec.Err()
+			}
+			set, err := imap.ParseSeqSet(s)
+			if err != nil || len(set) != 1 || set[0].Start == 0 || set[0].Stop == 0 {
+				return newClientBugError("Invalid PARTIAL range")
+			}
+			options.partial = &set[0]
+		case "UPDATE":
+			options.update = true
+		default:
+			return newClientBugError("unknown SORT RETURN option")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// If no return option is specified, ALL is assumed
+	if !options.min && !options.max && !options.count && options.partial == nil && !options.update {
+		options.all = true
+	}
+	return &options, nil
+}
+
+func (c *Conn) writeESort(tag string, numKind NumKind, nums []uint32, options *sortReturnOptions) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+
+	enc.Atom("*").SP().Atom("ESEARCH")
+	if tag != "" {
+		enc.SP().Special('(').Atom("TAG").SP().Quoted(tag).Special(')')
+	}
+	if numKind == NumKindUID {
+		enc.SP().Atom("UID")
+	}
+	// MIN and MAX refer to the first and last messages in sort order, and
+	// must be omitted if there are no matching messages
+	if options.min && len(nums) > 0 {
+		enc.SP().Atom("MIN").SP().Number(nums[0])
+	}
+	if options.max && len(nums) > 0 {
+		enc.SP().Atom("MAX").SP().Number(nums[len(nums)-1])
+	}
+	if options.count {
+		enc.SP().Atom("COUNT").SP().Number(uint32(len(nums)))
+	}
+	if options.all && len(nums) > 0 {
+		enc.SP().Atom("ALL").SP().SeqSet(sortedSeqSet(nums))
+	}
+	if r := options.partial; r != nil {
+		enc.SP().Atom("PARTIAL").SP().Special('(')
+		enc.Number(r.Start).Special(':').Number(r.Stop).SP()
+		if int(r.Start) <= len(nums) {
+			window := nums[r.Start-1 : min(int(r.Stop), len(nums))]
+			enc.SeqSet(sortedSeqSet(window))
+		} else {
+			enc.NIL()
+		}
+		enc.Special(')')
+	}
+	return enc.CRLF()
+}
+
+// sortedSeqSet builds a sequence set preserving the order of nums. Only
+// consecutive increasing numbers are merged into ranges.
+func sortedSeqSet(nums []uint32) imap.SeqSet {
+	var set imap.SeqSet
+	for _, num := range nums {
+		if n := len(set); n > 0 && set[n-1].Stop+1 == num {
+			set[n-1].Stop = num
+		} else {
+			set = append(set, imap.Seq{Start: num, Stop: num})
+		}
+	}
+	return set
+}
+
+func (c *Conn) writeSort(nums []uint32) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+
+	enc.Atom("*").SP().Atom("SORT")
+	for _, num := range nums {
+		enc.SP().Number(num)
+	}
+	return enc.CRLF()
+}
+
+func readSortCriterion(dec *imapwire.Decoder) (*imap.SortCriterion, error) {
+	var criterion imap.SortCriterion
+
+	var key string
+	if !dec.ExpectAtom(&key) {
+		return nil, dec.Err()
+	}
+	key = strings.ToUpper(key)
+	if key == "REVERSE" {
+		criterion.Reverse = true
+		if !dec.ExpectSP() || !dec.ExpectAtom(&key) {
+			return nil, dec.Err()
+		}
+		key = strings.ToUpper(key)
+	}
+
+	criterion.Key = imap.SortKey(key)
+	switch criterion.Key {
+	case imap.SortKeyArrival, imap.SortKeyCc, imap.SortKeyDate, imap.SortKeyFrom, imap.SortKeySize, imap.SortKeySubject, imap.SortKeyTo:
+		return &criterion, nil
+	default:
+		return nil, newClientBugError("unknown SORT key")
+	}
+}
+
+// BaseSubject extracts the base subject from a message subject, as defined
+// in RFC 5256 section 2.1. It can be used to sort and thread messages by
+// subject. isReplyOrForward is true if a reply or forward prefix or suffix
+// has been removed.
+//
+// The subject must already be decoded (e.g. RFC 2047 encoded-words must be
+// converted to UTF-8). The returned string should be compared using a
+// case-insensitive comparison.
+func BaseSubject(subject string) (base string, isReplyOrForward bool) {
+	s := strings.Join(strings.Fields(subject), " ")
+	for {
+		// Remove subj-trailer
+		for {
+			s = strings.TrimRight(s, " ")
+			if !hasSuffixFold(s, "(fwd)") {
+				break
+			}
+			s = s[:len(s)-len("(fwd)")]
+			isReplyOrForward = true
+		}
+
+		// Remove subj-leader and subj-blob
+		for {
+			prev := s
+			for {
+				t, refwd := trimSubjectLeader(s)
+				if t == s {
+					break
+				}
+				s = t
+				isReplyOrForward = isReplyOrForward || refwd
+			}
+			if t := trimSubjectBlob(s); t != "" {
+				s = t
+			}
+			if s == prev {
+				break
+			}
+		}
+
+		// Remove subj-fwd-hdr and subj-fwd-trl
+		if hasPrefixFold(s, "[fwd:") && strings.HasSuffix(s, "]") {
+			s = s[len("[fwd:") : len(s)-1]
+			isReplyOrForward = true
+			continue
+		}
+
+		return s, isReplyOrForward
+	}
+}
+
+// trimSubjectLeader removes a subj-leader from the start of s, if any. refwd
+// is true if the subj-leader contains a subj-refwd.
+func trimSubjectLeader(s string) (t string, refwd bool) {
+	if strings.HasPrefix(s, " ") {
+		return s[1:], false
+	}
+
+	t = s
+	for {
+		u := trimSubjectBlob(t)
+		if u == t {
+			break
+		}
+		t = u
+	}
+
+	switch {
+	case hasPrefixFold(t, "re"):
+		t = t[len("re"):]
+	case hasPrefixFold(t, "fwd"):
+		t = t[len("fwd"):]
+	case hasPrefixFold(t, "fw"):
+		t = t[len("fw"):]
+	default:
+		return s, false
+	}
+	t = strings.TrimLeft(t, " ")
+	t = trimSubjectBlob(t)
+	if !strings.HasPrefix(t, ":") {
+		return s, false
+	}
+	return t[1:], true
+}
+
+// trimSubjectBlob removes a subj-blob from the start of s, if any.
+func trimSubjectBlob(s string) string {
+	if !strings.HasPrefix(s, "[") {
+		return s
+	}
+	i := strings.IndexAny(s[1:], "[]")
+	if i < 0 || s[1+i] != ']' {
+		return s
+	}
+	return strings.TrimLeft(s[i+2:], " ")
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
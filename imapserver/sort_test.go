@@ -0,0 +1,196 @@
+package imapserver_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var baseSubjectTests = []struct {
+	subject, base string
+	reply         bool
+}{
+	{"Your Name.", "Your Name.", false},
+	{"Re: Your Name.", "Your Name.", true},
+	{"RE: re: Your Name.", "Your Name.", true},
+	{"Fwd: Your Name.", "Your Name.", true},
+	{"Fw: Re: Your Name.", "Your Name.", true},
+	{"Re[2]: Your Name.", "Your Name.", true},
+	{"[anime] Re: Your Name.", "Your Name.", true},
+	{"Re: [anime] Your Name.", "Your Name.", true},
+	{"[anime] Your Name.", "Your Name.", false},
+	{"Your Name. (fwd)", "Your Name.", true},
+	{"[Fwd: Your Name.]", "Your Name.", true},
+	{"  Your \t Name.  ", "Your Name.", false},
+	{"[anime]", "[anime]", false},
+	{"Re:", "", true},
+	{"Reply", "Reply", false},
+}
+
+func TestBaseSubject(t *testing.T) {
+	for _, test := range baseSubjectTests {
+		base, reply := imapserver.BaseSubject(test.subject)
+		if base != test.base || reply != test.reply {
+			t.Errorf("BaseSubject(%q) = %q, %v, want %q, %v", test.subject, base, reply, test.base, test.reply)
+		}
+	}
+}
+
+var sortTestMessages = []struct {
+	subject, from, date string
+}{
+	{"b", "alice", "Mon, 05 Sep 2016 19:00:00 +0900"},
+	{"Re: a", "bob", "Tue, 06 Sep 2016 19:00:00 +0900"},
+	{"a", "carol", "Sun, 04 Sep 2016 19:00:00 +0900"},
+	{"B", "alice", "Sun, 04 Sep 2016 19:00:00 +0900"},
+	{"Fwd: a", "bob", "Tue, 06 Sep 2016 19:00:00 +0900"},
+}
+
+var sortTests = []struct {
+	command string
+	resp    string
+}{
+	{"SORT (SUBJECT) UTF-8 ALL", "* SORT 2 3 5 1 4"},
+	{"SORT (REVERSE SUBJECT) UTF-8 ALL", "* SORT 1 4 2 3 5"},
+	{"SORT (SUBJECT DATE) UTF-8 ALL", "* SORT 3 2 5 4 1"},
+	{"SORT (SUBJECT REVERSE DATE) UTF-8 ALL", "* SORT 2 5 3 1 4"},
+	{"SORT (FROM DATE) UTF-8 ALL", "* SORT 4 1 2 5 3"},
+	{"SORT (ARRIVAL) US-ASCII FROM bob", "* SORT 2 5"},
+	{"UID SORT (DATE) UTF-8 1:3", "* SORT 3 1 2"},
+	{"SORT (SIZE) UTF-8 KEYWORD foo", "* SORT"},
+}
+
+func TestSort(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapSort:      {},
+		},
+	})
+	tc.login()
+	for _, msg := range sortTestMessages {
+		tc.appendMessage("INBOX", fmt.Sprintf("From: <%v@example.org>\r\n"+
+			"Subject: %v\r\n"+
+			"Date: %v\r\n"+
+			"\r\n"+
+			"Hi!\r\n", msg.from, msg.subject, msg.date))
+	}
+	tc.selectMailbox("INBOX")
+
+	for _, test := range sortTests {
+		tc.writeLine("T1 %v", test.command)
+		untagged := tc.expectOK("T1")
+		if len(untagged) != 1 || untagged[0] != test.resp {
+			t.Errorf("%v: got %q, want %q", test.command, untagged, test.resp)
+		}
+	}
+
+	tc.writeLine("T2 SORT (SUBJECT) ISO-8859-1 ALL")
+	if resp, _ := tc.readTagged("T2"); resp != "T2 NO [BADCHARSET (UTF-8 US-ASCII)] Unsupported SEARCH charset" {
+		t.Errorf("unexpected response for unsupported charset: %q", resp)
+	}
+}
+
+func TestSortIMAP4rev2(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev2: {},
+			imap.CapSort:      {},
+		},
+	})
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "SORT") {
+		t.Errorf("SORT isn't advertised: %v", caps)
+	}
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 SORT (ARRIVAL) UTF-8 ALL")
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != "* SORT 1" {
+		t.Errorf("got %q, want %q", untagged, "* SORT 1")
+	}
+}
+
+func TestESortIMAP4rev2(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev2: {},
+			imap.CapSort:      {},
+			imap.CapESort:     {},
+		},
+	})
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "ESORT") {
+		t.Errorf("ESORT isn't advertised: %v", caps)
+	}
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 SORT RETURN (COUNT) (ARRIVAL) UTF-8 ALL")
+	want := `* ESEARCH (TAG "T1") COUNT 1`
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+}
+
+func TestESort(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapSort:      {},
+			imap.CapESort:     {},
+		},
+	})
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "ESORT") {
+		t.Errorf("ESORT isn't advertised: %v", caps)
+	}
+	for i := 0; i < 100; i++ {
+		tc.appendMessage("INBOX", testMessage)
+	}
+	tc.selectMailbox("INBOX")
+
+	tests := []struct {
+		command, resp string
+	}{
+		{
+			command: "SORT RETURN (PARTIAL 1:10) (REVERSE ARRIVAL) UTF-8 ALL",
+			resp:    `* ESEARCH (TAG "T1") PARTIAL (1:10 100,99,98,97,96,95,94,93,92,91)`,
+		},
+		{
+			command: "SORT RETURN (PARTIAL 96:110) (ARRIVAL) UTF-8 ALL",
+			resp:    `* ESEARCH (TAG "T1") PARTIAL (96:110 96:100)`,
+		},
+		{
+			command: "SORT RETURN (PARTIAL 101:110) (ARRIVAL) UTF-8 ALL",
+			resp:    `* ESEARCH (TAG "T1") PARTIAL (101:110 NIL)`,
+		},
+		{
+			command: "SORT RETURN (MIN MAX COUNT) (REVERSE ARRIVAL) UTF-8 1:5",
+			resp:    `* ESEARCH (TAG "T1") MIN 5 MAX 1 COUNT 5`,
+		},
+		{
+			command: "SORT RETURN () (ARRIVAL) UTF-8 3:5,8",
+			resp:    `* ESEARCH (TAG "T1") ALL 3:5,8`,
+		},
+		{
+			command: "UID SORT RETURN (ALL) (REVERSE ARRIVAL) UTF-8 1:3",
+			resp:    `* ESEARCH (TAG "T1") UID ALL 3,2,1`,
+		},
+	}
+	for _, test := range tests {
+		tc.writeLine("T1 %v", test.command)
+		untagged := tc.expectOK("T1")
+		if len(untagged) != 1 || untagged[0] != test.resp {
+			t.Errorf("%v: got %q, want %q", test.command, untagged, test.resp)
+		}
+	}
+
+	tc.writeLine("T2 SORT RETURN (PARTIAL 0:10) (ARRIVAL) UTF-8 ALL")
+	if resp, _ := tc.readTagged("T2"); !strings.HasPrefix(resp, "T2 BAD ") {
+		t.Errorf("expected BAD for invalid PARTIAL range, got %q", resp)
+	}
+}
@@ -1,18 +1,20 @@
 package imapserver
 
 import (
-	"bytes"
 	"crypto/tls"
-	"io"
-	"net"
+	"errors"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
+var errStartTLSBufferedData = errors.New("imapserver: cleartext data received after STARTTLS")
+
 func (c *Conn) canStartTLS() bool {
-	_, isTLS := c.conn.(*tls.Conn)
-	return c.server.options.TLSConfig != nil && c.state == imap.ConnStateNotAuthenticated && !isTLS
+	// TLS is negotiated by the HTTP server for WebSocket connections
+	_, isWebSocket := c.conn.(*wsConn)
+	isTLS := connectionState(c.conn) != nil
+	return c.server.options.TLSConfig != nil && c.state == imap.ConnStateNotAuthenticated && !isTLS && !isWebSocket
 }
 
 func (c *Conn) handleStartTLS(tag string, dec *imapwire.Decoder) error {
@@ -46,38 +48,30 @@ func (c *Conn) handleStartTLS(tag string, dec *imapwire.Decoder) error {
 		return err
 	}
 
-	// Drain buffered data from our bufio.Reader
-	var buf bytes.Buffer
-	if _, err := io.CopyN(&buf, c.br, int64(c.br.Buffered())); err != nil {
-		panic(err) // unreachable
-	}
-
-	var cleartextConn net.Conn
-	if buf.Len() > 0 {
-		r := io.MultiReader(&buf, c.conn)
-		cleartextConn = startTLSConn{c.conn, r}
-	} else {
-		cleartextConn = c.conn
+	// Refuse to start TLS if the client has pipelined data after the
+	// STARTTLS command: it has been sent in cleartext and must not be
+	// processed as part of the encrypted session
+	if c.br.Buffered() > 0 {
+		c.conn.Close()
+		return errStartTLSBufferedData
 	}
 
-	tlsConn := tls.Server(cleartextConn, c.server.options.TLSConfig)
+	tlsConn := tls.Server(c.conn, c.server.options.TLSConfig)
 
 	c.mutex.Lock()
 	c.conn = tlsConn
 	c.mutex.Unlock()
 
-	rw := c.server.options.wrapReadWriter(tlsConn)
+	rw := c.wrapReadWriter(tlsConn)
 	c.br.Reset(rw)
 	c.bw.Reset(rw)
 
-	return nil
-}
-
-type startTLSConn struct {
-	net.Conn
-	r io.Reader
-}
+	if c.server.options.StartTLSCapability {
+		// Sent over TLS, so that the capabilities can't be tampered with
+		if err := writeCapability(enc.Encoder, c.availableCaps()); err != nil {
+			return err
+		}
+	}
 
-func (conn startTLSConn) Read(b []byte) (int, error) {
-	return conn.r.Read(b)
+	return nil
 }
@@ -0,0 +1,236 @@
+package imapserver_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func newTestCertificate(t *testing.T, dnsName string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() = %v", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*newTestCertificate(t, "localhost")},
+	}
+}
+
+// startTLS sends STARTTLS and performs the TLS handshake.
+func (tc *testConn) startTLS(config *tls.Config) *tls.Conn {
+	tc.t.Helper()
+	tc.writeLine("T1 STARTTLS")
+	tc.expectOK("T1")
+	tlsConn := tls.Client(tc.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		tc.t.Fatalf("TLS handshake failed: %v", err)
+	}
+	tc.conn = tlsConn
+	tc.br = bufio.NewReader(tlsConn)
+	return tlsConn
+}
+
+func (tc *testConn) capabilities() []string {
+	tc.t.Helper()
+	tc.writeLine("C1 CAPABILITY")
+	untagged := tc.expectOK("C1")
+	if len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* CAPABILITY ") {
+		tc.t.Fatalf("unexpected CAPABILITY response: %q", untagged)
+	}
+	return strings.Fields(strings.TrimPrefix(untagged[0], "* CAPABILITY "))
+}
+
+func hasCap(caps []string, c string) bool {
+	for _, cap := range caps {
+		if cap == c {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoginDisabled(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		TLSConfig: newTestTLSConfig(t),
+	})
+
+	caps := tc.capabilities()
+	if !hasCap(caps, "LOGINDISABLED") || !hasCap(caps, "STARTTLS") {
+		t.Errorf("expected LOGINDISABLED and STARTTLS before STARTTLS, got %v", caps)
+	}
+	if hasCap(caps, "AUTH=PLAIN") {
+		t.Errorf("AUTH=PLAIN must not be advertised before STARTTLS, got %v", caps)
+	}
+
+	tc.writeLine("L1 LOGIN %v %v", testUsername, testPassword)
+	if resp, _ := tc.readTagged("L1"); !strings.HasPrefix(resp, "L1 NO [PRIVACYREQUIRED] ") {
+		t.Errorf("expected NO [PRIVACYREQUIRED], got %q", resp)
+	}
+
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+
+	caps = tc.capabilities()
+	if hasCap(caps, "LOGINDISABLED") || hasCap(caps, "STARTTLS") {
+		t.Errorf("unexpected LOGINDISABLED or STARTTLS after STARTTLS, got %v", caps)
+	}
+	if !hasCap(caps, "AUTH=PLAIN") {
+		t.Errorf("expected AUTH=PLAIN after STARTTLS, got %v", caps)
+	}
+
+	tc.login()
+}
+
+func TestStartTLSCapability(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		TLSConfig:          newTestTLSConfig(t),
+		StartTLSCapability: true,
+	})
+
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+
+	// The new capabilities are sent without being requested
+	line := tc.readLine()
+	if !strings.HasPrefix(line, "* CAPABILITY ") {
+		t.Fatalf("expected CAPABILITY after STARTTLS, got %q", line)
+	}
+	caps := strings.Fields(strings.TrimPrefix(line, "* CAPABILITY "))
+	if hasCap(caps, "LOGINDISABLED") || hasCap(caps, "STARTTLS") {
+		t.Errorf("unexpected LOGINDISABLED or STARTTLS after STARTTLS, got %v", caps)
+	}
+	if !hasCap(caps, "AUTH=PLAIN") {
+		t.Errorf("expected AUTH=PLAIN after STARTTLS, got %v", caps)
+	}
+
+	tc.login()
+}
+
+func TestStartTLSInjection(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		TLSConfig: newTestTLSConfig(t),
+	})
+
+	tc.writeString("T1 STARTTLS\r\nN1 NOOP\r\n")
+	tc.expectOK("T1")
+
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := tc.br.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected EOF after pipelined STARTTLS, got %q, %v", line, err)
+	}
+}
+
+func TestStartTLSSNI(t *testing.T) {
+	certs := map[string]*tls.Certificate{
+		"a.example.org": newTestCertificate(t, "a.example.org"),
+		"b.example.org": newTestCertificate(t, "b.example.org"),
+	}
+	tc := newTestServer(t, &imapserver.Options{
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return certs[hello.ServerName], nil
+			},
+		},
+	})
+
+	for name := range certs {
+		tc := tc.newConn()
+		tlsConn := tc.startTLS(&tls.Config{ServerName: name, InsecureSkipVerify: true})
+		cert := tlsConn.ConnectionState().PeerCertificates[0]
+		if err := cert.VerifyHostname(name); err != nil {
+			t.Errorf("got certificate for %v, want %v", cert.DNSNames, name)
+		}
+		tc.login()
+	}
+}
+
+func TestConnInfoTLS(t *testing.T) {
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mitsuha"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &clientKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() = %v", err)
+	}
+	clientCert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: clientKey}
+
+	memServer := newTestMemServer()
+	infos := make(chan *imapserver.ConnInfo, 1)
+	serverTLSConfig := newTestTLSConfig(t)
+	serverTLSConfig.ClientAuth = tls.RequireAnyClientCert
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			infos <- conn.Info()
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:      imap.CapSet{imap.CapIMAP4rev1: {}},
+		TLSConfig: serverTLSConfig,
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	go server.Serve(tls.NewListener(ln, serverTLSConfig))
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial() = %v", err)
+	}
+	defer conn.Close()
+
+	info := <-infos
+	if info.TLS == nil {
+		t.Fatalf("missing TLS connection state")
+	}
+	if len(info.TLS.PeerCertificates) == 0 {
+		t.Fatalf("missing client certificate")
+	}
+	if cn := info.TLS.PeerCertificates[0].Subject.CommonName; cn != "mitsuha" {
+		t.Errorf("got client certificate CN %q, want %q", cn, "mitsuha")
+	}
+	if info.RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Errorf("got remote address %v, want %v", info.RemoteAddr, conn.LocalAddr())
+	}
+	if info.LocalAddr.String() != ln.Addr().String() {
+		t.Errorf("got local address %v, want %v", info.LocalAddr, ln.Addr())
+	}
+}
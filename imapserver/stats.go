@@ -0,0 +1,122 @@
+package imapserver
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// CommandInfo contains information about a command executed by the server.
+//
+// Byte counts refer to IMAP protocol data, after decryption and
+// decompression. When commands are executed concurrently (see
+// Options.MaxConcurrentCommands), BytesWritten may include responses written
+// for other commands.
+type CommandInfo struct {
+	// Command name, e.g. "FETCH" or "UID FETCH"
+	Name string
+	Tag  string
+	// Status is the type of the tagged status response: OK, NO or BAD. It's
+	// empty if the command panicked.
+	Status       imap.StatusResponseType
+	Duration     time.Duration
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// commandStats records statistics for a single command. A nil *commandStats
+// is valid and records nothing.
+type commandStats struct {
+	start         time.Time
+	read, written int64
+}
+
+func (c *Conn) newCommandStats() *commandStats {
+	if c.server.options.OnCommand == nil {
+		return nil
+	}
+	return &commandStats{
+		start:   time.Now(),
+		read:    c.consumedBytes(),
+		written: atomic.LoadInt64(&c.bytesWritten),
+	}
+}
+
+// consumedBytes returns the number of bytes consumed from the connection's
+// buffered reader.
+func (c *Conn) consumedBytes() int64 {
+	return atomic.LoadInt64(&c.bytesRead) - int64(c.br.Buffered())
+}
+
+// endRead records the number of bytes read for the command. It must be
+// called once the command has been fully decoded.
+func (stats *commandStats) endRead(c *Conn) {
+	if stats == nil {
+		return
+	}
+	stats.read = c.consumedBytes() - stats.read
+}
+
+func (c *Conn) reportCommand(stats *commandStats, tag, name string, status imap.StatusResponseType) {
+	if stats == nil {
+		return
+	}
+	c.server.options.OnCommand(CommandInfo{
+		Name:         name,
+		Tag:          tag,
+		Status:       status,
+		Duration:     time.Since(stats.start),
+		BytesRead:    stats.read,
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten) - stats.written,
+	})
+}
+
+// commandStatusType returns the type of the status response sent for a
+// command which returned err.
+func commandStatusType(err error) imap.StatusResponseType {
+	var (
+		imapErr *imap.Error
+		decErr  *imapwire.DecoderExpectError
+	)
+	switch {
+	case err == nil:
+		return imap.StatusResponseTypeOK
+	case errors.As(err, &imapErr):
+		return imapErr.Type
+	case errors.As(err, &decErr):
+		return imap.StatusResponseTypeBad
+	default:
+		return imap.StatusResponseTypeNo
+	}
+}
+
+// wrapReadWriter wraps the reader and writer used for the IMAP protocol
+// stream.
+func (c *Conn) wrapReadWriter(rw io.ReadWriter) io.ReadWriter {
+	rw = &writeFailer{ReadWriter: c.server.options.wrapReadWriter(rw), conn: c}
+	if c.server.options.OnCommand == nil {
+		return rw
+	}
+	return &countingReadWriter{rw: rw, conn: c}
+}
+
+type countingReadWriter struct {
+	rw   io.ReadWriter
+	conn *Conn
+}
+
+func (crw *countingReadWriter) Read(b []byte) (int, error) {
+	n, err := crw.rw.Read(b)
+	atomic.AddInt64(&crw.conn.bytesRead, int64(n))
+	return n, err
+}
+
+func (crw *countingReadWriter) Write(b []byte) (int, error) {
+	n, err := crw.rw.Write(b)
+	atomic.AddInt64(&crw.conn.bytesWritten, int64(n))
+	return n, err
+}
@@ -0,0 +1,178 @@
+package imapserver_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestOnCommand(t *testing.T) {
+	infos := make(chan imapserver.CommandInfo, 16)
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &failingFetchSession{memServer.NewSession()}, nil, nil
+		},
+		OnCommand: func(info imapserver.CommandInfo) {
+			infos <- info
+		},
+	})
+
+	nextInfo := func() imapserver.CommandInfo {
+		select {
+		case info := <-infos:
+			return info
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnCommand wasn't called")
+			panic("unreachable")
+		}
+	}
+
+	tc.writeLine("N1 NOOP")
+	tc.expectOK("N1")
+	info := nextInfo()
+	if info.Name != "NOOP" || info.Tag != "N1" || info.Status != imap.StatusResponseTypeOK {
+		t.Errorf("unexpected info for NOOP: %+v", info)
+	}
+	if want := int64(len("N1 NOOP\r\n")); info.BytesRead != want {
+		t.Errorf("BytesRead = %v, want %v", info.BytesRead, want)
+	}
+	if want := int64(len("N1 OK NOOP completed\r\n")); info.BytesWritten != want {
+		t.Errorf("BytesWritten = %v, want %v", info.BytesWritten, want)
+	}
+	if info.Duration <= 0 {
+		t.Errorf("Duration = %v, want > 0", info.Duration)
+	}
+
+	tc.login()
+	if info := nextInfo(); info.Name != "LOGIN" || info.Status != imap.StatusResponseTypeOK {
+		t.Errorf("unexpected info for LOGIN: %+v", info)
+	}
+
+	tc.writeLine("S1 SELECT Nope")
+	tc.readTagged("S1")
+	if info := nextInfo(); info.Name != "SELECT" || info.Status != imap.StatusResponseTypeNo {
+		t.Errorf("unexpected info for failed SELECT: %+v", info)
+	}
+
+	tc.writeLine("X1 BOGUS")
+	tc.readTagged("X1")
+	if info := nextInfo(); info.Name != "BOGUS" || info.Status != imap.StatusResponseTypeBad {
+		t.Errorf("unexpected info for unknown command: %+v", info)
+	}
+
+	tc.appendMessage("INBOX", testMessage)
+	info = nextInfo()
+	if want := int64(len(testMessage)); info.Name != "APPEND" || info.BytesRead < want {
+		t.Errorf("unexpected info for APPEND: %+v", info)
+	}
+
+	tc.selectMailbox("INBOX")
+	nextInfo()
+	tc.writeLine("F1 UID FETCH 1 (FLAGS)")
+	tc.readTagged("F1")
+	if info := nextInfo(); info.Name != "UID FETCH" || info.Status != imap.StatusResponseTypeNo {
+		t.Errorf("unexpected info for failed FETCH: %+v", info)
+	}
+}
+
+type panickingFetchSession struct {
+	imapserver.Session
+}
+
+func (sess *panickingFetchSession) Fetch(ctx context.Context, w *imapserver.FetchWriter, kind imapserver.NumKind, seqSet imap.SeqSet, options *imap.FetchOptions) error {
+	panic("oops")
+}
+
+func TestOnCommandPanic(t *testing.T) {
+	for _, maxConcurrent := range []int{0, 2} {
+		infos := make(chan imapserver.CommandInfo, 16)
+		memServer := newTestMemServer()
+		tc := newTestServer(t, &imapserver.Options{
+			NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+				return &panickingFetchSession{memServer.NewSession()}, nil, nil
+			},
+			OnCommand: func(info imapserver.CommandInfo) {
+				if info.Name == "FETCH" {
+					infos <- info
+				}
+			},
+			StructuredLogger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+			MaxConcurrentCommands: maxConcurrent,
+		})
+		tc.login()
+		tc.appendMessage("INBOX", testMessage)
+		tc.selectMailbox("INBOX")
+
+		tc.writeLine("F1 FETCH 1 (FLAGS)")
+		select {
+		case info := <-infos:
+			if info.Status != "" {
+				t.Errorf("Status = %v, want empty", info.Status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnCommand wasn't called after panic")
+		}
+	}
+}
+
+func TestCommandPanicResponse(t *testing.T) {
+	for _, maxConcurrent := range []int{0, 2} {
+		memServer := newTestMemServer()
+		tc := newTestServer(t, &imapserver.Options{
+			NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+				return &panickingFetchSession{memServer.NewSession()}, nil, nil
+			},
+			StructuredLogger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+			MaxConcurrentCommands: maxConcurrent,
+		})
+		tc.login()
+		tc.appendMessage("INBOX", testMessage)
+		tc.selectMailbox("INBOX")
+
+		tc.writeLine("F1 FETCH 1 (FLAGS)")
+		if resp, _ := tc.readTagged("F1"); resp != "F1 NO [SERVERBUG] Internal server error" {
+			t.Errorf("unexpected response after panic: %q", resp)
+		}
+		tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := tc.br.ReadString('\n'); err != io.EOF {
+			t.Errorf("expected EOF after panic, got %v", err)
+		}
+	}
+}
+
+type incompleteStatusSession struct {
+	imapserver.Session
+}
+
+func (sess *incompleteStatusSession) Status(ctx context.Context, mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	// NumMessages is missing: writing the response panics half-way
+	return &imap.StatusData{Mailbox: mailbox}, nil
+}
+
+func TestCommandPanicDuringResponse(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &incompleteStatusSession{memServer.NewSession()}, nil, nil
+		},
+		StructuredLogger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	tc.login()
+
+	tc.writeLine("S1 STATUS INBOX (MESSAGES)")
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(tc.br)
+	if err != nil {
+		t.Fatalf("failed to read until EOF: %v", err)
+	}
+	if strings.Contains(string(b), "S1 ") {
+		t.Errorf("tagged response written in the middle of another response: %q", b)
+	}
+}
@@ -7,15 +7,15 @@ import (
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-func (c *Conn) handleStatus(dec *imapwire.Decoder) error {
+func (c *Conn) handleStatus(dec *imapwire.Decoder) (exec func() error, err error) {
 	var mailbox string
 	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) || !dec.ExpectSP() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 
 	var options imap.StatusOptions
 	recent := false
-	err := dec.ExpectList(func() error {
+	err = dec.ExpectList(func() error {
 		isRecent, err := readStatusItem(dec, &options)
 		if err != nil {
 			return err
@@ -25,23 +25,34 @@ func (c *Conn) handleStatus(dec *imapwire.Decoder) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !dec.ExpectCRLF() {
-		return dec.Err()
+		return nil, dec.Err()
 	}
 
-	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
-		return err
+	if options.HighestModSeq {
+		if err := c.enableCondStore(); err != nil {
+			return nil, err
+		}
 	}
 
-	data, err := c.session.Status(mailbox, &options)
-	if err != nil {
-		return err
-	}
+	return func() error {
+		if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+			return err
+		}
+
+		data, err := c.session.Status(c.ctx, mailbox, &options)
+		if err != nil {
+			return err
+		}
 
-	return c.writeStatus(data, &options, recent)
+		if err := c.writeStatus(data, &options, recent); err != nil {
+			return err
+		}
+		return c.writeStatusOverQuota(mailbox)
+	}, nil
 }
 
 func (c *Conn) writeStatus(data *imap.StatusData, options *imap.StatusOptions, recent bool) error {
@@ -69,18 +80,28 @@ func (c *Conn) writeStatus(data *imap.StatusData, options *imap.StatusOptions, r
 		listEnc.Item().Atom("SIZE").SP().Number64(*data.Size)
 	}
 	if options.AppendLimit {
-		listEnc.Item().Atom("APPENDLIMIT").SP()
-		if data.AppendLimit != nil {
-			enc.Number(*data.AppendLimit)
-		} else {
-			enc.NIL()
+		// Mailboxes without a specific limit are subject to the server limit
+		limit := data.AppendLimit
+		if limit == nil {
+			limit = c.server.options.appendLimitUint32()
 		}
+		listEnc.Item().Atom("APPENDLIMIT").SP().Number(*limit)
 	}
 	if options.DeletedStorage {
 		listEnc.Item().Atom("DELETED-STORAGE").SP().Number64(*data.DeletedStorage)
 	}
+	if options.HighestModSeq {
+		listEnc.Item().Atom("HIGHESTMODSEQ").SP().ModSeq(data.HighestModSeq)
+	}
+	if options.MailboxID {
+		listEnc.Item().Atom("MAILBOXID").SP().Special('(').Atom(data.MailboxID).Special(')')
+	}
 	if recent {
-		listEnc.Item().Atom("RECENT").SP().Number(0)
+		var numRecent uint32
+		if data.NumRecent != nil {
+			numRecent = *data.NumRecent
+		}
+		listEnc.Item().Atom("RECENT").SP().Number(numRecent)
 	}
 	listEnc.End()
 
@@ -109,7 +130,12 @@ func readStatusItem(dec *imapwire.Decoder, options *imap.StatusOptions) (isRecen
 		options.AppendLimit = true
 	case "DELETED-STORAGE":
 		options.DeletedStorage = true
+	case "HIGHESTMODSEQ":
+		options.HighestModSeq = true
+	case "MAILBOXID":
+		options.MailboxID = true
 	case "RECENT":
+		options.NumRecent = true
 		isRecent = true
 	default:
 		return false, &imap.Error{
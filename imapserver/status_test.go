@@ -0,0 +1,151 @@
+package imapserver_test
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func TestStatus(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:   {},
+			imap.CapStatusSize:  {},
+			imap.CapCondStore:   {},
+			imap.CapQuota:       {},
+			"QUOTA=RES-STORAGE": {},
+		},
+	})
+	tc.login()
+
+	if caps := tc.capabilities(); !hasCap(caps, "STATUS=SIZE") {
+		t.Errorf("expected STATUS=SIZE to be advertised, got %v", caps)
+	}
+
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", testMessage)
+
+	tc.writeLine("T1 STATUS INBOX (MESSAGES SIZE)")
+	untagged := tc.expectOK("T1")
+	want := fmt.Sprintf("* STATUS INBOX (MESSAGES 2 SIZE %v)", 2*len(testMessage))
+	if len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+
+	tc.selectMailbox("INBOX")
+	tc.writeLine("T2 STORE 2 +FLAGS.SILENT (\\Deleted)")
+	tc.expectOK("T2")
+
+	tc.writeLine("T3 STATUS INBOX (DELETED DELETED-STORAGE UNSEEN)")
+	untagged = tc.expectOK("T3")
+	want = fmt.Sprintf("* STATUS INBOX (UNSEEN 2 DELETED 1 DELETED-STORAGE %v)", len(testMessage))
+	if len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+
+	tc.writeLine("T4 STATUS INBOX (HIGHESTMODSEQ MAILBOXID)")
+	untagged = tc.expectOK("T4")
+	re := regexp.MustCompile(`^\* STATUS INBOX \(HIGHESTMODSEQ [0-9]+ MAILBOXID \([A-Za-z0-9_-]+\)\)$`)
+	if len(untagged) != 1 || !re.MatchString(untagged[0]) {
+		t.Errorf("unexpected STATUS response: %q", untagged)
+	}
+}
+
+func TestAppendLimit(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:   {},
+			imap.CapAppendLimit: {},
+		},
+		MaxCommandLiteralSize: map[string]int64{"APPEND": 1024},
+	})
+	tc.login()
+
+	// A bare APPENDLIMIT indicates per-mailbox limits
+	if caps := tc.capabilities(); !hasCap(caps, "APPENDLIMIT") {
+		t.Errorf("expected APPENDLIMIT to be advertised, got %v", caps)
+	}
+
+	tc.writeLine("S1 STATUS INBOX (APPENDLIMIT)")
+	if untagged := tc.expectOK("S1"); len(untagged) != 1 || untagged[0] != "* STATUS INBOX (APPENDLIMIT 1024)" {
+		t.Errorf("unexpected STATUS response: %q", untagged)
+	}
+
+	tc.writeLine("A1 APPEND INBOX {2048}")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [TOOBIG] ") {
+		t.Errorf("expected NO [TOOBIG] for oversize APPEND, got %q", resp)
+	}
+	tc.appendMessage("INBOX", testMessage)
+}
+
+func TestAppendLimitGlobal(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:            {},
+			imap.Cap("APPENDLIMIT=1024"): {},
+		},
+	})
+	tc.login()
+
+	if caps := tc.capabilities(); !hasCap(caps, "APPENDLIMIT=1024") {
+		t.Errorf("expected APPENDLIMIT=1024 to be advertised, got %v", caps)
+	}
+
+	tc.writeLine("A1 APPEND INBOX {2048}")
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [TOOBIG] ") {
+		t.Errorf("expected NO [TOOBIG] for oversize APPEND, got %q", resp)
+	}
+}
+
+type mailboxAppendLimitSession struct {
+	imapserver.Session
+	limits map[string]uint32
+}
+
+func (sess *mailboxAppendLimitSession) Status(ctx context.Context, mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	data, err := sess.Session.Status(ctx, mailbox, options)
+	if err != nil {
+		return nil, err
+	}
+	if limit, ok := sess.limits[mailbox]; ok && options.AppendLimit {
+		data.AppendLimit = &limit
+	}
+	return data, nil
+}
+
+func TestAppendLimitMailbox(t *testing.T) {
+	memServer := newTestMemServer()
+	tc := newTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &mailboxAppendLimitSession{
+				Session: memServer.NewSession(),
+				limits:  map[string]uint32{"INBOX": 10},
+			}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:   {},
+			imap.CapAppendLimit: {},
+		},
+	})
+	tc.login()
+
+	tc.writeLine("S1 STATUS INBOX (APPENDLIMIT)")
+	if untagged := tc.expectOK("S1"); len(untagged) != 1 || untagged[0] != "* STATUS INBOX (APPENDLIMIT 10)" {
+		t.Errorf("unexpected STATUS response: %q", untagged)
+	}
+
+	tc.writeLine("A1 APPEND INBOX {%v}", len(testMessage))
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 NO [TOOBIG] ") {
+		t.Errorf("expected NO [TOOBIG] for APPEND over the mailbox limit, got %q", resp)
+	}
+
+	// Other mailboxes are subject to the server limit only
+	tc.writeLine("C1 CREATE Archive")
+	tc.expectOK("C1")
+	tc.appendMessage("Archive", testMessage)
+}
@@ -1,6 +1,8 @@
 package imapserver
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/emersion/go-imap/v2"
@@ -8,12 +10,41 @@ import (
 	"github.com/emersion/go-imap/v2/internal/imapwire"
 )
 
-func (c *Conn) handleStore(dec *imapwire.Decoder, numKind NumKind) error {
+// ModifiedError is returned by Session.Store when the UNCHANGEDSINCE
+// condition isn't met for some of the messages (see RFC 7162 section 3.1.3).
+//
+// These messages must be left untouched, the other ones are updated as usual.
+type ModifiedError struct {
+	// Messages which failed the UNCHANGEDSINCE test, as sequence numbers or
+	// UIDs depending on the NumKind passed to Session.Store
+	Modified imap.SeqSet
+}
+
+var _ error = (*ModifiedError)(nil)
+
+// Error implements the error interface.
+func (err *ModifiedError) Error() string {
+	return fmt.Sprintf("imapserver: conditional STORE failed for %v", err.Modified)
+}
+
+func (c *Conn) handleStore(tag string, dec *imapwire.Decoder, numKind NumKind) error {
 	var (
-		seqSet imap.SeqSet
-		item   string
+		seqSet  imap.SeqSet
+		item    string
+		options imap.StoreOptions
 	)
-	if !dec.ExpectSP() || !dec.ExpectSeqSet(&seqSet) || !dec.ExpectSP() || !dec.ExpectAtom(&item) || !dec.ExpectSP() {
+	if !dec.ExpectSP() || !dec.ExpectSeqSet(&seqSet) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+	hasModifiers, err := dec.List(func() error {
+		return readStoreModifier(dec, &options)
+	})
+	if err != nil {
+		return err
+	} else if hasModifiers && !dec.ExpectSP() {
+		return dec.Err()
+	}
+	if !dec.ExpectAtom(&item) || !dec.ExpectSP() {
 		return dec.Err()
 	}
 	var flags []imap.Flag
@@ -43,6 +74,11 @@ func (c *Conn) handleStore(dec *imapwire.Decoder, numKind NumKind) error {
 	if !dec.ExpectCRLF() {
 		return dec.Err()
 	}
+	for _, flag := range flags {
+		if flag == imap.FlagWildcard {
+			return newClientBugError("The \\* flag can't be stored")
+		}
+	}
 
 	item = strings.ToUpper(item)
 	silent := strings.HasSuffix(item, ".SILENT")
@@ -66,13 +102,76 @@ func (c *Conn) handleStore(dec *imapwire.Decoder, numKind NumKind) error {
 
 	if err := c.checkState(imap.ConnStateSelected); err != nil {
 		return err
+	} else if err := c.checkWritable(); err != nil {
+		return err
+	}
+
+	seqSet, err = c.resolveSeqSet(numKind, seqSet)
+	if err != nil {
+		return err
+	}
+
+	if options.HasUnchangedSince {
+		if err := c.enableCondStore(); err != nil {
+			return err
+		}
 	}
 
+	unlock, err := c.lockMailboxes(c.mailbox)
+	if err != nil {
+		return err
+	}
 	w := &FetchWriter{conn: c}
-	options := imap.StoreOptions{}
-	return c.session.Store(w, numKind, seqSet, &imap.StoreFlags{
+	err = c.session.Store(c.ctx, w, numKind, seqSet, &imap.StoreFlags{
 		Op:     op,
 		Silent: silent,
 		Flags:  flags,
 	}, &options)
+	unlock()
+	var modifiedErr *ModifiedError
+	if err != nil && !errors.As(err, &modifiedErr) {
+		return err
+	}
+
+	cmdName := "STORE"
+	if numKind == NumKindUID {
+		cmdName = "UID STORE"
+	}
+	if err := c.poll(cmdName); err != nil {
+		return err
+	}
+
+	if modifiedErr != nil {
+		return c.writeModified(tag, modifiedErr.Modified)
+	}
+	return c.writeStatusResp(tag, &imap.StatusResponse{
+		Type: imap.StatusResponseTypeOK,
+		Text: fmt.Sprintf("%v completed", cmdName),
+	})
+}
+
+func (c *Conn) writeModified(tag string, seqSet imap.SeqSet) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom(tag).SP().Atom("OK").SP()
+	enc.Special('[').Atom("MODIFIED").SP().SeqSet(seqSet).Special(']')
+	enc.SP().Text("Conditional STORE failed")
+	return enc.CRLF()
+}
+
+func readStoreModifier(dec *imapwire.Decoder, options *imap.StoreOptions) error {
+	var name string
+	if !dec.ExpectAtom(&name) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+	switch strings.ToUpper(name) {
+	case "UNCHANGEDSINCE":
+		if !dec.ExpectModSeq(&options.UnchangedSince) {
+			return dec.Err()
+		}
+		options.HasUnchangedSince = true
+	default:
+		return newClientBugError("Unknown STORE modifier")
+	}
+	return nil
 }
@@ -0,0 +1,108 @@
+package imapserver_test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoreUpdatesOtherSessions(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	other := tc.newConn()
+	other.login()
+	other.selectMailbox("INBOX")
+
+	// The originating session doesn't get an echo of a silent STORE
+	tc.writeLine("T1 STORE 1 +FLAGS.SILENT (\\Seen)")
+	if untagged := tc.expectOK("T1"); len(untagged) != 0 {
+		t.Errorf("unexpected response to STORE .SILENT: %q", untagged)
+	}
+	tc.writeLine("T2 NOOP")
+	if untagged := tc.expectOK("T2"); len(untagged) != 0 {
+		t.Errorf("unexpected updates for the originating session: %q", untagged)
+	}
+
+	// Other sessions are notified
+	other.writeLine("T3 NOOP")
+	untagged := other.expectOK("T3")
+	if len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* 1 FETCH ") || !strings.Contains(strings.ToLower(untagged[0]), `flags (\seen)`) {
+		t.Errorf("expected FETCH FLAGS update, got %q", untagged)
+	}
+
+	// A non-silent STORE is only answered once to the originating session
+	tc.writeLine("T4 STORE 2 +FLAGS (\\Flagged)")
+	if untagged := tc.expectOK("T4"); len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* 2 FETCH ") {
+		t.Errorf("expected a single FETCH response, got %q", untagged)
+	}
+	other.writeLine("T5 NOOP")
+	untagged = other.expectOK("T5")
+	if len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* 2 FETCH ") || !strings.Contains(strings.ToLower(untagged[0]), `flags (\flagged)`) {
+		t.Errorf("expected FETCH FLAGS update, got %q", untagged)
+	}
+}
+
+func TestStoreFlags(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{
+			command: `STORE 1:2 +FLAGS (\Seen)`,
+			want:    []string{`* 1 fetch (uid 1 flags (\seen))`, `* 2 fetch (uid 2 flags (\seen))`},
+		},
+		{
+			command: `STORE 1 +FLAGS.SILENT (\Flagged)`,
+			want:    nil,
+		},
+		{
+			command: `STORE 1 -FLAGS (\Seen)`,
+			want:    []string{`* 1 fetch (uid 1 flags (\flagged))`},
+		},
+		{
+			command: `STORE 2 FLAGS (\Answered)`,
+			want:    []string{`* 2 fetch (uid 2 flags (\answered))`},
+		},
+		{
+			command: `STORE 2 FLAGS.SILENT ()`,
+			want:    nil,
+		},
+		{
+			command: `STORE 1 -FLAGS.SILENT \Flagged`,
+			want:    nil,
+		},
+	}
+	for _, test := range tests {
+		tc.writeLine("T1 %v", test.command)
+		// Flags are case-insensitive
+		untagged := tc.expectOK("T1")
+		for i := range untagged {
+			untagged[i] = strings.ToLower(untagged[i])
+		}
+		if strings.Join(untagged, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%v: got %q, want %q", test.command, untagged, test.want)
+		}
+	}
+
+	tc.writeLine(`T2 FETCH 1:2 (FLAGS)`)
+	want := []string{`* 1 FETCH (UID 1 FLAGS ())`, `* 2 FETCH (UID 2 FLAGS ())`}
+	if untagged := tc.expectOK("T2"); strings.Join(untagged, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+
+	for _, cmd := range []string{`STORE 1 FLAGS.LOUD (\Seen)`, `STORE 1 +KEYWORDS (\Seen)`, `STORE 1 *FLAGS (\Seen)`} {
+		tc.writeLine("T3 %v", cmd)
+		if resp, _ := tc.readTagged("T3"); !strings.HasPrefix(resp, "T3 BAD ") {
+			t.Errorf("%v: expected BAD response, got %q", cmd, resp)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package imapserver
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+func (c *Conn) handleThread(dec *imapwire.Decoder, numKind NumKind) (exec func() error, err error) {
+	var algorithm, charset string
+	if !dec.ExpectSP() || !dec.ExpectAtom(&algorithm) || !dec.ExpectSP() || !dec.ExpectAString(&charset) || !dec.ExpectSP() {
+		return nil, dec.Err()
+	}
+
+	alg := imap.ThreadAlgorithm(strings.ToUpper(algorithm))
+	if !c.supportsThreadAlgorithm(alg) {
+		return nil, newClientBugError("Unsupported THREAD algorithm")
+	}
+	charsetEnc, err := c.searchCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	var criteria imap.SearchCriteria
+	if err := c.readSearchKeyList(&criteria, dec, ""); err != nil {
+		return nil, err
+	}
+	if err := decodeSearchCriteria(&criteria, charsetEnc); err != nil {
+		return nil, err
+	}
+
+	if !dec.ExpectCRLF() {
+		return nil, dec.Err()
+	}
+
+	return func() error {
+		if err := c.checkState(imap.ConnStateSelected); err != nil {
+			return err
+		}
+
+		session, ok := c.session.(SessionThread)
+		if !ok {
+			return newClientBugError("THREAD is not supported")
+		}
+
+		if err := c.resolveSearchCriteria(&criteria); err != nil {
+			return err
+		}
+
+		threads, err := session.Thread(c.ctx, numKind, alg, &criteria)
+		if err != nil {
+			return err
+		}
+
+		return c.writeThread(threads)
+	}, nil
+}
+
+func (c *Conn) supportsThreadAlgorithm(alg imap.ThreadAlgorithm) bool {
+	for _, supported := range c.server.options.caps().ThreadAlgorithms() {
+		if alg == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conn) writeThread(threads []imap.ThreadData) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+
+	enc.Atom("*").SP().Atom("THREAD")
+	if len(threads) > 0 {
+		enc.SP()
+	}
+	for i := range threads {
+		writeThreadList(enc.Encoder, &threads[i])
+	}
+	return enc.CRLF()
+}
+
+func writeThreadList(enc *imapwire.Encoder, data *imap.ThreadData) {
+	enc.Special('(')
+	for i, num := range data.Chain {
+		if i > 0 {
+			enc.SP()
+		}
+		enc.Number(num)
+	}
+	if len(data.Chain) > 0 && len(data.SubThreads) > 0 {
+		enc.SP()
+	}
+	for i := range data.SubThreads {
+		writeThreadList(enc, &data.SubThreads[i])
+	}
+	enc.Special(')')
+}
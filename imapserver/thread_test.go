@@ -0,0 +1,87 @@
+package imapserver_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+var threadTestMessages = []struct {
+	messageID, references, subject string
+}{
+	{"<1@example.org>", "", "Hello"},
+	{"<3@example.org>", "<2@example.org>", "Re: Lost"},
+	{"<4@example.org>", "<2@example.org>", "Re: Lost"},
+	{"<5@example.org>", "<1@example.org>", "Re: Hello"},
+	{"<6@example.org>", "<2@example.org> <4@example.org>", "Re: Lost"},
+	{"<7@example.org>", "", "Re: Hello"},
+}
+
+var threadTests = []struct {
+	command string
+	resp    string
+}{
+	{"THREAD ORDEREDSUBJECT UTF-8 ALL", "* THREAD (1 (4)(6))(2 (3)(5))"},
+	{"THREAD REFERENCES UTF-8 ALL", "* THREAD (1 (4)(6))((2)(3 5))"},
+	{"THREAD REFERENCES UTF-8 1:4", "* THREAD (1 4)((2)(3))"},
+	{"THREAD REFERENCES UTF-8 2", "* THREAD (2)"},
+	{"UID THREAD REFERENCES US-ASCII 2:6", "* THREAD ((2)(3 5))((4)(6))"},
+	{"THREAD REFERENCES UTF-8 KEYWORD foo", "* THREAD"},
+}
+
+func TestThread(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:            {},
+			imap.CapThreadOrderedSubject: {},
+			imap.CapThreadReferences:     {},
+		},
+	})
+	tc.login()
+	for i, msg := range threadTestMessages {
+		s := fmt.Sprintf("Message-Id: %v\r\n"+
+			"Subject: %v\r\n"+
+			"Date: Mon, 0%v Sep 2016 19:00:00 +0900\r\n", msg.messageID, msg.subject, i+1)
+		if msg.references != "" {
+			s += fmt.Sprintf("References: %v\r\n", msg.references)
+		}
+		s += "\r\nHi!\r\n"
+		tc.appendMessage("INBOX", s)
+	}
+	tc.selectMailbox("INBOX")
+
+	for _, test := range threadTests {
+		tc.writeLine("T1 %v", test.command)
+		untagged := tc.expectOK("T1")
+		if len(untagged) != 1 || untagged[0] != test.resp {
+			t.Errorf("%v: got %q, want %q", test.command, untagged, test.resp)
+		}
+	}
+
+	tc.writeLine("T2 THREAD ORDEREDSUBJECTS UTF-8 ALL")
+	if resp, _ := tc.readTagged("T2"); resp != "T2 BAD [CLIENTBUG] Unsupported THREAD algorithm" {
+		t.Errorf("unexpected response for unsupported algorithm: %q", resp)
+	}
+}
+
+func TestThreadIMAP4rev2(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev2:        {},
+			imap.CapThreadReferences: {},
+		},
+	})
+	tc.login()
+	if caps := tc.capabilities(); !hasCap(caps, "THREAD=REFERENCES") {
+		t.Errorf("THREAD=REFERENCES isn't advertised: %v", caps)
+	}
+	tc.appendMessage("INBOX", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("T1 THREAD REFERENCES UTF-8 ALL")
+	if untagged := tc.expectOK("T1"); len(untagged) != 1 || untagged[0] != "* THREAD (1)" {
+		t.Errorf("got %q, want %q", untagged, "* THREAD (1)")
+	}
+}
@@ -16,6 +16,7 @@ type MailboxTracker struct {
 	mutex       sync.Mutex
 	numMessages uint32
 	sessions    map[*SessionTracker]struct{}
+	watchers    map[chan<- struct{}]struct{}
 }
 
 // NewMailboxTracker creates a new mailbox tracker.
@@ -23,6 +24,7 @@ func NewMailboxTracker(numMessages uint32) *MailboxTracker {
 	return &MailboxTracker{
 		numMessages: numMessages,
 		sessions:    make(map[*SessionTracker]struct{}),
+		watchers:    make(map[chan<- struct{}]struct{}),
 	}
 }
 
@@ -38,6 +40,25 @@ func (t *MailboxTracker) NewSession() *SessionTracker {
 	return st
 }
 
+// Watch registers a channel which is signalled whenever an update is queued
+// for the mailbox. This can be used to watch a mailbox which isn't selected,
+// e.g. for NOTIFY.
+//
+// Sends are non-blocking: if the channel isn't ready, the signal is dropped.
+// The caller must call Unwatch once they are done.
+func (t *MailboxTracker) Watch(ch chan<- struct{}) {
+	t.mutex.Lock()
+	t.watchers[ch] = struct{}{}
+	t.mutex.Unlock()
+}
+
+// Unwatch unregisters a channel previously registered with Watch.
+func (t *MailboxTracker) Unwatch(ch chan<- struct{}) {
+	t.mutex.Lock()
+	delete(t.watchers, ch)
+	t.mutex.Unlock()
+}
+
 func (t *MailboxTracker) queueUpdate(update *trackerUpdate, source *SessionTracker) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
@@ -55,6 +76,12 @@ func (t *MailboxTracker) queueUpdate(update *trackerUpdate, source *SessionTrack
 		}
 		st.queueUpdate(update)
 	}
+	for ch := range t.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
 
 	switch {
 	case update.expunge != 0:
@@ -72,6 +99,17 @@ func (t *MailboxTracker) QueueExpunge(seqNum uint32) {
 	t.queueUpdate(&trackerUpdate{expunge: seqNum}, nil)
 }
 
+// QueueExpungeUID queues a new EXPUNGE update for a message with a known UID.
+//
+// Sessions which have enabled QRESYNC receive a VANISHED response instead of
+// EXPUNGE.
+func (t *MailboxTracker) QueueExpungeUID(seqNum, uid uint32) {
+	if seqNum == 0 || uid == 0 {
+		panic("imapserver: invalid expunge message sequence number or UID")
+	}
+	t.queueUpdate(&trackerUpdate{expunge: seqNum, expungeUID: uid}, nil)
+}
+
 // QueueNumMessages queues a new EXISTS update.
 func (t *MailboxTracker) QueueNumMessages(n uint32) {
 	// TODO: merge consecutive NumMessages updates
@@ -99,6 +137,7 @@ func (t *MailboxTracker) QueueMessageFlags(seqNum, uid uint32, flags []imap.Flag
 
 type trackerUpdate struct {
 	expunge      uint32
+	expungeUID   uint32
 	numMessages  uint32
 	mailboxFlags []imap.Flag
 	fetch        *trackerUpdateFetch
@@ -168,9 +207,20 @@ func (t *SessionTracker) Poll(w *UpdateWriter, allowExpunge bool) error {
 	}
 	t.mutex.Unlock()
 
-	for _, update := range updates {
+	for i := 0; i < len(updates); i++ {
+		update := updates[i]
 		var err error
 		switch {
+		case update.expunge != 0 && update.expungeUID != 0:
+			// Batch consecutive expunges, so that QRESYNC clients receive a
+			// single VANISHED response
+			seqNums, uids := []uint32{update.expunge}, []uint32{update.expungeUID}
+			for i+1 < len(updates) && updates[i+1].expunge != 0 && updates[i+1].expungeUID != 0 {
+				i++
+				seqNums = append(seqNums, updates[i].expunge)
+				uids = append(uids, updates[i].expungeUID)
+			}
+			err = w.writeExpungeUIDs(seqNums, uids)
 		case update.expunge != 0:
 			err = w.WriteExpunge(update.expunge)
 		case update.numMessages != 0:
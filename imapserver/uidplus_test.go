@@ -0,0 +1,96 @@
+package imapserver_test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+func newUIDPlusTestConn(t *testing.T) *testConn {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapUIDPlus:   {},
+		},
+	})
+	tc.login()
+	tc.writeLine("C1 CREATE Archive")
+	tc.expectOK("C1")
+	return tc
+}
+
+var appendUIDRegexp = regexp.MustCompile(`^A1 OK \[APPENDUID ([0-9]+) ([0-9]+)\] `)
+
+func TestAppendUID(t *testing.T) {
+	tc := newUIDPlusTestConn(t)
+
+	for i := 1; i <= 2; i++ {
+		tc.writeLine("A1 APPEND INBOX {%v+}\r\n%v", len(testMessage), testMessage)
+		resp, _ := tc.readTagged("A1")
+		m := appendUIDRegexp.FindStringSubmatch(resp)
+		if m == nil {
+			t.Fatalf("expected APPENDUID, got %q", resp)
+		}
+		if uid := fmt.Sprint(i); m[2] != uid {
+			t.Errorf("APPENDUID returned UID %v, want %v", m[2], uid)
+		}
+	}
+}
+
+func TestCopyUID(t *testing.T) {
+	tc := newUIDPlusTestConn(t)
+
+	// Use different sizes to tell messages apart
+	for i := 1; i <= 4; i++ {
+		tc.appendMessage("INBOX", testMessage+strings.Repeat("a", i))
+	}
+	tc.appendMessage("Archive", testMessage)
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("C2 COPY 1,3:4 Archive")
+	resp, _ := tc.readTagged("C2")
+	m := regexp.MustCompile(`^C2 OK \[COPYUID [0-9]+ (\S+) (\S+)\] `).FindStringSubmatch(resp)
+	if m == nil {
+		t.Fatalf("expected COPYUID, got %q", resp)
+	}
+	if m[1] != "1,3:4" || m[2] != "2:4" {
+		t.Errorf("got COPYUID source %v and destination %v, want 1,3:4 and 2:4", m[1], m[2])
+	}
+
+	// Destination UIDs must be in the same order as source UIDs
+	tc.selectMailbox("Archive")
+	tc.writeLine("F1 UID FETCH 2:4 (RFC822.SIZE)")
+	untagged := tc.expectOK("F1")
+	want := []string{
+		fmt.Sprintf("* 2 FETCH (UID 2 RFC822.SIZE %v)", len(testMessage)+1),
+		fmt.Sprintf("* 3 FETCH (UID 3 RFC822.SIZE %v)", len(testMessage)+3),
+		fmt.Sprintf("* 4 FETCH (UID 4 RFC822.SIZE %v)", len(testMessage)+4),
+	}
+	if strings.Join(untagged, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", untagged, want)
+	}
+
+	// No COPYUID if no message has been copied
+	tc.writeLine("C3 UID COPY 42 INBOX")
+	if resp, _ := tc.readTagged("C3"); resp != "C3 OK COPY completed" {
+		t.Errorf("unexpected response for empty COPY: %q", resp)
+	}
+}
+
+func TestCopyUIDUnsupported(t *testing.T) {
+	tc := newTestServer(t, nil)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+	tc.writeLine("C1 CREATE Archive")
+	tc.expectOK("C1")
+	tc.selectMailbox("INBOX")
+
+	tc.writeLine("C2 COPY 1 Archive")
+	if resp, _ := tc.readTagged("C2"); resp != "C2 OK COPY completed" {
+		t.Errorf("expected no COPYUID without UIDPLUS, got %q", resp)
+	}
+}
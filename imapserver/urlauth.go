@@ -0,0 +1,317 @@
+package imapserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/internal/imapwire"
+)
+
+// urlAuthMechInternal is the only supported URLAUTH mechanism. Tokens are
+// computed with HMAC-SHA1 over the URL rump, keyed with the mailbox access
+// key.
+const urlAuthMechInternal = "INTERNAL"
+
+type genURLAuthRequest struct {
+	rump, mech string
+}
+
+func (c *Conn) handleGenURLAuth(dec *imapwire.Decoder) error {
+	var reqs []genURLAuthRequest
+	if !dec.ExpectSP() {
+		return dec.Err()
+	}
+	for {
+		var req genURLAuthRequest
+		if !dec.ExpectAString(&req.rump) || !dec.ExpectSP() || !dec.ExpectAtom(&req.mech) {
+			return dec.Err()
+		}
+		reqs = append(reqs, req)
+		if !dec.SP() {
+			break
+		}
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.urlAuthSession()
+	if err != nil {
+		return err
+	}
+
+	urls := make([]string, len(reqs))
+	for i, req := range reqs {
+		if !strings.EqualFold(req.mech, urlAuthMechInternal) {
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Text: "Unsupported URLAUTH mechanism",
+			}
+		}
+		u, err := parseURLAuthRump(req.rump)
+		if err != nil {
+			return err
+		}
+		// Users can only authorize access to their own mailboxes
+		if u.user != session.Username() {
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCode(fmt.Sprintf("%v %v", imap.ResponseCodeBadURL, req.rump)),
+				Text: "URL doesn't belong to the authenticated user",
+			}
+		}
+		key, err := session.URLAuthKey(c.ctx, session.Username(), u.mailbox)
+		if err != nil {
+			return err
+		}
+		urls[i] = req.rump + ":" + strings.ToLower(urlAuthMechInternal) + ":" + urlAuthToken(key, req.rump)
+	}
+
+	return c.writeGenURLAuth(urls)
+}
+
+func (c *Conn) handleURLFetch(dec *imapwire.Decoder) error {
+	var urls []string
+	if !dec.ExpectSP() {
+		return dec.Err()
+	}
+	for {
+		var u string
+		if !dec.ExpectAString(&u) {
+			return dec.Err()
+		}
+		urls = append(urls, u)
+		if !dec.SP() {
+			break
+		}
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.urlAuthSession()
+	if err != nil {
+		return err
+	}
+
+	data := make([][]byte, len(urls))
+	for i, u := range urls {
+		data[i], err = c.urlFetch(session, u)
+		if err != nil {
+			return err
+		}
+	}
+	return c.writeURLFetch(urls, data)
+}
+
+// urlFetch returns the data referenced by a URLAUTH-authorized URL, or nil if
+// the URL is invalid or the access isn't authorized.
+//
+// Access is checked against the access identifier of the URL, which allows
+// the owner to delegate access to other users (e.g. a submission server).
+func (c *Conn) urlFetch(session SessionURLAuth, rawURL string) ([]byte, error) {
+	// The URL ends with ":<mechanism>:<token>"
+	i := strings.LastIndexByte(rawURL, ':')
+	if i < 0 {
+		return nil, nil
+	}
+	rumpMech, token := rawURL[:i], rawURL[i+1:]
+	i = strings.LastIndexByte(rumpMech, ':')
+	if i < 0 {
+		return nil, nil
+	}
+	rump, mech := rumpMech[:i], rumpMech[i+1:]
+	if !strings.EqualFold(mech, urlAuthMechInternal) {
+		return nil, nil
+	}
+
+	u, err := parseURLAuthRump(rump)
+	if err != nil {
+		return nil, nil
+	}
+	switch access := strings.ToLower(u.access); {
+	case access == "anonymous", access == "authuser":
+		// always granted to authenticated users
+	case strings.HasPrefix(access, "user+"), strings.HasPrefix(access, "submit+"):
+		_, name, _ := strings.Cut(u.access, "+")
+		if name != session.Username() {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	if !u.expire.IsZero() && !c.server.options.now().Before(u.expire) {
+		return nil, nil
+	}
+
+	var imapErr *imap.Error
+	key, err := session.URLAuthKey(c.ctx, u.user, u.mailbox)
+	if errors.As(err, &imapErr) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(strings.ToLower(token)), []byte(urlAuthToken(key, rump))) {
+		return nil, nil
+	}
+
+	b, err := session.FetchURL(c.ctx, u.user, u.path)
+	if errors.As(err, &imapErr) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (c *Conn) handleResetKey(dec *imapwire.Decoder) error {
+	var mailbox string
+	if dec.SP() {
+		if !dec.ExpectMailbox(&mailbox) {
+			return dec.Err()
+		}
+		for dec.SP() {
+			var mech string
+			if !dec.ExpectAtom(&mech) {
+				return dec.Err()
+			}
+			if !strings.EqualFold(mech, urlAuthMechInternal) {
+				return &imap.Error{
+					Type: imap.StatusResponseTypeNo,
+					Text: "Unsupported URLAUTH mechanism",
+				}
+			}
+		}
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	session, err := c.urlAuthSession()
+	if err != nil {
+		return err
+	}
+	return session.ResetURLAuthKey(c.ctx, mailbox)
+}
+
+func (c *Conn) urlAuthSession() (SessionURLAuth, error) {
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return nil, err
+	}
+	session, ok := c.session.(SessionURLAuth)
+	if !ok || !c.server.options.caps().Has(imap.CapURLAuth) {
+		return nil, newClientBugError("URLAUTH is not supported")
+	}
+	return session, nil
+}
+
+func (c *Conn) writeURLFetch(urls []string, data [][]byte) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("URLFETCH")
+	for i, u := range urls {
+		enc.SP().String(u).SP()
+		if data[i] == nil {
+			enc.NIL()
+		} else {
+			enc.String(string(data[i]))
+		}
+	}
+	return enc.CRLF()
+}
+
+func (c *Conn) writeGenURLAuth(urls []string) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("GENURLAUTH")
+	for _, u := range urls {
+		enc.SP().String(u)
+	}
+	return enc.CRLF()
+}
+
+// urlAuthURL is a parsed URLAUTH-authorized URL rump, e.g.
+// "imap://joe@example.org/INBOX/;uid=20;urlauth=anonymous".
+type urlAuthURL struct {
+	user    string
+	mailbox string
+	path    string // server-relative URL, without EXPIRE and URLAUTH
+	expire  time.Time
+	access  string
+}
+
+func parseURLAuthRump(rump string) (*urlAuthURL, error) {
+	badURL := &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCode(fmt.Sprintf("%v %v", imap.ResponseCodeBadURL, rump)),
+		Text: "Invalid URLAUTH URL",
+	}
+
+	lower := strings.ToLower(rump)
+	i := strings.LastIndex(lower, ";urlauth=")
+	if i < 0 {
+		return nil, badURL
+	}
+	// The rump must not already contain a mechanism and token
+	access := rump[i+len(";urlauth="):]
+	if access == "" || strings.Contains(access, ":") {
+		return nil, badURL
+	}
+	rump, lower = rump[:i], lower[:i]
+
+	var expire time.Time
+	if i := strings.LastIndex(lower, ";expire="); i >= 0 {
+		var err error
+		expire, err = time.Parse(time.RFC3339, rump[i+len(";expire="):])
+		if err != nil {
+			return nil, badURL
+		}
+		rump = rump[:i]
+	}
+
+	rest, ok := strings.CutPrefix(rump, "imap://")
+	if !ok {
+		return nil, badURL
+	}
+	authority, path, ok := strings.Cut(rest, "/")
+	if !ok {
+		return nil, badURL
+	}
+	userinfo, _, ok := strings.Cut(authority, "@")
+	if !ok {
+		return nil, badURL
+	}
+	// Strip the optional ";AUTH=<mechanism>"
+	userinfo, _, _ = strings.Cut(userinfo, ";")
+	user, err := url.PathUnescape(userinfo)
+	if err != nil || user == "" {
+		return nil, badURL
+	}
+
+	// The mailbox name may contain the hierarchy separator, so it extends up
+	// to the first parameter
+	rawMbox, _, _ := strings.Cut(path, ";")
+	mailbox, err := url.PathUnescape(strings.TrimSuffix(rawMbox, "/"))
+	if err != nil || mailbox == "" {
+		return nil, badURL
+	}
+
+	return &urlAuthURL{
+		user:    user,
+		mailbox: mailbox,
+		path:    "/" + path,
+		expire:  expire,
+		access:  access,
+	}, nil
+}
+
+func urlAuthToken(key []byte, rump string) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(rump))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,236 @@
+package imapserver_test
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+const testSubmitUsername = "submit-server"
+
+// urlAuthBackend stores the URLAUTH access keys of all users.
+type urlAuthBackend struct {
+	mutex sync.Mutex
+	users map[string]*imapmemserver.User
+	keys  map[string][]byte // indexed by "<user>/<mailbox>"
+}
+
+func newURLAuthBackend() (*imapmemserver.Server, *urlAuthBackend) {
+	memServer := imapmemserver.New()
+	be := &urlAuthBackend{
+		users: make(map[string]*imapmemserver.User),
+		keys:  make(map[string][]byte),
+	}
+	for _, username := range []string{testUsername, testSubmitUsername} {
+		user := imapmemserver.NewUser(username, testPassword)
+		user.Create(context.Background(), "INBOX", nil)
+		memServer.AddUser(user)
+		be.users[username] = user
+	}
+	return memServer, be
+}
+
+type urlAuthSession struct {
+	imapserver.Session
+	be       *urlAuthBackend
+	username string
+}
+
+func (sess *urlAuthSession) Login(ctx context.Context, username, password string) error {
+	if err := sess.Session.Login(ctx, username, password); err != nil {
+		return err
+	}
+	sess.username = username
+	return nil
+}
+
+func (sess *urlAuthSession) URLAuthKey(ctx context.Context, owner, mailbox string) ([]byte, error) {
+	sess.be.mutex.Lock()
+	defer sess.be.mutex.Unlock()
+	if _, ok := sess.be.users[owner]; !ok {
+		return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Text: "No such user"}
+	}
+	if key, ok := sess.be.keys[owner+"/"+mailbox]; ok {
+		return key, nil
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	sess.be.keys[owner+"/"+mailbox] = key
+	return key, nil
+}
+
+func (sess *urlAuthSession) ResetURLAuthKey(ctx context.Context, mailbox string) error {
+	sess.be.mutex.Lock()
+	defer sess.be.mutex.Unlock()
+	for k := range sess.be.keys {
+		if owner, name, _ := strings.Cut(k, "/"); owner == sess.username && (mailbox == "" || name == mailbox) {
+			delete(sess.be.keys, k)
+		}
+	}
+	return nil
+}
+
+func (sess *urlAuthSession) Username() string {
+	return sess.username
+}
+
+func (sess *urlAuthSession) FetchURL(ctx context.Context, owner, url string) ([]byte, error) {
+	user, ok := sess.be.users[owner]
+	if !ok {
+		return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Text: "No such user"}
+	}
+	return user.ResolveURL(ctx, url)
+}
+
+func newURLAuthTestServer(t *testing.T) string {
+	memServer, be := newURLAuthBackend()
+	_, addr := startTestServer(t, &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &urlAuthSession{Session: memServer.NewSession(), be: be}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapURLAuth:   {},
+		},
+	})
+	return addr
+}
+
+func TestGenURLAuth(t *testing.T) {
+	tc := dialTestServer(t, newURLAuthTestServer(t))
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	if caps := tc.capabilities(); !hasCap(caps, "URLAUTH") {
+		t.Errorf("URLAUTH isn't advertised: %v", caps)
+	}
+
+	const rump = "imap://test-user@example.org/INBOX/;uid=1/;section=TEXT;urlauth=submit+test-user"
+	re := regexp.MustCompile(`^\* GENURLAUTH "(.*)"$`)
+	genURLAuth := func() string {
+		tc.writeLine(`A1 GENURLAUTH "%v" INTERNAL`, rump)
+		return findSubmatch(t, tc.expectOK("A1"), re)
+	}
+	urlFetch := func(url string) string {
+		tc.writeLine(`A2 URLFETCH "%v"`, url)
+		return strings.Join(tc.expectOK("A2"), "\r\n")
+	}
+
+	url := genURLAuth()
+	if !strings.HasPrefix(url, rump+":internal:") {
+		t.Fatalf("unexpected URL %q", url)
+	}
+	if again := genURLAuth(); again != url {
+		t.Errorf("GENURLAUTH isn't stable: got %q, then %q", url, again)
+	}
+
+	want := fmt.Sprintf("* URLFETCH %q {14}\r\nWho are you?\r\n", url)
+	if got := urlFetch(url); got != want {
+		t.Errorf("URLFETCH: got %q, want %q", got, want)
+	}
+
+	// Tampered URLs aren't resolved
+	last := "0"
+	if strings.HasSuffix(url, last) {
+		last = "1"
+	}
+	for _, u := range []string{
+		url[:len(url)-1] + last,
+		strings.Replace(url, "uid=1", "uid=2", 1),
+		strings.Replace(url, "submit+test-user", "anonymous", 1),
+	} {
+		if got, want := urlFetch(u), fmt.Sprintf("* URLFETCH %q NIL", u); got != want {
+			t.Errorf("URLFETCH: got %q, want %q", got, want)
+		}
+	}
+
+	// Resetting the key invalidates the URL
+	tc.writeLine("A3 RESETKEY INBOX INTERNAL")
+	tc.expectOK("A3")
+	if got, want := urlFetch(url), fmt.Sprintf("* URLFETCH %q NIL", url); got != want {
+		t.Errorf("URLFETCH after RESETKEY: got %q, want %q", got, want)
+	}
+	if reset := genURLAuth(); reset == url {
+		t.Errorf("expected a different URL after RESETKEY")
+	}
+
+	for _, cmd := range []string{
+		`GENURLAUTH "imap://test-user@example.org/INBOX/;uid=1" INTERNAL`,
+		`GENURLAUTH "` + rump + `" HMAC-SHA1`,
+		`GENURLAUTH "imap://other-user@example.org/INBOX/;uid=1;urlauth=anonymous" INTERNAL`,
+	} {
+		tc.writeLine("A4 %v", cmd)
+		if resp, _ := tc.readTagged("A4"); !strings.HasPrefix(resp, "A4 NO ") {
+			t.Errorf("%v: expected NO, got %q", cmd, resp)
+		}
+	}
+}
+
+func TestURLFetchDelegated(t *testing.T) {
+	addr := newURLAuthTestServer(t)
+	tc := dialTestServer(t, addr)
+	tc.login()
+	tc.appendMessage("INBOX", testMessage)
+
+	genURLAuth := func(rump string) string {
+		tc.writeLine(`A1 GENURLAUTH "%v" INTERNAL`, rump)
+		return findSubmatch(t, tc.expectOK("A1"), regexp.MustCompile(`^\* GENURLAUTH "(.*)"$`))
+	}
+	const base = "imap://test-user@example.org/INBOX/;uid=1/;section=TEXT;urlauth="
+	submitURL := genURLAuth(base + "submit+" + testSubmitUsername)
+	userURL := genURLAuth(base + "user+" + testUsername)
+	anonURL := genURLAuth(base + "anonymous")
+
+	// The submission server fetches the URL on behalf of the owner
+	submit := dialTestServer(t, addr)
+	submit.writeLine("A1 LOGIN %v %v", testSubmitUsername, testPassword)
+	submit.expectOK("A1")
+	for _, test := range []struct {
+		url string
+		ok  bool
+	}{
+		{submitURL, true},
+		{anonURL, true},
+		{userURL, false},
+	} {
+		submit.writeLine(`A2 URLFETCH "%v"`, test.url)
+		got := strings.Join(submit.expectOK("A2"), "\r\n")
+		want := fmt.Sprintf("* URLFETCH %q NIL", test.url)
+		if test.ok {
+			want = fmt.Sprintf("* URLFETCH %q {14}\r\nWho are you?\r\n", test.url)
+		}
+		if got != want {
+			t.Errorf("URLFETCH: got %q, want %q", got, want)
+		}
+	}
+
+	// The owner can't fetch a URL delegated to someone else
+	tc.writeLine(`A2 URLFETCH "%v"`, submitURL)
+	if got, want := strings.Join(tc.expectOK("A2"), "\r\n"), fmt.Sprintf("* URLFETCH %q NIL", submitURL); got != want {
+		t.Errorf("URLFETCH: got %q, want %q", got, want)
+	}
+}
+
+func TestURLAuthUnsupportedSession(t *testing.T) {
+	tc := newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapURLAuth:   {},
+		},
+	})
+	tc.login()
+
+	if caps := tc.capabilities(); hasCap(caps, "URLAUTH") {
+		t.Errorf("URLAUTH advertised without SessionURLAuth: %v", caps)
+	}
+}
@@ -0,0 +1,58 @@
+package imapserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+const testUTF8Message = "From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+	"Subject: Kimi no na wa, 君の名は\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Who are you?\r\n"
+
+func newUTF8TestServer(t *testing.T) *testConn {
+	return newTestServer(t, &imapserver.Options{
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:  {},
+			imap.CapUTF8Accept: {},
+		},
+	})
+}
+
+func TestAppendUTF8(t *testing.T) {
+	tc := newUTF8TestServer(t)
+	tc.login()
+
+	tc.writeLine("E1 ENABLE UTF8=ACCEPT")
+	if untagged := tc.expectOK("E1"); len(untagged) != 1 || untagged[0] != "* ENABLED UTF8=ACCEPT" {
+		t.Fatalf("unexpected ENABLE response: %q", untagged)
+	}
+
+	tc.writeLine("A1 APPEND INBOX (\\Seen) UTF8 (~{%v+}\r\n%v)", len(testUTF8Message), testUTF8Message)
+	tc.expectOK("A1")
+
+	tc.selectMailbox("INBOX")
+	tc.writeLine("S2 SEARCH SUBJECT \"君の名は\"")
+	if untagged := tc.expectOK("S2"); len(untagged) != 1 || untagged[0] != "* SEARCH 1" {
+		t.Errorf("expected message 1 to match, got %q", untagged)
+	}
+
+	tc.writeLine("S3 SEARCH CHARSET UTF-8 SUBJECT \"君の名は\"")
+	if resp, _ := tc.readTagged("S3"); !strings.HasPrefix(resp, "S3 BAD ") {
+		t.Errorf("expected BAD for SEARCH CHARSET, got %q", resp)
+	}
+}
+
+func TestAppendUTF8NotEnabled(t *testing.T) {
+	tc := newUTF8TestServer(t)
+	tc.login()
+
+	tc.writeLine("A1 APPEND INBOX UTF8 (~{%v}", len(testUTF8Message))
+	if resp, _ := tc.readTagged("A1"); !strings.HasPrefix(resp, "A1 BAD [CLIENTBUG] ") {
+		t.Errorf("expected BAD [CLIENTBUG], got %q", resp)
+	}
+}
@@ -0,0 +1,327 @@
+package imapserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the client key to compute the
+// Sec-WebSocket-Accept header field, see RFC 6455 section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketProtocol is the WebSocket sub-protocol defined in RFC 7395.
+const websocketProtocol = "imap"
+
+// WebSocket frame opcodes, see RFC 6455 section 5.2.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// wsMaxControlPayload is the maximum payload size of a control frame.
+const wsMaxControlPayload = 125
+
+// wsCloseTimeout is the maximum duration to send a close frame.
+const wsCloseTimeout = 5 * time.Second
+
+// WebSocketHandler returns an HTTP handler serving IMAP over WebSocket, as
+// defined in RFC 7395.
+//
+// Clients must request the "imap" sub-protocol. Each WebSocket message
+// carries IMAP data, and the connection is otherwise handled like a
+// connection accepted by Serve. If the HTTP server uses TLS, the connection is
+// considered secure and STARTTLS isn't available. Cross-origin requests are
+// rejected, see Options.CheckWebSocketOrigin.
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(s.serveWebSocket)
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing WebSocket key", http.StatusBadRequest)
+		return
+	}
+	if !headerHasToken(req.Header, "Sec-WebSocket-Protocol", websocketProtocol) {
+		http.Error(w, "Expected the imap WebSocket sub-protocol", http.StatusBadRequest)
+		return
+	}
+	checkOrigin := s.options.CheckWebSocketOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(req) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	closed := s.closed
+	if !closed {
+		s.connWaitGroup.Add(1)
+	}
+	s.mutex.Unlock()
+	if closed {
+		http.Error(w, "Server closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.connWaitGroup.Done()
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		s.logger.Warn("failed to hijack WebSocket connection", "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %v\r\n"+
+		"Sec-WebSocket-Protocol: %v\r\n"+
+		"\r\n", websocketAccept(key), websocketProtocol)
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	s.serveConn(&wsConn{Conn: conn, br: brw.Reader, tls: req.TLS})
+}
+
+// checkSameOrigin accepts requests without an Origin header field, sent by
+// clients other than browsers, and requests whose origin matches the Host
+// header field.
+func checkSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken checks whether a comma-separated header field contains a
+// token, case-insensitively.
+func headerHasToken(h http.Header, k, token string) bool {
+	for _, v := range h.Values(k) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a net.Conn carrying data in WebSocket messages. Data written to
+// the connection is sent in binary messages.
+type wsConn struct {
+	net.Conn
+	br  *bufio.Reader
+	tls *tls.ConnectionState // nil if the HTTP connection isn't encrypted
+
+	// Current data frame
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+	fragment  bool // in a message whose final frame hasn't been received
+
+	writeMutex sync.Mutex
+	closeSent  bool
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.readFrameHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	for i := range b[:n] {
+		b[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % len(c.mask)
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// readFrameHeader reads frames until the start of a data frame. Control
+// frames are handled.
+func (c *wsConn) readFrameHeader() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0x0F
+	if hdr[0]&0x70 != 0 {
+		return errors.New("websocket: unexpected reserved bits")
+	}
+	if hdr[1]&0x80 == 0 {
+		return errors.New("websocket: client frame isn't masked")
+	}
+
+	size := int64(hdr[1] & 0x7F)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint64(b[:]))
+		if size < 0 {
+			return errors.New("websocket: invalid payload length")
+		}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return err
+	}
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		if (op == wsOpContinuation) != c.fragment {
+			return errors.New("websocket: unexpected continuation frame")
+		}
+		c.fragment = !fin
+		c.remaining = size
+		c.mask = mask
+		c.maskPos = 0
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		// handled below
+	default:
+		return fmt.Errorf("websocket: unknown opcode %v", op)
+	}
+
+	if !fin || size > wsMaxControlPayload {
+		return errors.New("websocket: invalid control frame")
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%len(mask)]
+	}
+
+	switch op {
+	case wsOpClose:
+		// Echo the status code, if any
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		c.writeFrame(wsOpClose, payload)
+		return io.EOF
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	}
+	return nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *wsConn) writeFrameLocked(op byte, payload []byte) error {
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == wsOpClose {
+		c.closeSent = true
+	}
+
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	buffers := net.Buffers{hdr, payload}
+	_, err := buffers.WriteTo(c.Conn)
+	return err
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		// Send a normal closure frame, unless a write is blocked
+		if c.writeMutex.TryLock() {
+			c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+			c.writeFrameLocked(wsOpClose, []byte{0x03, 0xE8})
+			c.writeMutex.Unlock()
+		}
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,270 @@
+package imapserver_test
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// wsTestConn is a minimal WebSocket client.
+type wsTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	// lines contains the payload of received messages
+	lines *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, url, protocol string) (*wsTestConn, *http.Response) {
+	return dialWebSocketHeader(t, url, http.Header{"Sec-Websocket-Protocol": {protocol}})
+}
+
+// dialWebSocketHeader opens a WebSocket connection with additional header
+// fields. URLs starting with "https://" are dialed with TLS.
+func dialWebSocketHeader(t *testing.T, url string, header http.Header) (*wsTestConn, *http.Response) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if addr, ok := strings.CutPrefix(url, "https://"); ok {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	}
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\n"+
+		"Host: example.org\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n")
+	header.Write(conn)
+	io.WriteString(conn, "\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse() = %v", err)
+	}
+	wc := &wsTestConn{t: t, conn: conn, br: br}
+	wc.lines = bufio.NewReader(readerFunc(wc.readMessage))
+	return wc, resp
+}
+
+type readerFunc func(b []byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// readMessage reads a single data frame.
+func (wc *wsTestConn) readMessage(b []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(wc.br, hdr[:]); err != nil {
+		return 0, err
+	}
+	if op := hdr[0] & 0x0F; op != 0x2 {
+		return 0, fmt.Errorf("unexpected opcode %v", op)
+	}
+	size := int(hdr[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(wc.br, ext[:]); err != nil {
+			return 0, err
+		}
+		size = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		return 0, fmt.Errorf("message too large")
+	}
+	if size > len(b) {
+		return 0, fmt.Errorf("message too large")
+	}
+	return io.ReadFull(wc.br, b[:size])
+}
+
+func (wc *wsTestConn) writeMessage(s string) {
+	wc.writeFrame(0x82, s)
+}
+
+// writeFrame writes a masked frame. b0 contains the FIN bit and the opcode.
+func (wc *wsTestConn) writeFrame(b0 byte, s string) {
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		wc.t.Fatalf("rand.Read() = %v", err)
+	}
+	frame := []byte{b0, 0x80 | byte(len(s))}
+	frame = append(frame, mask[:]...)
+	for i := 0; i < len(s); i++ {
+		frame = append(frame, s[i]^mask[i%len(mask)])
+	}
+	if _, err := wc.conn.Write(frame); err != nil {
+		wc.t.Fatalf("failed to write frame: %v", err)
+	}
+}
+
+func (wc *wsTestConn) readLine() string {
+	line, err := wc.lines.ReadString('\n')
+	if err != nil {
+		wc.t.Fatalf("failed to read line: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func startWebSocketTestServer(t *testing.T) string {
+	memServer := newTestMemServer()
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		InsecureAuth: true,
+	})
+	httpServer := httptest.NewServer(server.WebSocketHandler())
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Close()
+	})
+	return httpServer.URL
+}
+
+func TestWebSocket(t *testing.T) {
+	url := startWebSocketTestServer(t)
+
+	wc, resp := dialWebSocket(t, url, "imap")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// Example from RFC 6455 section 1.3
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("got Sec-WebSocket-Accept %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "imap" {
+		t.Errorf("got Sec-WebSocket-Protocol %q, want %q", got, "imap")
+	}
+
+	if greeting := wc.readLine(); !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+
+	// Commands may be split across messages
+	wc.writeMessage("A1 LOGIN " + testUsername)
+	wc.writeMessage(" " + testPassword + "\r\n")
+	if line := wc.readLine(); !strings.HasPrefix(line, "A1 OK ") {
+		t.Fatalf("unexpected LOGIN response: %q", line)
+	}
+
+	wc.writeMessage("A2 CAPABILITY\r\n")
+	if line := wc.readLine(); !strings.HasPrefix(line, "* CAPABILITY IMAP4rev1") {
+		t.Errorf("unexpected CAPABILITY response: %q", line)
+	}
+	if line := wc.readLine(); !strings.HasPrefix(line, "A2 OK ") {
+		t.Errorf("unexpected CAPABILITY status: %q", line)
+	}
+}
+
+func TestWebSocketMissingProtocol(t *testing.T) {
+	url := startWebSocketTestServer(t)
+
+	_, resp := dialWebSocket(t, url, "chat")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	memServer := newTestMemServer()
+	infos := make(chan *imapserver.ConnInfo, 1)
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			infos <- conn.Info()
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:      imap.CapSet{imap.CapIMAP4rev1: {}},
+		TLSConfig: newTestTLSConfig(t),
+	})
+	httpServer := httptest.NewTLSServer(server.WebSocketHandler())
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Close()
+	})
+
+	wc, resp := dialWebSocket(t, httpServer.URL, "imap")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	greeting := wc.readLine()
+	if !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+	if strings.Contains(greeting, "LOGINDISABLED") || strings.Contains(greeting, "STARTTLS") {
+		t.Errorf("TLS connection isn't detected: %q", greeting)
+	}
+	if info := <-infos; info.TLS == nil {
+		t.Errorf("missing TLS connection state")
+	}
+
+	wc.writeMessage("A1 LOGIN " + testUsername + " " + testPassword + "\r\n")
+	if line := wc.readLine(); !strings.HasPrefix(line, "A1 OK ") {
+		t.Fatalf("unexpected LOGIN response: %q", line)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	url := startWebSocketTestServer(t)
+
+	_, resp := dialWebSocketHeader(t, url, http.Header{
+		"Sec-Websocket-Protocol": {"imap"},
+		"Origin":                 {"https://attacker.example"},
+	})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusForbidden)
+	}
+
+	_, resp = dialWebSocketHeader(t, url, http.Header{
+		"Sec-Websocket-Protocol": {"imap"},
+		"Origin":                 {"https://example.org"},
+	})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestWebSocketUnexpectedContinuation(t *testing.T) {
+	url := startWebSocketTestServer(t)
+
+	wc, _ := dialWebSocket(t, url, "imap")
+	if greeting := wc.readLine(); !strings.HasPrefix(greeting, "* OK ") {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+
+	// Continuation frame without an initial data frame
+	wc.writeFrame(0x80, "A1 NOOP\r\n")
+	wc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := wc.lines.ReadString('\n')
+		if err != nil {
+			break // connection closed
+		}
+		if strings.HasPrefix(line, "A1 ") {
+			t.Fatalf("continuation frame was accepted: %q", line)
+		}
+	}
+}
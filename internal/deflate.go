@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// NewDeflateReadWriter wraps a reader and a writer with DEFLATE compression,
+// as defined in RFC 4978.
+//
+// Each write is immediately flushed, so that the other side receives complete
+// responses.
+func NewDeflateReadWriter(r io.Reader, w io.Writer) io.ReadWriter {
+	fw, err := flate.NewWriter(w, flate.DefaultCompression)
+	if err != nil {
+		panic(err) // unreachable: the compression level is valid
+	}
+	return &deflateReadWriter{r: flate.NewReader(r), w: fw}
+}
+
+type deflateReadWriter struct {
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+func (rw *deflateReadWriter) Read(b []byte) (int, error) {
+	n, err := rw.r.Read(b)
+	if err == io.ErrUnexpectedEOF {
+		// The connection has been closed without terminating the stream
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (rw *deflateReadWriter) Write(b []byte) (int, error) {
+	n, err := rw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, rw.w.Flush()
+}
@@ -2,6 +2,7 @@ package imapwire
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -31,6 +32,9 @@ func (err *DecoderExpectError) Error() string {
 	return fmt.Sprintf("imapwire: %v", err.Message)
 }
 
+// ErrLineTooLong is returned when a line exceeds Decoder.MaxLineSize.
+var ErrLineTooLong = errors.New("imapwire: line too long")
+
 // A Decoder reads IMAP data.
 //
 // There are multiple families of methods:
@@ -43,12 +47,18 @@ type Decoder struct {
 	// CheckBufferedLiteralFunc is called when a literal is about to be decoded
 	// and needs to be fully buffered in memory.
 	CheckBufferedLiteralFunc func(size int64, nonSync bool) error
+	// MaxLineSize is the maximum number of bytes in a line, excluding the
+	// contents of literals. If zero, lines are unlimited.
+	MaxLineSize int64
+	// StrictCRLF rejects lines terminated by a lone LF instead of CRLF.
+	StrictCRLF bool
 
-	r       *bufio.Reader
-	side    ConnSide
-	err     error
-	literal bool
-	crlf    bool
+	r        *bufio.Reader
+	side     ConnSide
+	err      error
+	literal  bool
+	crlf     bool
+	lineSize int64
 }
 
 // NewDecoder creates a new decoder.
@@ -89,6 +99,14 @@ func (dec *Decoder) readByte() (byte, bool) {
 		}
 		return b, dec.returnErr(err)
 	}
+	if b == '\n' {
+		dec.lineSize = 0
+	} else {
+		dec.lineSize++
+		if dec.MaxLineSize > 0 && dec.lineSize > dec.MaxLineSize {
+			return b, dec.returnErr(ErrLineTooLong)
+		}
+	}
 	return b, true
 }
 
@@ -147,7 +165,10 @@ func (dec *Decoder) ExpectSP() bool {
 }
 
 func (dec *Decoder) CRLF() bool {
-	dec.acceptByte('\r') // be liberal in what we receive and accept lone LF
+	// Unless strict, be liberal in what we receive and accept lone LF
+	if !dec.acceptByte('\r') && dec.StrictCRLF {
+		return false
+	}
 	if !dec.acceptByte('\n') {
 		return false
 	}
@@ -241,9 +262,22 @@ func (dec *Decoder) DiscardLine() {
 	if dec.crlf {
 		return
 	}
-	var text string
-	dec.Text(&text)
-	dec.CRLF()
+	// Don't buffer the line, and don't stop at MaxLineSize: the line may be
+	// discarded because it's too long
+	maxLineSize := dec.MaxLineSize
+	dec.MaxLineSize = 0
+	defer func() {
+		dec.MaxLineSize = maxLineSize
+	}()
+	for {
+		b, ok := dec.readByte()
+		if !ok {
+			return
+		} else if b == '\n' {
+			dec.crlf = true
+			return
+		}
+	}
 }
 
 func (dec *Decoder) DiscardValue() bool {
@@ -324,6 +358,23 @@ func (dec *Decoder) ExpectNumber64(ptr *int64) bool {
 	return dec.Expect(dec.Number64(ptr), "number64")
 }
 
+func (dec *Decoder) ModSeq(ptr *uint64) bool {
+	s, ok := dec.numberStr()
+	if !ok {
+		return false
+	}
+	v, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return false // can happen on overflow
+	}
+	*ptr = v
+	return true
+}
+
+func (dec *Decoder) ExpectModSeq(ptr *uint64) bool {
+	return dec.Expect(dec.ModSeq(ptr), "mod-sequence")
+}
+
 func (dec *Decoder) Quoted(ptr *string) bool {
 	if !dec.Special('"') {
 		return false
@@ -337,6 +388,8 @@ func (dec *Decoder) Quoted(ptr *string) bool {
 
 		if ch == '"' {
 			break
+		} else if ch == '\r' || ch == '\n' {
+			return dec.returnErr(&DecoderExpectError{Message: "unexpected line break in quoted string"})
 		}
 
 		if ch == '\\' {
@@ -358,6 +411,8 @@ func (dec *Decoder) ExpectAString(ptr *string) bool {
 	}
 	if dec.Literal(ptr) {
 		return true
+	} else if dec.err != nil {
+		return false
 	}
 	// TODO: accept unquoted resp-specials
 	return dec.ExpectAtom(ptr)
@@ -454,10 +509,11 @@ func (dec *Decoder) ExpectMailbox(ptr *string) bool {
 		return true
 	}
 	name, err := utf7.Encoding.NewDecoder().String(name)
-	if err == nil {
-		*ptr = name
+	if err != nil {
+		return dec.returnErr(&DecoderExpectError{Message: "invalid mailbox name: " + err.Error()})
 	}
-	return dec.returnErr(err)
+	*ptr = name
+	return true
 }
 
 func (dec *Decoder) ExpectSeqSet(ptr *imap.SeqSet) bool {
@@ -489,7 +545,7 @@ func (dec *Decoder) Literal(ptr *string) bool {
 	if dec.CheckBufferedLiteralFunc != nil {
 		if err := dec.CheckBufferedLiteralFunc(lit.Size(), nonSync); err != nil {
 			lit.cancel()
-			return false
+			return dec.returnErr(err)
 		}
 	}
 	var sb strings.Builder
@@ -531,6 +587,14 @@ func (dec *Decoder) ExpectLiteralReader() (lit *LiteralReader, nonSync bool, err
 	return lit, nonSync, nil
 }
 
+// ExpectLiteral8Reader reads a literal8, as defined in RFC 3516.
+func (dec *Decoder) ExpectLiteral8Reader() (lit *LiteralReader, nonSync bool, err error) {
+	if !dec.ExpectSpecial('~') {
+		return nil, false, dec.Err()
+	}
+	return dec.ExpectLiteralReader()
+}
+
 type LiteralReader struct {
 	dec  *Decoder
 	size int64
@@ -551,6 +615,10 @@ func (lit *LiteralReader) Size() int64 {
 func (lit *LiteralReader) Read(b []byte) (int, error) {
 	n, err := lit.r.Read(b)
 	if err == io.EOF {
+		// The underlying reader may end before the literal does
+		if lr, ok := lit.r.(*io.LimitedReader); ok && lr.N > 0 {
+			err = io.ErrUnexpectedEOF
+		}
 		lit.cancel()
 	}
 	return n, err
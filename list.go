@@ -5,10 +5,12 @@ type ListOptions struct {
 	SelectSubscribed     bool
 	SelectRemote         bool
 	SelectRecursiveMatch bool // requires SelectSubscribed to be set
+	SelectSpecialUse     bool // requires SPECIAL-USE
 
 	ReturnSubscribed bool
 	ReturnChildren   bool
 	ReturnStatus     *StatusOptions // requires IMAP4rev2 or LIST-STATUS
+	ReturnSpecialUse bool           // requires SPECIAL-USE
 }
 
 // ListData is the mailbox data returned by a LIST command.
@@ -16,6 +18,10 @@ type ListData struct {
 	Attrs   []MailboxAttr
 	Delim   rune
 	Mailbox string
+	// NoDelim indicates that the mailbox has no hierarchy delimiter (NIL),
+	// even though Delim is zero. Servers fill in a zero Delim with the
+	// session's delimiter unless this is set.
+	NoDelim bool
 
 	// Extended data
 	ChildInfo *ListDataChildInfo
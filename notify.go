@@ -0,0 +1,44 @@
+package imap
+
+// NotifyOptions contains options for the NOTIFY SET command.
+type NotifyOptions struct {
+	// Status requests an initial STATUS response for each watched mailbox
+	Status bool
+	Items  []NotifyItem
+}
+
+// NotifyMailboxSpecifier selects the mailboxes an event group applies to.
+type NotifyMailboxSpecifier string
+
+const (
+	NotifySelected        NotifyMailboxSpecifier = "SELECTED"
+	NotifySelectedDelayed NotifyMailboxSpecifier = "SELECTED-DELAYED"
+	NotifyInboxes         NotifyMailboxSpecifier = "INBOXES"
+	NotifyPersonal        NotifyMailboxSpecifier = "PERSONAL"
+	NotifySubscribed      NotifyMailboxSpecifier = "SUBSCRIBED"
+	NotifySubtree         NotifyMailboxSpecifier = "SUBTREE"
+	NotifyMailboxes       NotifyMailboxSpecifier = "MAILBOXES"
+)
+
+// NotifyItem is an event group of a NOTIFY SET command.
+type NotifyItem struct {
+	MailboxSpecifier NotifyMailboxSpecifier
+	// Mailboxes is only used with NotifySubtree and NotifyMailboxes
+	Mailboxes []string
+	// Events is empty if no events should be sent for the mailboxes (NONE)
+	Events []NotifyEvent
+}
+
+// NotifyEvent is an event which can be requested with NOTIFY.
+type NotifyEvent string
+
+const (
+	NotifyEventMessageNew            NotifyEvent = "MessageNew"
+	NotifyEventMessageExpunge        NotifyEvent = "MessageExpunge"
+	NotifyEventFlagChange            NotifyEvent = "FlagChange"
+	NotifyEventAnnotationChange      NotifyEvent = "AnnotationChange"
+	NotifyEventMailboxName           NotifyEvent = "MailboxName"
+	NotifyEventSubscriptionChange    NotifyEvent = "SubscriptionChange"
+	NotifyEventMailboxMetadataChange NotifyEvent = "MailboxMetadataChange"
+	NotifyEventServerMetadataChange  NotifyEvent = "ServerMetadataChange"
+)
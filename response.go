@@ -43,12 +43,36 @@ const (
 	ResponseCodeUnavailable          ResponseCode = "UNAVAILABLE"
 	ResponseCodeUnknownCTE           ResponseCode = "UNKNOWN-CTE"
 
+	// LOGIN-REFERRALS
+	ResponseCodeReferral ResponseCode = "REFERRAL"
+
 	// METADATA
 	ResponseCodeTooMany   ResponseCode = "TOOMANY"
 	ResponseCodeNoPrivate ResponseCode = "NOPRIVATE"
 
 	// APPENDLIMIT
 	ResponseCodeTooBig ResponseCode = "TOOBIG"
+
+	// CATENATE
+	ResponseCodeBadURL ResponseCode = "BADURL"
+
+	// NOTIFY
+	ResponseCodeBadEvent             ResponseCode = "BADEVENT"
+	ResponseCodeNotificationOverflow ResponseCode = "NOTIFICATIONOVERFLOW"
+
+	// COMPRESS
+	ResponseCodeCompressionActive ResponseCode = "COMPRESSIONACTIVE"
+
+	// CONDSTORE
+	ResponseCodeHighestModSeq ResponseCode = "HIGHESTMODSEQ"
+	ResponseCodeNoModSeq      ResponseCode = "NOMODSEQ"
+	ResponseCodeModified      ResponseCode = "MODIFIED"
+
+	// SPECIAL-USE
+	ResponseCodeUseAttr ResponseCode = "USEATTR"
+
+	// OBJECTID
+	ResponseCodeMailboxID ResponseCode = "MAILBOXID"
 )
 
 // StatusResponse is a generic status response.
@@ -14,6 +14,8 @@ type SearchOptions struct {
 	ReturnCount bool
 	// Requires IMAP4rev2 or SEARCHRES
 	ReturnSave bool
+	// Requires SEARCH=FUZZY
+	ReturnRelevancy bool
 }
 
 // SearchCriteria is a criteria for the SEARCH command.
@@ -30,6 +32,20 @@ type SearchCriteria struct {
 	SentSince  time.Time
 	SentBefore time.Time
 
+	// Requires WITHIN. Unlike Since and Before, the internal date is compared
+	// with full precision: Younger matches messages received at or after the
+	// specified time, Older matches messages received before.
+	Younger time.Time
+	Older   time.Time
+
+	// Requires SAVEDATE. Like Since and Before, but the date when the message
+	// was saved in the mailbox is compared instead of the internal date.
+	// SaveDateSupported matches all messages if the mailbox supports save
+	// dates, and none otherwise.
+	SavedSince        time.Time
+	SavedBefore       time.Time
+	SaveDateSupported bool
+
 	Header []SearchCriteriaHeaderField
 	Body   []string
 	Text   []string
@@ -42,6 +58,10 @@ type SearchCriteria struct {
 
 	Not []SearchCriteria
 	Or  [][2]SearchCriteria
+
+	// Requires SEARCH=FUZZY. Messages must match each of these criteria,
+	// using an implementation-defined fuzzy matching algorithm.
+	Fuzzy []SearchCriteria
 }
 
 // And intersects two search criteria.
@@ -53,6 +73,11 @@ func (criteria *SearchCriteria) And(other *SearchCriteria) {
 	criteria.Before = intersectBefore(criteria.Before, other.Before)
 	criteria.SentSince = intersectSince(criteria.SentSince, other.SentSince)
 	criteria.SentBefore = intersectBefore(criteria.SentBefore, other.SentBefore)
+	criteria.Younger = intersectSince(criteria.Younger, other.Younger)
+	criteria.Older = intersectBefore(criteria.Older, other.Older)
+	criteria.SavedSince = intersectSince(criteria.SavedSince, other.SavedSince)
+	criteria.SavedBefore = intersectBefore(criteria.SavedBefore, other.SavedBefore)
+	criteria.SaveDateSupported = criteria.SaveDateSupported || other.SaveDateSupported
 
 	criteria.Header = append(criteria.Header, other.Header...)
 	criteria.Body = append(criteria.Body, other.Body...)
@@ -70,6 +95,7 @@ func (criteria *SearchCriteria) And(other *SearchCriteria) {
 
 	criteria.Not = append(criteria.Not, other.Not...)
 	criteria.Or = append(criteria.Or, other.Or...)
+	criteria.Fuzzy = append(criteria.Fuzzy, other.Fuzzy...)
 }
 
 func intersectSince(t1, t2 time.Time) time.Time {
@@ -98,6 +124,12 @@ func intersectBefore(t1, t2 time.Time) time.Time {
 	}
 }
 
+// SearchCriteriaHeaderField is a HEADER search key.
+//
+// Messages match if they have a header field named Key whose value contains
+// Value as a case-insensitive substring. An empty Value matches all messages
+// with the header field. Servers are expected to decode RFC 2047
+// encoded-words before matching.
 type SearchCriteriaHeaderField struct {
 	Key, Value string
 }
@@ -106,11 +138,23 @@ type SearchCriteriaHeaderField struct {
 type SearchData struct {
 	All SeqSet
 
-	// requires IMAP4rev2 or ESEARCH
+	// UID is true if All, Min and Max contain UIDs instead of sequence
+	// numbers
 	UID   bool
 	Min   uint32
 	Max   uint32
 	Count uint32
+
+	// requires CONDSTORE: highest mod-sequence of the matching messages
+	ModSeq uint64
+
+	// ESearch is set by clients when the server replied with an ESEARCH
+	// response (requires IMAP4rev2 or ESEARCH)
+	ESearch bool
+
+	// requires SEARCH=FUZZY: relevancy score between 1 and 100 of each
+	// message in All, in the same order
+	Relevancy []uint8
 }
 
 // AllNums returns All as a slice of numbers.
@@ -2,7 +2,25 @@ package imap
 
 // SelectOptions contains options for the SELECT or EXAMINE command.
 type SelectOptions struct {
-	ReadOnly bool
+	ReadOnly  bool
+	CondStore bool // requires CONDSTORE
+
+	QResync *SelectQResyncOptions // requires QRESYNC
+}
+
+// SelectQResyncOptions contains the QRESYNC parameter for the SELECT or
+// EXAMINE command.
+//
+// The client provides the last known UIDVALIDITY and mod-sequence of the
+// mailbox, and optionally the set of UIDs it knows about.
+type SelectQResyncOptions struct {
+	UIDValidity uint32
+	ModSeq      uint64
+	KnownUIDs   SeqSet // optional
+
+	// Optional message sequence match data
+	KnownSeqNums    SeqSet
+	KnownSeqNumUIDs SeqSet
 }
 
 // SelectData is the data returned by a SELECT command.
@@ -18,5 +36,18 @@ type SelectData struct {
 	UIDNext     uint32
 	UIDValidity uint32
 
+	// Number of messages with the \Recent flag, and sequence number of the
+	// first message without the \Seen flag (zero if there is none). They are
+	// only sent to IMAP4rev1 clients.
+	//
+	// A message is recent if this is the first session to be notified about
+	// it. Sessions selecting a mailbox read-write should clear the \Recent
+	// flag of the reported messages, see RFC 3501 section 2.3.2.
+	NumRecent         uint32
+	FirstUnseenSeqNum uint32
+
 	List *ListData // requires IMAP4rev2
+
+	HighestModSeq uint64 // requires CONDSTORE
+	MailboxID     string // requires OBJECTID
 }
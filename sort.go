@@ -0,0 +1,20 @@
+package imap
+
+// SortKey is a key used to sort messages.
+type SortKey string
+
+const (
+	SortKeyArrival SortKey = "ARRIVAL"
+	SortKeyCc      SortKey = "CC"
+	SortKeyDate    SortKey = "DATE"
+	SortKeyFrom    SortKey = "FROM"
+	SortKeySize    SortKey = "SIZE"
+	SortKeySubject SortKey = "SUBJECT"
+	SortKeyTo      SortKey = "TO"
+)
+
+// SortCriterion is a criterion used to sort messages.
+type SortCriterion struct {
+	Key     SortKey
+	Reverse bool
+}
@@ -8,14 +8,19 @@ type StatusOptions struct {
 	NumUnseen   bool
 	NumDeleted  bool // requires IMAP4rev2 or QUOTA
 	Size        bool // requires IMAP4rev2 or STATUS=SIZE
+	NumRecent   bool // obsolete in IMAP4rev2
 
 	AppendLimit    bool // requires APPENDLIMIT
 	DeletedStorage bool // requires QUOTA=RES-STORAGE
+	HighestModSeq  bool // requires CONDSTORE
+	MailboxID      bool // requires OBJECTID
 }
 
 // StatusData is the data returned by a STATUS command.
 //
-// The mailbox name is always populated. The remaining fields are optional.
+// The mailbox name is always populated. The remaining fields are optional:
+// pointers are nil and other fields are left to their zero value if the
+// corresponding item wasn't returned by the server.
 type StatusData struct {
 	Mailbox string
 
@@ -25,7 +30,10 @@ type StatusData struct {
 	NumUnseen   *uint32
 	NumDeleted  *uint32
 	Size        *int64
+	NumRecent   *uint32
 
 	AppendLimit    *uint32
 	DeletedStorage *int64
+	HighestModSeq  uint64
+	MailboxID      string
 }
@@ -1,7 +1,12 @@
 package imap
 
 // StoreOptions contains options for the STORE command.
-type StoreOptions struct{}
+type StoreOptions struct {
+	UnchangedSince uint64 // requires CONDSTORE
+	// HasUnchangedSince is set if UnchangedSince has been specified. Zero is
+	// a valid value, which makes the STORE fail for all messages.
+	HasUnchangedSince bool
+}
 
 // StoreFlagsOp is a flag operation: set, add or delete.
 type StoreFlagsOp int
@@ -7,3 +7,12 @@ const (
 	ThreadOrderedSubject ThreadAlgorithm = "ORDEREDSUBJECT"
 	ThreadReferences     ThreadAlgorithm = "REFERENCES"
 )
+
+// ThreadData represents a thread of messages.
+//
+// Chain contains a list of messages, each message being the parent of the
+// next one. The last message of the chain is the parent of all SubThreads.
+type ThreadData struct {
+	Chain      []uint32
+	SubThreads []ThreadData
+}